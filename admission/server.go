@@ -0,0 +1,211 @@
+// Package admission serves a validating admission webhook that evaluates the
+// machine policies and the field rules of driver schemas against machines and
+// machine templates when they are created or changed, so the API server
+// rejects a violating object instead of the controller failing its machines
+// later.
+package admission
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/machine-controller/policy"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// Path is the path the webhook is served on.
+	Path = "/validate"
+)
+
+// Review is an AdmissionReview of admission.k8s.io/v1beta1, with the fields
+// the webhook reads and writes.
+type Review struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *Request  `json:"request,omitempty"`
+	Response        *Response `json:"response,omitempty"`
+}
+
+// Request is the object to admit.
+type Request struct {
+	UID       types.UID               `json:"uid"`
+	Kind      metav1.GroupVersionKind `json:"kind"`
+	Namespace string                  `json:"namespace,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	Operation string                  `json:"operation"`
+	Object    json.RawMessage         `json:"object,omitempty"`
+}
+
+// Response is the decision of the webhook.
+type Response struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+type templateGetter interface {
+	Get(name string, opts metav1.GetOptions) (runtime.Object, error)
+}
+
+// Server evaluates the rules of the machine-policies ConfigMap and of the
+// fields of the driver schema against the driver config of machine
+// templates, and of the template of machines.
+type Server struct {
+	configMaps typedv1.ConfigMapsGetter
+	templates  templateGetter
+	// schemas is nil in multi-tenancy mode, where the schemas are
+	// namespaced and templates are not.
+	schemas schemastore.Client
+}
+
+// NewServer returns the admission webhook server.
+func NewServer(management *config.ManagementContext, multiTenancy bool) *Server {
+	s := &Server{
+		configMaps: management.K8sClient.CoreV1(),
+		templates:  management.Management.MachineTemplates("").ObjectClient().UnstructuredClient(),
+	}
+	if !multiTenancy {
+		s.schemas = management.Management.DynamicSchemas("")
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != Path {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	review := Review{}
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := &Response{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	if err := s.admit(review.Request); err != nil {
+		code := int32(http.StatusInternalServerError)
+		switch err.(type) {
+		case *policy.Violation, *policy.FieldError:
+			code = http.StatusForbidden
+		}
+		logrus.Infof("Denied %s of %s %s: %v", review.Request.Operation, review.Request.Kind.Kind, review.Request.Name, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Code:    code,
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(Review{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	})
+}
+
+// admit returns the violation of the object of the request, if any.
+func (s *Server) admit(req *Request) error {
+	if req.Operation != "CREATE" && req.Operation != "UPDATE" {
+		return nil
+	}
+	if req.Kind.Group != v3.MachineGroupVersionKind.Group {
+		return nil
+	}
+
+	var (
+		driver    string
+		objLabels map[string]string
+		config    map[string]interface{}
+	)
+	switch req.Kind.Kind {
+	case v3.MachineTemplateGroupVersionKind.Kind:
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(req.Object, &obj); err != nil {
+			return err
+		}
+		template := &v3.MachineTemplate{}
+		if err := json.Unmarshal(req.Object, template); err != nil {
+			return err
+		}
+		driver, objLabels = template.Spec.Driver, template.Labels
+		config = driverConfig(obj, driver)
+	case v3.MachineGroupVersionKind.Kind:
+		machine := &v3.Machine{}
+		if err := json.Unmarshal(req.Object, machine); err != nil {
+			return err
+		}
+		if machine.Spec.MachineTemplateName == "" {
+			return nil
+		}
+		// A machine may be created before its template; the controller
+		// evaluates the policies again when it creates the machine.
+		rawTemplate, err := s.templates.Get(machine.Spec.MachineTemplateName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		obj := rawTemplate.(*unstructured.Unstructured).Object
+		driver = convert.ToString(values.GetValueN(obj, "spec", "driver"))
+		objLabels = machine.Labels
+		config = driverConfig(obj, driver)
+	default:
+		return nil
+	}
+	if driver == "" {
+		return nil
+	}
+
+	rules, err := policy.Load(s.configMaps)
+	if err != nil {
+		return err
+	}
+	if err := policy.Evaluate(rules, driver, objLabels, config); err != nil {
+		return err
+	}
+
+	if s.schemas == nil {
+		return nil
+	}
+	driverSchema, err := schemastore.Get(s.schemas, strings.ToLower(driver)+"config")
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Only the rules are checked, as fields missing from the config may be
+	// set by the driver defaults.
+	return policy.ValidateSchemaRules(driverSchema, config)
+}
+
+// driverConfig returns the driver config of a raw machine template, which is
+// empty if it is not set.
+func driverConfig(obj map[string]interface{}, driver string) map[string]interface{} {
+	rawConfig, _ := values.GetValue(obj, driver+"Config")
+	config := convert.ToMapInterface(rawConfig)
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	return config
+}
@@ -0,0 +1,231 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+type fakeConfigMaps struct {
+	typedv1.ConfigMapInterface
+	cm *v1.ConfigMap
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) typedv1.ConfigMapInterface {
+	return f
+}
+
+func (f *fakeConfigMaps) Get(name string, opts metav1.GetOptions) (*v1.ConfigMap, error) {
+	return f.cm, nil
+}
+
+type fakeTemplates map[string]map[string]interface{}
+
+func (f fakeTemplates) Get(name string, opts metav1.GetOptions) (runtime.Object, error) {
+	obj, ok := f[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "machinetemplates"}, name)
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+func template(labels map[string]interface{}, instanceType string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata":        map[string]interface{}{"name": "prod", "labels": labels},
+		"spec":            map[string]interface{}{"driver": "amazonec2"},
+		"amazonec2Config": map[string]interface{}{"instanceType": instanceType},
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	rules := `[{"name": "prod-instance-types", "driver": "amazonec2", "selector": "env=prod",
+		"expression": "config.instanceType in ['m5.large', 'm5.xlarge']"}]`
+	server := &Server{
+		configMaps: &fakeConfigMaps{cm: &v1.ConfigMap{Data: map[string]string{"rules": rules}}},
+		templates: fakeTemplates{
+			"prod": template(nil, "t2.micro"),
+		},
+	}
+	prod := map[string]interface{}{"env": "prod"}
+	tests := []struct {
+		name      string
+		kind      schema.GroupVersionKind
+		operation string
+		object    interface{}
+		allowed   bool
+	}{
+		{
+			name:      "template violating a rule",
+			kind:      v3.MachineTemplateGroupVersionKind,
+			operation: "CREATE",
+			object:    template(prod, "t2.micro"),
+		},
+		{
+			name:      "template satisfying the rules",
+			kind:      v3.MachineTemplateGroupVersionKind,
+			operation: "UPDATE",
+			object:    template(prod, "m5.large"),
+			allowed:   true,
+		},
+		{
+			name:      "template the rules do not apply to",
+			kind:      v3.MachineTemplateGroupVersionKind,
+			operation: "CREATE",
+			object:    template(nil, "t2.micro"),
+			allowed:   true,
+		},
+		{
+			name:      "machine of a template violating a rule",
+			kind:      v3.MachineGroupVersionKind,
+			operation: "CREATE",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "m1", "labels": prod},
+				"spec":     map[string]interface{}{"machineTemplateName": "prod"},
+			},
+		},
+		{
+			name:      "machine without the labels of the rule",
+			kind:      v3.MachineGroupVersionKind,
+			operation: "CREATE",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "m1"},
+				"spec":     map[string]interface{}{"machineTemplateName": "prod"},
+			},
+			allowed: true,
+		},
+		{
+			name:      "machine of a missing template",
+			kind:      v3.MachineGroupVersionKind,
+			operation: "CREATE",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "m1", "labels": prod},
+				"spec":     map[string]interface{}{"machineTemplateName": "missing"},
+			},
+			allowed: true,
+		},
+		{
+			name:      "delete",
+			kind:      v3.MachineTemplateGroupVersionKind,
+			operation: "DELETE",
+			object:    template(prod, "t2.micro"),
+			allowed:   true,
+		},
+	}
+	for _, test := range tests {
+		response := review(t, server, test.kind, test.operation, test.object)
+		if response == nil {
+			t.Errorf("%s: no response", test.name)
+			continue
+		}
+		if response.Allowed != test.allowed {
+			t.Errorf("%s: allowed is %v, want %v", test.name, response.Allowed, test.allowed)
+		}
+		if !test.allowed && (response.Result == nil || response.Result.Code != http.StatusForbidden) {
+			t.Errorf("%s: result is %+v, want a forbidden status", test.name, response.Result)
+		}
+	}
+}
+
+func TestServeHTTPFieldRules(t *testing.T) {
+	rules := `{"instanceType": [{"rule": "self.startsWith('m5.') || rootSize == null", "message": "needs an m5 instance"}]}`
+	server := &Server{
+		configMaps: &fakeConfigMaps{cm: &v1.ConfigMap{}},
+		schemas: &fakeSchemas{schema: &v3.DynamicSchema{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "amazonec2config",
+				Annotations: map[string]string{"io.cattle.machine_driver.field_rules": rules},
+			},
+			Spec: v3.DynamicSchemaSpec{ResourceFields: map[string]v3.Field{
+				"instanceType": {Type: "string"},
+				"rootSize":     {Type: "int"},
+			}},
+		}},
+	}
+
+	violating := template(nil, "t2.micro")
+	violating["amazonec2Config"].(map[string]interface{})["rootSize"] = "40"
+	response := review(t, server, v3.MachineTemplateGroupVersionKind, "CREATE", violating)
+	if response == nil || response.Allowed || response.Result == nil || response.Result.Message != "field instanceType needs an m5 instance" {
+		t.Errorf("violating template: response is %+v", response)
+	}
+
+	response = review(t, server, v3.MachineTemplateGroupVersionKind, "CREATE", template(nil, "t2.micro"))
+	if response == nil || !response.Allowed {
+		t.Errorf("template satisfying the rules: response is %+v", response)
+	}
+}
+
+type fakeSchemas struct {
+	schemastore.Client
+	schema *v3.DynamicSchema
+}
+
+func (f *fakeSchemas) Get(name string, opts metav1.GetOptions) (*v3.DynamicSchema, error) {
+	if name != f.schema.Name {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, name)
+	}
+	return f.schema, nil
+}
+
+// review posts an AdmissionReview of the object to the server and returns
+// its response.
+func review(t *testing.T, server *Server, kind schema.GroupVersionKind, operation string, obj interface{}) *Response {
+	object, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(Review{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &Request{
+			UID: "1234",
+			Kind: metav1.GroupVersionKind{
+				Group:   kind.Group,
+				Version: kind.Version,
+				Kind:    kind.Kind,
+			},
+			Operation: operation,
+			Object:    object,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, Path, bytes.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Errorf("status is %d", rw.Code)
+		return nil
+	}
+	result := Review{}
+	if err := json.NewDecoder(rw.Body).Decode(&result); err != nil {
+		t.Errorf("invalid response: %v", err)
+		return nil
+	}
+	if result.Kind != "AdmissionReview" || result.Response == nil || result.Response.UID != "1234" {
+		t.Errorf("response is %+v", result)
+		return nil
+	}
+	return result.Response
+}
+
+func TestServeHTTPInvalidReview(t *testing.T) {
+	server := &Server{}
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, Path, bytes.NewReader([]byte(`{}`))))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("status is %d, want %d", rw.Code, http.StatusBadRequest)
+	}
+}
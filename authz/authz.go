@@ -0,0 +1,56 @@
+// Package authz authenticates the requests of the HTTP servers of the
+// controller with the bearer token of the caller and authorizes them with
+// SubjectAccessReviews, so access follows the RBAC rules of the cluster.
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Authenticate returns the user of the bearer token of req.
+func Authenticate(k8s kubernetes.Interface, req *http.Request) (authenticationv1.UserInfo, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		return authenticationv1.UserInfo{}, fmt.Errorf("bearer token required")
+	}
+
+	review, err := k8s.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	})
+	if err != nil {
+		return authenticationv1.UserInfo{}, err
+	}
+	if !review.Status.Authenticated {
+		return authenticationv1.UserInfo{}, fmt.Errorf("invalid token")
+	}
+	return review.Status.User, nil
+}
+
+// Allowed returns whether user may access the resource described by attrs.
+func Allowed(k8s kubernetes.Interface, user authenticationv1.UserInfo, attrs authorizationv1.ResourceAttributes) (bool, error) {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	access, err := k8s.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			Groups:             user.Groups,
+			Extra:              extra,
+			UID:                user.UID,
+			ResourceAttributes: &attrs,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return access.Status.Allowed, nil
+}
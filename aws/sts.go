@@ -0,0 +1,182 @@
+// Package aws obtains temporary AWS credentials by assuming an IAM role
+// through STS, so machines can be provisioned without long-lived keys.
+package aws
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	stsVersion     = "2011-06-15"
+	defaultRegion  = "us-east-1"
+	requestTimeout = 30 * time.Second
+)
+
+// Credentials are AWS access keys, temporary if SessionToken is set.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+// EnvCredentials returns the credentials of the controller from the standard
+// AWS environment variables, or nil.
+func EnvCredentials() *Credentials {
+	creds := &Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil
+	}
+	return creds
+}
+
+// Role is an IAM role to assume.
+type Role struct {
+	ARN        string `json:"roleArn"`
+	ExternalID string `json:"externalId,omitempty"`
+	// SessionDuration is how long the credentials are valid, e.g. "2h".
+	// STS defaults to one hour.
+	SessionDuration string `json:"sessionDuration,omitempty"`
+}
+
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string `xml:"SecretAccessKey"`
+		SessionToken    string `xml:"SessionToken"`
+		Expiration      string `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// AssumeRole calls STS in region, or the global endpoint if empty, with base
+// to obtain temporary credentials of role.
+func AssumeRole(base *Credentials, region string, role Role, sessionName string) (*Credentials, error) {
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", stsVersion)
+	form.Set("RoleArn", role.ARN)
+	form.Set("RoleSessionName", sessionName)
+	if role.ExternalID != "" {
+		form.Set("ExternalId", role.ExternalID)
+	}
+	if role.SessionDuration != "" {
+		d, err := time.ParseDuration(role.SessionDuration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid session duration %q", role.SessionDuration)
+		}
+		form.Set("DurationSeconds", strconv.FormatInt(int64(d/time.Second), 10))
+	}
+
+	host := "sts.amazonaws.com"
+	if region == "" {
+		region = defaultRegion
+	} else {
+		host = fmt.Sprintf("sts.%s.amazonaws.com", region)
+	}
+
+	body := []byte(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sign(req, body, base, region, "sts", time.Now().UTC())
+
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to assume role %s", role.ARN)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		stsErr := errorResponse{}
+		if xml.Unmarshal(data, &stsErr) == nil && stsErr.Code != "" {
+			return nil, fmt.Errorf("failed to assume role %s: %s: %s", role.ARN, stsErr.Code, stsErr.Message)
+		}
+		return nil, fmt.Errorf("failed to assume role %s: %s", role.ARN, resp.Status)
+	}
+
+	result := assumeRoleResponse{}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return nil, errors.Wrap(err, "failed to parse STS response")
+	}
+	expiration, _ := time.Parse(time.RFC3339, result.Credentials.Expiration)
+	return &Credentials{
+		AccessKey:    result.Credentials.AccessKeyID,
+		SecretKey:    result.Credentials.SecretAccessKey,
+		SessionToken: result.Credentials.SessionToken,
+		Expiration:   expiration,
+	}, nil
+}
+
+// sign adds an AWS signature version 4 to a request without query string.
+func sign(req *http.Request, body []byte, creds *Credentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("content-type:%s\nhost:%s\nx-amz-date:%s\n",
+		req.Header.Get("Content-Type"), req.URL.Host, amzDate)
+	if creds.SessionToken != "" {
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + creds.SessionToken + "\n"
+	}
+
+	canonicalRequest := fmt.Sprintf("%s\n/\n\n%s\n%s\n%s",
+		req.Method, canonicalHeaders, signedHeaders, hexSHA256(body))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hexSHA256([]byte(canonicalRequest)))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKey, scope, signedHeaders, signature))
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,88 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/download"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Entry is a machine driver offered by a catalog.
+type Entry struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Builtin     bool   `json:"builtin,omitempty"`
+	Active      bool   `json:"active,omitempty"`
+}
+
+// Index is the document a catalog serves, listing its drivers.
+type Index struct {
+	Drivers []Entry `json:"drivers"`
+}
+
+// ParsePublicKey decodes a base64 encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid catalog key")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid catalog key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Fetch downloads the index at indexURL and returns it with the hex encoded
+// sha256 digest of its content. If key is set, the base64 encoded ed25519
+// signature served at indexURL + ".sig" must verify against it.
+func Fetch(indexURL string, key ed25519.PublicKey) (*Index, string, error) {
+	data, err := get(indexURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if key != nil {
+		sigData, err := get(indexURL + ".sig")
+		if err != nil {
+			return nil, "", err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "invalid signature of catalog %s", indexURL)
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return nil, "", fmt.Errorf("signature of catalog %s does not verify", indexURL)
+		}
+	}
+
+	index := &Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, "", errors.Wrapf(err, "failed to parse catalog %s", indexURL)
+	}
+
+	digest := sha256.Sum256(data)
+	return index, hex.EncodeToString(digest[:]), nil
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := download.Client().Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,146 @@
+// Package cloudevents publishes CloudEvents, in the JSON format of version
+// 1.0, to an HTTP endpoint or a NATS subject.
+package cloudevents
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SpecVersion = "1.0"
+	// ContentType is the media type of a CloudEvent in structured mode.
+	ContentType = "application/cloudevents+json"
+
+	defaultSource = "/machine-controller"
+	queueSize     = 1000
+	maxAttempts   = 3
+)
+
+// Options configure where events are published.
+type Options struct {
+	// Sink is the URL events are published to: http:// or https:// to POST
+	// them to an endpoint, nats://[user:password@]host:port/<subject> to
+	// publish them on a NATS subject. Disabled if empty.
+	Sink string
+	// Source is the source attribute of the events, /machine-controller if
+	// empty.
+	Source string
+}
+
+// Event is a CloudEvent with JSON data.
+type Event struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype,omitempty"`
+	Data            interface{} `json:"data,omitempty"`
+}
+
+// Sink delivers encoded events.
+type Sink interface {
+	Send(event []byte) error
+}
+
+// NewSink returns the sink of a URL.
+func NewSink(rawURL string) (Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return newHTTPSink(u), nil
+	case "nats":
+		return newNATSSink(u)
+	case "kafka":
+		return nil, fmt.Errorf("kafka sinks are not supported, publish to an HTTP bridge into Kafka instead")
+	}
+	return nil, fmt.Errorf("unsupported event sink %q, must be http, https or nats", rawURL)
+}
+
+// Publisher sends events to a sink in the background. Events are queued so
+// a slow or unavailable sink never blocks a controller; they are dropped
+// once the queue is full or a send failed maxAttempts times.
+type Publisher struct {
+	source string
+	sink   Sink
+	queue  chan Event
+}
+
+// NewPublisher returns the publisher of opts, or nil if no sink is set.
+func NewPublisher(opts Options) (*Publisher, error) {
+	if opts.Sink == "" {
+		return nil, nil
+	}
+	sink, err := NewSink(opts.Sink)
+	if err != nil {
+		return nil, err
+	}
+	source := opts.Source
+	if source == "" {
+		source = defaultSource
+	}
+	p := &Publisher{
+		source: source,
+		sink:   sink,
+		queue:  make(chan Event, queueSize),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Publish queues an event of type eventType about subject.
+func (p *Publisher) Publish(eventType, subject string, data interface{}) {
+	event := Event{
+		SpecVersion:     SpecVersion,
+		ID:              newID(),
+		Source:          p.source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	select {
+	case p.queue <- event:
+	default:
+		logrus.Warnf("Event queue is full, dropping %s event of %s", eventType, subject)
+	}
+}
+
+func (p *Publisher) run() {
+	for event := range p.queue {
+		data, err := json.Marshal(event)
+		if err != nil {
+			logrus.Errorf("Failed to encode %s event of %s: %v", event.Type, event.Subject, err)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = p.sink.Send(data)
+			if err == nil {
+				break
+			}
+			if attempt == maxAttempts {
+				logrus.Errorf("Dropping %s event of %s after %d attempts: %v", event.Type, event.Subject, attempt, err)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,40 @@
+package cloudevents
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(u *url.URL) *httpSink {
+	return &httpSink{
+		url: u.String(),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Send POSTs the event in structured mode.
+func (s *httpSink) Send(event []byte) error {
+	resp, err := s.client.Post(s.url, ContentType, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event sink %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package cloudevents
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultNATSPort = "4222"
+	natsDialTimeout = 10 * time.Second
+	// natsReplyTimeout limits how long a send waits for the server to
+	// confirm it.
+	natsReplyTimeout = 10 * time.Second
+)
+
+// natsSink publishes events with the text protocol of NATS core. It keeps a
+// single connection, answers the PINGs of the server on it and reconnects
+// on the next send once it failed. Each PUB is followed by a PING, so a send
+// only succeeds once the server answered it with a PONG, after the message
+// was processed.
+type natsSink struct {
+	addr     string
+	subject  string
+	user     string
+	password string
+	token    string
+
+	lock      sync.Mutex
+	writeLock sync.Mutex
+	conn      net.Conn
+	replies   chan string
+}
+
+// natsInfo is the part of the INFO the server greets with that the sink
+// checks.
+type natsInfo struct {
+	TLSRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+}
+
+func newNATSSink(u *url.URL) (*natsSink, error) {
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("NATS event sink %s must name a subject as its path", u.Host)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+	}
+	s := &natsSink{
+		addr:    addr,
+		subject: subject,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.user = u.User.Username()
+			s.password = password
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+func (s *natsSink) Send(event []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", s.subject, len(event), event)
+	if err := s.write(s.conn, msg); err != nil {
+		s.drop()
+		return err
+	}
+
+	timer := time.NewTimer(natsReplyTimeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-s.replies:
+		if !ok {
+			s.drop()
+			return fmt.Errorf("NATS server %s closed the connection", s.addr)
+		}
+		if reply != "PONG" {
+			s.drop()
+			return fmt.Errorf("NATS server %s: %s", s.addr, reply)
+		}
+		return nil
+	case <-timer.C:
+		s.drop()
+		return fmt.Errorf("NATS server %s did not confirm the event within %v", s.addr, natsReplyTimeout)
+	}
+}
+
+// connect opens the connection and waits for the server to accept it, the
+// caller holds the lock.
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+	if err := s.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *natsSink) handshake(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("NATS server %s sent %q instead of INFO", s.addr, strings.TrimSpace(line))
+	}
+	info := natsInfo{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return fmt.Errorf("NATS server %s sent an invalid INFO: %v", s.addr, err)
+	}
+	if info.TLSRequired {
+		return fmt.Errorf("NATS server %s requires TLS, which the event sink does not support", s.addr)
+	}
+	if info.AuthRequired && s.user == "" && s.token == "" {
+		return fmt.Errorf("NATS server %s requires authentication, set user:password or a token in the event sink URL", s.addr)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "machine-controller",
+	}
+	switch {
+	case s.token != "":
+		options["auth_token"] = s.token
+	case s.user != "":
+		options["user"] = s.user
+		options["pass"] = s.password
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		return err
+	}
+
+	// The server answers the PING once it accepted the CONNECT, or reports
+	// why it did not.
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			conn.SetReadDeadline(time.Time{})
+			s.conn = conn
+			s.replies = make(chan string, 1)
+			go s.read(conn, reader, s.replies)
+			return nil
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server %s refused the connection: %s", s.addr, line)
+		}
+	}
+}
+
+func (s *natsSink) write(conn net.Conn, data string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(natsReplyTimeout))
+	_, err := conn.Write([]byte(data))
+	return err
+}
+
+// drop closes the connection, the caller holds the lock.
+func (s *natsSink) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// read answers the PINGs of the server and passes its PONGs and errors to
+// Send. It closes replies once the connection is closed.
+func (s *natsSink) read(conn net.Conn, reader *bufio.Reader, replies chan string) {
+	defer close(replies)
+	defer conn.Close()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			if err := s.write(conn, "PONG\r\n"); err != nil {
+				return
+			}
+		case line == "PONG", strings.HasPrefix(line, "-ERR"):
+			select {
+			case replies <- line:
+			default:
+				logrus.Errorf("NATS server %s: unexpected %s", s.addr, line)
+			}
+		}
+	}
+}
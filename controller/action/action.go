@@ -0,0 +1,78 @@
+package action
+
+import (
+	"encoding/json"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// requestPrefix is suffixed with an action name to request that action
+	// on an object. The annotation value is the action input.
+	requestPrefix = "io.cattle.action."
+	// resultPrefix is suffixed with an action name and holds the Result of
+	// the last run of that action.
+	resultPrefix = "io.cattle.action_result."
+)
+
+// Result is the outcome of an action, stored as JSON on the object.
+type Result struct {
+	Time    string `json:"time"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// Pending returns the input of a requested action and whether the action has
+// been requested on obj.
+func Pending(obj metav1.Object, name string) (string, bool) {
+	input, ok := obj.GetAnnotations()[requestPrefix+name]
+	return input, ok
+}
+
+// Request requests an action on obj with input.
+func Request(obj metav1.Object, name string, input string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[requestPrefix+name] = input
+	obj.SetAnnotations(annotations)
+}
+
+// Complete removes the request for an action from obj and records its
+// result.
+func Complete(obj metav1.Object, name string, output string, err error) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	delete(annotations, requestPrefix+name)
+
+	result := Result{
+		Time:    time.Now().Format(time.RFC3339),
+		Success: err == nil,
+		Output:  output,
+	}
+	if err != nil {
+		result.Message = err.Error()
+	}
+	bytes, _ := json.Marshal(result)
+	annotations[resultPrefix+name] = string(bytes)
+
+	obj.SetAnnotations(annotations)
+}
+
+// GetResult returns the result of the last run of an action on obj.
+func GetResult(obj metav1.Object, name string) (*Result, bool) {
+	data, ok := obj.GetAnnotations()[resultPrefix+name]
+	if !ok {
+		return nil, false
+	}
+	result := &Result{}
+	if err := json.Unmarshal([]byte(data), result); err != nil {
+		return nil, false
+	}
+	return result, true
+}
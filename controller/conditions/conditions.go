@@ -0,0 +1,44 @@
+package conditions
+
+import (
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// SetTransitionTimes sets the LastTransitionTime of every condition of obj
+// whose status differs from the same condition in orig, or that has none yet.
+// orig and obj must be pointers to the same type with a Status.Conditions
+// slice, such as machines and machine drivers. LastUpdateTime is already
+// touched whenever a status is set, so together they tell a condition stuck
+// since an hour from one that is actively progressing.
+func SetTransitionTimes(orig, obj runtime.Object) {
+	if obj == nil || reflect.ValueOf(obj).IsNil() {
+		return
+	}
+
+	before := map[string]string{}
+	if orig != nil && !reflect.ValueOf(orig).IsNil() {
+		origConds := conditionsOf(orig)
+		for i := 0; i < origConds.Len(); i++ {
+			cond := origConds.Index(i)
+			before[cond.FieldByName("Type").String()] = cond.FieldByName("Status").String()
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	conds := conditionsOf(obj)
+	for i := 0; i < conds.Len(); i++ {
+		cond := conds.Index(i)
+		transition := cond.FieldByName("LastTransitionTime")
+		status, seen := before[cond.FieldByName("Type").String()]
+		if transition.String() == "" || !seen || status != cond.FieldByName("Status").String() {
+			transition.SetString(now)
+		}
+	}
+}
+
+func conditionsOf(obj runtime.Object) reflect.Value {
+	return reflect.ValueOf(obj).Elem().FieldByName("Status").FieldByName("Conditions")
+}
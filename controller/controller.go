@@ -1,12 +1,34 @@
 package controller
 
 import (
+	"github.com/rancher/machine-controller/controller/events"
 	"github.com/rancher/machine-controller/controller/machine"
 	"github.com/rancher/machine-controller/controller/machinedriver"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/machine-controller/controller/status"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/sandbox"
 	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
 )
 
-func Register(management *config.ManagementContext) {
-	machine.Register(management)
-	machinedriver.Register(management)
+func Register(management *config.ManagementContext, opts options.Options) {
+	if err := machine.AddIndexers(management); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := sandbox.Configure(opts.Sandbox); err != nil {
+		logrus.Fatalf("Failed to configure driver sandbox: %v", err)
+	}
+	dockermachine.ConfigureEnv(opts.DriverEnv)
+
+	if opts.SchemaOnly {
+		logrus.Info("Running in schema-only mode, machines are not provisioned")
+	} else {
+		machine.Register(management, opts)
+	}
+	machinedriver.Register(management, opts, machinedriver.DriverFor)
+	status.Register(management)
+	if err := events.Register(management, opts); err != nil {
+		logrus.Fatalf("Invalid event sink: %v", err)
+	}
 }
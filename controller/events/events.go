@@ -0,0 +1,181 @@
+// Package events publishes the lifecycle transitions of machines and machine
+// drivers as CloudEvents, in addition to the Kubernetes Events the
+// controllers record.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/machine-controller/cloudevents"
+	"github.com/rancher/machine-controller/controller/machine"
+	"github.com/rancher/machine-controller/controller/machinedriver"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MachineEventPrefix is followed by the phase a machine entered, or
+	// deleted, in the type of its events.
+	MachineEventPrefix = "io.cattle.machine."
+	// DriverEventPrefix is followed by the state a machine driver entered,
+	// active, inactive, failed or deleted, in the type of its events.
+	DriverEventPrefix = "io.cattle.machinedriver."
+
+	stateDeleted = "deleted"
+)
+
+// MachineData is the data of a machine event.
+type MachineData struct {
+	Namespace     string `json:"namespace,omitempty"`
+	Name          string `json:"name"`
+	Hostname      string `json:"hostname,omitempty"`
+	Phase         string `json:"phase"`
+	PreviousPhase string `json:"previousPhase,omitempty"`
+	Driver        string `json:"driver,omitempty"`
+	Pool          string `json:"pool,omitempty"`
+	Node          string `json:"node,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// DriverData is the data of a machine driver event.
+type DriverData struct {
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	PreviousState string `json:"previousState,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// tracker remembers the last state of each object it has seen. Objects seen
+// for the first time only count as a transition if they were created after
+// the controller started, so a restart does not replay the whole fleet;
+// transitions while the controller was down are not published.
+type tracker struct {
+	lock    sync.Mutex
+	started time.Time
+	states  map[string]string
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		started: time.Now(),
+		states:  map[string]string{},
+	}
+}
+
+// transition records state of key and returns its previous state and
+// whether it changed.
+func (t *tracker) transition(key, state string, created time.Time) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	previous, seen := t.states[key]
+	if state == stateDeleted {
+		delete(t.states, key)
+		return previous, seen
+	}
+	t.states[key] = state
+	if !seen {
+		return "", created.After(t.started)
+	}
+	return previous, previous != state
+}
+
+// Register publishes the transitions of machines and machine drivers to the
+// event sink of opts, if one is set.
+func Register(management *config.ManagementContext, opts options.Options) error {
+	publisher, err := cloudevents.NewPublisher(opts.Events)
+	if err != nil || publisher == nil {
+		return err
+	}
+	logrus.Infof("Publishing machine lifecycle events to %s", opts.Events.Sink)
+
+	machines := newTracker()
+	management.Management.Machines("").AddSyncHandler(func(key string, obj *v3.Machine) error {
+		if obj != nil && !opts.Namespaces.Contains(obj.Namespace) {
+			return nil
+		}
+		publishMachine(publisher, machines, key, obj)
+		return nil
+	})
+
+	drivers := newTracker()
+	management.Management.MachineDrivers("").AddSyncHandler(func(key string, obj *v3.MachineDriver) error {
+		publishDriver(publisher, drivers, key, obj)
+		return nil
+	})
+	return nil
+}
+
+func publishMachine(publisher *cloudevents.Publisher, t *tracker, key string, obj *v3.Machine) {
+	if obj == nil || obj.DeletionTimestamp != nil {
+		if previous, ok := t.transition(key, stateDeleted, time.Time{}); ok {
+			data := MachineData{Name: key, Phase: stateDeleted, PreviousPhase: previous}
+			if obj != nil {
+				data = machineData(obj, stateDeleted)
+				data.PreviousPhase = previous
+			}
+			publisher.Publish(MachineEventPrefix+stateDeleted, key, data)
+		}
+		return
+	}
+
+	phase := machine.Phase(obj)
+	previous, ok := t.transition(key, phase, obj.CreationTimestamp.Time)
+	if !ok {
+		return
+	}
+	data := machineData(obj, phase)
+	data.PreviousPhase = previous
+	publisher.Publish(MachineEventPrefix+phase, key, data)
+}
+
+func machineData(obj *v3.Machine, phase string) MachineData {
+	data := MachineData{
+		Namespace: obj.Namespace,
+		Name:      obj.Name,
+		Hostname:  obj.Spec.RequestedHostname,
+		Phase:     phase,
+		Pool:      obj.Spec.MachineTemplateName,
+		Node:      obj.Status.NodeName,
+	}
+	if obj.Status.MachineTemplateSpec != nil {
+		data.Driver = obj.Status.MachineTemplateSpec.Driver
+	}
+	for _, cond := range obj.Status.Conditions {
+		if cond.Status == "False" {
+			data.Message = cond.Message
+			break
+		}
+	}
+	return data
+}
+
+func publishDriver(publisher *cloudevents.Publisher, t *tracker, key string, obj *v3.MachineDriver) {
+	if obj == nil || obj.DeletionTimestamp != nil {
+		if previous, ok := t.transition(key, stateDeleted, time.Time{}); ok {
+			publisher.Publish(DriverEventPrefix+stateDeleted, key, DriverData{
+				Name:          key,
+				State:         stateDeleted,
+				PreviousState: previous,
+			})
+		}
+		return
+	}
+
+	state, message := machinedriver.State(obj)
+	previous, ok := t.transition(key, state, obj.CreationTimestamp.Time)
+	if !ok {
+		return
+	}
+	publisher.Publish(DriverEventPrefix+state, key, DriverData{
+		Name:          obj.Name,
+		State:         state,
+		PreviousState: previous,
+		URL:           obj.Spec.URL,
+		Message:       message,
+	})
+}
@@ -0,0 +1,25 @@
+package machine
+
+import (
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// actionHandlers process the actions requested on a machine through
+// annotations, see the action package.
+var actionHandlers = []func(m *Lifecycle, obj *v3.Machine) *v3.Machine{
+	(*Lifecycle).clone,
+	(*Lifecycle).template,
+	(*Lifecycle).snapshot,
+	(*Lifecycle).imageBuild,
+	(*Lifecycle).preview,
+	(*Lifecycle).terraform,
+	(*Lifecycle).reprovision,
+	(*Lifecycle).rotateKeyAction,
+}
+
+func (m *Lifecycle) runActions(obj *v3.Machine) *v3.Machine {
+	for _, handler := range actionHandlers {
+		obj = handler(m, obj)
+	}
+	return obj
+}
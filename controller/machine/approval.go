@@ -0,0 +1,171 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// requireApprovalAnnotation on a machine, or on its machine template,
+	// set to "true" holds the cloud create of the machine until it is
+	// approved. When the controller requires approval of every machine,
+	// "false" on the machine template exempts its machines; the annotation
+	// of the machine is then ignored, as its creator could set it.
+	requireApprovalAnnotation = "io.cattle.machine.require_approval"
+	// approvedAnnotation is set on a waiting machine by the approver: "true"
+	// to go ahead with the create, "false" to reject it, with
+	// approvalReasonAnnotation as the reason. It is only read once the
+	// machine waits for approval; a value set before is removed.
+	approvedAnnotation       = "io.cattle.machine.approved"
+	approvalReasonAnnotation = "io.cattle.machine.approval_reason"
+	// approvalRequestedAnnotation records when a machine started waiting for
+	// approval.
+	approvalRequestedAnnotation = "io.cattle.machine.approval_requested"
+	// approvalNotifiedAnnotation records when the approval webhook accepted
+	// the request of a machine, so it is only sent once.
+	approvalNotifiedAnnotation = "io.cattle.machine.approval_notified"
+
+	approvalWebhookTimeout    = 10 * time.Second
+	approvalWebhookRetryAfter = time.Minute
+)
+
+var (
+	// MachineConditionApproved is unknown while the create of a machine waits
+	// for approval, true once it was approved and false if it was rejected.
+	MachineConditionApproved condition.Cond = "Approved"
+)
+
+// ApprovalRequest is POSTed as JSON to the approval webhook when a machine
+// starts waiting for approval. The approver answers by setting Annotation on
+// the machine.
+type ApprovalRequest struct {
+	Namespace  string   `json:"namespace,omitempty"`
+	Name       string   `json:"name"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Cluster    string   `json:"cluster,omitempty"`
+	Role       []string `json:"role,omitempty"`
+	Template   string   `json:"template,omitempty"`
+	Driver     string   `json:"driver"`
+	Revision   string   `json:"revision,omitempty"`
+	Annotation string   `json:"annotation"`
+}
+
+// awaitApproval returns whether the create of a machine is held until it is
+// approved. The first time it is held the request is recorded, an approval
+// the machine was created with is dropped and the approval webhook, if any,
+// is called.
+func (m *Lifecycle) awaitApproval(obj *v3.Machine) (bool, error) {
+	required, err := m.requiresApproval(obj)
+	if err != nil || !required {
+		return false, err
+	}
+
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	if obj.Annotations[approvalRequestedAnnotation] == "" {
+		if _, ok := obj.Annotations[approvedAnnotation]; ok {
+			m.logger.Infof(obj, "Ignoring approval of machine %s set before approval was requested", obj.Spec.RequestedHostname)
+			delete(obj.Annotations, approvedAnnotation)
+			delete(obj.Annotations, approvalReasonAnnotation)
+		}
+		m.logger.Infof(obj, "Machine %s is waiting for approval", obj.Spec.RequestedHostname)
+		obj.Annotations[approvalRequestedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	switch obj.Annotations[approvedAnnotation] {
+	case "true":
+		if conditionStatus(obj, MachineConditionApproved) != "True" {
+			m.logger.Infof(obj, "Machine %s was approved", obj.Spec.RequestedHostname)
+			MachineConditionApproved.True(obj)
+			MachineConditionApproved.Reason(obj, "")
+			MachineConditionApproved.Message(obj, "")
+		}
+		return false, nil
+	case "false":
+		reason := obj.Annotations[approvalReasonAnnotation]
+		if conditionStatus(obj, MachineConditionApproved) != "False" || MachineConditionApproved.GetMessage(obj) != reason {
+			m.logger.Errorf(obj, "Machine %s was rejected: %s", obj.Spec.RequestedHostname, reason)
+			MachineConditionApproved.False(obj)
+			MachineConditionApproved.Reason(obj, "Rejected")
+			MachineConditionApproved.Message(obj, reason)
+		}
+		return true, nil
+	}
+
+	reason := "PendingApproval"
+	if m.approvalWebhook != "" && obj.Annotations[approvalNotifiedAnnotation] == "" {
+		if err := m.requestApproval(obj); err != nil {
+			reason = "ApprovalRequestFailed"
+			MachineConditionApproved.Message(obj, err.Error())
+			m.enqueueAfter(obj, approvalWebhookRetryAfter)
+		} else {
+			obj.Annotations[approvalNotifiedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			MachineConditionApproved.Message(obj, "")
+		}
+	}
+	if conditionStatus(obj, MachineConditionApproved) != "Unknown" || MachineConditionApproved.GetReason(obj) != reason {
+		MachineConditionApproved.Unknown(obj)
+		MachineConditionApproved.Reason(obj, reason)
+	}
+	return true, nil
+}
+
+// requiresApproval returns whether the create of obj has to be approved. The
+// exemption of a machine template is read from the template, not from the
+// annotation copied to the machine.
+func (m *Lifecycle) requiresApproval(obj *v3.Machine) (bool, error) {
+	if !m.requireApproval {
+		return obj.Annotations[requireApprovalAnnotation] == "true", nil
+	}
+	template, err := m.machineTemplateClient.Get(obj.Spec.MachineTemplateName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return template.Annotations[requireApprovalAnnotation] != "false", nil
+}
+
+// requestApproval POSTs the ApprovalRequest of a machine to the approval
+// webhook.
+func (m *Lifecycle) requestApproval(obj *v3.Machine) error {
+	request := ApprovalRequest{
+		Namespace:  obj.Namespace,
+		Name:       obj.Name,
+		Hostname:   obj.Spec.RequestedHostname,
+		Cluster:    obj.Spec.ClusterName,
+		Role:       obj.Spec.Role,
+		Template:   obj.Spec.MachineTemplateName,
+		Driver:     obj.Status.MachineTemplateSpec.Driver,
+		Revision:   obj.Annotations[templateRevisionAnnotation],
+		Annotation: approvedAnnotation,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: approvalWebhookTimeout}
+	resp, err := client.Post(m.approvalWebhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("approval webhook failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("approval webhook returned %s", resp.Status)
+	}
+	return nil
+}
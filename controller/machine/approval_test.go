@@ -0,0 +1,209 @@
+package machine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeLogger struct{}
+
+func (fakeLogger) Info(obj runtime.Object, message string)                           {}
+func (fakeLogger) Infof(obj runtime.Object, messagefmt string, args ...interface{})  {}
+func (fakeLogger) Error(obj runtime.Object, message string)                          {}
+func (fakeLogger) Errorf(obj runtime.Object, messagefmt string, args ...interface{}) {}
+
+type fakeMachineTemplates struct {
+	v3.MachineTemplateInterface
+	objs map[string]*v3.MachineTemplate
+}
+
+func (f *fakeMachineTemplates) Get(name string, opts metav1.GetOptions) (*v3.MachineTemplate, error) {
+	obj, ok := f.objs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "machinetemplates"}, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func approvalTemplate(name string, annotations map[string]string) *v3.MachineTemplate {
+	template := &v3.MachineTemplate{}
+	template.Name = name
+	template.Annotations = annotations
+	return template
+}
+
+func approvalMachine(template string, annotations map[string]string) *v3.Machine {
+	obj := &v3.Machine{}
+	obj.Name = "m1"
+	obj.Annotations = annotations
+	obj.Spec.MachineTemplateName = template
+	obj.Status.MachineTemplateSpec = &v3.MachineTemplateSpec{Driver: "amazonec2"}
+	if annotations[approvalRequestedAnnotation] != "" {
+		// A machine has been waiting since the request was recorded.
+		obj.Status.Conditions = []v3.MachineCondition{{
+			Type:   MachineConditionApproved,
+			Status: v1.ConditionUnknown,
+			Reason: "PendingApproval",
+		}}
+	}
+	return obj
+}
+
+func TestAwaitApproval(t *testing.T) {
+	templates := &fakeMachineTemplates{objs: map[string]*v3.MachineTemplate{
+		"exempt":   approvalTemplate("exempt", map[string]string{requireApprovalAnnotation: "false"}),
+		"required": approvalTemplate("required", nil),
+	}}
+	requested := "2026-01-02T03:04:05Z"
+	tests := []struct {
+		name            string
+		requireApproval bool
+		machine         *v3.Machine
+		held            bool
+		status          string
+		reason          string
+	}{
+		{
+			name:    "not required",
+			machine: approvalMachine("required", nil),
+		},
+		{
+			name:    "requested by the machine",
+			machine: approvalMachine("required", map[string]string{requireApprovalAnnotation: "true"}),
+			held:    true,
+			status:  "Unknown",
+			reason:  "PendingApproval",
+		},
+		{
+			name: "approved before it was requested",
+			machine: approvalMachine("required", map[string]string{
+				requireApprovalAnnotation: "true",
+				approvedAnnotation:        "true",
+			}),
+			held:   true,
+			status: "Unknown",
+			reason: "PendingApproval",
+		},
+		{
+			name: "approved",
+			machine: approvalMachine("required", map[string]string{
+				requireApprovalAnnotation:   "true",
+				approvalRequestedAnnotation: requested,
+				approvedAnnotation:          "true",
+			}),
+			status: "True",
+		},
+		{
+			name: "rejected",
+			machine: approvalMachine("required", map[string]string{
+				requireApprovalAnnotation:   "true",
+				approvalRequestedAnnotation: requested,
+				approvedAnnotation:          "false",
+				approvalReasonAnnotation:    "over budget",
+			}),
+			held:   true,
+			status: "False",
+			reason: "Rejected",
+		},
+		{
+			name:            "required by the controller",
+			requireApproval: true,
+			machine:         approvalMachine("required", nil),
+			held:            true,
+			status:          "Unknown",
+			reason:          "PendingApproval",
+		},
+		{
+			name:            "exempted by the template",
+			requireApproval: true,
+			machine:         approvalMachine("exempt", nil),
+		},
+		{
+			name:            "exempted by the machine only",
+			requireApproval: true,
+			machine:         approvalMachine("required", map[string]string{requireApprovalAnnotation: "false"}),
+			held:            true,
+			status:          "Unknown",
+			reason:          "PendingApproval",
+		},
+		{
+			name:            "template deleted",
+			requireApproval: true,
+			machine:         approvalMachine("deleted", nil),
+			held:            true,
+			status:          "Unknown",
+			reason:          "PendingApproval",
+		},
+	}
+	for _, test := range tests {
+		m := &Lifecycle{
+			logger:                fakeLogger{},
+			machineTemplateClient: templates,
+			requireApproval:       test.requireApproval,
+		}
+		approved := test.machine.Annotations[approvedAnnotation]
+		held, err := m.awaitApproval(test.machine)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if held != test.held {
+			t.Errorf("%s: held is %v, want %v", test.name, held, test.held)
+		}
+		if status := conditionStatus(test.machine, MachineConditionApproved); status != test.status {
+			t.Errorf("%s: Approved is %q, want %q", test.name, status, test.status)
+		}
+		if reason := MachineConditionApproved.GetReason(test.machine); test.status != "" && reason != test.reason {
+			t.Errorf("%s: Approved has reason %q, want %q", test.name, reason, test.reason)
+		}
+		if test.status == "" {
+			continue
+		}
+		if test.machine.Annotations[approvalRequestedAnnotation] == "" {
+			t.Errorf("%s: approval request is not recorded", test.name)
+		}
+		if want := test.reason != "PendingApproval"; approved != "" && (test.machine.Annotations[approvedAnnotation] != "") != want {
+			t.Errorf("%s: approval is kept %v, want %v", test.name, !want, want)
+		}
+	}
+}
+
+func TestAwaitApprovalNotifiesOnce(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+	}))
+	defer server.Close()
+
+	m := &Lifecycle{
+		logger:          fakeLogger{},
+		approvalWebhook: server.URL,
+	}
+	obj := approvalMachine("required", map[string]string{requireApprovalAnnotation: "true"})
+	for i := 0; i < 2; i++ {
+		if held, err := m.awaitApproval(obj); err != nil || !held {
+			t.Fatalf("machine is not held: %v", err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 1 {
+		t.Errorf("approval webhook was called %d times, want once", requests)
+	}
+	if obj.Annotations[approvalNotifiedAnnotation] == "" {
+		t.Error("notification is not recorded")
+	}
+}
@@ -0,0 +1,128 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/aws"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// awsRoleAnnotation on an amazonec2 machine, or on its machine template,
+	// holds the aws.Role to provision with, as JSON. The access keys of the
+	// driver config, or of the controller environment, are then only used to
+	// assume the role.
+	awsRoleAnnotation = "io.cattle.machine.aws_assume_role"
+
+	amazonEC2Driver = "amazonec2"
+)
+
+var sessionNameRegexp = regexp.MustCompile(`[^\w+=,.@-]`)
+
+func awsRole(obj *v3.Machine) (*aws.Role, error) {
+	data := obj.Annotations[awsRoleAnnotation]
+	if data == "" || obj.Status.MachineTemplateSpec == nil || obj.Status.MachineTemplateSpec.Driver != amazonEC2Driver {
+		return nil, nil
+	}
+	role := &aws.Role{}
+	if err := json.Unmarshal([]byte(data), role); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", awsRoleAnnotation)
+	}
+	if role.ARN == "" {
+		return nil, fmt.Errorf("%s annotation has no roleArn", awsRoleAnnotation)
+	}
+	return role, nil
+}
+
+// assumeAWSRole returns temporary credentials of the role of an amazonec2
+// machine, or nil if it has none. config is the driver config of the
+// machine.
+func (m *Lifecycle) assumeAWSRole(obj *v3.Machine, config map[string]interface{}) (*aws.Credentials, error) {
+	role, err := awsRole(obj)
+	if err != nil || role == nil {
+		return nil, err
+	}
+
+	base := &aws.Credentials{
+		AccessKey:    convert.ToString(config["accessKey"]),
+		SecretKey:    convert.ToString(config["secretKey"]),
+		SessionToken: convert.ToString(config["sessionToken"]),
+	}
+	if base.AccessKey == "" || base.SecretKey == "" {
+		if base = aws.EnvCredentials(); base == nil {
+			return nil, fmt.Errorf("no AWS credentials to assume role %s with", role.ARN)
+		}
+	}
+
+	sessionName := sessionNameRegexp.ReplaceAllString("machine-"+obj.Name, "-")
+	if len(sessionName) > 64 {
+		sessionName = sessionName[:64]
+	}
+	creds, err := aws.AssumeRole(base, convert.ToString(config["region"]), *role, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Infof(obj, "Assumed role %s for machine %s until %s", role.ARN, obj.Spec.RequestedHostname,
+		creds.Expiration.UTC().Format(time.RFC3339))
+	return creds, nil
+}
+
+// applyAWSRole replaces the access keys of the driver config of an amazonec2
+// machine with temporary credentials of its role, if it has one.
+func (m *Lifecycle) applyAWSRole(obj *v3.Machine, config map[string]interface{}) error {
+	creds, err := m.assumeAWSRole(obj, config)
+	if err != nil || creds == nil {
+		return err
+	}
+	config["accessKey"] = creds.AccessKey
+	config["secretKey"] = creds.SecretKey
+	config["sessionToken"] = creds.SessionToken
+	return nil
+}
+
+// refreshAWSRole renews the temporary credentials docker-machine stored for an
+// amazonec2 machine with a role, which have likely expired since it was
+// created, before the driver is started again.
+func (m *Lifecycle) refreshAWSRole(obj *v3.Machine, machineDir string) error {
+	if role, err := awsRole(obj); err != nil || role == nil {
+		return err
+	}
+
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &config); err != nil {
+		return errors.Wrap(err, "failed to unmarshal machine config")
+	}
+	creds, err := m.assumeAWSRole(obj, config)
+	if err != nil {
+		return err
+	}
+
+	hostConfig := filepath.Join(machineDir, "machines", obj.Spec.RequestedHostname, "config.json")
+	data, err := ioutil.ReadFile(hostConfig)
+	if err != nil {
+		return err
+	}
+	host := map[string]interface{}{}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", hostConfig)
+	}
+	driver, ok := host["Driver"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s has no driver config", hostConfig)
+	}
+	driver["AccessKey"] = creds.AccessKey
+	driver["SecretKey"] = creds.SecretKey
+	driver["SessionToken"] = creds.SessionToken
+
+	if data, err = json.MarshalIndent(host, "", "    "); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(hostConfig, data, 0600)
+}
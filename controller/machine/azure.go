@@ -0,0 +1,93 @@
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// azureCertificateAnnotation on an azure machine, or on its machine
+	// template, names a kubernetes.io/tls Secret in cattle-system holding the
+	// certificate and key the service principal authenticates with, instead
+	// of a client secret. The Secret is read every time the driver is
+	// started, so it is rotated by updating the Secret.
+	azureCertificateAnnotation = "io.cattle.machine.azure_client_certificate"
+
+	azureDriver = "azure"
+	// azureCertificateField is the driver field taking the path of a PEM
+	// file with the certificate and key, not offered by every azure driver.
+	azureCertificateField = "clientCertificatePath"
+	azureCertificateFile  = "azure-client-certificate.pem"
+)
+
+func azureCertificateSecret(obj *v3.Machine) string {
+	if obj.Status.MachineTemplateSpec == nil || obj.Status.MachineTemplateSpec.Driver != azureDriver {
+		return ""
+	}
+	return obj.Annotations[azureCertificateAnnotation]
+}
+
+// applyAzureCertificate writes the client certificate of an azure machine
+// into its docker-machine storage directory and points the driver config at
+// it in place of the client secret.
+func (m *Lifecycle) applyAzureCertificate(obj *v3.Machine, machineDir string, config map[string]interface{}) error {
+	if azureCertificateSecret(obj) == "" {
+		return nil
+	}
+
+	driverSchema, err := schemastore.Get(m.driverSchemaClient(obj), azureDriver+"config")
+	if err != nil {
+		return err
+	}
+	if _, ok := driverSchema.Spec.ResourceFields[azureCertificateField]; !ok {
+		return fmt.Errorf("the installed azure driver does not support certificate authentication, it has no %s field",
+			azureCertificateField)
+	}
+
+	certFile, err := m.writeAzureCertificate(obj, machineDir)
+	if err != nil {
+		return err
+	}
+	delete(config, "clientSecret")
+	config[azureCertificateField] = certFile
+	return nil
+}
+
+// writeAzureCertificate writes the current certificate and key of the Secret
+// of an azure machine to its storage directory and returns the file.
+func (m *Lifecycle) writeAzureCertificate(obj *v3.Machine, machineDir string) (string, error) {
+	name := azureCertificateSecret(obj)
+	secret, err := m.secrets.Secrets(policyNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get azure client certificate secret %s", name)
+	}
+	if !driverSecret(secret, obj.Spec.MachineTemplateName) {
+		return "", fmt.Errorf("azure client certificate secret %s is neither labeled %s=true nor owned by machine template %s",
+			name, driverSecretLabel, obj.Spec.MachineTemplateName)
+	}
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return "", fmt.Errorf("secret %s must have %s and %s", name, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+	}
+
+	certFile := filepath.Join(machineDir, azureCertificateFile)
+	pem := append(append(append([]byte{}, cert...), '\n'), key...)
+	return certFile, ioutil.WriteFile(certFile, pem, 0600)
+}
+
+// refreshAzureCertificate rewrites the client certificate of an azure machine
+// from its Secret before the driver is started again, picking up rotations.
+func (m *Lifecycle) refreshAzureCertificate(obj *v3.Machine, machineDir string) error {
+	if azureCertificateSecret(obj) == "" {
+		return nil
+	}
+	_, err := m.writeAzureCertificate(obj, machineDir)
+	return err
+}
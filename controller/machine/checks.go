@@ -0,0 +1,99 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// checksAnnotation on a machine, or on its machine template, holds a JSON
+	// list of Checks that must pass after provisioning before the machine is
+	// registered.
+	checksAnnotation = "io.cattle.machine.checks"
+
+	maxCheckOutput = 4096
+)
+
+var (
+	MachineConditionVerified condition.Cond = "Verified"
+)
+
+// Check is a command run on a freshly provisioned machine over SSH. It passes
+// if the command exits with ExitCode and, if Output is set, its combined
+// output matches the Output regular expression.
+type Check struct {
+	Name     string `json:"name"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output"`
+}
+
+func (c Check) name(i int) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return fmt.Sprintf("check %d", i+1)
+}
+
+func parseChecks(data string) ([]Check, error) {
+	var checks []Check
+	if data == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(data), &checks); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", checksAnnotation)
+	}
+	return checks, nil
+}
+
+// verify runs the first-boot checks of the machine. A failure sets the
+// Verified condition to False with reason VerificationFailed and the captured
+// output as message.
+func verify(p *Provisioning) error {
+	checks, err := parseChecks(p.Machine.Annotations[checksAnnotation])
+	if err != nil || len(checks) == 0 {
+		return err
+	}
+
+	for i, check := range checks {
+		name := check.name(i)
+		if err := runCheck(p.Machine, p.Config.Dir(), check); err != nil {
+			p.Logger.Errorf(p.Machine, "First-boot check %s failed on machine %s: %v", name, p.Machine.Spec.RequestedHostname, err)
+			return condition.Error("VerificationFailed", errors.Wrapf(err, "check %s failed", name))
+		}
+		p.Logger.Infof(p.Machine, "First-boot check %s passed on machine %s", name, p.Machine.Spec.RequestedHostname)
+	}
+	return nil
+}
+
+func runCheck(obj *v3.Machine, machineDir string, check Check) error {
+	var outputRegexp *regexp.Regexp
+	if check.Output != "" {
+		var err error
+		if outputRegexp, err = regexp.Compile(check.Output); err != nil {
+			return errors.Wrap(err, "invalid output expression")
+		}
+	}
+
+	out, exitCode, err := sshRun(obj, machineDir, check.Command, 0)
+	if err != nil {
+		return err
+	}
+
+	output := string(out)
+	if len(output) > maxCheckOutput {
+		output = output[len(output)-maxCheckOutput:]
+	}
+	if exitCode != check.ExitCode {
+		return fmt.Errorf("exit code %d, expected %d: %s", exitCode, check.ExitCode, output)
+	}
+	if outputRegexp != nil && !outputRegexp.MatchString(output) {
+		return fmt.Errorf("output does not match %q: %s", check.Output, output)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// cloneAction creates a new machine with the resolved driver config of
+	// an existing one. The input is the name of the new machine, or empty to
+	// generate one.
+	cloneAction = "clone"
+)
+
+func (m *Lifecycle) clone(obj *v3.Machine) *v3.Machine {
+	name, ok := action.Pending(obj, cloneAction)
+	if !ok {
+		return obj
+	}
+
+	newMachine, err := m.createClone(obj, name)
+	output := ""
+	if err == nil {
+		output = newMachine.Name
+		m.logger.Infof(obj, "Cloned machine %s to %s", obj.Name, newMachine.Name)
+	}
+	action.Complete(obj, cloneAction, output, err)
+	return obj
+}
+
+func (m *Lifecycle) createClone(obj *v3.Machine, name string) (*v3.Machine, error) {
+	if obj.Status.MachineTemplateSpec == nil || obj.Status.MachineDriverConfig == "" {
+		return nil, fmt.Errorf("machine %s has no driver config to clone", obj.Name)
+	}
+
+	if name != "" {
+		return m.machineClient.Create(cloneMachine(obj, name))
+	}
+
+	tmpl, err := m.nameTemplate(obj.Spec.MachineTemplateName, defaultCloneNameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	// The resource version changes once the action completes, so only a
+	// retry of the same request yields the same name.
+	seed := fmt.Sprintf("clone/%s@%s", obj.UID, obj.ResourceVersion)
+	params := nameParams{
+		Pool:   obj.Spec.MachineTemplateName,
+		Source: obj.Name,
+		Kind:   "clone",
+	}
+	return m.createGenerated(tmpl, params, seed, func(name string) *v3.Machine {
+		return cloneMachine(obj, name)
+	})
+}
+
+// cloneMachine copies the spec and resolved driver config of obj into a new
+// machine, leaving out everything tied to the identity of the original.
+func cloneMachine(obj *v3.Machine, name string) *v3.Machine {
+	clone := &v3.Machine{}
+	clone.Name = name
+	clone.Namespace = obj.Namespace
+	clone.Labels = map[string]string{}
+	for k, v := range obj.Labels {
+		clone.Labels[k] = v
+	}
+	copyMetadata(obj, clone)
+
+	clone.Spec = *obj.Spec.DeepCopy()
+	clone.Spec.RequestedHostname = name
+	clone.Spec.DisplayName = ""
+	clone.Spec.NodeSpec.ProviderID = ""
+	clone.Spec.NodeSpec.ExternalID = ""
+	clone.Spec.NodeSpec.PodCIDR = ""
+
+	clone.Status.MachineTemplateSpec = obj.Status.MachineTemplateSpec.DeepCopy()
+	clone.Status.MachineDriverConfig = obj.Status.MachineDriverConfig
+	clone.Status.SSHUser = obj.Status.SSHUser
+	v3.MachineConditionInitialized.True(clone)
+
+	return clone
+}
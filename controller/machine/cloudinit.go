@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// cloudInitAnnotation on a machine, or on its machine template, makes
+	// provisioning wait for cloud-init to finish on the host. The value is
+	// "true" or how long to wait at most, e.g. "20m".
+	cloudInitAnnotation = "io.cattle.machine.wait_for_cloud_init"
+
+	StepCloudInit = "cloud-init"
+
+	defaultCloudInitTimeout = 10 * time.Minute
+
+	// cloudInitCommand blocks until cloud-init is done, through its status
+	// command where available and its boot-finished sentinel otherwise. Hosts
+	// without cloud-init pass right away.
+	cloudInitCommand = `[ -d /var/lib/cloud ] || exit 0; ` +
+		`if cloud-init status --help >/dev/null 2>&1; then cloud-init status --wait >/dev/null; s=$?; [ $s -eq 2 ] && exit 0; exit $s; fi; ` +
+		`while [ ! -e /var/lib/cloud/instance/boot-finished ]; do sleep 5; done`
+)
+
+// cloudInitTimeout returns how long to wait for cloud-init on obj, or zero.
+func cloudInitTimeout(obj *v3.Machine) time.Duration {
+	value := obj.Annotations[cloudInitAnnotation]
+	switch value {
+	case "", "false":
+		return 0
+	case "true":
+		return defaultCloudInitTimeout
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultCloudInitTimeout
+	}
+	return d
+}
+
+// waitCloudInit waits up to timeout for cloud-init to finish on the host of
+// a machine.
+func waitCloudInit(obj *v3.Machine, machineDir string, timeout time.Duration) error {
+	out, exitCode, err := sshRun(obj, machineDir, cloudInitCommand, timeout)
+	if err != nil {
+		return errors.Wrap(err, "waiting for cloud-init")
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("cloud-init failed: exit code %d: %s", exitCode, out)
+	}
+	return nil
+}
+
+func waitForCloudInit(p *Provisioning) error {
+	timeout := cloudInitTimeout(p.Machine)
+	if timeout <= 0 {
+		return nil
+	}
+
+	p.Logger.Infof(p.Machine, "Waiting for cloud-init to finish on machine %s", p.Machine.Spec.RequestedHostname)
+	return waitCloudInit(p.Machine, p.Config.Dir(), timeout)
+}
+
+// provisionAfterCloudInit recovers from a create that failed installing the
+// engine because cloud-init was still busy on the host: once cloud-init is
+// done the engine is installed again with docker-machine provision. createErr
+// is returned if the gate is off or the host was never created.
+func (p *Provisioning) provisionAfterCloudInit(createErr error) error {
+	timeout := cloudInitTimeout(p.Machine)
+	if timeout <= 0 {
+		return createErr
+	}
+	hostname := p.Machine.Spec.RequestedHostname
+	if exists, err := machineExists(p.Config.Dir(), hostname); err != nil || !exists {
+		return createErr
+	}
+
+	p.Logger.Infof(p.Machine, "Provisioning machine %s failed, installing the engine again once cloud-init is done: %v",
+		hostname, createErr)
+	if err := waitCloudInit(p.Machine, p.Config.Dir(), timeout); err != nil {
+		return errors.Wrapf(createErr, "%v, provisioning failed", err)
+	}
+	if output, err := p.lifecycle.runProvision(p.Machine, p.Config.Dir()); err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
@@ -7,8 +7,14 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/policy"
+	"github.com/rancher/machine-controller/sshclient"
 	"github.com/rancher/machine-controller/store"
 	machineconfig "github.com/rancher/machine-controller/store/config"
+	schemastore "github.com/rancher/machine-controller/store/schema"
 	"github.com/rancher/norman/clientbase"
 	"github.com/rancher/norman/event"
 	"github.com/rancher/norman/types/convert"
@@ -16,19 +22,50 @@ import (
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 )
 
 const (
 	defaultEngineInstallURL = "https://releases.rancher.com/install-docker/17.03.2.sh"
 )
 
-func Register(management *config.ManagementContext) {
-	secretStore, err := machineconfig.NewStore(management)
+// templateAnnotations are copied from a machine template to its machines
+// unless set on the machine.
+var templateAnnotations = []string{
+	keepOnFailureAnnotation,
+	provisioningRetriesAnnotation,
+	requireApprovalAnnotation,
+	checksAnnotation,
+	credentialProfileAnnotation,
+	awsRoleAnnotation,
+	gcpWorkloadIdentityAnnotation,
+	azureCertificateAnnotation,
+	ipamPoolAnnotation,
+	loadBalancerAnnotation,
+	cloudInitAnnotation,
+	sshclient.Annotation,
+	sshKeyTypeAnnotation,
+	fallbackInstanceTypesAnnotation,
+	storageDetachTimeoutAnnotation,
+	storageDetachPolicyAnnotation,
+}
+
+func Register(management *config.ManagementContext, opts options.Options) {
+	secretStore, err := machineconfig.NewStore(management, opts.MachineStateNamespace)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	allowedBinaries, err := policy.NewBinaryAllowList(management.K8sClient.CoreV1(), opts.DriverAllowListKey)
 	if err != nil {
+		logrus.Fatalf("Invalid driver allow list key: %v", err)
+	}
+	if err := sshclient.ValidateKeyType(opts.SSHKeyType); err != nil {
 		logrus.Fatal(err)
 	}
 
@@ -39,11 +76,58 @@ func Register(management *config.ManagementContext) {
 		machineClient:                machineClient,
 		machineTemplateClient:        management.Management.MachineTemplates(""),
 		machineTemplateGenericClient: management.Management.MachineTemplates("").ObjectClient().UnstructuredClient(),
+		machineDriverClient:          management.Management.MachineDrivers(""),
 		configMapGetter:              management.K8sClient.CoreV1(),
+		secrets:                      management.K8sClient.CoreV1(),
+		namespaceClient:              management.K8sClient.CoreV1(),
+		schemaClient:                 management.Management.DynamicSchemas(""),
+		restClient:                   management.Management.RESTClient(),
+		multiTenancy:                 opts.MultiTenancy,
+		statusUpdateInterval:         opts.StatusUpdateInterval,
 		logger:                       management.EventLogger,
+		allowedBinaries:              allowedBinaries,
+		sshKeyType:                   opts.SSHKeyType,
+		namespaces:                   opts.Namespaces,
+		provisionQueue:               newProvisionQueue(opts.MaxConcurrentProvisions),
+		provisioningRetryLimit:       opts.ProvisioningRetries,
+		requireApproval:              opts.RequireApproval,
+		approvalWebhook:              opts.ApprovalWebhook,
+	}
+	machineLifecycle.flagPolicy = &configMapFlagMutator{
+		configMapGetter: management.K8sClient.CoreV1(),
+		schemaClient:    machineLifecycle.driverSchemaClient,
 	}
 
-	machineClient.AddLifecycle("machine-controller", machineLifecycle)
+	// Machines outside the namespaces of the controller are skipped before
+	// the lifecycle sees them, so their finalizers are left to the
+	// controller that manages them.
+	sync := v3.NewMachineLifecycleAdapter("machine-controller", machineClient, machineLifecycle)
+	machineClient.AddSyncHandler(func(key string, obj *v3.Machine) error {
+		if obj != nil && !opts.Namespaces.Contains(obj.Namespace) {
+			return nil
+		}
+		return sync(key, obj)
+	})
+
+	rotator := &keyRotator{
+		machines:      machineClient.Controller().Lister(),
+		machineClient: machineClient,
+		configMaps:    management.K8sClient.CoreV1(),
+		namespaces:    opts.Namespaces,
+	}
+	go rotator.run()
+
+	rollouts := &rolloutController{
+		lifecycle:      machineLifecycle,
+		machines:       machineClient.Controller().Lister(),
+		machineIndexer: machineClient.Controller().Informer().GetIndexer(),
+	}
+	go rollouts.run()
+
+	validator := &templateValidator{
+		lifecycle: machineLifecycle,
+	}
+	management.Management.MachineTemplates("").AddSyncHandler(validator.sync)
 }
 
 type Lifecycle struct {
@@ -51,8 +135,23 @@ type Lifecycle struct {
 	machineTemplateGenericClient *clientbase.ObjectClient
 	machineClient                v3.MachineInterface
 	machineTemplateClient        v3.MachineTemplateInterface
+	machineDriverClient          v3.MachineDriverInterface
 	configMapGetter              typedv1.ConfigMapsGetter
+	secrets                      typedv1.SecretsGetter
+	namespaceClient              typedv1.NamespacesGetter
+	schemaClient                 v3.DynamicSchemaInterface
+	restClient                   rest.Interface
+	multiTenancy                 bool
+	statusUpdateInterval         time.Duration
 	logger                       event.Logger
+	flagPolicy                   FlagMutator
+	allowedBinaries              *policy.BinaryAllowList
+	sshKeyType                   string
+	namespaces                   options.NamespaceScope
+	provisionQueue               *provisionQueue
+	provisioningRetryLimit       int
+	requireApproval              bool
+	approvalWebhook              string
 }
 
 func (m *Lifecycle) Create(obj *v3.Machine) (*v3.Machine, error) {
@@ -60,12 +159,30 @@ func (m *Lifecycle) Create(obj *v3.Machine) (*v3.Machine, error) {
 		return obj, nil
 	}
 
+	orig := obj.DeepCopy()
 	newObj, err := v3.MachineConditionInitialized.Once(obj, func() (runtime.Object, error) {
 		template, err := m.machineTemplateClient.Get(obj.Spec.MachineTemplateName, metav1.GetOptions{})
 		if err != nil {
 			return obj, err
 		}
 		obj.Status.MachineTemplateSpec = &template.Spec
+		if err := m.checkDriverAllowed(obj, template.Spec.Driver); err != nil {
+			return obj, err
+		}
+		for _, key := range templateAnnotations {
+			if value, ok := template.Annotations[key]; ok && obj.Annotations[key] == "" {
+				if obj.Annotations == nil {
+					obj.Annotations = map[string]string{}
+				}
+				obj.Annotations[key] = value
+			}
+		}
+		if m.sshKeyType != "" && obj.Annotations[sshKeyTypeAnnotation] == "" {
+			if obj.Annotations == nil {
+				obj.Annotations = map[string]string{}
+			}
+			obj.Annotations[sshKeyTypeAnnotation] = m.sshKeyType
+		}
 		if obj.Spec.RequestedHostname == "" {
 			obj.Spec.RequestedHostname = obj.Name
 		}
@@ -83,12 +200,67 @@ func (m *Lifecycle) Create(obj *v3.Machine) (*v3.Machine, error) {
 		if !ok {
 			return obj, fmt.Errorf("machine config not specified")
 		}
+		if obj.Annotations == nil {
+			obj.Annotations = map[string]string{}
+		}
+		// The revision is that of the template alone, taken before the
+		// driver defaults are merged, so changing defaults applies to new
+		// machines only and does not roll out pools.
+		obj.Annotations[templateRevisionAnnotation] = templateRevision(template, rawConfig)
+
+		if err := m.applyDriverDefaults(obj, template.Spec.Driver, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		if err := m.resolveSecretRefs(obj, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		if err := m.applyImage(obj, template, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		if err := m.checkApprovedImage(template.Spec.Driver, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		if err := m.allocateAddress(obj, template.Spec.Driver, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		rules, err := policy.Load(m.configMapGetter)
+		if err != nil {
+			return obj, err
+		}
+		if err := policy.Evaluate(rules, template.Spec.Driver, obj.Labels, convert.ToMapInterface(rawConfig)); err != nil {
+			return obj, err
+		}
+
+		driverSchema, err := schemastore.Get(m.driverSchemaClient(obj), strings.ToLower(template.Spec.Driver)+"config")
+		if err != nil && !apierrors.IsNotFound(err) {
+			return obj, err
+		} else if err == nil {
+			// The schema defaults are set on the machine, not its template,
+			// so they do not change the revision of the template.
+			applyFieldDefaults(driverSchema.Spec.ResourceFields, convert.ToMapInterface(rawConfig))
+			if err := policy.ValidateSchema(driverSchema, convert.ToMapInterface(rawConfig)); err != nil {
+				return obj, err
+			}
+		}
 
 		sshUser, ok := convert.ToMapInterface(rawConfig)["sshUser"]
 		if ok {
 			obj.Status.SSHUser = convert.ToString(sshUser)
 		}
 
+		sshOptions, err := sshclient.Parse(obj.Annotations[sshclient.Annotation])
+		if err != nil {
+			return obj, err
+		}
+		if sshOptions.User != "" {
+			obj.Status.SSHUser = sshOptions.User
+		}
+
 		if obj.Status.SSHUser == "" {
 			obj.Status.SSHUser = "root"
 		}
@@ -102,9 +274,20 @@ func (m *Lifecycle) Create(obj *v3.Machine) (*v3.Machine, error) {
 		return obj, nil
 	})
 
+	conditions.SetTransitionTimes(orig, newObj)
+	setListLabels(newObj.(*v3.Machine))
 	return newObj.(*v3.Machine), err
 }
 
+// driverSchemaClient returns the client for the driver schemas visible to a
+// machine, which live in the machine's namespace in multi-tenancy mode.
+func (m *Lifecycle) driverSchemaClient(obj *v3.Machine) schemastore.Client {
+	if !m.multiTenancy {
+		return m.schemaClient
+	}
+	return schemastore.NewNamespacedClient(m.restClient, obj.Namespace)
+}
+
 func (m *Lifecycle) Remove(obj *v3.Machine) (*v3.Machine, error) {
 	if obj.Status.MachineTemplateSpec == nil {
 		return obj, nil
@@ -114,23 +297,20 @@ func (m *Lifecycle) Remove(obj *v3.Machine) (*v3.Machine, error) {
 	if err != nil {
 		return obj, err
 	}
-	if err := config.Restore(); err != nil {
-		return obj, err
-	}
-	defer config.Remove()
-
-	mExists, err := machineExists(config.Dir(), obj.Spec.RequestedHostname)
-	if err != nil {
+	force := obj.Annotations[forceDeleteAnnotation] == "true"
+	if err := config.Restore(); err != nil && !force {
 		return obj, err
 	}
 
-	if mExists {
-		m.logger.Infof(obj, "Removing machine %s", obj.Spec.RequestedHostname)
-		if err := deleteMachine(config.Dir(), obj); err != nil {
-			return nil, err
-		}
-		m.logger.Infof(obj, "Removing machine %s done", obj.Spec.RequestedHostname)
+	m.logger.Infof(obj, "Removing machine %s", obj.Spec.RequestedHostname)
+	if err := m.teardown(obj, config, force); err != nil {
+		// The stored state is kept, so the next attempt can still remove
+		// the instance.
+		config.Cleanup()
+		return nil, err
 	}
+	config.Remove()
+	m.logger.Infof(obj, "Removing machine %s done", obj.Spec.RequestedHostname)
 
 	return obj, nil
 }
@@ -140,15 +320,103 @@ func (m *Lifecycle) provision(machineDir string, obj *v3.Machine) (*v3.Machine,
 	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &configRawMap); err != nil {
 		return obj, errors.Wrap(err, "failed to unmarshal machine config")
 	}
+	if err := m.applyAWSRole(obj, configRawMap); err != nil {
+		return obj, err
+	}
+	if err := applyWorkloadIdentity(obj, configRawMap); err != nil {
+		return obj, err
+	}
+	if err := m.applyAzureCertificate(obj, machineDir, configRawMap); err != nil {
+		return obj, err
+	}
+	if err := m.applyMetadata(obj, configRawMap); err != nil {
+		return obj, err
+	}
+
+	field, instanceTypes, err := m.instanceTypes(obj, configRawMap)
+	if err != nil {
+		return obj, err
+	}
+	if len(instanceTypes) == 0 {
+		return m.place(machineDir, obj, configRawMap)
+	}
+	for i, instanceType := range instanceTypes {
+		// place sets the zone field, so each instance type starts from the
+		// config as it was.
+		config := map[string]interface{}{}
+		for key, value := range configRawMap {
+			config[key] = value
+		}
+		config[field] = instanceType
+		if i > 0 {
+			m.logger.Infof(obj, "Trying instance type %s for machine %s", instanceType, obj.Spec.RequestedHostname)
+		}
+		obj, err = m.place(machineDir, obj, config)
+		if err == nil {
+			return obj, recordInstanceType(obj, field, instanceType)
+		}
+		if !placementFailed(err) || i == len(instanceTypes)-1 {
+			return obj, err
+		}
+		m.logger.Infof(obj, "Instance type %s is not available for machine %s: %v", instanceType, obj.Spec.RequestedHostname, err)
+		if err := deleteMachine(machineDir, obj); err != nil {
+			return obj, err
+		}
+	}
+	return obj, nil
+}
+
+// place creates a machine, in the zone with the most capacity that has room
+// for it if its driver config asks for automatic placement.
+func (m *Lifecycle) place(machineDir string, obj *v3.Machine, configRawMap map[string]interface{}) (*v3.Machine, error) {
+	field, zones, err := m.autoZones(obj, configRawMap)
+	if err != nil {
+		return obj, err
+	}
+	if len(zones) == 0 {
+		return m.create(machineDir, obj, configRawMap)
+	}
+	for i, zone := range zones {
+		configRawMap[field] = zone
+		m.logger.Infof(obj, "Placing machine %s in zone %s", obj.Spec.RequestedHostname, zone)
+		obj, err = m.create(machineDir, obj, configRawMap)
+		if err == nil {
+			return obj, recordConfigField(obj, field, zone)
+		}
+		if !placementFailed(err) || i == len(zones)-1 {
+			return obj, err
+		}
+		m.logger.Infof(obj, "Zone %s has insufficient capacity for machine %s, trying the next zone", zone, obj.Spec.RequestedHostname)
+		if err := deleteMachine(machineDir, obj); err != nil {
+			return obj, err
+		}
+	}
+	return obj, nil
+}
+
+func (m *Lifecycle) create(machineDir string, obj *v3.Machine, configRawMap map[string]interface{}) (*v3.Machine, error) {
+	createCommandsArgs, err := m.mutateCreateCommand(obj, buildCreateCommand(obj, configRawMap))
+	if err != nil {
+		return obj, err
+	}
+	createCommandsArgs = append(createCommandsArgs, obj.Spec.RequestedHostname)
 
 	// Since we know this will take a long time persist so user sees status
-	obj, err := m.machineClient.Update(obj)
+	obj, err = m.machineClient.Update(obj)
 	if err != nil {
 		return obj, err
 	}
 
-	createCommandsArgs := buildCreateCommand(obj, configRawMap)
-	cmd := buildCommand(machineDir, createCommandsArgs)
+	if err := m.checkDriverBinary(obj.Status.MachineTemplateSpec.Driver); err != nil {
+		return obj, err
+	}
+	limits, err := m.driverLimits(obj.Status.MachineTemplateSpec.Driver)
+	if err != nil {
+		return obj, err
+	}
+	dockermachine.MarkUsed(obj.Status.MachineTemplateSpec.Driver)
+	cmd := dockermachine.LimitedCommand(machineDir, createCommandsArgs, limits)
+	workloadIdentityEnv(obj, cmd)
 	m.logger.Infof(obj, "Provisioning machine %s", obj.Spec.RequestedHostname)
 
 	stdoutReader, stderrReader, err := startReturnOutput(cmd)
@@ -160,7 +428,8 @@ func (m *Lifecycle) provision(machineDir string, obj *v3.Machine) (*v3.Machine,
 	defer cmd.Wait()
 
 	hostExist := false
-	obj, err = m.reportStatus(stdoutReader, stderrReader, obj)
+	log := newProvisionLog()
+	obj, err = m.reportStatus(stdoutReader, stderrReader, obj, log)
 	if err != nil {
 		if strings.Contains(err.Error(), "Host already exists") {
 			hostExist = true
@@ -175,102 +444,51 @@ func (m *Lifecycle) provision(machineDir string, obj *v3.Machine) (*v3.Machine,
 	}
 
 	m.logger.Infof(obj, "Provisioning machine %s done", obj.Spec.RequestedHostname)
+	log.setPhase(ProvisionPhaseDone)
+	m.saveProvisionLog(obj, log)
 	return obj, nil
 }
 
-func (m *Lifecycle) ready(obj *v3.Machine) (*v3.Machine, error) {
-	config, err := machineconfig.NewMachineConfig(m.secretStore, obj)
-	if err != nil {
-		return obj, err
-	}
-	defer config.Cleanup()
-
-	if err := config.Restore(); err != nil {
-		return obj, err
-	}
-
-	// Provision in the background so we can poll and save the config
-	done := make(chan error)
-	go func() {
-		newObj, err := v3.MachineConditionProvisioned.Once(obj, func() (runtime.Object, error) {
-			return m.provision(config.Dir(), obj)
-		})
-		obj = newObj.(*v3.Machine)
-		done <- err
+func (m *Lifecycle) Updated(obj *v3.Machine) (*v3.Machine, error) {
+	orig := obj.DeepCopy()
+	defer func() {
+		conditions.SetTransitionTimes(orig, obj)
+		setListLabels(obj)
 	}()
 
-	// Poll and save config
-outer:
-	for {
-		select {
-		case err = <-done:
-			break outer
-		case <-time.After(5 * time.Second):
-			config.Save()
-		}
-	}
-
-	newObj, saveError := v3.MachineConditionConfigSaved.Once(obj, func() (runtime.Object, error) {
-		return m.saveConfig(config, config.Dir(), obj)
-	})
-	obj = newObj.(*v3.Machine)
-	if err == nil {
-		return obj, saveError
-	}
-	return obj, err
-}
-
-func (m *Lifecycle) Updated(obj *v3.Machine) (*v3.Machine, error) {
+	obj = m.runActions(obj)
 	if obj.Status.MachineTemplateSpec == nil {
 		return obj, nil
 	}
 
-	newObj, err := v3.MachineConditionConfigReady.Once(obj, func() (runtime.Object, error) {
-		return m.ready(obj)
-	})
-	obj = newObj.(*v3.Machine)
-
-	return obj, err
-}
-
-func (m *Lifecycle) saveConfig(config *machineconfig.MachineConfig, machineDir string, obj *v3.Machine) (*v3.Machine, error) {
-	logrus.Infof("Generating and uploading machine config %s", obj.Spec.RequestedHostname)
-	if err := config.Save(); err != nil {
-		return obj, err
+	if m.resumeProvisionRetry(obj) {
+		return obj, nil
 	}
-
-	ip, err := config.IP()
-	if err != nil {
-		return obj, err
+	if needsProvisionSlot(obj) {
+		held, err := m.awaitApproval(obj)
+		if err != nil || held {
+			return obj, err
+		}
 	}
-
-	interalAddress, err := config.InternalIP()
-	if err != nil {
-		return obj, err
+	if needsProvisionSlot(obj) {
+		release, ok, err := m.acquireProvisionSlot(obj)
+		if err != nil || !ok {
+			return obj, err
+		}
+		defer release()
 	}
 
-	sshKey, err := getSSHKey(machineDir, obj)
+	newObj, err := v3.MachineConditionConfigReady.Once(obj, func() (runtime.Object, error) {
+		return m.runPipeline(obj)
+	})
+	obj = newObj.(*v3.Machine)
 	if err != nil {
+		if m.scheduleProvisionRetry(obj) {
+			return obj, nil
+		}
 		return obj, err
 	}
+	finishProvisionRetry(obj)
 
-	if err := config.Save(); err != nil {
-		return obj, err
-	}
-
-	obj.Status.NodeConfig = &v3.RKEConfigNode{
-		MachineName:      obj.Spec.ClusterName + ":" + obj.Name,
-		Address:          ip,
-		InternalAddress:  interalAddress,
-		User:             obj.Status.SSHUser,
-		Role:             obj.Spec.Role,
-		HostnameOverride: obj.Spec.RequestedHostname,
-		SSHKey:           sshKey,
-	}
-
-	if len(obj.Status.NodeConfig.Role) == 0 {
-		obj.Status.NodeConfig.Role = []string{"worker"}
-	}
-
-	return obj, nil
+	return m.reconcileFirewall(obj), nil
 }
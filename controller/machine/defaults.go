@@ -0,0 +1,214 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// driverDefaultsConfigMap holds defaults merged into the driver config of
+	// machines. In cattle-system it is keyed by driver name for all machines
+	// and by <cluster>.<driver> for the machines of a cluster, in any other
+	// namespace by driver name for the machines of that namespace. Each
+	// value is a JSON driverDefaults.
+	driverDefaultsConfigMap = "machine-driver-defaults"
+	// appliedDefaultsAnnotation on a machine lists the defaults merged into
+	// its driver config as JSON appliedDefaults.
+	appliedDefaultsAnnotation = "io.cattle.machine.applied_defaults"
+)
+
+// driverDefaults are the values of driver config fields, set on machines
+// whose config leaves them empty. The fields in Merge are combined with the
+// value of the config instead: maps get the missing keys, lists the missing
+// items and comma separated strings the missing items of the default.
+type driverDefaults struct {
+	Fields map[string]interface{} `json:"fields"`
+	Merge  []string               `json:"merge,omitempty"`
+}
+
+// defaultsSource is a driverDefaults and the ConfigMap key it was read from.
+type defaultsSource struct {
+	Source   string
+	Defaults driverDefaults
+}
+
+// appliedDefaults are the fields of a driver config set or merged from
+// Source.
+type appliedDefaults struct {
+	Source string   `json:"source"`
+	Fields []string `json:"fields"`
+}
+
+// applyDriverDefaults merges the defaults of the namespace, cluster and
+// driver of a machine into its driver config. The config takes precedence
+// over the defaults of its namespace, those over the defaults of its cluster
+// and those over the defaults of the driver.
+func (m *Lifecycle) applyDriverDefaults(obj *v3.Machine, driver string, config map[string]interface{}) error {
+	if config == nil {
+		return nil
+	}
+	sources, err := m.loadDriverDefaults(obj.Namespace, obj.Spec.ClusterName, driver)
+	if err != nil {
+		return err
+	}
+
+	applied := mergeDriverDefaults(sources, config)
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	if len(applied) == 0 {
+		delete(obj.Annotations, appliedDefaultsAnnotation)
+		return nil
+	}
+	for _, a := range applied {
+		m.logger.Infof(obj, "Defaults %s set %s", a.Source, strings.Join(a.Fields, ", "))
+	}
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	obj.Annotations[appliedDefaultsAnnotation] = string(data)
+	return nil
+}
+
+// loadDriverDefaults returns the defaults of a driver that apply to the
+// machines in namespace and cluster, highest precedence first. Empty
+// namespace and cluster return those of the driver only.
+func (m *Lifecycle) loadDriverDefaults(namespace, cluster, driver string) ([]defaultsSource, error) {
+	driver = strings.ToLower(driver)
+	keys := []struct {
+		namespace, key string
+	}{
+		{namespace, driver},
+		{policyNamespace, cluster + "." + driver},
+		{policyNamespace, driver},
+	}
+
+	var sources []defaultsSource
+	for i, k := range keys {
+		switch {
+		case i == 0 && (namespace == "" || namespace == policyNamespace):
+			continue
+		case i == 1 && cluster == "":
+			continue
+		}
+		cm, err := m.configMapGetter.ConfigMaps(k.namespace).Get(driverDefaultsConfigMap, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		data, ok := cm.Data[k.key]
+		if !ok {
+			continue
+		}
+		source := defaultsSource{
+			Source: fmt.Sprintf("%s/%s[%s]", k.namespace, driverDefaultsConfigMap, k.key),
+		}
+		if err := json.Unmarshal([]byte(data), &source.Defaults); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse driver defaults %s", source.Source)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// mergeDriverDefaults merges sources, highest precedence first, into config.
+func mergeDriverDefaults(sources []defaultsSource, config map[string]interface{}) []appliedDefaults {
+	var applied []appliedDefaults
+	for _, source := range sources {
+		merge := map[string]bool{}
+		for _, field := range source.Defaults.Merge {
+			merge[field] = true
+		}
+
+		var fields []string
+		for field, value := range source.Defaults.Fields {
+			current, ok := config[field]
+			switch {
+			case !ok || convert.IsEmpty(current):
+				config[field] = value
+			case merge[field]:
+				merged, changed := mergeValue(current, value)
+				if !changed {
+					continue
+				}
+				config[field] = merged
+			default:
+				continue
+			}
+			fields = append(fields, field)
+		}
+		if len(fields) > 0 {
+			sort.Strings(fields)
+			applied = append(applied, appliedDefaults{Source: source.Source, Fields: fields})
+		}
+	}
+	return applied
+}
+
+// mergeValue combines the value of a config field with a default and returns
+// whether it added anything.
+func mergeValue(current, value interface{}) (interface{}, bool) {
+	switch c := current.(type) {
+	case map[string]interface{}:
+		v, ok := value.(map[string]interface{})
+		if !ok {
+			return current, false
+		}
+		merged := map[string]interface{}{}
+		for key, item := range c {
+			merged[key] = item
+		}
+		changed := false
+		for key, item := range v {
+			if _, ok := merged[key]; !ok {
+				merged[key] = item
+				changed = true
+			}
+		}
+		return merged, changed
+	case []interface{}:
+		merged := append([]interface{}{}, c...)
+		changed := false
+		for _, item := range convert.ToInterfaceSlice(value) {
+			if !containsValue(merged, item) {
+				merged = append(merged, item)
+				changed = true
+			}
+		}
+		return merged, changed
+	case string:
+		items := map[string]bool{}
+		for _, item := range strings.Split(c, ",") {
+			items[strings.TrimSpace(item)] = true
+		}
+		merged := c
+		for _, item := range strings.Split(convert.ToString(value), ",") {
+			if item = strings.TrimSpace(item); item == "" || items[item] {
+				continue
+			}
+			items[item] = true
+			merged += "," + item
+		}
+		return merged, merged != c
+	}
+	return current, false
+}
+
+func containsValue(items []interface{}, value interface{}) bool {
+	for _, item := range items {
+		if convert.ToString(item) == convert.ToString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		current interface{}
+		value   interface{}
+		merged  interface{}
+		changed bool
+	}{
+		{"map adds missing keys",
+			map[string]interface{}{"team": "a"}, map[string]interface{}{"team": "b", "env": "prod"},
+			map[string]interface{}{"team": "a", "env": "prod"}, true},
+		{"map complete",
+			map[string]interface{}{"team": "a"}, map[string]interface{}{"team": "b"},
+			map[string]interface{}{"team": "a"}, false},
+		{"map with non map default",
+			map[string]interface{}{"team": "a"}, "env=prod",
+			map[string]interface{}{"team": "a"}, false},
+		{"list adds missing items",
+			[]interface{}{"a"}, []interface{}{"a", "b"},
+			[]interface{}{"a", "b"}, true},
+		{"list complete",
+			[]interface{}{"a", "b"}, []interface{}{"b"},
+			[]interface{}{"a", "b"}, false},
+		{"string adds missing items",
+			"team=a,env=dev", "env=dev, owner=ops",
+			"team=a,env=dev,owner=ops", true},
+		{"string complete",
+			"team=a, env=dev", "env=dev,team=a",
+			"team=a, env=dev", false},
+		{"string skips empty items",
+			"team=a", ",team=a,",
+			"team=a", false},
+		{"other types are kept",
+			true, false,
+			true, false},
+	}
+	for _, test := range tests {
+		merged, changed := mergeValue(test.current, test.value)
+		if !reflect.DeepEqual(merged, test.merged) || changed != test.changed {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, merged, changed, test.merged, test.changed)
+		}
+	}
+}
+
+func TestMergeDriverDefaults(t *testing.T) {
+	namespace := defaultsSource{
+		Source: "team-a/machine-driver-defaults[amazonec2]",
+		Defaults: driverDefaults{
+			Fields: map[string]interface{}{"region": "us-east-1", "tags": "team=a"},
+			Merge:  []string{"tags"},
+		},
+	}
+	driver := defaultsSource{
+		Source: "cattle-system/machine-driver-defaults[amazonec2]",
+		Defaults: driverDefaults{
+			Fields: map[string]interface{}{"region": "us-west-2", "instanceType": "t2.micro", "tags": "managed=true"},
+			Merge:  []string{"tags"},
+		},
+	}
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		merged  map[string]interface{}
+		applied []appliedDefaults
+	}{
+		{
+			name:   "empty config",
+			config: map[string]interface{}{},
+			merged: map[string]interface{}{"region": "us-east-1", "instanceType": "t2.micro", "tags": "team=a,managed=true"},
+			applied: []appliedDefaults{
+				{Source: namespace.Source, Fields: []string{"region", "tags"}},
+				{Source: driver.Source, Fields: []string{"instanceType", "tags"}},
+			},
+		},
+		{
+			name:   "config takes precedence",
+			config: map[string]interface{}{"region": "eu-west-1", "instanceType": "", "tags": "owner=ops"},
+			merged: map[string]interface{}{"region": "eu-west-1", "instanceType": "t2.micro", "tags": "owner=ops,team=a,managed=true"},
+			applied: []appliedDefaults{
+				{Source: namespace.Source, Fields: []string{"tags"}},
+				{Source: driver.Source, Fields: []string{"instanceType", "tags"}},
+			},
+		},
+		{
+			name:   "nothing to merge",
+			config: map[string]interface{}{"region": "eu-west-1", "instanceType": "m5.large", "tags": "managed=true,team=a"},
+			merged: map[string]interface{}{"region": "eu-west-1", "instanceType": "m5.large", "tags": "managed=true,team=a"},
+		},
+	}
+	for _, test := range tests {
+		applied := mergeDriverDefaults([]defaultsSource{namespace, driver}, test.config)
+		if !reflect.DeepEqual(test.config, test.merged) {
+			t.Errorf("%s: merged config is %v, want %v", test.name, test.config, test.merged)
+		}
+		if !reflect.DeepEqual(applied, test.applied) {
+			t.Errorf("%s: applied %v, want %v", test.name, applied, test.applied)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package machine
+
+import (
+	"github.com/rancher/machine-controller/policy"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// MachineConditionDriverAllowed is false with the violation as message
+	// when the driver of a machine is not allowed in its cluster or project.
+	// Machines no allow list applies to do not have it.
+	MachineConditionDriverAllowed condition.Cond = "DriverAllowed"
+)
+
+// checkDriverAllowed rejects machines whose driver is not on the allow list
+// of their cluster or of the project of their namespace.
+func (m *Lifecycle) checkDriverAllowed(obj *v3.Machine, driver string) error {
+	project, err := m.project(obj.Namespace)
+	if err != nil {
+		return err
+	}
+	scopes, err := policy.LoadAllowedDrivers(m.configMapGetter, obj.Spec.ClusterName, project)
+	if err != nil || len(scopes) == 0 {
+		return err
+	}
+
+	if err := policy.CheckDriver(scopes, driver); err != nil {
+		MachineConditionDriverAllowed.False(obj)
+		MachineConditionDriverAllowed.Message(obj, err.Error())
+		return err
+	}
+	MachineConditionDriverAllowed.True(obj)
+	MachineConditionDriverAllowed.Message(obj, "")
+	return nil
+}
+
+// project returns the ID of the project a namespace belongs to, if any.
+func (m *Lifecycle) project(namespace string) (string, error) {
+	if namespace == "" {
+		return "", nil
+	}
+	ns, err := m.namespaceClient.Namespaces().Get(namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return ns.Annotations[policy.ProjectAnnotation], nil
+}
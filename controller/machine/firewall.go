@@ -0,0 +1,155 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// firewallRulesAnnotation on a machine template lists the inbound rules
+	// its machines need, as JSON FirewallRules. The firewall hook of the
+	// driver maintains a security group with exactly these rules for the
+	// template and attaches it to each machine.
+	firewallRulesAnnotation = "io.cattle.machine.firewall_rules"
+	// firewallAnnotation records the last reconciliation of the firewall of
+	// a machine as a JSON firewallStatus.
+	firewallAnnotation = "io.cattle.machine.firewall"
+
+	firewallHook = "firewall"
+	// firewallReconcileInterval is how often the rules are applied again to
+	// revert changes made outside of the controller.
+	firewallReconcileInterval = 10 * time.Minute
+)
+
+var (
+	MachineConditionFirewallReconciled condition.Cond = "FirewallReconciled"
+)
+
+// FirewallRule allows inbound traffic of Protocol (tcp, udp or icmp) on Ports,
+// a port or "<first>-<last>" range, from the Source CIDR.
+type FirewallRule struct {
+	Protocol string `json:"protocol"`
+	Ports    string `json:"ports,omitempty"`
+	Source   string `json:"source,omitempty"`
+}
+
+// FirewallArgs are passed as args to the firewall hook of a driver. The hook
+// prints {"group": "<id>"} with the ID of the security group it attached.
+type FirewallArgs struct {
+	Pool  string         `json:"pool"`
+	Rules []FirewallRule `json:"rules"`
+}
+
+type firewallStatus struct {
+	Group string `json:"group,omitempty"`
+	Rules string `json:"rules"`
+	Time  string `json:"time"`
+}
+
+// reconcileFirewall applies the firewall rules of the template of a
+// provisioned machine when they changed, or the last time was long enough ago
+// for out of band changes to deserve reverting. Once the rules are removed the
+// hook runs one last time without rules to detach the group.
+func (m *Lifecycle) reconcileFirewall(obj *v3.Machine) *v3.Machine {
+	if obj.Spec.MachineTemplateName == "" || !v3.MachineConditionConfigReady.IsTrue(obj) {
+		return obj
+	}
+
+	rules, err := m.firewallRules(obj.Spec.MachineTemplateName)
+	if err != nil {
+		setFirewallError(obj, err)
+		return obj
+	}
+
+	status := &firewallStatus{}
+	applied := obj.Annotations[firewallAnnotation]
+	if applied != "" {
+		if err := json.Unmarshal([]byte(applied), status); err != nil {
+			status = &firewallStatus{}
+		}
+	} else if rules == nil {
+		return obj
+	}
+
+	hash := rulesHash(rules)
+	if last, err := time.Parse(time.RFC3339, status.Time); err == nil && status.Rules == hash &&
+		time.Since(last) < firewallReconcileInterval {
+		return obj
+	}
+
+	args, err := json.Marshal(FirewallArgs{
+		Pool:  obj.Spec.MachineTemplateName,
+		Rules: rules,
+	})
+	if err != nil {
+		setFirewallError(obj, err)
+		return obj
+	}
+	output := struct {
+		Group string `json:"group"`
+	}{}
+	if err := m.runHook(obj, firewallHook, string(args), &output); err != nil {
+		m.logger.Errorf(obj, "Failed to reconcile firewall of machine %s: %v", obj.Name, err)
+		setFirewallError(obj, err)
+		return obj
+	}
+
+	if rules == nil {
+		delete(obj.Annotations, firewallAnnotation)
+	} else {
+		data, _ := json.Marshal(firewallStatus{
+			Group: output.Group,
+			Rules: hash,
+			Time:  time.Now().UTC().Format(time.RFC3339),
+		})
+		obj.Annotations[firewallAnnotation] = string(data)
+	}
+	if !MachineConditionFirewallReconciled.IsTrue(obj) {
+		m.logger.Infof(obj, "Reconciled firewall of machine %s", obj.Name)
+	}
+	MachineConditionFirewallReconciled.True(obj)
+	MachineConditionFirewallReconciled.Reason(obj, "")
+	MachineConditionFirewallReconciled.Message(obj, "")
+	return obj
+}
+
+// firewallRules returns the firewall rules of a machine template, nil if it
+// has none.
+func (m *Lifecycle) firewallRules(templateName string) ([]FirewallRule, error) {
+	template, err := m.machineTemplateClient.Get(templateName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data := template.Annotations[firewallRulesAnnotation]
+	if data == "" {
+		return nil, nil
+	}
+	rules := []FirewallRule{}
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation on machine template %s", firewallRulesAnnotation, templateName)
+	}
+	return rules, nil
+}
+
+func rulesHash(rules []FirewallRule) string {
+	data, _ := json.Marshal(rules)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func setFirewallError(obj *v3.Machine, err error) {
+	MachineConditionFirewallReconciled.False(obj)
+	MachineConditionFirewallReconciled.Reason(obj, "ReconcileFailed")
+	MachineConditionFirewallReconciled.Message(obj, err.Error())
+}
@@ -0,0 +1,107 @@
+package machine
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/hook"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leftoversAnnotation records the cloud resources a failed provision left
+	// behind, as a JSON object of docker-machine driver fields, until they are
+	// garbage collected.
+	leftoversAnnotation = "io.cattle.machine.leftovers"
+
+	gcHook = "gc"
+)
+
+// leftoverFields are the fields of the docker-machine driver config naming
+// cloud resources that drivers create on their own.
+var leftoverFields = []string{
+	"InstanceId",
+	"DropletID",
+	"KeyName",
+	"KeyPairName",
+	"SSHKeyID",
+	"SecurityGroupId",
+	"SecurityGroupIds",
+	"VolumeId",
+	"AllocationId",
+}
+
+func recordLeftovers(obj *v3.Machine, config *machineconfig.MachineConfig) {
+	driverConfig, err := config.DriverConfig()
+	if err != nil {
+		logrus.Errorf("Failed to read driver config of machine %s: %v", obj.Name, err)
+		return
+	}
+
+	leftovers := map[string]interface{}{}
+	for _, field := range leftoverFields {
+		value, ok := driverConfig[field]
+		if !ok || convert.IsEmpty(value) {
+			continue
+		}
+		leftovers[field] = value
+	}
+	if len(leftovers) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(leftovers)
+	if err != nil {
+		return
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[leftoversAnnotation] = string(data)
+}
+
+// collectGarbage removes what a failed or deleted machine left behind: the
+// docker-machine host, which makes the driver delete what it knows about, and
+// then the recorded leftovers through the gc hook of the driver, if any.
+func (m *Lifecycle) collectGarbage(obj *v3.Machine, config *machineconfig.MachineConfig) error {
+	exists, err := machineExists(config.Dir(), obj.Spec.RequestedHostname)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if obj.Status.MachineTemplateSpec != nil {
+			dockermachine.MarkUsed(obj.Status.MachineTemplateSpec.Driver)
+		}
+		if err := m.refreshAWSRole(obj, config.Dir()); err != nil {
+			logrus.Warnf("Failed to refresh AWS credentials of machine %s: %v", obj.Name, err)
+		}
+		if err := m.refreshAzureCertificate(obj, config.Dir()); err != nil {
+			logrus.Warnf("Failed to refresh azure client certificate of machine %s: %v", obj.Name, err)
+		}
+		if err := deleteMachine(config.Dir(), obj); err != nil {
+			return err
+		}
+	}
+
+	leftovers := obj.Annotations[leftoversAnnotation]
+	if leftovers == "" || obj.Status.MachineTemplateSpec == nil {
+		return nil
+	}
+
+	h, err := hook.Lookup(m.configMapGetter, obj.Status.MachineTemplateSpec.Driver, gcHook)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		if err := runHook(h, obj, config, leftovers, nil); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Infof(obj, "Collected leftovers of machine %s: %s", obj.Name, leftovers)
+	delete(obj.Annotations, leftoversAnnotation)
+	return nil
+}
@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// gcpWorkloadIdentityAnnotation set to "true" on a google machine, or on
+	// its machine template, provisions it with the service account of the
+	// controller pod, e.g. through GKE workload identity, instead of a
+	// service account key in the driver config.
+	gcpWorkloadIdentityAnnotation = "io.cattle.machine.gcp_workload_identity"
+
+	googleDriver     = "google"
+	metadataHost     = "metadata.google.internal"
+	metadataTokenURL = "http://" + metadataHost + "/computeMetadata/v1/instance/service-accounts/default/token"
+	metadataTimeout  = 10 * time.Second
+)
+
+func useWorkloadIdentity(obj *v3.Machine) bool {
+	return obj.Annotations[gcpWorkloadIdentityAnnotation] == "true" &&
+		obj.Status.MachineTemplateSpec != nil && obj.Status.MachineTemplateSpec.Driver == googleDriver
+}
+
+// applyWorkloadIdentity drops the service account key from the driver config
+// of a google machine using workload identity, and checks that the metadata
+// server hands out tokens, so a missing identity fails fast.
+func applyWorkloadIdentity(obj *v3.Machine, config map[string]interface{}) error {
+	if !useWorkloadIdentity(obj) {
+		return nil
+	}
+	delete(config, "authEncodedJson")
+
+	req, err := http.NewRequest(http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "workload identity is not available")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("workload identity is not available: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// workloadIdentityEnv makes the google driver started by cmd authenticate
+// through the metadata server: application default credentials from a key
+// file are removed from its environment and the metadata server is named
+// explicitly, so the driver does not have to probe for it.
+func workloadIdentityEnv(obj *v3.Machine, cmd *exec.Cmd) {
+	if !useWorkloadIdentity(obj) {
+		return
+	}
+
+	var env []string
+	for _, ev := range cmd.Env {
+		if !strings.HasPrefix(ev, "GOOGLE_APPLICATION_CREDENTIALS=") && !strings.HasPrefix(ev, "GCE_METADATA_HOST=") {
+			env = append(env, ev)
+		}
+	}
+	cmd.Env = append(env, "GCE_METADATA_HOST="+metadataHost)
+}
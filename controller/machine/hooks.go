@@ -0,0 +1,55 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/hook"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// runHook runs the named driver hook of a provisioned machine with its
+// docker-machine state restored, see the hook package.
+func (m *Lifecycle) runHook(obj *v3.Machine, name, args string, output interface{}) error {
+	if obj.Status.MachineTemplateSpec == nil {
+		return fmt.Errorf("machine %s is not provisioned", obj.Name)
+	}
+	driver := obj.Status.MachineTemplateSpec.Driver
+
+	h, err := hook.Lookup(m.configMapGetter, driver, name)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("machine driver %s does not support %s", driver, name)
+	}
+
+	config, err := machineconfig.NewMachineConfig(m.secretStore, obj)
+	if err != nil {
+		return err
+	}
+	defer config.Cleanup()
+	if err := config.Restore(); err != nil {
+		return err
+	}
+
+	return runHook(h, obj, config, args, output)
+}
+
+func runHook(h *hook.Hook, obj *v3.Machine, config *machineconfig.MachineConfig, args string, output interface{}) error {
+	driverConfig := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &driverConfig); err != nil {
+		return errors.Wrap(err, "failed to unmarshal machine config")
+	}
+
+	return h.Run(hook.Input{
+		Machine:   obj.Name,
+		Hostname:  obj.Spec.RequestedHostname,
+		Driver:    h.Driver,
+		StorePath: config.Dir(),
+		Config:    driverConfig,
+		Args:      args,
+	}, output)
+}
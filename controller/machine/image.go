@@ -0,0 +1,94 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/rancher/machine-controller/policy"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// imageAnnotation on a machine or machine template names a snapshot or
+	// image ID, typically captured with the snapshot action, to boot from
+	// instead of the image in the driver config.
+	imageAnnotation = "io.cattle.machine.image"
+	// imageFieldAnnotation on a MachineDriver names the driver config field
+	// selecting the boot image, for drivers not in defaultImageFields.
+	imageFieldAnnotation = "io.cattle.machine_driver.image_field"
+)
+
+var defaultImageFields = map[string]string{
+	"amazonec2":    "ami",
+	"azure":        "image",
+	"digitalocean": "image",
+	"exoscale":     "image",
+	"google":       "machineImage",
+	"openstack":    "imageId",
+	"packet":       "os",
+}
+
+// applyImage points the driver config of a machine at the image referenced by
+// the machine or, failing that, its template.
+func (m *Lifecycle) applyImage(obj *v3.Machine, template *v3.MachineTemplate, config map[string]interface{}) error {
+	image := obj.Annotations[imageAnnotation]
+	if image == "" {
+		image = template.Annotations[imageAnnotation]
+	}
+	if image == "" {
+		return nil
+	}
+
+	field, err := m.imageField(template.Spec.Driver)
+	if err != nil {
+		return err
+	}
+	if field == "" {
+		return fmt.Errorf("machine driver %s has no known image field for %s", template.Spec.Driver, image)
+	}
+
+	if config == nil {
+		return fmt.Errorf("machine config not specified")
+	}
+	config[field] = image
+	m.logger.Infof(obj, "Booting machine %s from image %s", obj.Name, image)
+	return nil
+}
+
+func (m *Lifecycle) imageField(driver string) (string, error) {
+	return m.driverField(driver, imageFieldAnnotation, defaultImageFields)
+}
+
+// driverField returns the driver config field named by annotation on the
+// MachineDriver, or the default for the driver.
+func (m *Lifecycle) driverField(driver, annotation string, defaults map[string]string) (string, error) {
+	machineDriver, err := m.machineDriverClient.Get(driver, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	} else if err == nil {
+		if field := machineDriver.Annotations[annotation]; field != "" {
+			return field, nil
+		}
+	}
+	return defaults[driver], nil
+}
+
+// checkApprovedImage rejects driver configs using an image that is not on
+// the approved list of the driver.
+func (m *Lifecycle) checkApprovedImage(driver string, config map[string]interface{}) error {
+	patterns, ok, err := policy.LoadApprovedImages(m.configMapGetter, driver)
+	if err != nil || !ok {
+		return err
+	}
+
+	field, err := m.imageField(driver)
+	if err != nil {
+		return err
+	}
+	if field == "" {
+		return fmt.Errorf("machine driver %s has approved images but no known image field", driver)
+	}
+	return policy.CheckImage(patterns, field, convert.ToString(config[field]))
+}
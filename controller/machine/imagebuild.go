@@ -0,0 +1,72 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// imageBuildAction builds a provider image from a bootstrapped machine
+	// through the image hook of its driver, which may wrap Packer, and points
+	// a machine template at the result. The input is the template to update
+	// and defaults to the template of the machine.
+	imageBuildAction = "image"
+
+	imageHook = "image"
+)
+
+func (m *Lifecycle) imageBuild(obj *v3.Machine) *v3.Machine {
+	templateName, ok := action.Pending(obj, imageBuildAction)
+	if !ok {
+		return obj
+	}
+
+	if templateName == "" {
+		templateName = obj.Spec.MachineTemplateName
+	}
+
+	image, err := m.buildImage(obj, templateName)
+	if err == nil {
+		m.logger.Infof(obj, "Built image %s from machine %s for machine template %s", image, obj.Name, templateName)
+	}
+	action.Complete(obj, imageBuildAction, image, err)
+	return obj
+}
+
+func (m *Lifecycle) buildImage(obj *v3.Machine, templateName string) (string, error) {
+	if templateName == "" {
+		return "", fmt.Errorf("no machine template to update")
+	}
+
+	output := struct {
+		Image string `json:"image"`
+	}{}
+	if err := m.runHook(obj, imageHook, templateName, &output); err != nil {
+		return "", err
+	}
+	if output.Image == "" {
+		return "", fmt.Errorf("image hook returned no image")
+	}
+
+	// The typed client would drop the driver config of the template.
+	rawTemplate, err := m.machineTemplateGenericClient.Get(templateName, metav1.GetOptions{})
+	if err != nil {
+		return output.Image, errors.Wrapf(err, "failed to get machine template %s", templateName)
+	}
+	template := rawTemplate.(*unstructured.Unstructured)
+	annotations := template.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[imageAnnotation] = output.Image
+	template.SetAnnotations(annotations)
+	if _, err := m.machineTemplateGenericClient.Update(templateName, template); err != nil {
+		return output.Image, errors.Wrapf(err, "failed to update machine template %s", templateName)
+	}
+	return output.Image, nil
+}
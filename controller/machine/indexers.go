@@ -0,0 +1,58 @@
+package machine
+
+import (
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// MachineByDriverIndex indexes machines by the name of their driver.
+	MachineByDriverIndex = "machine.cattle.io/by-driver"
+	// MachineByCredentialIndex indexes machines by the Secrets in
+	// cattle-system their driver config was resolved from.
+	MachineByCredentialIndex = "machine.cattle.io/by-credential"
+	// MachineByTemplateIndex indexes machines by their machine template,
+	// which groups machines into pools.
+	MachineByTemplateIndex = "machine.cattle.io/by-template"
+
+	// credentialsAnnotation lists the Secrets referenced by the driver config
+	// of a machine, comma separated.
+	credentialsAnnotation = "io.cattle.machine.credentials"
+)
+
+// AddIndexers registers the machine indexers on the shared machine informer.
+// It has to be called once, before the controllers are started.
+func AddIndexers(management *config.ManagementContext) error {
+	return management.Management.Machines("").Controller().Informer().AddIndexers(cache.Indexers{
+		MachineByDriverIndex:     machineByDriver,
+		MachineByCredentialIndex: machineByCredential,
+		MachineByTemplateIndex:   machineByTemplate,
+	})
+}
+
+func machineByDriver(obj interface{}) ([]string, error) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Status.MachineTemplateSpec == nil {
+		return nil, nil
+	}
+	return []string{machine.Status.MachineTemplateSpec.Driver}, nil
+}
+
+func machineByCredential(obj interface{}) ([]string, error) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Annotations[credentialsAnnotation] == "" {
+		return nil, nil
+	}
+	return strings.Split(machine.Annotations[credentialsAnnotation], ","), nil
+}
+
+func machineByTemplate(obj interface{}) ([]string, error) {
+	machine, ok := obj.(*v3.Machine)
+	if !ok || machine.Spec.MachineTemplateName == "" {
+		return nil, nil
+	}
+	return []string{machine.Spec.MachineTemplateName}, nil
+}
@@ -0,0 +1,81 @@
+package machine
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// fallbackInstanceTypesAnnotation on a machine template, or a machine,
+	// lists the instance types to try, comma separated and in order, when the
+	// provider has no capacity for the instance type of the driver config or
+	// does not offer it.
+	fallbackInstanceTypesAnnotation = "io.cattle.machine.fallback_instance_types"
+	// instanceTypeAnnotation records the instance type a machine with
+	// fallback instance types was created with.
+	instanceTypeAnnotation = "io.cattle.machine.instance_type"
+	// instanceTypeFieldAnnotation on a MachineDriver names the driver config
+	// field selecting the instance type, for drivers not in
+	// defaultInstanceTypeFields.
+	instanceTypeFieldAnnotation = "io.cattle.machine_driver.instance_type_field"
+)
+
+var (
+	defaultInstanceTypeFields = map[string]string{
+		"amazonec2":    "instanceType",
+		"azure":        "size",
+		"digitalocean": "size",
+		"exoscale":     "instanceProfile",
+		"google":       "machineType",
+		"openstack":    "flavorName",
+		"packet":       "plan",
+	}
+
+	instanceTypeUnavailableRegexp = regexp.MustCompile(`(?i)Unsupported\w*\s*instance\s*type|InstanceTypeNotSupported|instance type .*not (supported|available)|size .*not available|machine type .*(does not exist|not available)|unavailable (instance type|size|flavor)`)
+)
+
+// instanceTypes returns the instance type field of a machine with fallback
+// instance types, together with the instance types to try in order.
+func (m *Lifecycle) instanceTypes(obj *v3.Machine, config map[string]interface{}) (string, []string, error) {
+	fallbacks := obj.Annotations[fallbackInstanceTypesAnnotation]
+	if strings.TrimSpace(fallbacks) == "" {
+		return "", nil, nil
+	}
+	field, err := m.driverField(obj.Status.MachineTemplateSpec.Driver, instanceTypeFieldAnnotation, defaultInstanceTypeFields)
+	if err != nil || field == "" {
+		return "", nil, err
+	}
+
+	var types []string
+	seen := map[string]bool{}
+	for _, instanceType := range append([]string{convert.ToString(config[field])}, strings.Split(fallbacks, ",")...) {
+		instanceType = strings.TrimSpace(instanceType)
+		if instanceType != "" && !seen[instanceType] {
+			seen[instanceType] = true
+			types = append(types, instanceType)
+		}
+	}
+	return field, types, nil
+}
+
+func instanceTypeUnavailable(err error) bool {
+	return instanceTypeUnavailableRegexp.MatchString(err.Error())
+}
+
+// placementFailed returns whether a create failed for lack of capacity or of
+// the instance type, which another zone or instance type may not lack.
+func placementFailed(err error) bool {
+	return insufficientCapacity(err) || instanceTypeUnavailable(err)
+}
+
+// recordInstanceType records the instance type a machine was created with.
+func recordInstanceType(obj *v3.Machine, field, instanceType string) error {
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[instanceTypeAnnotation] = instanceType
+	return recordConfigField(obj, field, instanceType)
+}
@@ -0,0 +1,103 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/ipam"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// ipamPoolAnnotation on a machine or machine template names the pool in
+	// the machine-ipam-pools ConfigMap the address of the machine is
+	// allocated from.
+	ipamPoolAnnotation = "io.cattle.machine.ipam_pool"
+	// ipamAllocationAnnotation records the address allocated to a machine as
+	// JSON, it is released again when the machine is removed.
+	ipamAllocationAnnotation = "io.cattle.machine.ipam_allocation"
+	// addressFieldAnnotation on a MachineDriver names the driver config field
+	// taking a static address, for drivers not in defaultAddressFields.
+	addressFieldAnnotation = "io.cattle.machine_driver.address_field"
+)
+
+var defaultAddressFields = map[string]string{
+	"generic": "ipAddress",
+}
+
+// allocateAddress sets the address field of the driver config of a machine
+// to an address allocated from its IPAM pool. An earlier allocation is
+// reused.
+func (m *Lifecycle) allocateAddress(obj *v3.Machine, driver string, config map[string]interface{}) error {
+	pool := obj.Annotations[ipamPoolAnnotation]
+	if pool == "" {
+		return nil
+	}
+
+	field, err := m.driverField(driver, addressFieldAnnotation, defaultAddressFields)
+	if err != nil {
+		return err
+	}
+	if field == "" {
+		return fmt.Errorf("machine driver %s has no known address field for IPAM pool %s", driver, pool)
+	}
+	if config == nil {
+		return fmt.Errorf("machine config not specified")
+	}
+
+	allocation, err := getAllocation(obj)
+	if err != nil {
+		return err
+	}
+	if allocation == nil || allocation.Pool != pool {
+		provider, err := ipam.Lookup(m.configMapGetter, m.secrets, pool)
+		if err != nil {
+			return err
+		}
+		allocation, err = provider.Allocate(obj.Namespace+"/"+obj.Name, obj.Spec.RequestedHostname)
+		if err != nil {
+			return errors.Wrapf(err, "failed to allocate address from IPAM pool %s", pool)
+		}
+		data, err := json.Marshal(allocation)
+		if err != nil {
+			return err
+		}
+		obj.Annotations[ipamAllocationAnnotation] = string(data)
+		m.logger.Infof(obj, "Allocated address %s to machine %s from IPAM pool %s", allocation.Address, obj.Name, pool)
+	}
+
+	config[field] = allocation.Address
+	return nil
+}
+
+// releaseAddress returns the address allocated to a machine to its pool.
+func (m *Lifecycle) releaseAddress(obj *v3.Machine) error {
+	allocation, err := getAllocation(obj)
+	if err != nil || allocation == nil {
+		return err
+	}
+
+	provider, err := ipam.Lookup(m.configMapGetter, m.secrets, allocation.Pool)
+	if err != nil {
+		return err
+	}
+	if err := provider.Release(allocation); err != nil {
+		return errors.Wrapf(err, "failed to release address %s to IPAM pool %s", allocation.Address, allocation.Pool)
+	}
+	m.logger.Infof(obj, "Released address %s of machine %s to IPAM pool %s", allocation.Address, obj.Name, allocation.Pool)
+	delete(obj.Annotations, ipamAllocationAnnotation)
+	return nil
+}
+
+func getAllocation(obj *v3.Machine) (*ipam.Allocation, error) {
+	data := obj.Annotations[ipamAllocationAnnotation]
+	if data == "" {
+		return nil, nil
+	}
+	allocation := &ipam.Allocation{}
+	if err := json.Unmarshal([]byte(data), allocation); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", ipamAllocationAnnotation)
+	}
+	return allocation, nil
+}
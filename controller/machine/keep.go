@@ -0,0 +1,77 @@
+package machine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// keepOnFailureAnnotation on a machine, or on its machine template, keeps
+	// the instance and docker-machine state of a failed provision for SSH
+	// debugging. The value is "true" or how long to keep it, e.g. "4h".
+	keepOnFailureAnnotation = "io.cattle.machine.keep_on_failure"
+	// keptUntilAnnotation records when a kept failed machine is reclaimed.
+	keptUntilAnnotation = "io.cattle.machine.kept_until"
+
+	defaultKeepDuration = 24 * time.Hour
+)
+
+// keepDuration returns how long a failed provision of obj is kept, or zero.
+func keepDuration(obj *v3.Machine) time.Duration {
+	value := obj.Annotations[keepOnFailureAnnotation]
+	switch value {
+	case "", "false":
+		return 0
+	case "true":
+		return defaultKeepDuration
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultKeepDuration
+	}
+	return d
+}
+
+func keptUntil(obj *v3.Machine) (time.Time, bool) {
+	value := obj.Annotations[keptUntilAnnotation]
+	if value == "" {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	return until, err == nil
+}
+
+// keepFailed marks a failed machine as kept if requested and reports whether
+// its cleanup should be skipped.
+func (p *Provisioning) keepFailed() bool {
+	d := keepDuration(p.Machine)
+	if d <= 0 {
+		return false
+	}
+
+	until := time.Now().Add(d).UTC()
+	p.Machine.Annotations[keptUntilAnnotation] = until.Format(time.RFC3339)
+	p.Logger.Infof(p.Machine, "Keeping failed machine %s for debugging until %s", p.Machine.Spec.RequestedHostname,
+		until.Format(time.RFC3339))
+	return true
+}
+
+// checkKept holds back new provisioning attempts of a kept failed machine until
+// it expires and is garbage collected.
+func (p *Provisioning) checkKept() error {
+	until, ok := keptUntil(p.Machine)
+	if !ok {
+		return nil
+	}
+	if time.Now().Before(until) {
+		return fmt.Errorf("failed machine %s is kept for debugging until %s", p.Machine.Spec.RequestedHostname,
+			until.Format(time.RFC3339))
+	}
+
+	delete(p.Machine.Annotations, keptUntilAnnotation)
+	p.cleanupFailed()
+	return nil
+}
@@ -0,0 +1,291 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/machine-controller/sshclient"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// keyRotationLabel marks the ConfigMaps in cattle-system that request,
+	// and track the progress of, an SSH key rotation across machines. The
+	// machines key lists <namespace>/<name> of machines and the templates key
+	// machine templates whose machines are rotated, comma separated. Without
+	// either the whole fleet is rotated. keyType is the type of the new keys
+	// and batchSize how many machines are rotated at once.
+	keyRotationLabel     = "io.cattle.machine.key_rotation"
+	keyRotationNamespace = "cattle-system"
+
+	keyRotationInterval = 15 * time.Second
+	defaultKeyBatchSize = 5
+	// rotationRequestTimeout is how long a requested rotate-key action may
+	// be missing from a machine before it counts as cancelled.
+	rotationRequestTimeout = 2 * time.Minute
+
+	// Keys of a rotation ConfigMap written by the controller.
+	rotationPhaseKey    = "phase"
+	rotationProgressKey = "progress"
+	rotationStatusKey   = "status"
+
+	rotationRunning   = "Running"
+	rotationCompleted = "Completed"
+	rotationFailed    = "Failed"
+
+	machinePending  = "pending"
+	machineRotating = "rotating"
+	machineRotated  = "rotated"
+	machineFailed   = "failed"
+	machineSkipped  = "skipped"
+)
+
+// machineRotation is the progress of a rotation on one machine.
+type machineRotation struct {
+	State   string `json:"state"`
+	Started string `json:"started,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// keyRotator drives the key rotations requested through rotation ConfigMaps.
+// Every machine is rotated with its rotate-key action, at most batchSize at a
+// time, and the outcome is recorded in the status of the ConfigMap.
+type keyRotator struct {
+	machines      v3.MachineLister
+	machineClient v3.MachineInterface
+	configMaps    typedv1.ConfigMapsGetter
+	namespaces    options.NamespaceScope
+}
+
+func (r *keyRotator) run() {
+	for range time.Tick(keyRotationInterval) {
+		rotations, err := r.configMaps.ConfigMaps(keyRotationNamespace).List(metav1.ListOptions{
+			LabelSelector: keyRotationLabel + "=true",
+		})
+		if err != nil {
+			logrus.Errorf("Failed to list SSH key rotations: %v", err)
+			continue
+		}
+		for i := range rotations.Items {
+			if err := r.rotate(&rotations.Items[i]); err != nil {
+				logrus.Errorf("SSH key rotation %s failed: %v", rotations.Items[i].Name, err)
+			}
+		}
+	}
+}
+
+func (r *keyRotator) rotate(orig *v1.ConfigMap) error {
+	switch orig.Data[rotationPhaseKey] {
+	case rotationCompleted, rotationFailed:
+		return nil
+	}
+
+	cm := orig.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	keyType := strings.TrimSpace(cm.Data["keyType"])
+	if err := sshclient.ValidateKeyType(keyType); err != nil {
+		cm.Data[rotationPhaseKey] = rotationFailed
+		cm.Data[rotationProgressKey] = err.Error()
+		return r.save(orig, cm)
+	}
+	batchSize := defaultKeyBatchSize
+	if n, err := strconv.Atoi(cm.Data["batchSize"]); err == nil && n > 0 {
+		batchSize = n
+	}
+
+	status := map[string]*machineRotation{}
+	if data := cm.Data[rotationStatusKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			return fmt.Errorf("invalid %s: %v", rotationStatusKey, err)
+		}
+	} else {
+		targets, err := r.targets(cm)
+		if err != nil {
+			return err
+		}
+		for _, machine := range targets {
+			entry := &machineRotation{State: machinePending}
+			if machine.Status.NodeConfig == nil {
+				entry = &machineRotation{State: machineSkipped, Message: "machine is not provisioned"}
+			}
+			status[machineKey(machine)] = entry
+		}
+		logrus.Infof("Starting SSH key rotation %s of %d machines", cm.Name, len(status))
+	}
+
+	keys := make([]string, 0, len(status))
+	for key := range status {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rotating := 0
+	for _, key := range keys {
+		if entry := status[key]; entry.State == machineRotating {
+			r.check(key, entry)
+			if entry.State == machineRotating {
+				rotating++
+			}
+		}
+	}
+	for _, key := range keys {
+		if rotating >= batchSize {
+			break
+		}
+		if entry := status[key]; entry.State == machinePending {
+			r.start(key, keyType, entry)
+			if entry.State == machineRotating {
+				rotating++
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	for _, entry := range status {
+		counts[entry.State]++
+	}
+	switch {
+	case counts[machinePending] > 0 || counts[machineRotating] > 0:
+		cm.Data[rotationPhaseKey] = rotationRunning
+	case counts[machineFailed] > 0:
+		cm.Data[rotationPhaseKey] = rotationFailed
+	default:
+		cm.Data[rotationPhaseKey] = rotationCompleted
+	}
+	cm.Data[rotationProgressKey] = fmt.Sprintf("%d/%d rotated, %d failed, %d skipped",
+		counts[machineRotated], len(status), counts[machineFailed], counts[machineSkipped])
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	cm.Data[rotationStatusKey] = string(data)
+	return r.save(orig, cm)
+}
+
+func (r *keyRotator) save(orig, cm *v1.ConfigMap) error {
+	if reflect.DeepEqual(orig.Data, cm.Data) {
+		return nil
+	}
+	if phase := cm.Data[rotationPhaseKey]; phase != orig.Data[rotationPhaseKey] && phase != rotationRunning {
+		logrus.Infof("SSH key rotation %s %s: %s", cm.Name, strings.ToLower(phase), cm.Data[rotationProgressKey])
+	}
+	_, err := r.configMaps.ConfigMaps(keyRotationNamespace).Update(cm)
+	return err
+}
+
+// targets returns the machines a rotation applies to.
+func (r *keyRotator) targets(cm *v1.ConfigMap) ([]*v3.Machine, error) {
+	all, err := r.machines.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	names := splitList(cm.Data["machines"])
+	templates := splitList(cm.Data["templates"])
+	var targets []*v3.Machine
+	for _, machine := range all {
+		if machine.DeletionTimestamp != nil || machine.Spec.MachineTemplateName == "" || !r.namespaces.Contains(machine.Namespace) {
+			continue
+		}
+		if len(names) > 0 || len(templates) > 0 {
+			if !names[machineKey(machine)] && !templates[machine.Spec.MachineTemplateName] {
+				continue
+			}
+		}
+		targets = append(targets, machine)
+	}
+	return targets, nil
+}
+
+// start requests the rotate-key action on a machine.
+func (r *keyRotator) start(key, keyType string, entry *machineRotation) {
+	machine, err := r.get(key)
+	if err != nil {
+		entry.State, entry.Message = machineFailed, err.Error()
+		return
+	}
+	if _, pending := action.Pending(machine, rotateKeyAction); !pending {
+		machine = machine.DeepCopy()
+		action.Request(machine, rotateKeyAction, keyType)
+		if _, err := r.machineClient.Update(machine); err != nil {
+			// Retried on the next run.
+			logrus.Errorf("Failed to request SSH key rotation of machine %s: %v", key, err)
+			return
+		}
+	}
+	entry.State = machineRotating
+	entry.Started = time.Now().UTC().Format(time.RFC3339)
+}
+
+// check records the result of the rotate-key action of a machine once it ran.
+func (r *keyRotator) check(key string, entry *machineRotation) {
+	machine, err := r.get(key)
+	if err != nil {
+		entry.State, entry.Message = machineFailed, err.Error()
+		return
+	}
+	if _, pending := action.Pending(machine, rotateKeyAction); pending {
+		return
+	}
+
+	started, _ := time.Parse(time.RFC3339, entry.Started)
+	result, ok := action.GetResult(machine, rotateKeyAction)
+	if ok {
+		if finished, err := time.Parse(time.RFC3339, result.Time); err != nil || finished.Before(started) {
+			ok = false
+		}
+	}
+	if !ok {
+		// The cache may not have caught up with the request yet.
+		if time.Since(started) > rotationRequestTimeout {
+			entry.State, entry.Message = machineFailed, "rotate-key action was cancelled"
+		}
+		return
+	}
+	if result.Success {
+		entry.State, entry.Message = machineRotated, ""
+	} else {
+		entry.State, entry.Message = machineFailed, result.Message
+	}
+}
+
+func (r *keyRotator) get(key string) (*v3.Machine, error) {
+	namespace, name := splitMachineKey(key)
+	machine, err := r.machines.Get(namespace, name)
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("machine was removed")
+	}
+	return machine, err
+}
+
+func machineKey(machine *v3.Machine) string {
+	if machine.Namespace == "" {
+		return machine.Name
+	}
+	return machine.Namespace + "/" + machine.Name
+}
+
+func splitList(value string) map[string]bool {
+	result := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result[item] = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,31 @@
+package machine
+
+import (
+	"github.com/rancher/machine-controller/dockermachine"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// driverLimits returns the resource limits of the processes of a driver.
+func (m *Lifecycle) driverLimits(driver string) (dockermachine.Limits, error) {
+	machineDriver, err := m.machineDriverClient.Get(driver, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return dockermachine.Limits{}, nil
+	} else if err != nil {
+		return dockermachine.Limits{}, err
+	}
+	return dockermachine.ParseLimits(machineDriver.Annotations[dockermachine.LimitsAnnotation])
+}
+
+// checkDriverBinary fails unless the binary of driver is in the allow list,
+// if one is enforced.
+func (m *Lifecycle) checkDriverBinary(driver string) error {
+	if m.allowedBinaries == nil {
+		return nil
+	}
+	binary, err := dockermachine.DriverBinary(driver)
+	if err != nil {
+		return err
+	}
+	return m.allowedBinaries.Check(binary)
+}
@@ -0,0 +1,95 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/hook"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// loadBalancerAnnotation on a machine or machine template names the load
+	// balancer or target group, in the terms of the driver's lb-register and
+	// lb-deregister hooks, the machine is registered with once it is
+	// provisioned and deregistered from when it is deleted.
+	loadBalancerAnnotation = "io.cattle.machine.load_balancer"
+	// loadBalancerRegisteredAnnotation records the registration, as the JSON
+	// arguments of the hooks, until it is deregistered.
+	loadBalancerRegisteredAnnotation = "io.cattle.machine.load_balancer_registered"
+
+	StepLoadBalancer = "load-balancer"
+
+	lbRegisterHook   = "lb-register"
+	lbDeregisterHook = "lb-deregister"
+)
+
+var (
+	MachineConditionLoadBalanced condition.Cond = "LoadBalanced"
+)
+
+// LoadBalancerTarget is passed as args to the lb-register and lb-deregister
+// hooks of a driver.
+type LoadBalancerTarget struct {
+	Target          string `json:"target"`
+	Address         string `json:"address"`
+	InternalAddress string `json:"internalAddress,omitempty"`
+}
+
+func registerLoadBalancer(p *Provisioning) error {
+	obj := p.Machine
+	target := obj.Annotations[loadBalancerAnnotation]
+	if target == "" {
+		return nil
+	}
+
+	args, err := json.Marshal(LoadBalancerTarget{
+		Target:          target,
+		Address:         p.Address,
+		InternalAddress: p.InternalAddress,
+	})
+	if err != nil {
+		return err
+	}
+
+	h, err := hook.Lookup(p.lifecycle.configMapGetter, obj.Status.MachineTemplateSpec.Driver, lbRegisterHook)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("machine driver %s does not support %s", obj.Status.MachineTemplateSpec.Driver, lbRegisterHook)
+	}
+	if err := runHook(h, obj, p.Config, string(args), nil); err != nil {
+		return condition.Error("RegistrationFailed", err)
+	}
+
+	obj.Annotations[loadBalancerRegisteredAnnotation] = string(args)
+	p.Logger.Infof(obj, "Registered machine %s with load balancer %s", obj.Name, target)
+	return nil
+}
+
+// deregisterLoadBalancer removes a machine from the load balancer it was
+// registered with, before its instance is deleted.
+func (m *Lifecycle) deregisterLoadBalancer(obj *v3.Machine, config *machineconfig.MachineConfig) error {
+	args := obj.Annotations[loadBalancerRegisteredAnnotation]
+	if args == "" || obj.Status.MachineTemplateSpec == nil {
+		return nil
+	}
+
+	h, err := hook.Lookup(m.configMapGetter, obj.Status.MachineTemplateSpec.Driver, lbDeregisterHook)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		if err := runHook(h, obj, config, args, nil); err != nil {
+			return errors.Wrap(err, "failed to deregister machine from load balancer")
+		}
+	}
+
+	m.logger.Infof(obj, "Deregistered machine %s from load balancer %s", obj.Name, obj.Annotations[loadBalancerAnnotation])
+	delete(obj.Annotations, loadBalancerRegisteredAnnotation)
+	return nil
+}
@@ -0,0 +1,183 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// MetadataAnnotationPrefix marks the annotations of a machine that are
+	// passed to the provider as metadata, such as instance tags: the
+	// annotation metadata.machine.cattle.io/<key> adds the tag <key> with the
+	// value of the annotation. It is an escape hatch for provider features
+	// the driver schema does not model.
+	MetadataAnnotationPrefix = "metadata.machine.cattle.io/"
+	// metadataFieldAnnotation on a MachineDriver names the driver config
+	// field metadata is passed in, for drivers not in defaultMetadataFields,
+	// and metadataFormatAnnotation how it is encoded: metadataPairs,
+	// metadataColon or metadataEquals, the default.
+	metadataFieldAnnotation  = "io.cattle.machine_driver.metadata_field"
+	metadataFormatAnnotation = "io.cattle.machine_driver.metadata_format"
+
+	// metadataPairs encodes metadata as key1,value1,key2,value2.
+	metadataPairs = "pairs"
+	// metadataColon and metadataEquals encode metadata as comma separated
+	// key:value and key=value entries, or as entries of a list field.
+	metadataColon  = "key:value"
+	metadataEquals = "key=value"
+)
+
+var (
+	defaultMetadataFields = map[string]string{
+		"amazonec2":    "tags",
+		"digitalocean": "tags",
+	}
+	defaultMetadataFormats = map[string]string{
+		"amazonec2":    metadataPairs,
+		"digitalocean": metadataColon,
+	}
+)
+
+type metadataEntry struct {
+	key, value string
+}
+
+// applyMetadata adds the metadata annotations of a machine to the metadata
+// field of its driver config. Annotations replace entries of the driver
+// config with the same key; annotations with an empty value add the bare key,
+// e.g. a tag without value, unless the driver takes pairs.
+func (m *Lifecycle) applyMetadata(obj *v3.Machine, config map[string]interface{}) error {
+	metadata := map[string]string{}
+	var keys []string
+	for key, value := range obj.Annotations {
+		if strings.HasPrefix(key, MetadataAnnotationPrefix) && key != MetadataAnnotationPrefix {
+			key = strings.TrimPrefix(key, MetadataAnnotationPrefix)
+			if strings.Contains(key+value, ",") {
+				return fmt.Errorf("metadata %s of machine %s contains a comma", key, obj.Name)
+			}
+			metadata[key] = value
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	driver := obj.Status.MachineTemplateSpec.Driver
+	field, err := m.driverField(driver, metadataFieldAnnotation, defaultMetadataFields)
+	if err != nil {
+		return err
+	}
+	if field == "" {
+		return fmt.Errorf("machine driver %s has no known metadata field for the %s annotations", driver, MetadataAnnotationPrefix)
+	}
+	format, err := m.driverField(driver, metadataFormatAnnotation, defaultMetadataFormats)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "":
+		format = metadataEquals
+	case metadataPairs, metadataColon, metadataEquals:
+	default:
+		return fmt.Errorf("unknown metadata format %q of machine driver %s", format, driver)
+	}
+
+	list, isList := config[field].([]interface{})
+	var entries []metadataEntry
+	if isList {
+		for _, item := range list {
+			entries = append(entries, parseMetadata([]string{convert.ToString(item)}, format)...)
+		}
+	} else if value := convert.ToString(config[field]); value != "" {
+		entries = parseMetadata(strings.Split(value, ","), format)
+	}
+
+	for _, key := range keys {
+		replaced := false
+		for i := range entries {
+			if entries[i].key == key {
+				entries[i].value = metadata[key]
+				replaced = true
+			}
+		}
+		if !replaced {
+			entries = append(entries, metadataEntry{key: key, value: metadata[key]})
+		}
+	}
+
+	rendered := renderMetadata(entries, format)
+	if isList {
+		var items []interface{}
+		for _, item := range rendered {
+			items = append(items, item)
+		}
+		config[field] = items
+	} else {
+		config[field] = strings.Join(rendered, ",")
+	}
+	return nil
+}
+
+// copyMetadata copies the metadata annotations of a machine to a machine
+// created from it.
+func copyMetadata(from, to *v3.Machine) {
+	for key, value := range from.Annotations {
+		if strings.HasPrefix(key, MetadataAnnotationPrefix) {
+			if to.Annotations == nil {
+				to.Annotations = map[string]string{}
+			}
+			to.Annotations[key] = value
+		}
+	}
+}
+
+func parseMetadata(items []string, format string) []metadataEntry {
+	var entries []metadataEntry
+	if format == metadataPairs {
+		for i := 0; i < len(items); i += 2 {
+			entry := metadataEntry{key: items[i]}
+			if i+1 < len(items) {
+				entry.value = items[i+1]
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	sep := "="
+	if format == metadataColon {
+		sep = ":"
+	}
+	for _, item := range items {
+		parts := strings.SplitN(item, sep, 2)
+		entry := metadataEntry{key: parts[0]}
+		if len(parts) == 2 {
+			entry.value = parts[1]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func renderMetadata(entries []metadataEntry, format string) []string {
+	var items []string
+	for _, entry := range entries {
+		switch {
+		case format == metadataPairs:
+			items = append(items, entry.key, entry.value)
+		case entry.value == "":
+			items = append(items, entry.key)
+		case format == metadataColon:
+			items = append(items, entry.key+":"+entry.value)
+		default:
+			items = append(items, entry.key+"="+entry.value)
+		}
+	}
+	return items
+}
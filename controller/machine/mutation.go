@@ -0,0 +1,212 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/dockermachine"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	policyNamespace           = "cattle-system"
+	flagPolicyConfigMap       = "machine-driver-flag-policies"
+	appliedMutationAnnotation = "io.cattle.machine.applied_mutations"
+)
+
+// FlagMutator rewrites the rendered docker-machine create arguments of a
+// machine right before they are executed. It returns the new arguments and a
+// human readable description of every change it made, which is recorded on the
+// machine for auditing.
+type FlagMutator interface {
+	Name() string
+	Mutate(machine *v3.Machine, args []string) ([]string, []string, error)
+}
+
+var (
+	mutatorsLock = sync.Mutex{}
+	mutators     []FlagMutator
+)
+
+// RegisterFlagMutator adds a mutator that is run, in registration order, on
+// the create arguments of every machine.
+func RegisterFlagMutator(mutator FlagMutator) {
+	mutatorsLock.Lock()
+	defer mutatorsLock.Unlock()
+
+	mutators = append(mutators, mutator)
+}
+
+func flagMutators() []FlagMutator {
+	mutatorsLock.Lock()
+	defer mutatorsLock.Unlock()
+
+	return append([]FlagMutator{}, mutators...)
+}
+
+// flagPolicy is the per driver policy read from the flag policy ConfigMap. Flag
+// names are given without the leading "--", e.g. amazonec2-private-address-only.
+// Bool flags take no value, so setting one to "true" adds it and setting it to
+// "false" removes it.
+type flagPolicy struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// configMapFlagMutator applies the admin defined policies stored in the
+// machine-driver-flag-policies ConfigMap, keyed by driver name. The bool
+// flags of a driver are looked up in its schema.
+type configMapFlagMutator struct {
+	configMapGetter typedv1.ConfigMapsGetter
+	schemaClient    func(machine *v3.Machine) schemastore.Client
+}
+
+func (c *configMapFlagMutator) Name() string {
+	return flagPolicyConfigMap
+}
+
+func (c *configMapFlagMutator) Mutate(machine *v3.Machine, args []string) ([]string, []string, error) {
+	cm, err := c.configMapGetter.ConfigMaps(policyNamespace).Get(flagPolicyConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return args, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	driver := strings.ToLower(machine.Status.MachineTemplateSpec.Driver)
+	data, ok := cm.Data[driver]
+	if !ok {
+		return args, nil, nil
+	}
+
+	policy := flagPolicy{}
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse flag policy for driver %s", driver)
+	}
+
+	boolFlags, err := c.boolFlags(machine, driver)
+	if err != nil {
+		return nil, nil, err
+	}
+	return applyFlagPolicy(args, policy, boolFlags)
+}
+
+// boolFlags returns the names of the bool flags of a driver, which are none
+// while the driver has no schema.
+func (c *configMapFlagMutator) boolFlags(machine *v3.Machine, driver string) (map[string]bool, error) {
+	driverSchema, err := schemastore.Get(c.schemaClient(machine), driver+"config")
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	flags := map[string]bool{}
+	for name, field := range driverSchema.Spec.ResourceFields {
+		if field.Type == "boolean" {
+			flags[dockermachine.FlagName(driver, name)] = true
+		}
+	}
+	return flags, nil
+}
+
+// applyFlagPolicy removes and then sets the flags of policy in args, setting
+// flags in the order of their names so the arguments are stable.
+func applyFlagPolicy(args []string, policy flagPolicy, boolFlags map[string]bool) ([]string, []string, error) {
+	var audit []string
+	for _, flag := range policy.Remove {
+		var removed bool
+		args, removed = removeFlag(args, "--"+flag, boolFlags[flag])
+		if removed {
+			audit = append(audit, fmt.Sprintf("removed --%s", flag))
+		}
+	}
+
+	var flags []string
+	for flag := range policy.Set {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	for _, flag := range flags {
+		value := policy.Set[flag]
+		if !boolFlags[flag] {
+			args = setFlag(args, "--"+flag, value)
+			audit = append(audit, fmt.Sprintf("set --%s=%s", flag, value))
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bool flag --%s cannot be set to %q", flag, value)
+		}
+		args, _ = removeFlag(args, "--"+flag, true)
+		if enabled {
+			args = append(args, "--"+flag)
+		}
+		audit = append(audit, fmt.Sprintf("set --%s=%t", flag, enabled))
+	}
+
+	return args, audit, nil
+}
+
+func (m *Lifecycle) mutateCreateCommand(machine *v3.Machine, args []string) ([]string, error) {
+	var applied []string
+	for _, mutator := range append([]FlagMutator{m.flagPolicy}, flagMutators()...) {
+		newArgs, audit, err := mutator.Mutate(machine, args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "flag mutator %s failed", mutator.Name())
+		}
+		args = newArgs
+		for _, msg := range audit {
+			applied = append(applied, mutator.Name()+": "+msg)
+			m.logger.Infof(machine, "Policy %s %s", mutator.Name(), msg)
+		}
+	}
+
+	if len(applied) > 0 {
+		bytes, err := json.Marshal(applied)
+		if err != nil {
+			return nil, err
+		}
+		if machine.Annotations == nil {
+			machine.Annotations = map[string]string{}
+		}
+		machine.Annotations[appliedMutationAnnotation] = string(bytes)
+	}
+
+	return args, nil
+}
+
+// removeFlag drops every occurrence of the given flag, together with its
+// value unless it is a bool flag.
+func removeFlag(args []string, flag string, isBool bool) ([]string, bool) {
+	var (
+		result  []string
+		removed bool
+	)
+	for i := 0; i < len(args); i++ {
+		if args[i] != flag {
+			result = append(result, args[i])
+			continue
+		}
+		removed = true
+		if !isBool {
+			i++
+		}
+	}
+	return result, removed
+}
+
+// setFlag replaces all values of the given flag, which takes a value, with
+// value, appending the flag if it is not present.
+func setFlag(args []string, flag, value string) []string {
+	args, _ = removeFlag(args, flag, false)
+	return append(args, flag, value)
+}
@@ -0,0 +1,89 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyFlagPolicy(t *testing.T) {
+	boolFlags := map[string]bool{
+		"amazonec2-private-address-only": true,
+		"amazonec2-use-ebs-optimized":    true,
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		policy flagPolicy
+		result []string
+		audit  []string
+	}{
+		{
+			name:   "remove bool flag in the middle",
+			args:   []string{"--amazonec2-private-address-only", "--amazonec2-region", "us-east-1"},
+			policy: flagPolicy{Remove: []string{"amazonec2-private-address-only"}},
+			result: []string{"--amazonec2-region", "us-east-1"},
+			audit:  []string{"removed --amazonec2-private-address-only"},
+		},
+		{
+			name:   "remove bool flag at the end",
+			args:   []string{"--amazonec2-region", "us-east-1", "--amazonec2-private-address-only"},
+			policy: flagPolicy{Remove: []string{"amazonec2-private-address-only"}},
+			result: []string{"--amazonec2-region", "us-east-1"},
+			audit:  []string{"removed --amazonec2-private-address-only"},
+		},
+		{
+			name:   "remove flag with value",
+			args:   []string{"--amazonec2-ssh-keypath", "/tmp/key", "--amazonec2-private-address-only"},
+			policy: flagPolicy{Remove: []string{"amazonec2-ssh-keypath", "amazonec2-zone"}},
+			result: []string{"--amazonec2-private-address-only"},
+			audit:  []string{"removed --amazonec2-ssh-keypath"},
+		},
+		{
+			name:   "set bool flag",
+			args:   []string{"--amazonec2-private-address-only", "--amazonec2-region", "us-east-1"},
+			policy: flagPolicy{Set: map[string]string{"amazonec2-private-address-only": "true"}},
+			result: []string{"--amazonec2-region", "us-east-1", "--amazonec2-private-address-only"},
+			audit:  []string{"set --amazonec2-private-address-only=true"},
+		},
+		{
+			name:   "unset bool flag",
+			args:   []string{"--amazonec2-region", "us-east-1", "--amazonec2-private-address-only"},
+			policy: flagPolicy{Set: map[string]string{"amazonec2-private-address-only": "false"}},
+			result: []string{"--amazonec2-region", "us-east-1"},
+			audit:  []string{"set --amazonec2-private-address-only=false"},
+		},
+		{
+			name: "set flags in order",
+			args: []string{"--amazonec2-region", "us-east-1"},
+			policy: flagPolicy{Set: map[string]string{
+				"amazonec2-zone":              "b",
+				"amazonec2-use-ebs-optimized": "true",
+				"amazonec2-region":            "us-west-2",
+			}},
+			result: []string{"--amazonec2-region", "us-west-2", "--amazonec2-use-ebs-optimized", "--amazonec2-zone", "b"},
+			audit: []string{
+				"set --amazonec2-region=us-west-2",
+				"set --amazonec2-use-ebs-optimized=true",
+				"set --amazonec2-zone=b",
+			},
+		},
+	}
+	for _, test := range tests {
+		result, audit, err := applyFlagPolicy(test.args, test.policy, boolFlags)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: args are %v, want %v", test.name, result, test.result)
+		}
+		if !reflect.DeepEqual(audit, test.audit) {
+			t.Errorf("%s: audit is %v, want %v", test.name, audit, test.audit)
+		}
+	}
+
+	_, _, err := applyFlagPolicy(nil, flagPolicy{Set: map[string]string{"amazonec2-private-address-only": "yes"}}, boolFlags)
+	if err == nil {
+		t.Errorf("invalid bool value: expected an error")
+	}
+}
@@ -0,0 +1,130 @@
+package machine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// nameTemplateAnnotation on a machine template is the Go template the
+	// names of the machines the controller creates for its pool are rendered
+	// from, e.g. "{{.Pool}}-{{.Suffix}}". It may use .Pool, the template
+	// name, .Source, the machine cloned or replaced, .Kind, "clone",
+	// "replacement" or "pool", and .Suffix, a hash that makes the name
+	// unique.
+	nameTemplateAnnotation = "io.cattle.machine.name_template"
+	// nameSeedAnnotation on a machine with a generated name is the seed its
+	// suffix was derived from. A create retried with the same seed finds its
+	// machine instead of creating another one.
+	nameSeedAnnotation = "io.cattle.machine.name_seed"
+
+	defaultCloneNameTemplate       = "{{.Source}}-clone-{{.Suffix}}"
+	defaultReplacementNameTemplate = "{{.Pool}}-{{.Suffix}}"
+
+	maxNameAttempts = 5
+	maxNameLength   = 63
+)
+
+// nameParams are the values a name template is rendered with.
+type nameParams struct {
+	Pool   string
+	Source string
+	Kind   string
+	Suffix string
+}
+
+// nameTemplate returns the name template of the pool of a machine template,
+// or fallback if it has none.
+func (m *Lifecycle) nameTemplate(templateName, fallback string) (string, error) {
+	if templateName == "" {
+		return fallback, nil
+	}
+	template, err := m.machineTemplateClient.Get(templateName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fallback, nil
+	} else if err != nil {
+		return "", err
+	}
+	if tmpl := template.Annotations[nameTemplateAnnotation]; tmpl != "" {
+		return tmpl, nil
+	}
+	return fallback, nil
+}
+
+// createGenerated creates the machine build returns for a name rendered from
+// tmpl. The name only depends on seed, and on the attempt when it is taken by
+// another machine, so retrying a create with the same seed yields the machine
+// created before.
+func (m *Lifecycle) createGenerated(tmpl string, params nameParams, seed string, build func(name string) *v3.Machine) (*v3.Machine, error) {
+	parsed, err := template.New("name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid name template %q", tmpl)
+	}
+
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		params.Suffix = nameSuffix(seed, attempt)
+		name, err := renderName(parsed, params)
+		if err != nil {
+			return nil, err
+		}
+
+		machine := build(name)
+		if machine.Annotations == nil {
+			machine.Annotations = map[string]string{}
+		}
+		machine.Annotations[nameSeedAnnotation] = seed
+		created, err := m.machineClient.Create(machine)
+		if !apierrors.IsAlreadyExists(err) {
+			return created, err
+		}
+
+		existing, err := m.machineClient.GetNamespace(name, machine.Namespace, metav1.GetOptions{})
+		if err == nil && existing.Annotations[nameSeedAnnotation] == seed {
+			return existing, nil
+		}
+	}
+	return nil, fmt.Errorf("no free machine name after %d attempts", maxNameAttempts)
+}
+
+func nameSuffix(seed string, attempt int) string {
+	hash := sha256.Sum256([]byte(seed + "/" + strconv.Itoa(attempt)))
+	return hex.EncodeToString(hash[:])[:8]
+}
+
+// renderName renders a name template into a valid machine name and hostname:
+// lower case letters, digits and dashes, at most 63 characters, keeping the
+// end of the name, which holds the suffix in the default templates.
+func renderName(tmpl *template.Template, params nameParams) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, params); err != nil {
+		return "", errors.Wrap(err, "failed to render name template")
+	}
+
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, buf.String())
+	if len(name) > maxNameLength {
+		name = name[len(name)-maxNameLength:]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return "", fmt.Errorf("name template %q renders an empty name", tmpl.Root.String())
+	}
+	return name, nil
+}
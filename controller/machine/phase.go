@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// PhaseLabel, DriverLabel and PoolLabel are kept up to date on every
+	// machine, so machines can be listed and watched by phase, driver and
+	// machine template with label selectors.
+	PhaseLabel  = "io.cattle.machine.phase"
+	DriverLabel = "io.cattle.machine.driver"
+	PoolLabel   = "io.cattle.machine.pool"
+	// CredentialLabelPrefix is suffixed with the name of each Secret in
+	// cattle-system the driver config of a machine was resolved from.
+	CredentialLabelPrefix = "credential.machine.cattle.io/"
+
+	PhasePending      = "pending"
+	PhaseProvisioning = "provisioning"
+	PhaseReady        = "ready"
+	PhaseFailed       = "failed"
+)
+
+// Phase summarizes the conditions of a machine in a single word. It does not
+// modify obj, so it can be called on objects from a cache.
+func Phase(obj *v3.Machine) string {
+	for _, cond := range obj.Status.Conditions {
+		if cond.Status == "False" {
+			return PhaseFailed
+		}
+	}
+	switch {
+	case conditionStatus(obj, v3.MachineConditionConfigReady) == "True":
+		return PhaseReady
+	case conditionStatus(obj, v3.MachineConditionInitialized) == "True":
+		return PhaseProvisioning
+	}
+	return PhasePending
+}
+
+func setListLabels(obj *v3.Machine) {
+	if obj == nil {
+		return
+	}
+	if obj.Labels == nil {
+		obj.Labels = map[string]string{}
+	}
+	obj.Labels[PhaseLabel] = Phase(obj)
+	if obj.Status.MachineTemplateSpec != nil {
+		obj.Labels[DriverLabel] = obj.Status.MachineTemplateSpec.Driver
+	}
+	if name := obj.Spec.MachineTemplateName; name != "" && len(validation.IsValidLabelValue(name)) == 0 {
+		obj.Labels[PoolLabel] = name
+	} else {
+		delete(obj.Labels, PoolLabel)
+	}
+
+	credentials := map[string]bool{}
+	for _, name := range strings.Split(obj.Annotations[credentialsAnnotation], ",") {
+		// Secret names too long for a label key are left out.
+		if name != "" && len(validation.IsQualifiedName(CredentialLabelPrefix+name)) == 0 {
+			credentials[CredentialLabelPrefix+name] = true
+		}
+	}
+	for key := range obj.Labels {
+		if strings.HasPrefix(key, CredentialLabelPrefix) && !credentials[key] {
+			delete(obj.Labels, key)
+		}
+	}
+	for key := range credentials {
+		obj.Labels[key] = "true"
+	}
+}
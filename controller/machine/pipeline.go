@@ -0,0 +1,258 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/norman/event"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	StepAllocate       = "allocate"
+	StepCreateInstance = "create-instance"
+	StepWaitIP         = "wait-ip"
+	StepBootstrap      = "bootstrap"
+	StepVerify         = "verify"
+	StepRegister       = "register"
+)
+
+// Step is a single stage of the machine provisioning pipeline. If Condition is
+// set the step is wrapped in Condition.Once so it is not repeated once it has
+// succeeded.
+type Step struct {
+	Name      string
+	Condition condition.Cond
+	Run       func(p *Provisioning) error
+}
+
+// Provisioning is the state shared by the steps of a single pipeline run.
+type Provisioning struct {
+	Machine         *v3.Machine
+	Config          *machineconfig.MachineConfig
+	Logger          event.Logger
+	Address         string
+	InternalAddress string
+	SSHKey          string
+
+	lifecycle *Lifecycle
+}
+
+var (
+	stepsLock = sync.Mutex{}
+	steps     = []Step{
+		{Name: StepAllocate, Run: allocate},
+		{Name: StepCreateInstance, Condition: v3.MachineConditionProvisioned, Run: createInstance},
+		{Name: StepWaitIP, Run: waitIP},
+		{Name: StepCloudInit, Run: waitForCloudInit},
+		{Name: StepSSHKey, Run: replaceKey},
+		{Name: StepBootstrap, Run: bootstrap},
+		{Name: StepVerify, Condition: MachineConditionVerified, Run: verify},
+		{Name: StepRegister, Condition: v3.MachineConditionConfigSaved, Run: register},
+		{Name: StepLoadBalancer, Condition: MachineConditionLoadBalanced, Run: registerLoadBalancer},
+	}
+)
+
+// RegisterStep appends a step to the end of the provisioning pipeline.
+func RegisterStep(step Step) error {
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+
+	if indexOfStep(step.Name) >= 0 {
+		return fmt.Errorf("provisioning step %s is already registered", step.Name)
+	}
+	steps = append(steps, step)
+	return nil
+}
+
+// RegisterStepBefore inserts a step directly before the named step.
+func RegisterStepBefore(name string, step Step) error {
+	return insertStep(name, 0, step)
+}
+
+// RegisterStepAfter inserts a step directly after the named step.
+func RegisterStepAfter(name string, step Step) error {
+	return insertStep(name, 1, step)
+}
+
+// Steps returns the currently registered provisioning steps in order.
+func Steps() []Step {
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+
+	return append([]Step{}, steps...)
+}
+
+func insertStep(name string, offset int, step Step) error {
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+
+	if indexOfStep(step.Name) >= 0 {
+		return fmt.Errorf("provisioning step %s is already registered", step.Name)
+	}
+
+	idx := indexOfStep(name)
+	if idx < 0 {
+		return fmt.Errorf("provisioning step %s not found", name)
+	}
+	idx += offset
+
+	steps = append(steps, Step{})
+	copy(steps[idx+1:], steps[idx:])
+	steps[idx] = step
+	return nil
+}
+
+func indexOfStep(name string) int {
+	for i, step := range steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Lifecycle) runPipeline(obj *v3.Machine) (*v3.Machine, error) {
+	p := &Provisioning{
+		Machine:   obj,
+		Logger:    m.logger,
+		lifecycle: m,
+	}
+	defer func() {
+		if p.Config != nil {
+			p.Config.Cleanup()
+		}
+	}()
+
+	for _, step := range Steps() {
+		logrus.Debugf("Running provisioning step %s for machine %s", step.Name, p.Machine.Name)
+		if err := p.run(step); err != nil {
+			return p.Machine, err
+		}
+	}
+
+	return p.Machine, nil
+}
+
+func (p *Provisioning) run(step Step) error {
+	if step.Condition == "" {
+		return step.Run(p)
+	}
+
+	newObj, err := step.Condition.Once(p.Machine, func() (runtime.Object, error) {
+		err := step.Run(p)
+		return p.Machine, err
+	})
+	p.Machine = newObj.(*v3.Machine)
+	return err
+}
+
+func allocate(p *Provisioning) error {
+	config, err := machineconfig.NewMachineConfig(p.lifecycle.secretStore, p.Machine)
+	if err != nil {
+		return err
+	}
+	p.Config = config
+
+	return config.Restore()
+}
+
+func createInstance(p *Provisioning) error {
+	if err := p.checkKept(); err != nil {
+		return err
+	}
+
+	// Provision in the background so we can poll and save the config
+	done := make(chan error)
+	go func() {
+		newObj, err := p.lifecycle.provision(p.Config.Dir(), p.Machine)
+		if newObj != nil {
+			p.Machine = newObj
+		}
+		done <- err
+	}()
+
+	// Poll and save config
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				err = p.provisionAfterCloudInit(err)
+			}
+			if saveErr := p.Config.Save(); err == nil {
+				err = saveErr
+			} else if !p.keepFailed() {
+				p.cleanupFailed()
+			}
+			return err
+		case <-time.After(5 * time.Second):
+			p.Config.Save()
+		}
+	}
+}
+
+// cleanupFailed garbage collects what a failed create left behind so the next
+// attempt starts from scratch.
+func (p *Provisioning) cleanupFailed() {
+	recordLeftovers(p.Machine, p.Config)
+	if err := p.lifecycle.collectGarbage(p.Machine, p.Config); err != nil {
+		p.Logger.Errorf(p.Machine, "Failed to clean up machine %s: %v", p.Machine.Spec.RequestedHostname, err)
+		return
+	}
+	p.Config.Save()
+}
+
+func waitIP(p *Provisioning) error {
+	logrus.Infof("Generating and uploading machine config %s", p.Machine.Spec.RequestedHostname)
+	if err := p.Config.Save(); err != nil {
+		return err
+	}
+
+	ip, err := p.Config.IP()
+	if err != nil {
+		return err
+	}
+
+	internalAddress, err := p.Config.InternalIP()
+	if err != nil {
+		return err
+	}
+
+	p.Address = ip
+	p.InternalAddress = internalAddress
+	return nil
+}
+
+func bootstrap(p *Provisioning) error {
+	sshKey, err := getSSHKey(p.Config.Dir(), p.Machine)
+	if err != nil {
+		return err
+	}
+	p.SSHKey = sshKey
+
+	return p.Config.Save()
+}
+
+func register(p *Provisioning) error {
+	obj := p.Machine
+	obj.Status.NodeConfig = &v3.RKEConfigNode{
+		MachineName:      obj.Spec.ClusterName + ":" + obj.Name,
+		Address:          p.Address,
+		InternalAddress:  p.InternalAddress,
+		User:             obj.Status.SSHUser,
+		Role:             obj.Spec.Role,
+		HostnameOverride: obj.Spec.RequestedHostname,
+		SSHKey:           p.SSHKey,
+	}
+
+	if len(obj.Status.NodeConfig.Role) == 0 {
+		obj.Status.NodeConfig.Role = []string{"worker"}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package machine
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// withSteps replaces the registered provisioning steps until the returned
+// function is called.
+func withSteps(replacement ...Step) func() {
+	stepsLock.Lock()
+	defer stepsLock.Unlock()
+	saved := steps
+	steps = append([]Step{}, replacement...)
+	return func() {
+		stepsLock.Lock()
+		defer stepsLock.Unlock()
+		steps = saved
+	}
+}
+
+func stepNames() []string {
+	var names []string
+	for _, step := range Steps() {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func TestRegisterStep(t *testing.T) {
+	noop := func(p *Provisioning) error { return nil }
+	tests := []struct {
+		name     string
+		register func() error
+		order    []string
+		fails    bool
+	}{
+		{
+			name:     "append",
+			register: func() error { return RegisterStep(Step{Name: "d", Run: noop}) },
+			order:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name:     "before first",
+			register: func() error { return RegisterStepBefore("a", Step{Name: "d", Run: noop}) },
+			order:    []string{"d", "a", "b", "c"},
+		},
+		{
+			name:     "before",
+			register: func() error { return RegisterStepBefore("c", Step{Name: "d", Run: noop}) },
+			order:    []string{"a", "b", "d", "c"},
+		},
+		{
+			name:     "after",
+			register: func() error { return RegisterStepAfter("a", Step{Name: "d", Run: noop}) },
+			order:    []string{"a", "d", "b", "c"},
+		},
+		{
+			name:     "after last",
+			register: func() error { return RegisterStepAfter("c", Step{Name: "d", Run: noop}) },
+			order:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name:     "duplicate",
+			register: func() error { return RegisterStep(Step{Name: "b", Run: noop}) },
+			order:    []string{"a", "b", "c"},
+			fails:    true,
+		},
+		{
+			name:     "duplicate before",
+			register: func() error { return RegisterStepBefore("c", Step{Name: "a", Run: noop}) },
+			order:    []string{"a", "b", "c"},
+			fails:    true,
+		},
+		{
+			name:     "after missing step",
+			register: func() error { return RegisterStepAfter("x", Step{Name: "d", Run: noop}) },
+			order:    []string{"a", "b", "c"},
+			fails:    true,
+		},
+	}
+	for _, test := range tests {
+		restore := withSteps(Step{Name: "a", Run: noop}, Step{Name: "b", Run: noop}, Step{Name: "c", Run: noop})
+		err := test.register()
+		order := stepNames()
+		restore()
+
+		if (err != nil) != test.fails {
+			t.Errorf("%s: got error %v, want failure %v", test.name, err, test.fails)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%s: steps are %v, want %v", test.name, order, test.order)
+		}
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	var cond condition.Cond = "TestStepDone"
+	failure := errors.New("bootstrap failed")
+	tests := []struct {
+		name   string
+		done   bool
+		failAt string
+		ran    []string
+	}{
+		{name: "all steps", ran: []string{"allocate", "create", "bootstrap", "register"}},
+		{name: "error stops later steps", failAt: "create", ran: []string{"allocate", "create"}},
+		{name: "error in last step", failAt: "register", ran: []string{"allocate", "create", "bootstrap", "register"}},
+		{name: "done step is skipped", done: true, ran: []string{"allocate", "bootstrap", "register"}},
+	}
+	for _, test := range tests {
+		var ran []string
+		step := func(name string) func(p *Provisioning) error {
+			return func(p *Provisioning) error {
+				ran = append(ran, name)
+				if name == test.failAt {
+					return failure
+				}
+				return nil
+			}
+		}
+		restore := withSteps(
+			Step{Name: "allocate", Run: step("allocate")},
+			Step{Name: "create", Condition: cond, Run: step("create")},
+			Step{Name: "bootstrap", Run: step("bootstrap")},
+			Step{Name: "register", Run: step("register")},
+		)
+
+		obj := &v3.Machine{}
+		if test.done {
+			obj.Status.Conditions = []v3.MachineCondition{{Type: cond, Status: "True"}}
+		}
+		m := &Lifecycle{logger: fakeLogger{}}
+		_, err := m.runPipeline(obj)
+		restore()
+
+		if test.failAt == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.failAt != "" && err != failure {
+			t.Errorf("%s: got error %v, want %v", test.name, err, failure)
+		}
+		if !reflect.DeepEqual(ran, test.ran) {
+			t.Errorf("%s: ran %v, want %v", test.name, ran, test.ran)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// poolStatusAnnotation on a machine template counts the machines of its
+	// pool by phase as a JSON poolStatus.
+	poolStatusAnnotation = "io.cattle.machine.pool_status"
+)
+
+var (
+	MachineTemplateConditionAllMachinesReady condition.Cond = "AllMachinesReady"
+	MachineTemplateConditionUpdateInProgress condition.Cond = "UpdateInProgress"
+	MachineTemplateConditionQuotaBlocked     condition.Cond = "QuotaBlocked"
+
+	quotaExceededRegexp = regexp.MustCompile(`(?i)quota|LimitExceeded|limit exceeded|exceeds? .*limit|droplet limit`)
+)
+
+// poolStatus is the number of machines of a pool in each phase.
+type poolStatus struct {
+	Desired      int `json:"desired,omitempty"`
+	Machines     int `json:"machines"`
+	Ready        int `json:"ready"`
+	Provisioning int `json:"provisioning"`
+	Pending      int `json:"pending"`
+	Failed       int `json:"failed"`
+}
+
+// setPoolConditions publishes the conditions of a machine template that
+// aggregate those of the machines of its pool, so automation can wait for a
+// pool as a whole.
+func setPoolConditions(template *v3.MachineTemplate, pool []*v3.Machine) {
+	status := poolStatus{Machines: len(pool)}
+	if spec, err := poolSpec(template); err == nil && spec != nil {
+		status.Desired = spec.Quantity
+	}
+	var blocked []string
+	for _, machine := range pool {
+		switch Phase(machine) {
+		case PhaseReady:
+			status.Ready++
+		case PhaseProvisioning:
+			status.Provisioning++
+		case PhaseFailed:
+			status.Failed++
+		default:
+			status.Pending++
+		}
+		if message := quotaMessage(machine); message != "" {
+			blocked = append(blocked, fmt.Sprintf("%s: %s", machineKey(machine), message))
+		}
+	}
+	data, _ := json.Marshal(status)
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[poolStatusAnnotation] = string(data)
+
+	// Pools with a PoolSpec are only ready once they reached their quantity.
+	total := status.Machines
+	if status.Desired > total {
+		total = status.Desired
+	}
+	switch {
+	case total == 0:
+		setTemplateCondition(template, MachineTemplateConditionAllMachinesReady, "Unknown", "NoMachines")
+	case status.Ready == total:
+		setTemplateCondition(template, MachineTemplateConditionAllMachinesReady, "True", "")
+	default:
+		setTemplateCondition(template, MachineTemplateConditionAllMachinesReady, "False",
+			fmt.Sprintf("%d of %d machines ready", status.Ready, total))
+	}
+
+	rollout := rolloutStatus{}
+	json.Unmarshal([]byte(template.Annotations[rolloutStatusAnnotation]), &rollout)
+	switch rollout.Phase {
+	case rolloutCanary, rolloutRolling:
+		setTemplateCondition(template, MachineTemplateConditionUpdateInProgress, "True", fmt.Sprintf("Rolling out revision %s", rollout.Revision))
+	default:
+		setTemplateCondition(template, MachineTemplateConditionUpdateInProgress, "False", "")
+	}
+
+	if len(blocked) > 0 {
+		sort.Strings(blocked)
+		reason := blocked[0]
+		if len(blocked) > 1 {
+			reason = fmt.Sprintf("%s, and %d more machines", reason, len(blocked)-1)
+		}
+		setTemplateCondition(template, MachineTemplateConditionQuotaBlocked, "True", reason)
+	} else {
+		setTemplateCondition(template, MachineTemplateConditionQuotaBlocked, "False", "")
+	}
+}
+
+// quotaMessage returns the error of a machine that is held up by a quota or
+// limit of its provider account, if any.
+func quotaMessage(machine *v3.Machine) string {
+	for _, cond := range machine.Status.Conditions {
+		if cond.Status != "True" && cond.Message != "" && quotaExceededRegexp.MatchString(cond.Message) {
+			return cond.Message
+		}
+	}
+	return ""
+}
+
+// setTemplateCondition sets the status and reason of a condition of a machine
+// template. The condition is only touched when it changes.
+func setTemplateCondition(template *v3.MachineTemplate, cond condition.Cond, status, reason string) {
+	for _, c := range template.Status.Conditions {
+		if c.Type == string(cond) && string(c.Status) == status && c.Reason == reason {
+			return
+		}
+	}
+	switch status {
+	case "True":
+		cond.True(template)
+	case "False":
+		cond.False(template)
+	default:
+		cond.Unknown(template)
+	}
+	cond.Reason(template, reason)
+}
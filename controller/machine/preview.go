@@ -0,0 +1,142 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// previewAction compares the driver config of a machine with that of a
+	// machine template, the current one if the input is empty, without
+	// changing anything. The output lists the changed fields that force the
+	// machine to be replaced and those that can be updated in place.
+	previewAction = "preview"
+)
+
+// Preview is the output of the preview action.
+type Preview struct {
+	Template string   `json:"template"`
+	Replace  []string `json:"replace"`
+	InPlace  []string `json:"inPlace"`
+}
+
+func (m *Lifecycle) preview(obj *v3.Machine) *v3.Machine {
+	templateName, ok := action.Pending(obj, previewAction)
+	if !ok {
+		return obj
+	}
+
+	if templateName == "" {
+		templateName = obj.Spec.MachineTemplateName
+	}
+
+	output := ""
+	preview, err := m.diff(obj, templateName)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(preview)
+		output = string(data)
+	}
+	action.Complete(obj, previewAction, output, err)
+	return obj
+}
+
+func (m *Lifecycle) diff(obj *v3.Machine, templateName string) (*Preview, error) {
+	if obj.Status.MachineTemplateSpec == nil || obj.Status.MachineDriverConfig == "" {
+		return nil, fmt.Errorf("machine %s has no driver config to compare", obj.Name)
+	}
+
+	current := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &current); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal machine config")
+	}
+
+	template, err := m.machineTemplateClient.Get(templateName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rawTemplate, err := m.machineTemplateGenericClient.Get(templateName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rawConfig, _ := values.GetValue(rawTemplate.(*unstructured.Unstructured).Object, template.Spec.Driver+"Config")
+	proposed := convert.ToMapInterface(rawConfig)
+	if proposed == nil {
+		return nil, fmt.Errorf("machine config not specified")
+	}
+	resolved := obj.DeepCopy()
+	resolved.Spec.MachineTemplateName = templateName
+	if err := m.resolveSecretRefs(resolved, proposed); err != nil {
+		return nil, err
+	}
+	if err := m.applyImage(obj, template, proposed); err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{
+		Template: templateName,
+		Replace:  []string{},
+		InPlace:  []string{},
+	}
+	if !strings.EqualFold(template.Spec.Driver, obj.Status.MachineTemplateSpec.Driver) {
+		preview.Replace = append(preview.Replace, "driver")
+		return preview, nil
+	}
+
+	var fields map[string]v3.Field
+	driverSchema, err := schemastore.Get(m.driverSchemaClient(obj), strings.ToLower(template.Spec.Driver)+"config")
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		fields = driverSchema.Spec.ResourceFields
+	}
+
+	for _, name := range changedFields(current, proposed) {
+		if fields[name].Update {
+			preview.InPlace = append(preview.InPlace, name)
+		} else {
+			preview.Replace = append(preview.Replace, name)
+		}
+	}
+	return preview, nil
+}
+
+func changedFields(current, proposed map[string]interface{}) []string {
+	var changed []string
+	for name, value := range proposed {
+		if !reflect.DeepEqual(normalize(current[name]), normalize(value)) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range current {
+		if _, ok := proposed[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// normalize makes values read from JSON and from the API server comparable.
+func normalize(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var result interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
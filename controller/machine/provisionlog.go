@@ -0,0 +1,151 @@
+package machine
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// provisionLogLabel marks the ConfigMaps holding the output of the last
+	// docker-machine create of a machine, in the namespace of the machine,
+	// or cattle-system for machines without one. The value is the name of
+	// the machine. The log key holds the last maxProvisionLogLines lines of
+	// stdout and stderr and the phase key the provisioning phase.
+	provisionLogLabel     = "io.cattle.machine.provision_log"
+	provisionLogNamespace = "cattle-system"
+	provisionLogKey       = "log"
+	provisionPhaseKey     = "phase"
+	maxProvisionLogLines  = 500
+	// provisionPhaseAnnotation on a machine mirrors the phase of its log.
+	provisionPhaseAnnotation = "io.cattle.machine.provision_phase"
+
+	ProvisionPhaseCreating         = "Creating"
+	ProvisionPhaseProvisioning     = "Provisioning"
+	ProvisionPhaseInstallingDocker = "InstallingDocker"
+	ProvisionPhaseDone             = "Done"
+)
+
+// provisionPhaseMarkers are the docker-machine create output starting each
+// phase.
+var provisionPhaseMarkers = []struct {
+	marker, phase string
+}{
+	{"Running pre-create checks", ProvisionPhaseCreating},
+	{"Detecting the provisioner", ProvisionPhaseProvisioning},
+	{"Provisioning with", ProvisionPhaseProvisioning},
+	{"Installing Docker", ProvisionPhaseInstallingDocker},
+}
+
+// provisionLog collects the output of a docker-machine create while it runs.
+type provisionLog struct {
+	lock  sync.Mutex
+	lines []string
+	phase string
+	dirty bool
+}
+
+func newProvisionLog() *provisionLog {
+	return &provisionLog{
+		phase: ProvisionPhaseCreating,
+		dirty: true,
+	}
+}
+
+func (l *provisionLog) add(line string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lines = append(l.lines, line)
+	if len(l.lines) > maxProvisionLogLines {
+		l.lines = l.lines[len(l.lines)-maxProvisionLogLines:]
+	}
+	for _, m := range provisionPhaseMarkers {
+		if strings.Contains(line, m.marker) {
+			l.phase = m.phase
+		}
+	}
+	l.dirty = true
+}
+
+func (l *provisionLog) setPhase(phase string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.phase = phase
+	l.dirty = true
+}
+
+// take returns the log and phase if they changed since the last call.
+func (l *provisionLog) take() (string, string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.dirty {
+		return "", "", false
+	}
+	l.dirty = false
+	return strings.Join(l.lines, "\n"), l.phase, true
+}
+
+// saveProvisionLog writes the log of a machine to its ConfigMap and its
+// phase to the provisionPhaseAnnotation of obj, which the caller persists.
+// Errors are only logged, the log must not fail a provision.
+func (m *Lifecycle) saveProvisionLog(obj *v3.Machine, l *provisionLog) {
+	log, phase, changed := l.take()
+	if !changed {
+		return
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[provisionPhaseAnnotation] = phase
+
+	namespace := obj.Namespace
+	if namespace == "" {
+		namespace = provisionLogNamespace
+	}
+	configMaps := m.configMapGetter.ConfigMaps(namespace)
+	name := provisionLogName(obj)
+	data := map[string]string{
+		provisionLogKey:   log,
+		provisionPhaseKey: phase,
+	}
+
+	cm, err := configMaps.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					provisionLogLabel: obj.Name,
+				},
+			},
+			Data: data,
+		}
+		if obj.UID != "" {
+			cm.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: v3.MachineGroupVersionKind.GroupVersion().String(),
+				Kind:       v3.MachineGroupVersionKind.Kind,
+				Name:       obj.Name,
+				UID:        obj.UID,
+			}}
+		}
+		_, err = configMaps.Create(cm)
+	} else if err == nil {
+		cm = cm.DeepCopy()
+		cm.Data = data
+		_, err = configMaps.Update(cm)
+	}
+	if err != nil {
+		logrus.Warnf("Failed to save provisioning log of machine %s: %v", obj.Name, err)
+	}
+}
+
+func provisionLogName(obj *v3.Machine) string {
+	return obj.Name + "-provision-log"
+}
@@ -0,0 +1,181 @@
+package machine
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// maxConcurrentProvisionsAnnotation on a MachineDriver limits how many
+	// of its machines are provisioned at once, in addition to the global
+	// limit of the controller.
+	maxConcurrentProvisionsAnnotation = "io.cattle.machine_driver.max_concurrent_provisions"
+
+	queueRetryInterval = 10 * time.Second
+	// queueWaiterExpiry drops machines from the queue that stopped asking
+	// for a slot, e.g. because they were deleted.
+	queueWaiterExpiry = 3 * queueRetryInterval
+)
+
+var (
+	MachineConditionQueued condition.Cond = "Queued"
+)
+
+// provisionQueue hands out the slots machines are provisioned in, at most
+// limit at once and at most the limit of its driver per driver, in the order
+// the machines asked for them.
+type provisionQueue struct {
+	lock    sync.Mutex
+	limit   int
+	running map[string]int
+	total   int
+	waiting []*queueWaiter
+}
+
+type queueWaiter struct {
+	key, driver string
+	driverLimit int
+	seen        time.Time
+}
+
+func newProvisionQueue(limit int) *provisionQueue {
+	return &provisionQueue{
+		limit:   limit,
+		running: map[string]int{},
+	}
+}
+
+// acquire takes a slot for the machine key of driver, whose own limit is
+// driverLimit, zero for none. If no slot is free it returns false and the
+// position of the machine in the queue.
+func (q *provisionQueue) acquire(key, driver string, driverLimit int) (func(), int, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	var waiting []*queueWaiter
+	var self *queueWaiter
+	for _, w := range q.waiting {
+		if w.key == key {
+			w.seen = now
+			w.driverLimit = driverLimit
+			self = w
+		}
+		if now.Sub(w.seen) < queueWaiterExpiry {
+			waiting = append(waiting, w)
+		}
+	}
+	if self == nil {
+		self = &queueWaiter{key: key, driver: driver, driverLimit: driverLimit, seen: now}
+		waiting = append(waiting, self)
+	}
+	q.waiting = waiting
+
+	// Machines queued before this one go first if there is room for them,
+	// but do not hold up machines of other drivers that they cannot use.
+	position := 0
+	for i, w := range q.waiting {
+		if w == self {
+			position = i + 1
+		}
+	}
+	total := q.total
+	running := map[string]int{}
+	for _, w := range q.waiting {
+		if q.limit > 0 && total >= q.limit {
+			return nil, position, false
+		}
+		if w.driverLimit > 0 && q.running[w.driver]+running[w.driver] >= w.driverLimit {
+			if w == self {
+				return nil, position, false
+			}
+			continue
+		}
+		if w == self {
+			break
+		}
+		total++
+		running[w.driver]++
+	}
+
+	q.waiting = append(q.waiting[:position-1], q.waiting[position:]...)
+	q.total++
+	q.running[driver]++
+	return func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.total--
+		if q.running[driver]--; q.running[driver] == 0 {
+			delete(q.running, driver)
+		}
+	}, 0, true
+}
+
+// needsProvisionSlot returns whether the pipeline of a machine is about to
+// create its instance.
+func needsProvisionSlot(obj *v3.Machine) bool {
+	return obj.Status.MachineTemplateSpec != nil && obj.DeletionTimestamp == nil &&
+		!v3.MachineConditionProvisioned.IsTrue(obj) && !v3.MachineConditionProvisioned.IsFalse(obj) &&
+		!v3.MachineConditionConfigReady.IsTrue(obj) && !v3.MachineConditionConfigReady.IsFalse(obj)
+}
+
+// acquireProvisionSlot takes a provisioning slot for a machine. If none is
+// free the machine is marked as queued and asks again later.
+func (m *Lifecycle) acquireProvisionSlot(obj *v3.Machine) (func(), bool, error) {
+	driver := obj.Status.MachineTemplateSpec.Driver
+	driverLimit, err := m.driverProvisionLimit(driver)
+	if err != nil {
+		return nil, false, err
+	}
+
+	release, position, ok := m.provisionQueue.acquire(machineKey(obj), driver, driverLimit)
+	if !ok {
+		reason := fmt.Sprintf("Waiting for a provisioning slot, position %d in the queue", position)
+		if !MachineConditionQueued.IsTrue(obj) || MachineConditionQueued.GetReason(obj) != reason {
+			MachineConditionQueued.True(obj)
+			MachineConditionQueued.Reason(obj, reason)
+		}
+		m.enqueueAfter(obj, queueRetryInterval)
+		return nil, false, nil
+	}
+
+	removeCondition(obj, MachineConditionQueued)
+	return release, true, nil
+}
+
+func (m *Lifecycle) driverProvisionLimit(driver string) (int, error) {
+	machineDriver, err := m.machineDriverClient.Get(driver, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	value := machineDriver.Annotations[maxConcurrentProvisionsAnnotation]
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid %s annotation of machine driver %s: %q", maxConcurrentProvisionsAnnotation, driver, value)
+	}
+	return limit, nil
+}
+
+// removeCondition drops a condition from a machine. Conditions like Queued
+// only make sense while they are true; a false one would mark the machine
+// as failed.
+func removeCondition(obj *v3.Machine, cond condition.Cond) {
+	for i, c := range obj.Status.Conditions {
+		if c.Type == cond {
+			obj.Status.Conditions = append(obj.Status.Conditions[:i:i], obj.Status.Conditions[i+1:]...)
+			return
+		}
+	}
+}
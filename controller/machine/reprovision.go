@@ -0,0 +1,113 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/hook"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// reprovisionAction reruns the bootstrap of an existing machine without
+	// recreating its instance: docker-machine provision reinstalls and
+	// configures the engine, then the bootstrap hook of the driver, if any,
+	// and the first-boot checks are run again. The input is passed to the
+	// hook.
+	reprovisionAction = "reprovision"
+
+	bootstrapHook = "bootstrap"
+)
+
+func (m *Lifecycle) reprovision(obj *v3.Machine) *v3.Machine {
+	args, ok := action.Pending(obj, reprovisionAction)
+	if !ok {
+		return obj
+	}
+
+	m.logger.Infof(obj, "Reprovisioning machine %s", obj.Spec.RequestedHostname)
+	output, err := m.rerunBootstrap(obj, args)
+	if len(output) > maxCheckOutput {
+		output = output[len(output)-maxCheckOutput:]
+	}
+	if err != nil {
+		m.logger.Errorf(obj, "Reprovisioning machine %s failed: %v", obj.Spec.RequestedHostname, err)
+	} else {
+		m.logger.Infof(obj, "Reprovisioning machine %s done", obj.Spec.RequestedHostname)
+	}
+	action.Complete(obj, reprovisionAction, output, err)
+	return obj
+}
+
+func (m *Lifecycle) rerunBootstrap(obj *v3.Machine, args string) (string, error) {
+	if obj.Status.NodeConfig == nil || obj.Status.MachineTemplateSpec == nil {
+		return "", fmt.Errorf("machine %s is not provisioned", obj.Name)
+	}
+	driver := obj.Status.MachineTemplateSpec.Driver
+
+	config, err := machineconfig.NewMachineConfig(m.secretStore, obj)
+	if err != nil {
+		return "", err
+	}
+	defer config.Cleanup()
+	if err := config.Restore(); err != nil {
+		return "", err
+	}
+
+	output, err := m.runProvision(obj, config.Dir())
+	if err != nil {
+		return output, err
+	}
+
+	h, err := hook.Lookup(m.configMapGetter, driver, bootstrapHook)
+	if err != nil {
+		return output, err
+	}
+	if h != nil {
+		if err := runHook(h, obj, config, args, nil); err != nil {
+			return output, errors.Wrap(err, "bootstrap hook failed")
+		}
+	}
+
+	checks, err := parseChecks(obj.Annotations[checksAnnotation])
+	if err != nil {
+		return output, err
+	}
+	for i, check := range checks {
+		if err := runCheck(obj, config.Dir(), check); err != nil {
+			return output, errors.Wrapf(err, "check %s failed", check.name(i))
+		}
+	}
+
+	return output, config.Save()
+}
+
+// runProvision reinstalls and configures the engine of an existing machine
+// with docker-machine provision.
+func (m *Lifecycle) runProvision(obj *v3.Machine, machineDir string) (string, error) {
+	driver := obj.Status.MachineTemplateSpec.Driver
+	if err := m.checkDriverBinary(driver); err != nil {
+		return "", err
+	}
+	limits, err := m.driverLimits(driver)
+	if err != nil {
+		return "", err
+	}
+	if err := m.refreshAWSRole(obj, machineDir); err != nil {
+		return "", err
+	}
+	if err := m.refreshAzureCertificate(obj, machineDir); err != nil {
+		return "", err
+	}
+	dockermachine.MarkUsed(driver)
+	cmd := dockermachine.LimitedCommand(machineDir, []string{"provision", obj.Spec.RequestedHostname}, limits)
+	workloadIdentityEnv(obj, cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), errors.Wrap(err, "docker-machine provision failed")
+	}
+	return string(out), nil
+}
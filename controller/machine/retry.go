@@ -0,0 +1,164 @@
+package machine
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// provisioningRetriesAnnotation on a machine, or on its machine
+	// template, is how often a failed create is retried before the machine
+	// is left failed. It overrides the default of the controller.
+	provisioningRetriesAnnotation = "io.cattle.machine.provisioning_retries"
+	// provisioningAttemptsAnnotation counts the failed creates of a machine,
+	// retryAtAnnotation records when the next one is attempted.
+	provisioningAttemptsAnnotation = "io.cattle.machine.provisioning_attempts"
+	retryAtAnnotation              = "io.cattle.machine.retry_at"
+
+	initialRetryBackoff = 30 * time.Second
+	maxRetryBackoff     = 10 * time.Minute
+)
+
+var (
+	// MachineConditionProvisionRetried is true while failed creates of a
+	// machine are retried and false once its retries are used up. Its
+	// message is the error of the last failed attempt.
+	MachineConditionProvisionRetried condition.Cond = "ProvisionRetried"
+)
+
+// scheduleProvisionRetry schedules another attempt after the create of a
+// machine failed, with exponential backoff, unless its retries are used up.
+// It returns whether an attempt was scheduled.
+func (m *Lifecycle) scheduleProvisionRetry(obj *v3.Machine) bool {
+	if obj.DeletionTimestamp != nil || conditionStatus(obj, v3.MachineConditionProvisioned) != "False" {
+		return false
+	}
+	retries := m.provisioningRetries(obj)
+	if retries <= 0 {
+		return false
+	}
+
+	failures := provisioningAttempts(obj) + 1
+	lastError := v3.MachineConditionProvisioned.GetMessage(obj)
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[provisioningAttemptsAnnotation] = strconv.Itoa(failures)
+	// The condition helpers only change the status of a condition that
+	// exists already.
+	if conditionStatus(obj, MachineConditionProvisionRetried) == "" {
+		MachineConditionProvisionRetried.Unknown(obj)
+	}
+	if failures > retries {
+		m.logger.Errorf(obj, "Giving up provisioning machine %s after %d attempts", obj.Spec.RequestedHostname, failures)
+		MachineConditionProvisionRetried.False(obj)
+		MachineConditionProvisionRetried.Reason(obj, fmt.Sprintf("Failed %d attempts", failures))
+		MachineConditionProvisionRetried.Message(obj, lastError)
+		return false
+	}
+
+	wait := retryBackoff(failures)
+	// Kept machines are only retried once they are reclaimed.
+	if until, ok := keptUntil(obj); ok && time.Until(until) > wait {
+		wait = time.Until(until)
+	}
+	at := time.Now().Add(wait).UTC().Format(time.RFC3339)
+	obj.Annotations[retryAtAnnotation] = at
+	m.logger.Infof(obj, "Attempt %d of %d to provision machine %s failed, retrying at %s", failures, retries+1,
+		obj.Spec.RequestedHostname, at)
+	MachineConditionProvisionRetried.True(obj)
+	MachineConditionProvisionRetried.Reason(obj, fmt.Sprintf("Attempt %d of %d failed, retrying at %s", failures, retries+1, at))
+	MachineConditionProvisionRetried.Message(obj, lastError)
+	m.enqueueAfter(obj, wait)
+	return true
+}
+
+// resumeProvisionRetry returns whether a machine waits for its next attempt
+// to be created. Once that is due its conditions are reset so the pipeline
+// creates the instance again.
+func (m *Lifecycle) resumeProvisionRetry(obj *v3.Machine) bool {
+	value := obj.Annotations[retryAtAnnotation]
+	if value == "" || conditionStatus(obj, v3.MachineConditionProvisioned) != "False" {
+		return false
+	}
+	if obj.DeletionTimestamp != nil {
+		delete(obj.Annotations, retryAtAnnotation)
+		return false
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if wait := time.Until(at); err == nil && wait > 0 {
+		m.enqueueAfter(obj, wait)
+		return true
+	}
+
+	delete(obj.Annotations, retryAtAnnotation)
+	attempt := provisioningAttempts(obj) + 1
+	m.logger.Infof(obj, "Retrying to provision machine %s, attempt %d of %d", obj.Spec.RequestedHostname, attempt,
+		m.provisioningRetries(obj)+1)
+	MachineConditionProvisionRetried.Reason(obj, fmt.Sprintf("Running attempt %d of %d", attempt, m.provisioningRetries(obj)+1))
+	removeCondition(obj, v3.MachineConditionProvisioned)
+	removeCondition(obj, v3.MachineConditionConfigReady)
+	return false
+}
+
+// finishProvisionRetry records the attempt a retried machine was created in.
+func finishProvisionRetry(obj *v3.Machine) {
+	if conditionStatus(obj, MachineConditionProvisionRetried) == "True" && conditionStatus(obj, v3.MachineConditionProvisioned) == "True" &&
+		obj.Annotations[retryAtAnnotation] == "" {
+		reason := fmt.Sprintf("Provisioned on attempt %d", provisioningAttempts(obj)+1)
+		if MachineConditionProvisionRetried.GetReason(obj) != reason {
+			MachineConditionProvisionRetried.Reason(obj, reason)
+			MachineConditionProvisionRetried.Message(obj, "")
+		}
+	}
+}
+
+// provisioningRetries returns how often a failed create of obj is retried.
+func (m *Lifecycle) provisioningRetries(obj *v3.Machine) int {
+	if value := obj.Annotations[provisioningRetriesAnnotation]; value != "" {
+		if retries, err := strconv.Atoi(value); err == nil && retries >= 0 {
+			return retries
+		}
+	}
+	return m.provisioningRetryLimit
+}
+
+func provisioningAttempts(obj *v3.Machine) int {
+	attempts, _ := strconv.Atoi(obj.Annotations[provisioningAttemptsAnnotation])
+	return attempts
+}
+
+// retryBackoff returns how long to wait after the given number of failed
+// attempts, doubling from initialRetryBackoff up to maxRetryBackoff.
+func retryBackoff(failures int) time.Duration {
+	wait := initialRetryBackoff
+	for i := 1; i < failures && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+func (m *Lifecycle) enqueueAfter(obj *v3.Machine, wait time.Duration) {
+	namespace, name := obj.Namespace, obj.Name
+	time.AfterFunc(wait, func() {
+		m.machineClient.Controller().Enqueue(namespace, name)
+	})
+}
+
+// conditionStatus returns the status of a condition of a machine, or "" if it
+// has none. Unlike the condition helpers it does not add the condition.
+func conditionStatus(obj *v3.Machine, cond condition.Cond) string {
+	for _, c := range obj.Status.Conditions {
+		if c.Type == cond {
+			return string(c.Status)
+		}
+	}
+	return ""
+}
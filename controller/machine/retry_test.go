@@ -0,0 +1,270 @@
+package machine
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeMachines stores machines in memory, keyed by machineKey.
+type fakeMachines struct {
+	v3.MachineInterface
+	lock    sync.Mutex
+	objs    map[string]*v3.Machine
+	deleted []string
+}
+
+func newFakeMachines(objs ...*v3.Machine) *fakeMachines {
+	f := &fakeMachines{objs: map[string]*v3.Machine{}}
+	for _, obj := range objs {
+		f.objs[machineKey(obj)] = obj
+	}
+	return f
+}
+
+func (f *fakeMachines) Create(obj *v3.Machine) (*v3.Machine, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.objs[machineKey(obj)]; ok {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "machines"}, obj.Name)
+	}
+	f.objs[machineKey(obj)] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeMachines) GetNamespace(name, namespace string, opts metav1.GetOptions) (*v3.Machine, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	obj, ok := f.objs[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "machines"}, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (f *fakeMachines) DeleteNamespace(name, namespace string, options *metav1.DeleteOptions) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := namespace + "/" + name
+	if _, ok := f.objs[key]; !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "machines"}, name)
+	}
+	delete(f.objs, key)
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func (f *fakeMachines) Controller() v3.MachineController {
+	return fakeMachineController{}
+}
+
+// fakeMachineLister reads the machines of a fakeMachines.
+type fakeMachineLister struct {
+	v3.MachineLister
+	machines *fakeMachines
+}
+
+func (f fakeMachineLister) Get(namespace, name string) (*v3.Machine, error) {
+	return f.machines.GetNamespace(name, namespace, metav1.GetOptions{})
+}
+
+type fakeMachineController struct {
+	v3.MachineController
+}
+
+func (fakeMachineController) Enqueue(namespace, name string) {}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{20, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if wait := retryBackoff(test.failures); wait != test.wait {
+			t.Errorf("%d failures: waits %v, want %v", test.failures, wait, test.wait)
+		}
+	}
+}
+
+func failedMachine(annotations map[string]string) *v3.Machine {
+	obj := &v3.Machine{}
+	obj.Namespace = "team-a"
+	obj.Name = "m1"
+	obj.Annotations = annotations
+	obj.Status.Conditions = []v3.MachineCondition{{
+		Type:    v3.MachineConditionProvisioned,
+		Status:  v1.ConditionFalse,
+		Message: "quota exceeded",
+	}}
+	return obj
+}
+
+func TestScheduleProvisionRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		machine   *v3.Machine
+		scheduled bool
+		attempts  string
+		wait      time.Duration
+		status    string
+	}{
+		{name: "retries disabled", machine: failedMachine(nil)},
+		{
+			name:      "first failure",
+			limit:     3,
+			machine:   failedMachine(nil),
+			scheduled: true,
+			attempts:  "1",
+			wait:      30 * time.Second,
+			status:    "True",
+		},
+		{
+			name:      "backs off",
+			limit:     3,
+			machine:   failedMachine(map[string]string{provisioningAttemptsAnnotation: "2"}),
+			scheduled: true,
+			attempts:  "3",
+			wait:      2 * time.Minute,
+			status:    "True",
+		},
+		{
+			name:     "retries used up",
+			limit:    3,
+			machine:  failedMachine(map[string]string{provisioningAttemptsAnnotation: "3"}),
+			attempts: "4",
+			status:   "False",
+		},
+		{
+			name:      "limit of the machine",
+			limit:     0,
+			machine:   failedMachine(map[string]string{provisioningRetriesAnnotation: "1"}),
+			scheduled: true,
+			attempts:  "1",
+			wait:      30 * time.Second,
+			status:    "True",
+		},
+	}
+	for _, test := range tests {
+		m := &Lifecycle{
+			logger:                 fakeLogger{},
+			machineClient:          newFakeMachines(),
+			provisioningRetryLimit: test.limit,
+		}
+		before := time.Now()
+		scheduled := m.scheduleProvisionRetry(test.machine)
+		if scheduled != test.scheduled {
+			t.Errorf("%s: scheduled is %v, want %v", test.name, scheduled, test.scheduled)
+		}
+		if got := test.machine.Annotations[provisioningAttemptsAnnotation]; got != test.attempts {
+			t.Errorf("%s: attempts are %q, want %q", test.name, got, test.attempts)
+		}
+		if status := conditionStatus(test.machine, MachineConditionProvisionRetried); status != test.status {
+			t.Errorf("%s: ProvisionRetried is %q, want %q", test.name, status, test.status)
+		}
+		if test.status != "" && MachineConditionProvisionRetried.GetMessage(test.machine) != "quota exceeded" {
+			t.Errorf("%s: last error is not recorded: %v", test.name, test.machine.Status.Conditions)
+		}
+
+		at, err := time.Parse(time.RFC3339, test.machine.Annotations[retryAtAnnotation])
+		if !test.scheduled {
+			if err == nil {
+				t.Errorf("%s: retry is scheduled at %v", test.name, at)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if wait := at.Sub(before); wait < test.wait-time.Second || wait > test.wait+time.Second {
+			t.Errorf("%s: retries in %v, want %v", test.name, wait, test.wait)
+		}
+	}
+}
+
+func TestResumeProvisionRetry(t *testing.T) {
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	deleting := failedMachine(map[string]string{retryAtAnnotation: past})
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	notFailed := failedMachine(map[string]string{retryAtAnnotation: past})
+	notFailed.Status.Conditions[0].Status = v1.ConditionTrue
+
+	tests := []struct {
+		name    string
+		machine *v3.Machine
+		waits   bool
+		retryAt bool
+		reset   bool
+	}{
+		{name: "no retry", machine: failedMachine(nil)},
+		{name: "not due", machine: failedMachine(map[string]string{retryAtAnnotation: future}), waits: true, retryAt: true},
+		{name: "due", machine: failedMachine(map[string]string{retryAtAnnotation: past}), reset: true},
+		{name: "deleted", machine: deleting},
+		{name: "not failed", machine: notFailed, retryAt: true},
+	}
+	for _, test := range tests {
+		m := &Lifecycle{
+			logger:                 fakeLogger{},
+			machineClient:          newFakeMachines(),
+			provisioningRetryLimit: 3,
+		}
+		waits := m.resumeProvisionRetry(test.machine)
+		if waits != test.waits {
+			t.Errorf("%s: waits is %v, want %v", test.name, waits, test.waits)
+		}
+		if _, ok := test.machine.Annotations[retryAtAnnotation]; ok != test.retryAt {
+			t.Errorf("%s: retry time is kept %v, want %v", test.name, ok, test.retryAt)
+		}
+		if reset := conditionStatus(test.machine, v3.MachineConditionProvisioned) == ""; reset != test.reset {
+			t.Errorf("%s: Provisioned is reset %v, want %v", test.name, reset, test.reset)
+		}
+	}
+}
+
+func TestProvisionRetryRoundTrip(t *testing.T) {
+	m := &Lifecycle{
+		logger:                 fakeLogger{},
+		machineClient:          newFakeMachines(),
+		provisioningRetryLimit: 2,
+	}
+	obj := failedMachine(nil)
+	for attempt := 1; attempt <= 3; attempt++ {
+		scheduled := m.scheduleProvisionRetry(obj)
+		if scheduled != (attempt <= 2) {
+			t.Fatalf("failure %d: scheduled is %v", attempt, scheduled)
+		}
+		if !scheduled {
+			break
+		}
+		// The retry is due: the machine is created again and fails again.
+		obj.Annotations[retryAtAnnotation] = time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+		if m.resumeProvisionRetry(obj) {
+			t.Fatalf("failure %d: due retry waits", attempt)
+		}
+		obj.Status.Conditions = append(obj.Status.Conditions, v3.MachineCondition{
+			Type:    v3.MachineConditionProvisioned,
+			Status:  v1.ConditionFalse,
+			Message: "quota exceeded",
+		})
+	}
+	if got := obj.Annotations[provisioningAttemptsAnnotation]; got != strconv.Itoa(3) {
+		t.Errorf("attempts are %q, want 3", got)
+	}
+	if failedForGood(obj) != true {
+		t.Errorf("machine is not failed for good after its retries: %v", obj.Status.Conditions)
+	}
+}
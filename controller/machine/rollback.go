@@ -0,0 +1,124 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// revisionSnapshotAnnotation on a machine template holds the content of
+	// the revision its pool last rolled out to as a JSON revisionSnapshot,
+	// and previousRevisionAnnotation that of the revision before it.
+	revisionSnapshotAnnotation = "io.cattle.machine.revision_snapshot"
+	previousRevisionAnnotation = "io.cattle.machine.previous_revision"
+
+	// rollbackAction on a machine template with a rollout strategy restores
+	// its previous revision, which rolls its pool back to it.
+	rollbackAction = "rollback"
+)
+
+// revisionSnapshot is the content of a machine template that makes up its
+// revision.
+type revisionSnapshot struct {
+	Revision    string                  `json:"revision"`
+	Spec        *v3.MachineTemplateSpec `json:"spec"`
+	Config      interface{}             `json:"config,omitempty"`
+	Annotations map[string]string       `json:"annotations,omitempty"`
+}
+
+func newRevisionSnapshot(template *v3.MachineTemplate, rawConfig interface{}) *revisionSnapshot {
+	annotations := map[string]string{}
+	for _, key := range templateAnnotations {
+		if value, ok := template.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	return &revisionSnapshot{
+		Revision:    templateRevision(template, rawConfig),
+		Spec:        template.Spec.DeepCopy(),
+		Config:      rawConfig,
+		Annotations: annotations,
+	}
+}
+
+// recordRevision records snapshot as the revision a pool rolls out to, and the
+// revision recorded before as the previous one.
+func recordRevision(template *v3.MachineTemplate, snapshot *revisionSnapshot) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	if current := template.Annotations[revisionSnapshotAnnotation]; current != "" {
+		template.Annotations[previousRevisionAnnotation] = current
+	}
+	data, _ := json.Marshal(snapshot)
+	template.Annotations[revisionSnapshotAnnotation] = string(data)
+}
+
+// rollback runs the rollback action of a machine template. The restored
+// revision is rolled out like any other change of the template; the machine
+// being replaced by a rollout in progress is of the restored revision and
+// kept.
+func (r *rolloutController) rollback(template *v3.MachineTemplate) error {
+	rawTemplate, err := r.lifecycle.machineTemplateGenericClient.Get(template.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	obj := rawTemplate.(*unstructured.Unstructured)
+
+	err = restoreRevision(template, obj)
+	if err != nil {
+		logrus.Errorf("Rollback of machine template %s failed: %v", template.Name, err)
+	} else {
+		logrus.Infof("Rolling back machine template %s to its previous revision", template.Name)
+	}
+	action.Complete(obj, rollbackAction, "", err)
+	_, err = r.lifecycle.machineTemplateGenericClient.Update(template.Name, obj)
+	return err
+}
+
+// restoreRevision replaces the spec, driver config and machine annotations of
+// the raw machine template obj with those of its previous revision.
+func restoreRevision(template *v3.MachineTemplate, obj *unstructured.Unstructured) error {
+	if template.Annotations[rolloutAnnotation] == "" {
+		return fmt.Errorf("machine template %s has no rollout strategy", template.Name)
+	}
+	data := template.Annotations[previousRevisionAnnotation]
+	if data == "" {
+		return fmt.Errorf("machine template %s has no previous revision", template.Name)
+	}
+	previous := &revisionSnapshot{}
+	if err := json.Unmarshal([]byte(data), previous); err != nil || previous.Spec == nil {
+		return fmt.Errorf("invalid %s annotation", previousRevisionAnnotation)
+	}
+
+	spec, err := convert.EncodeToMap(previous.Spec)
+	if err != nil {
+		return err
+	}
+	obj.Object["spec"] = spec
+	delete(obj.Object, template.Spec.Driver+"Config")
+	if previous.Config != nil {
+		obj.Object[previous.Spec.Driver+"Config"] = previous.Config
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for _, key := range templateAnnotations {
+		if value, ok := previous.Annotations[key]; ok {
+			annotations[key] = value
+		} else {
+			delete(annotations, key)
+		}
+	}
+	obj.SetAnnotations(annotations)
+	return nil
+}
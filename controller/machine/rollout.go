@@ -0,0 +1,535 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/controller/conditions"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// templateRevisionAnnotation on a machine is the revision of its machine
+	// template it was created from, a digest of the template spec, driver
+	// config and the annotations copied to machines.
+	templateRevisionAnnotation = "io.cattle.machine.template_revision"
+	// rolloutAnnotation on a machine template opts its pool into rolling
+	// updates: when the revision of the template changes its machines are
+	// replaced one at a time with machines of the new revision. The value is
+	// a JSON RolloutStrategy.
+	rolloutAnnotation = "io.cattle.machine.rollout"
+	// rolloutStatusAnnotation on a machine template tracks the rollout of its
+	// current revision as a JSON rolloutStatus.
+	rolloutStatusAnnotation = "io.cattle.machine.rollout_status"
+	// replacesAnnotation on a machine created by a rollout names the machine
+	// it replaces.
+	replacesAnnotation = "io.cattle.machine.replaces"
+
+	rolloutInterval = 15 * time.Second
+
+	rolloutCanary   = "canary"
+	rolloutRolling  = "rolling"
+	rolloutComplete = "complete"
+	rolloutHalted   = "halted"
+)
+
+var (
+	MachineTemplateConditionCanary    condition.Cond = "Canary"
+	MachineTemplateConditionRolledOut condition.Cond = "RolledOut"
+)
+
+// RolloutStrategy configures the rolling update of a pool. With Canary set
+// the first replacement is a canary: it has to provision, pass its first-boot
+// checks and stay ready for CanarySoak, e.g. "10m", before the rest of the
+// pool is replaced.
+type RolloutStrategy struct {
+	Canary     bool   `json:"canary"`
+	CanarySoak string `json:"canarySoak,omitempty"`
+}
+
+// rolloutStatus is the progress of the rollout of Revision. Old is the machine
+// being replaced by New, CanaryReady when the canary became ready.
+type rolloutStatus struct {
+	Revision    string `json:"revision"`
+	Phase       string `json:"phase"`
+	Old         string `json:"old,omitempty"`
+	New         string `json:"new,omitempty"`
+	CanaryReady string `json:"canaryReady,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// templateRevision returns the revision of a machine template with the raw
+// driver config rawConfig. Driver defaults are not part of it, they differ
+// between the machines of a template.
+func templateRevision(template *v3.MachineTemplate, rawConfig interface{}) string {
+	spec := template.Spec.DeepCopy()
+	if spec.EngineInstallURL == "" {
+		spec.EngineInstallURL = defaultEngineInstallURL
+	}
+	annotations := map[string]string{}
+	for _, key := range templateAnnotations {
+		if value, ok := template.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+
+	data, _ := json.Marshal(struct {
+		Spec        *v3.MachineTemplateSpec `json:"spec"`
+		Config      interface{}             `json:"config"`
+		Annotations map[string]string       `json:"annotations"`
+	}{spec, rawConfig, annotations})
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// rolloutController rolls the machines of pools with a rollout strategy over
+// to the current revision of their machine template, and publishes the
+// aggregate conditions of every pool.
+type rolloutController struct {
+	lifecycle      *Lifecycle
+	machines       v3.MachineLister
+	machineIndexer cache.Indexer
+}
+
+func (r *rolloutController) run() {
+	for range time.Tick(rolloutInterval) {
+		templates, err := r.templates()
+		if err != nil {
+			logrus.Errorf("Failed to list machine templates for rollouts: %v", err)
+			continue
+		}
+		for i := range templates {
+			template := &templates[i]
+			if template.DeletionTimestamp != nil {
+				continue
+			}
+			if _, ok := action.Pending(template, rollbackAction); ok {
+				if err := r.rollback(template); err != nil {
+					logrus.Errorf("Failed to save rollback of machine template %s: %v", template.Name, err)
+				}
+				continue
+			}
+			if err := r.sync(template); err != nil {
+				logrus.Errorf("Failed to update pool of machine template %s: %v", template.Name, err)
+			}
+		}
+	}
+}
+
+// templates lists all machine templates in pages.
+func (r *rolloutController) templates() ([]v3.MachineTemplate, error) {
+	var templates []v3.MachineTemplate
+	opts := metav1.ListOptions{Limit: schemastore.PageSize}
+	for {
+		list, err := r.lifecycle.machineTemplateClient.List(opts)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, list.Items...)
+		if list.Continue == "" {
+			return templates, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// sync advances the rollout of a machine template, scales its pool and
+// updates its pool conditions. Templates whose PoolSpec namespace is out of
+// scope are skipped.
+func (r *rolloutController) sync(orig *v3.MachineTemplate) error {
+	// The pool of a template in a namespace out of scope is synced by the
+	// controller managing that namespace, writing its conditions here too
+	// would flap them.
+	if spec, err := poolSpec(orig); err == nil && spec != nil && !r.lifecycle.namespaces.Contains(spec.Namespace) {
+		return nil
+	}
+
+	pool, err := r.pool(orig.Name)
+	if err != nil {
+		return err
+	}
+
+	template := orig.DeepCopy()
+	if template.Annotations[rolloutAnnotation] != "" {
+		if err := r.rollout(template, pool); err != nil {
+			logrus.Errorf("Rollout of machine template %s failed: %v", template.Name, err)
+		}
+	}
+	r.scale(template, pool)
+	setPoolConditions(template, pool)
+
+	// Pools are synced every rolloutInterval; the template is only written
+	// when its pool status or conditions changed.
+	if reflect.DeepEqual(orig.Annotations, template.Annotations) &&
+		reflect.DeepEqual(orig.Status.Conditions, template.Status.Conditions) {
+		return nil
+	}
+	conditions.SetTransitionTimes(orig, template)
+	return r.lifecycle.updateTemplate(orig, template)
+}
+
+// updateTemplate writes the annotations and conditions template changed from
+// orig to the machine template. It goes through the generic client, as the
+// typed MachineTemplate has no driver config and an update through the typed
+// client would drop it. Annotations and conditions are merged into the stored
+// template key by key, so changes made since orig was read are kept.
+func (m *Lifecycle) updateTemplate(orig, template *v3.MachineTemplate) error {
+	rawTemplate, err := m.machineTemplateGenericClient.Get(template.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	obj := rawTemplate.(*unstructured.Unstructured)
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for key, value := range template.Annotations {
+		if old, ok := orig.Annotations[key]; !ok || old != value {
+			annotations[key] = value
+		}
+	}
+	for key := range orig.Annotations {
+		if _, ok := template.Annotations[key]; !ok {
+			delete(annotations, key)
+		}
+	}
+	obj.SetAnnotations(annotations)
+
+	if err := mergeTemplateConditions(obj, orig.Status.Conditions, template.Status.Conditions); err != nil {
+		return err
+	}
+	_, err = m.machineTemplateGenericClient.Update(template.Name, obj)
+	return err
+}
+
+// mergeTemplateConditions replaces the conditions of the raw machine template
+// obj that changed from orig to updated, and removes those updated dropped.
+func mergeTemplateConditions(obj *unstructured.Unstructured, orig, updated []v3.MachineTemplateCondition) error {
+	changed := map[string]*v3.MachineTemplateCondition{}
+	for i := range updated {
+		cond := &updated[i]
+		if old := findTemplateCondition(orig, cond.Type); old == nil || *old != *cond {
+			changed[cond.Type] = cond
+		}
+	}
+	removed := map[string]bool{}
+	for _, cond := range orig {
+		if findTemplateCondition(updated, cond.Type) == nil {
+			removed[cond.Type] = true
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	stored, _ := values.GetValue(obj.Object, "status", "conditions")
+	var result []interface{}
+	for _, item := range convert.ToInterfaceSlice(stored) {
+		condType := convert.ToString(convert.ToMapInterface(item)["type"])
+		if removed[condType] {
+			continue
+		}
+		if cond, ok := changed[condType]; ok {
+			item = toUnstructuredCondition(cond)
+			delete(changed, condType)
+		}
+		if item != nil {
+			result = append(result, item)
+		}
+	}
+	for i := range updated {
+		if cond, ok := changed[updated[i].Type]; ok {
+			result = append(result, toUnstructuredCondition(cond))
+		}
+	}
+	values.PutValue(obj.Object, result, "status", "conditions")
+	return nil
+}
+
+func findTemplateCondition(conds []v3.MachineTemplateCondition, condType string) *v3.MachineTemplateCondition {
+	for i := range conds {
+		if conds[i].Type == condType {
+			return &conds[i]
+		}
+	}
+	return nil
+}
+
+func toUnstructuredCondition(cond *v3.MachineTemplateCondition) interface{} {
+	data, _ := json.Marshal(cond)
+	var result interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func (r *rolloutController) rollout(template *v3.MachineTemplate, pool []*v3.Machine) error {
+	strategy := RolloutStrategy{}
+	if err := json.Unmarshal([]byte(template.Annotations[rolloutAnnotation]), &strategy); err != nil {
+		return errors.Wrapf(err, "invalid %s annotation", rolloutAnnotation)
+	}
+	soak := time.Duration(0)
+	if strategy.CanarySoak != "" {
+		var err error
+		if soak, err = time.ParseDuration(strategy.CanarySoak); err != nil {
+			return errors.Wrapf(err, "invalid canarySoak")
+		}
+	}
+
+	snapshot, err := r.snapshot(template)
+	if err != nil {
+		return err
+	}
+	revision := snapshot.Revision
+
+	status := rolloutStatus{}
+	if data := template.Annotations[rolloutStatusAnnotation]; data != "" {
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			status = rolloutStatus{}
+		}
+	}
+
+	switch {
+	case status.Revision == "":
+		// Machines created before the pool opted into rollouts are taken
+		// to be of the current revision.
+		if err := r.stamp(pool, revision); err != nil {
+			return err
+		}
+		status = rolloutStatus{Revision: revision, Phase: rolloutComplete}
+		recordRevision(template, snapshot)
+		MachineTemplateConditionRolledOut.True(template)
+	case status.Revision != revision:
+		logrus.Infof("Rolling out revision %s of machine template %s", revision, template.Name)
+		recordRevision(template, snapshot)
+		status = rolloutStatus{Revision: revision, Phase: rolloutRolling}
+		if strategy.Canary {
+			status.Phase = rolloutCanary
+			MachineTemplateConditionCanary.Unknown(template)
+			MachineTemplateConditionCanary.Reason(template, "Provisioning")
+		}
+		MachineTemplateConditionRolledOut.Unknown(template)
+		MachineTemplateConditionRolledOut.Reason(template, "RollingOut")
+	case template.Annotations[revisionSnapshotAnnotation] == "":
+		// Pools that rolled out before revisions were recorded.
+		recordRevision(template, snapshot)
+	}
+
+	if status.Phase == rolloutCanary || status.Phase == rolloutRolling {
+		r.step(template, &status, pool, soak)
+	}
+
+	data, _ := json.Marshal(status)
+	template.Annotations[rolloutStatusAnnotation] = string(data)
+	return nil
+}
+
+// step advances a rollout in progress: it waits for the replacement being
+// provisioned, soaks the canary, removes replaced machines and starts the
+// next replacement.
+func (r *rolloutController) step(template *v3.MachineTemplate, status *rolloutStatus, pool []*v3.Machine, soak time.Duration) {
+	if status.New != "" {
+		replacement, err := r.get(status.New)
+		if err != nil {
+			r.halt(template, status, fmt.Sprintf("replacement machine %s: %v", status.New, err))
+			return
+		}
+		switch Phase(replacement) {
+		case PhaseFailed:
+			r.halt(template, status, fmt.Sprintf("replacement machine %s failed", status.New))
+			return
+		case PhaseReady:
+		default:
+			return
+		}
+
+		if status.Phase == rolloutCanary {
+			if status.CanaryReady == "" {
+				status.CanaryReady = time.Now().UTC().Format(time.RFC3339)
+			}
+			ready, _ := time.Parse(time.RFC3339, status.CanaryReady)
+			if time.Since(ready) < soak {
+				return
+			}
+			logrus.Infof("Canary %s of machine template %s passed, rolling out to the pool", status.New, template.Name)
+			MachineTemplateConditionCanary.True(template)
+			MachineTemplateConditionCanary.Reason(template, "")
+			status.Phase = rolloutRolling
+		}
+
+		if err := r.remove(status.Old); err != nil {
+			logrus.Errorf("Failed to remove machine %s replaced by %s: %v", status.Old, status.New, err)
+			return
+		}
+		status.Old, status.New = "", ""
+	}
+
+	var outdated []*v3.Machine
+	for _, machine := range pool {
+		if machine.Annotations[templateRevisionAnnotation] != status.Revision {
+			outdated = append(outdated, machine)
+		}
+	}
+	if len(outdated) == 0 {
+		logrus.Infof("Rolled out revision %s of machine template %s", status.Revision, template.Name)
+		status.Phase = rolloutComplete
+		MachineTemplateConditionRolledOut.True(template)
+		MachineTemplateConditionRolledOut.Reason(template, "")
+		return
+	}
+	sort.Slice(outdated, func(i, j int) bool {
+		return machineKey(outdated[i]) < machineKey(outdated[j])
+	})
+
+	old := outdated[0]
+	tmpl := template.Annotations[nameTemplateAnnotation]
+	if tmpl == "" {
+		tmpl = defaultReplacementNameTemplate
+	}
+	params := nameParams{
+		Pool:   template.Name,
+		Source: old.Name,
+		Kind:   "replacement",
+	}
+	seed := fmt.Sprintf("replacement/%s/%s", old.UID, status.Revision)
+	replacement, err := r.lifecycle.createGenerated(tmpl, params, seed, func(name string) *v3.Machine {
+		return replacementMachine(old, name)
+	})
+	if err != nil {
+		logrus.Errorf("Failed to create replacement of machine %s: %v", machineKey(old), err)
+		return
+	}
+	logrus.Infof("Replacing machine %s of machine template %s with %s", machineKey(old), template.Name, replacement.Name)
+	status.Old, status.New = machineKey(old), machineKey(replacement)
+}
+
+// halt stops a rollout with the machines replaced so far. It resumes once the
+// template changes again.
+func (r *rolloutController) halt(template *v3.MachineTemplate, status *rolloutStatus, message string) {
+	logrus.Errorf("Halting rollout of machine template %s: %s", template.Name, message)
+	if status.Phase == rolloutCanary {
+		MachineTemplateConditionCanary.False(template)
+		MachineTemplateConditionCanary.Reason(template, "CanaryFailed")
+	}
+	MachineTemplateConditionRolledOut.False(template)
+	MachineTemplateConditionRolledOut.Reason(template, "Halted")
+	status.Phase = rolloutHalted
+	status.Message = message
+}
+
+// snapshot returns the current revision of a machine template.
+func (r *rolloutController) snapshot(template *v3.MachineTemplate) (*revisionSnapshot, error) {
+	rawTemplate, err := r.lifecycle.machineTemplateGenericClient.Get(template.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rawConfig, _ := values.GetValue(rawTemplate.(*unstructured.Unstructured).Object, template.Spec.Driver+"Config")
+	return newRevisionSnapshot(template, rawConfig), nil
+}
+
+// pool returns the machines of a machine template in the namespaces of the
+// controller that are not being deleted.
+func (r *rolloutController) pool(templateName string) ([]*v3.Machine, error) {
+	objs, err := r.machineIndexer.ByIndex(MachineByTemplateIndex, templateName)
+	if err != nil {
+		return nil, err
+	}
+	var pool []*v3.Machine
+	for _, obj := range objs {
+		machine, ok := obj.(*v3.Machine)
+		if ok && machine.DeletionTimestamp == nil && r.lifecycle.namespaces.Contains(machine.Namespace) {
+			pool = append(pool, machine)
+		}
+	}
+	return pool, nil
+}
+
+// stamp records revision on the machines of a pool that have none.
+func (r *rolloutController) stamp(pool []*v3.Machine, revision string) error {
+	for _, machine := range pool {
+		if machine.Annotations[templateRevisionAnnotation] != "" {
+			continue
+		}
+		machine = machine.DeepCopy()
+		if machine.Annotations == nil {
+			machine.Annotations = map[string]string{}
+		}
+		machine.Annotations[templateRevisionAnnotation] = revision
+		if _, err := r.lifecycle.machineClient.Update(machine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rolloutController) get(key string) (*v3.Machine, error) {
+	namespace, name := splitMachineKey(key)
+	machine, err := r.machines.Get(namespace, name)
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("machine was removed")
+	}
+	return machine, err
+}
+
+func (r *rolloutController) remove(key string) error {
+	if key == "" {
+		return nil
+	}
+	namespace, name := splitMachineKey(key)
+	err := r.lifecycle.machineClient.DeleteNamespace(name, namespace, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// replacementMachine returns a machine named name that takes the place of old
+// in its pool.
+func replacementMachine(old *v3.Machine, name string) *v3.Machine {
+	replacement := &v3.Machine{}
+	replacement.Name = name
+	replacement.Namespace = old.Namespace
+	replacement.Labels = map[string]string{}
+	for k, v := range old.Labels {
+		if k != PhaseLabel {
+			replacement.Labels[k] = v
+		}
+	}
+	replacement.Annotations = map[string]string{
+		replacesAnnotation: machineKey(old),
+	}
+	copyMetadata(old, replacement)
+
+	replacement.Spec = *old.Spec.DeepCopy()
+	replacement.Spec.RequestedHostname = name
+	replacement.Spec.DisplayName = ""
+	replacement.Spec.NodeSpec.ProviderID = ""
+	replacement.Spec.NodeSpec.ExternalID = ""
+	replacement.Spec.NodeSpec.PodCIDR = ""
+	return replacement
+}
+
+// splitMachineKey returns the namespace and name of a machineKey.
+func splitMachineKey(key string) (string, string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
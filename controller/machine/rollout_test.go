@@ -0,0 +1,187 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+)
+
+func rolloutMachine(name, revision, phase string) *v3.Machine {
+	obj := &v3.Machine{}
+	obj.Namespace = "team-a"
+	obj.Name = name
+	obj.Annotations = map[string]string{templateRevisionAnnotation: revision}
+	obj.Spec.MachineTemplateName = "workers"
+	switch phase {
+	case PhaseReady:
+		obj.Status.Conditions = []v3.MachineCondition{
+			{Type: v3.MachineConditionInitialized, Status: v1.ConditionTrue},
+			{Type: v3.MachineConditionConfigReady, Status: v1.ConditionTrue},
+		}
+	case PhaseFailed:
+		obj.Status.Conditions = []v3.MachineCondition{{Type: v3.MachineConditionProvisioned, Status: v1.ConditionFalse}}
+	}
+	return obj
+}
+
+// rolloutTemplate returns a template with the conditions rollout sets when
+// the rollout of a revision starts in phase.
+func rolloutTemplate(phase string) *v3.MachineTemplate {
+	template := &v3.MachineTemplate{}
+	template.Name = "workers"
+	template.Annotations = map[string]string{}
+	template.Status.Conditions = []v3.MachineTemplateCondition{
+		{Type: string(MachineTemplateConditionRolledOut), Status: v1.ConditionUnknown, Reason: "RollingOut"},
+	}
+	if phase == rolloutCanary {
+		template.Status.Conditions = append(template.Status.Conditions, v3.MachineTemplateCondition{
+			Type: string(MachineTemplateConditionCanary), Status: v1.ConditionUnknown, Reason: "Provisioning",
+		})
+	}
+	return template
+}
+
+func templateCondition(template *v3.MachineTemplate, cond condition.Cond) (string, string) {
+	if c := findTemplateCondition(template.Status.Conditions, string(cond)); c != nil {
+		return string(c.Status), c.Reason
+	}
+	return "", ""
+}
+
+func TestRolloutStep(t *testing.T) {
+	ready := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name        string
+		phase       string
+		replacement string
+		canaryReady string
+		soak        time.Duration
+		pool        []*v3.Machine
+
+		wantPhase   string
+		removed     []string
+		replacing   bool
+		canary      string
+		canaryCause string
+		rolledOut   string
+	}{
+		{
+			name:        "canary fails",
+			phase:       rolloutCanary,
+			replacement: PhaseFailed,
+			pool:        []*v3.Machine{rolloutMachine("old", "r1", PhaseReady), rolloutMachine("other", "r1", PhaseReady)},
+			wantPhase:   rolloutHalted,
+			canary:      "False",
+			canaryCause: "CanaryFailed",
+			rolledOut:   "False",
+		},
+		{
+			name:        "canary provisioning",
+			phase:       rolloutCanary,
+			replacement: PhasePending,
+			pool:        []*v3.Machine{rolloutMachine("old", "r1", PhaseReady), rolloutMachine("other", "r1", PhaseReady)},
+			wantPhase:   rolloutCanary,
+			canary:      "Unknown",
+			canaryCause: "Provisioning",
+			rolledOut:   "Unknown",
+		},
+		{
+			name:        "canary soaking",
+			phase:       rolloutCanary,
+			replacement: PhaseReady,
+			soak:        10 * time.Minute,
+			pool:        []*v3.Machine{rolloutMachine("old", "r1", PhaseReady), rolloutMachine("other", "r1", PhaseReady)},
+			wantPhase:   rolloutCanary,
+			canary:      "Unknown",
+			canaryCause: "Provisioning",
+			rolledOut:   "Unknown",
+		},
+		{
+			name:        "canary ready proceeds",
+			phase:       rolloutCanary,
+			replacement: PhaseReady,
+			canaryReady: ready,
+			soak:        10 * time.Minute,
+			pool:        []*v3.Machine{rolloutMachine("new", "r2", PhaseReady), rolloutMachine("other", "r1", PhaseReady)},
+			wantPhase:   rolloutRolling,
+			removed:     []string{"team-a/old"},
+			replacing:   true,
+			canary:      "True",
+			rolledOut:   "Unknown",
+		},
+		{
+			name:        "replacement fails",
+			phase:       rolloutRolling,
+			replacement: PhaseFailed,
+			pool:        []*v3.Machine{rolloutMachine("old", "r1", PhaseReady)},
+			wantPhase:   rolloutHalted,
+			rolledOut:   "False",
+		},
+		{
+			name:        "last replacement ready",
+			phase:       rolloutRolling,
+			replacement: PhaseReady,
+			pool:        []*v3.Machine{rolloutMachine("new", "r2", PhaseReady)},
+			wantPhase:   rolloutComplete,
+			removed:     []string{"team-a/old"},
+			rolledOut:   "True",
+		},
+		{
+			name:      "replacement removed",
+			phase:     rolloutRolling,
+			pool:      []*v3.Machine{rolloutMachine("old", "r1", PhaseReady)},
+			wantPhase: rolloutHalted,
+			rolledOut: "False",
+		},
+	}
+	for _, test := range tests {
+		objs := []*v3.Machine{rolloutMachine("old", "r1", PhaseReady)}
+		if test.replacement != "" {
+			objs = append(objs, rolloutMachine("new", "r2", test.replacement))
+		}
+		machines := newFakeMachines(objs...)
+		r := &rolloutController{
+			lifecycle: &Lifecycle{logger: fakeLogger{}, machineClient: machines},
+			machines:  fakeMachineLister{machines: machines},
+		}
+		template := rolloutTemplate(test.phase)
+		status := &rolloutStatus{
+			Revision:    "r2",
+			Phase:       test.phase,
+			Old:         "team-a/old",
+			New:         "team-a/new",
+			CanaryReady: test.canaryReady,
+		}
+
+		r.step(template, status, test.pool, test.soak)
+
+		if status.Phase != test.wantPhase {
+			t.Errorf("%s: phase is %s, want %s", test.name, status.Phase, test.wantPhase)
+		}
+		if !reflect.DeepEqual(machines.deleted, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.name, machines.deleted, test.removed)
+		}
+		if test.wantPhase == rolloutHalted && status.Message == "" {
+			t.Errorf("%s: halted without a message", test.name)
+		}
+		if replacing := status.New != "" && status.New != "team-a/new"; replacing != test.replacing {
+			t.Errorf("%s: replacing %s, want a new replacement %v", test.name, status.New, test.replacing)
+		}
+		if test.replacing && status.Old != "team-a/other" {
+			t.Errorf("%s: replaces %s, want team-a/other", test.name, status.Old)
+		}
+		if status, reason := templateCondition(template, MachineTemplateConditionCanary); status != test.canary || reason != test.canaryCause {
+			t.Errorf("%s: Canary is %s %q, want %s %q", test.name, status, reason, test.canary, test.canaryCause)
+		}
+		if status, _ := templateCondition(template, MachineTemplateConditionRolledOut); status != test.rolledOut {
+			t.Errorf("%s: RolledOut is %s, want %s", test.name, status, test.rolledOut)
+		}
+		if test.name == "canary soaking" && status.CanaryReady == "" {
+			t.Errorf("%s: the time the canary became ready is not recorded", test.name)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// poolSpecAnnotation on a machine template makes the controller keep its
+	// pool at a number of machines. The value is a JSON PoolSpec.
+	poolSpecAnnotation = "io.cattle.machine.pool_spec"
+	// poolCreatedAnnotation on a machine template counts the machines the
+	// controller created for its pool. It seeds the names of new machines
+	// and is incremented before each machine is created, so no seed is used
+	// twice.
+	poolCreatedAnnotation = "io.cattle.machine.pool_created"
+
+	defaultPoolNameTemplate = "{{.Pool}}-{{.Suffix}}"
+)
+
+var (
+	// MachineTemplateConditionScaled is true while the pool of a machine
+	// template with a PoolSpec has the requested number of machines.
+	MachineTemplateConditionScaled condition.Cond = "Scaled"
+
+	// scaleDownOrder are the phases machines are removed from first when a
+	// pool is scaled down.
+	scaleDownOrder = map[string]int{
+		PhasePending:      0,
+		PhaseProvisioning: 1,
+		PhaseReady:        2,
+	}
+)
+
+// PoolSpec is the desired pool of a machine template: Quantity machines in
+// Namespace, created for the cluster ClusterName with the roles Role and the
+// labels Labels.
+type PoolSpec struct {
+	Quantity    int               `json:"quantity"`
+	Namespace   string            `json:"namespace,omitempty"`
+	ClusterName string            `json:"clusterName"`
+	Role        []string          `json:"role,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// poolSpec returns the PoolSpec of a machine template, or nil if it has none.
+func poolSpec(template *v3.MachineTemplate) (*PoolSpec, error) {
+	data := template.Annotations[poolSpecAnnotation]
+	if data == "" {
+		return nil, nil
+	}
+	spec := &PoolSpec{}
+	if err := json.Unmarshal([]byte(data), spec); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", poolSpecAnnotation)
+	}
+	if spec.Quantity < 0 {
+		return nil, fmt.Errorf("quantity of %s must not be negative", poolSpecAnnotation)
+	}
+	if spec.ClusterName == "" {
+		return nil, fmt.Errorf("%s must set clusterName", poolSpecAnnotation)
+	}
+	return spec, nil
+}
+
+// scale keeps the pool of a machine template with a PoolSpec at its
+// quantity: machines that failed for good are removed, one per sync, and
+// replaced, missing machines are created and surplus ones removed. Pools
+// are not scaled while a rollout replaces their machines.
+func (r *rolloutController) scale(template *v3.MachineTemplate, pool []*v3.Machine) {
+	spec, err := poolSpec(template)
+	if err != nil {
+		setTemplateCondition(template, MachineTemplateConditionScaled, "False", err.Error())
+		return
+	} else if spec == nil {
+		removeTemplateCondition(template, MachineTemplateConditionScaled)
+		return
+	}
+
+	rollout := rolloutStatus{}
+	json.Unmarshal([]byte(template.Annotations[rolloutStatusAnnotation]), &rollout)
+	if rollout.Phase == rolloutCanary || rollout.Phase == rolloutRolling {
+		return
+	}
+
+	var active, failed []*v3.Machine
+	for _, machine := range pool {
+		if failedForGood(machine) {
+			failed = append(failed, machine)
+		} else {
+			active = append(active, machine)
+		}
+	}
+
+	for _, machine := range failed {
+		if until, ok := keptUntil(machine); ok && time.Now().Before(until) {
+			continue
+		}
+		logrus.Infof("Replacing failed machine %s of machine template %s", machineKey(machine), template.Name)
+		if err := r.remove(machineKey(machine)); err != nil {
+			logrus.Errorf("Failed to remove failed machine %s: %v", machineKey(machine), err)
+		}
+		break
+	}
+
+	switch {
+	case len(active) < spec.Quantity:
+		for i := len(active); i < spec.Quantity; i++ {
+			machine, err := r.createPoolMachine(template, spec)
+			if err != nil {
+				setTemplateCondition(template, MachineTemplateConditionScaled, "False", err.Error())
+				return
+			}
+			logrus.Infof("Created machine %s for machine template %s", machineKey(machine), template.Name)
+			active = append(active, machine)
+		}
+	case len(active) > spec.Quantity:
+		sortScaleDown(active)
+		surplus := active[:len(active)-spec.Quantity]
+		for _, machine := range surplus {
+			logrus.Infof("Removing machine %s to scale machine template %s down to %d", machineKey(machine), template.Name, spec.Quantity)
+			if err := r.remove(machineKey(machine)); err != nil {
+				setTemplateCondition(template, MachineTemplateConditionScaled, "False", err.Error())
+				return
+			}
+		}
+		active = active[len(surplus):]
+	}
+
+	if len(failed) > 0 {
+		setTemplateCondition(template, MachineTemplateConditionScaled, "Unknown",
+			fmt.Sprintf("Replacing %d failed machines", len(failed)))
+		return
+	}
+	setTemplateCondition(template, MachineTemplateConditionScaled, "True", "")
+}
+
+// sortScaleDown orders the machines of a pool by the order they are removed
+// in when it is scaled down: by scaleDownOrder of their phase, the newest
+// first.
+func sortScaleDown(machines []*v3.Machine) {
+	sort.Slice(machines, func(i, j int) bool {
+		a, b := scaleDownOrder[Phase(machines[i])], scaleDownOrder[Phase(machines[j])]
+		if a != b {
+			return a < b
+		}
+		return machines[j].CreationTimestamp.Before(&machines[i].CreationTimestamp)
+	})
+}
+
+// createPoolMachine creates the next machine of a pool, owned by its machine
+// template.
+func (r *rolloutController) createPoolMachine(template *v3.MachineTemplate, spec *PoolSpec) (*v3.Machine, error) {
+	tmpl := template.Annotations[nameTemplateAnnotation]
+	if tmpl == "" {
+		tmpl = defaultPoolNameTemplate
+	}
+	created, err := r.reservePoolSeed(template)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reserve pool machine name")
+	}
+	params := nameParams{
+		Pool: template.Name,
+		Kind: "pool",
+	}
+	seed := fmt.Sprintf("pool/%s/%d", template.UID, created)
+	machine, err := r.lifecycle.createGenerated(tmpl, params, seed, func(name string) *v3.Machine {
+		return poolMachine(template, spec, name)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create pool machine")
+	}
+	return machine, nil
+}
+
+// reservePoolSeed increments poolCreatedAnnotation on the stored machine
+// template, before the machine is created, and returns the value it had.
+// Each seed is so used for a single machine even if the later update of the
+// template fails.
+func (r *rolloutController) reservePoolSeed(template *v3.MachineTemplate) (int, error) {
+	rawTemplate, err := r.lifecycle.machineTemplateGenericClient.Get(template.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	obj := rawTemplate.(*unstructured.Unstructured)
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	created, _ := strconv.Atoi(template.Annotations[poolCreatedAnnotation])
+	if stored, _ := strconv.Atoi(annotations[poolCreatedAnnotation]); stored > created {
+		created = stored
+	}
+	annotations[poolCreatedAnnotation] = strconv.Itoa(created + 1)
+	obj.SetAnnotations(annotations)
+	if _, err := r.lifecycle.machineTemplateGenericClient.Update(template.Name, obj); err != nil {
+		return 0, err
+	}
+	template.Annotations[poolCreatedAnnotation] = strconv.Itoa(created + 1)
+	return created, nil
+}
+
+// poolMachine returns a machine named name for the pool of a machine
+// template.
+func poolMachine(template *v3.MachineTemplate, spec *PoolSpec, name string) *v3.Machine {
+	machine := &v3.Machine{}
+	machine.Name = name
+	machine.Namespace = spec.Namespace
+	machine.Labels = map[string]string{}
+	for k, v := range spec.Labels {
+		machine.Labels[k] = v
+	}
+	machine.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: v3.MachineTemplateGroupVersionKind.GroupVersion().String(),
+		Kind:       v3.MachineTemplateGroupVersionKind.Kind,
+		Name:       template.Name,
+		UID:        template.UID,
+	}}
+	machine.Spec.MachineTemplateName = template.Name
+	machine.Spec.ClusterName = spec.ClusterName
+	machine.Spec.Role = append([]string{}, spec.Role...)
+	machine.Spec.RequestedHostname = name
+	return machine
+}
+
+// failedForGood returns whether a machine failed and will not be retried.
+func failedForGood(machine *v3.Machine) bool {
+	if Phase(machine) != PhaseFailed || machine.Annotations[retryAtAnnotation] != "" {
+		return false
+	}
+	return conditionStatus(machine, MachineConditionProvisionRetried) != "True"
+}
+
+func removeTemplateCondition(template *v3.MachineTemplate, cond condition.Cond) {
+	for i, c := range template.Status.Conditions {
+		if c.Type == string(cond) {
+			template.Status.Conditions = append(template.Status.Conditions[:i], template.Status.Conditions[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSortScaleDown(t *testing.T) {
+	now := time.Now()
+	machine := func(name string, age time.Duration, conds ...condition.Cond) *v3.Machine {
+		obj := &v3.Machine{}
+		obj.Name = name
+		obj.CreationTimestamp = metav1.NewTime(now.Add(-age))
+		for _, cond := range conds {
+			obj.Status.Conditions = append(obj.Status.Conditions, v3.MachineCondition{Type: cond, Status: v1.ConditionTrue})
+		}
+		return obj
+	}
+
+	tests := []struct {
+		name     string
+		machines []*v3.Machine
+		order    []string
+	}{
+		{
+			name: "by phase",
+			machines: []*v3.Machine{
+				machine("ready", time.Hour, v3.MachineConditionInitialized, v3.MachineConditionConfigReady),
+				machine("provisioning", time.Hour, v3.MachineConditionInitialized),
+				machine("pending", time.Hour),
+			},
+			order: []string{"pending", "provisioning", "ready"},
+		},
+		{
+			name: "newest first",
+			machines: []*v3.Machine{
+				machine("old", 2*time.Hour, v3.MachineConditionInitialized, v3.MachineConditionConfigReady),
+				machine("new", time.Minute, v3.MachineConditionInitialized, v3.MachineConditionConfigReady),
+				machine("older", 3*time.Hour, v3.MachineConditionInitialized, v3.MachineConditionConfigReady),
+			},
+			order: []string{"new", "old", "older"},
+		},
+		{
+			name: "phase before age",
+			machines: []*v3.Machine{
+				machine("new-ready", time.Minute, v3.MachineConditionInitialized, v3.MachineConditionConfigReady),
+				machine("old-pending", time.Hour),
+				machine("new-pending", time.Minute),
+			},
+			order: []string{"new-pending", "old-pending", "new-ready"},
+		},
+	}
+	for _, test := range tests {
+		sortScaleDown(test.machines)
+		var order []string
+		for _, machine := range test.machines {
+			order = append(order, machine.Name)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%s: got %v, want %v", test.name, order, test.order)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package machine
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// snapshotAction snapshots the disks of a machine through the snapshot
+	// hook of its driver. The input is passed to the hook unchanged, e.g. to
+	// select the disks.
+	snapshotAction = "snapshot"
+
+	snapshotHook        = "snapshot"
+	snapshotsAnnotation = "io.cattle.machine.snapshots"
+	maxSnapshots        = 10
+)
+
+// Snapshot is a set of disk snapshots taken together.
+type Snapshot struct {
+	Time      string   `json:"time"`
+	Snapshots []string `json:"snapshots"`
+}
+
+func (m *Lifecycle) snapshot(obj *v3.Machine) *v3.Machine {
+	args, ok := action.Pending(obj, snapshotAction)
+	if !ok {
+		return obj
+	}
+
+	output := struct {
+		Snapshots []string `json:"snapshots"`
+	}{}
+	err := m.runHook(obj, snapshotHook, args, &output)
+	if err == nil {
+		err = recordSnapshot(obj, output.Snapshots)
+		m.logger.Infof(obj, "Snapshotted machine %s: %s", obj.Name, strings.Join(output.Snapshots, ", "))
+	}
+	action.Complete(obj, snapshotAction, strings.Join(output.Snapshots, ","), err)
+	return obj
+}
+
+// Snapshots returns the snapshots recorded on a machine, oldest first.
+func Snapshots(obj *v3.Machine) []Snapshot {
+	var snapshots []Snapshot
+	if data := obj.Annotations[snapshotsAnnotation]; data != "" {
+		json.Unmarshal([]byte(data), &snapshots)
+	}
+	return snapshots
+}
+
+func recordSnapshot(obj *v3.Machine, ids []string) error {
+	snapshots := append(Snapshots(obj), Snapshot{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Snapshots: ids,
+	})
+	if len(snapshots) > maxSnapshots {
+		snapshots = snapshots[len(snapshots)-maxSnapshots:]
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[snapshotsAnnotation] = string(data)
+	return nil
+}
@@ -0,0 +1,85 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/sshclient"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// hostConfig is the part of the config docker-machine saves for a host that
+// is needed to connect to it.
+type hostConfig struct {
+	Driver struct {
+		IPAddress string
+		SSHUser   string
+		SSHPort   int
+	}
+}
+
+// sshRun runs command on the host of a machine and returns its combined output
+// and exit code. It connects to the address, port and user docker-machine
+// recorded for the host, with the SSH options of the machine on top, and gives
+// up after timeout unless it is zero.
+func sshRun(obj *v3.Machine, machineDir, command string, timeout time.Duration) ([]byte, int, error) {
+	opts, err := sshclient.Parse(obj.Annotations[sshclient.Annotation])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hostname := obj.Spec.RequestedHostname
+	host := hostConfig{}
+	data, err := ioutil.ReadFile(filepath.Join(machineDir, "machines", hostname, "config.json"))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read config of machine %s", hostname)
+	}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid config of machine %s", hostname)
+	}
+	address := host.Driver.IPAddress
+	if address == "" && obj.Status.NodeConfig != nil {
+		address = obj.Status.NodeConfig.Address
+	}
+	if address == "" {
+		return nil, 0, fmt.Errorf("machine %s has no address", hostname)
+	}
+	user := host.Driver.SSHUser
+	if user == "" {
+		user = obj.Status.SSHUser
+	}
+
+	key, err := getSSHPrivateKey(machineDir, obj)
+	if err != nil {
+		return nil, 0, err
+	}
+	if key == "" {
+		return nil, 0, fmt.Errorf("machine %s has no SSH key", hostname)
+	}
+
+	client, err := sshclient.Dial(address, host.Driver.SSHPort, user, []byte(key), opts)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to connect to machine %s", hostname)
+	}
+	defer client.Close()
+
+	if timeout <= 0 {
+		return sshclient.Run(client, command)
+	}
+
+	timedOut := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		close(timedOut)
+		client.Close()
+	})
+	out, exitCode, err := sshclient.Run(client, command)
+	if !timer.Stop() {
+		<-timedOut
+		return out, exitCode, fmt.Errorf("timeout after %v", timeout)
+	}
+	return out, exitCode, err
+}
@@ -0,0 +1,189 @@
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/sshclient"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// sshKeyTypeAnnotation on a machine, or on its machine template, selects
+	// the algorithm of the machine's SSH key: rsa-4096, ed25519 or ecdsa.
+	// The RSA key docker-machine generates is replaced with one of this type
+	// before the machine is bootstrapped. Without it the controller-wide
+	// --ssh-key-type applies.
+	sshKeyTypeAnnotation = "io.cattle.machine.ssh_key_type"
+
+	// rotateKeyAction replaces the SSH key of a provisioned machine. The input
+	// is the key type of the new key, or empty to keep the configured type.
+	rotateKeyAction = "rotate-key"
+
+	StepSSHKey = "ssh-key"
+)
+
+// replaceKey replaces the key docker-machine generated for a new machine with
+// one of the configured type.
+func replaceKey(p *Provisioning) error {
+	keyType := p.Machine.Annotations[sshKeyTypeAnnotation]
+	if keyType == "" {
+		return nil
+	}
+	if err := sshclient.ValidateKeyType(keyType); err != nil {
+		return err
+	}
+
+	current, err := getSSHKey(p.Config.Dir(), p.Machine)
+	if err != nil {
+		return err
+	}
+	if sshclient.HasKeyType([]byte(current), keyType) {
+		return nil
+	}
+
+	p.Logger.Infof(p.Machine, "Replacing SSH key of machine %s with a %s key", p.Machine.Spec.RequestedHostname, keyType)
+	return rotateKey(p.Machine, p.Config, keyType)
+}
+
+func (m *Lifecycle) rotateKeyAction(obj *v3.Machine) *v3.Machine {
+	keyType, ok := action.Pending(obj, rotateKeyAction)
+	if !ok {
+		return obj
+	}
+
+	err := m.rotateMachineKey(obj, strings.TrimSpace(keyType))
+	if err != nil {
+		m.logger.Errorf(obj, "Rotating SSH key of machine %s failed: %v", obj.Spec.RequestedHostname, err)
+	} else {
+		m.logger.Infof(obj, "Rotated SSH key of machine %s", obj.Spec.RequestedHostname)
+	}
+	action.Complete(obj, rotateKeyAction, "", err)
+	return obj
+}
+
+// rotateMachineKey replaces the key of a provisioned machine with a new one of
+// keyType, or of its configured type if keyType is empty, and records it in
+// the node config of the machine.
+func (m *Lifecycle) rotateMachineKey(obj *v3.Machine, keyType string) error {
+	if obj.Status.NodeConfig == nil {
+		return fmt.Errorf("machine %s is not provisioned", obj.Name)
+	}
+	if keyType == "" {
+		keyType = obj.Annotations[sshKeyTypeAnnotation]
+	}
+	if keyType == "" {
+		keyType = sshclient.KeyTypeRSA4096
+	}
+	if err := sshclient.ValidateKeyType(keyType); err != nil {
+		return err
+	}
+
+	config, err := machineconfig.NewMachineConfig(m.secretStore, obj)
+	if err != nil {
+		return err
+	}
+	defer config.Cleanup()
+	if err := config.Restore(); err != nil {
+		return err
+	}
+
+	if err := rotateKey(obj, config, keyType); err != nil {
+		return err
+	}
+	key, err := getSSHPrivateKey(config.Dir(), obj)
+	if err != nil {
+		return err
+	}
+	obj.Status.NodeConfig.SSHKey = key
+	// Keep the replaced key from being replaced again on the next run of the
+	// pipeline.
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[sshKeyTypeAnnotation] = keyType
+	return nil
+}
+
+// rotateKey authorizes a new key of keyType on the host of a machine with the
+// current key, switches the machine config to the new key once logging in
+// with it works, and then retires the old key on the host.
+func rotateKey(obj *v3.Machine, config *machineconfig.MachineConfig, keyType string) error {
+	keyPath := filepath.Join(config.Dir(), "machines", obj.Spec.RequestedHostname, "id_rsa")
+	oldKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read SSH key")
+	}
+	oldPublic, err := sshclient.AuthorizedKey(oldKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse SSH key")
+	}
+	newKey, newPublic, err := sshclient.GenerateKey(keyType)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate SSH key")
+	}
+
+	if err := runKeyCommand(obj, config.Dir(), authorizeKeyCommand(newPublic)); err != nil {
+		return errors.Wrap(err, "failed to authorize new SSH key")
+	}
+
+	if err := writeKey(keyPath, newKey, newPublic); err != nil {
+		return err
+	}
+	if err := runKeyCommand(obj, config.Dir(), "true"); err != nil {
+		// Keep using the old key, which is still authorized.
+		writeKey(keyPath, oldKey, oldPublic)
+		runKeyCommand(obj, config.Dir(), retireKeyCommand(newPublic))
+		return errors.Wrap(err, "failed to log in with new SSH key")
+	}
+
+	if err := runKeyCommand(obj, config.Dir(), retireKeyCommand(oldPublic)); err != nil {
+		return errors.Wrap(err, "failed to retire old SSH key")
+	}
+	return config.Save()
+}
+
+func writeKey(keyPath string, private []byte, public string) error {
+	if err := ioutil.WriteFile(keyPath, private, 0600); err != nil {
+		return errors.Wrap(err, "failed to write SSH key")
+	}
+	return ioutil.WriteFile(keyPath+".pub", []byte(public+"\n"), 0644)
+}
+
+func runKeyCommand(obj *v3.Machine, machineDir, command string) error {
+	out, exitCode, err := sshRun(obj, machineDir, command, 0)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: %s", exitCode, out)
+	}
+	return nil
+}
+
+// keyBlob returns the base64 key of an authorized_keys line, which identifies
+// it regardless of its comment. It only contains characters safe to quote.
+func keyBlob(authorizedKey string) string {
+	fields := strings.Fields(authorizedKey)
+	if len(fields) < 2 {
+		return authorizedKey
+	}
+	return fields[1]
+}
+
+func authorizeKeyCommand(public string) string {
+	return fmt.Sprintf(`umask 077; mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && `+
+		`(grep -qF '%s' ~/.ssh/authorized_keys || echo '%s' >> ~/.ssh/authorized_keys)`, keyBlob(public), public)
+}
+
+// retireKeyCommand removes a key from authorized_keys, rewriting the file in
+// place to keep its owner and mode. The file is left alone if grep fails.
+func retireKeyCommand(public string) string {
+	return fmt.Sprintf(`f=~/.ssh/authorized_keys; grep -vF '%s' "$f" > "$f.new"; `+
+		`[ $? -le 1 ] && cat "$f.new" > "$f"; s=$?; rm -f "$f.new"; exit $s`, keyBlob(public))
+}
@@ -0,0 +1,64 @@
+package machine
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/hook"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// storageDetachTimeoutAnnotation on a machine, or on its machine
+	// template, is how long the storage-detach hook of its driver may run,
+	// e.g. "10m".
+	storageDetachTimeoutAnnotation = "io.cattle.machine.storage_detach_timeout"
+	// storageDetachPolicyAnnotation on a machine, or on its machine template,
+	// selects what happens when the storage-detach hook fails or times out:
+	// "retry", the default, keeps the instance and retries the removal, and
+	// "continue" deletes the instance anyway.
+	storageDetachPolicyAnnotation = "io.cattle.machine.storage_detach_policy"
+
+	storageDetachHook = "storage-detach"
+
+	storageDetachContinue = "continue"
+
+	defaultStorageDetachTimeout = 5 * time.Minute
+)
+
+func storageDetachTimeout(obj *v3.Machine) time.Duration {
+	d, err := time.ParseDuration(obj.Annotations[storageDetachTimeoutAnnotation])
+	if err != nil || d <= 0 {
+		return defaultStorageDetachTimeout
+	}
+	return d
+}
+
+// detachStorage runs the storage-detach hook of the driver of a machine, if
+// any, before its instance is deleted, so volumes are detached cleanly
+// instead of staying attached to a terminated instance. The hook may run
+// again if a later step of the removal fails and must be idempotent.
+func (m *Lifecycle) detachStorage(obj *v3.Machine, config *machineconfig.MachineConfig) error {
+	exists, err := machineExists(config.Dir(), obj.Spec.RequestedHostname)
+	if err != nil || !exists {
+		return err
+	}
+
+	h, err := hook.Lookup(m.configMapGetter, obj.Status.MachineTemplateSpec.Driver, storageDetachHook)
+	if err != nil || h == nil {
+		return err
+	}
+	h.Timeout = storageDetachTimeout(obj)
+
+	err = runHook(h, obj, config, "", nil)
+	if err == nil {
+		m.logger.Infof(obj, "Detached storage of machine %s", obj.Spec.RequestedHostname)
+		return nil
+	}
+	if obj.Annotations[storageDetachPolicyAnnotation] == storageDetachContinue {
+		m.logger.Errorf(obj, "Failed to detach storage of machine %s, deleting it anyway: %v", obj.Spec.RequestedHostname, err)
+		return nil
+	}
+	return errors.Wrap(err, "failed to detach storage")
+}
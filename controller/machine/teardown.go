@@ -0,0 +1,39 @@
+package machine
+
+import (
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// forceDeleteAnnotation set to true on a machine that is being deleted
+	// lets the deletion finish even if its cloud resources cannot be torn
+	// down, e.g. because they are already gone or the account was closed.
+	// Whatever could not be removed is left behind.
+	forceDeleteAnnotation = "io.cattle.machine.force_delete"
+)
+
+// teardown removes the cloud resources of a machine that is deleted: its load
+// balancer registration, its volumes, the docker-machine host and the
+// leftovers of failed provisions, and its reserved address. Unless force is
+// set it stops at the first step that fails; with force every step is tried
+// and failures are only reported.
+func (m *Lifecycle) teardown(obj *v3.Machine, config *machineconfig.MachineConfig, force bool) error {
+	steps := []func() error{
+		func() error { return m.deregisterLoadBalancer(obj, config) },
+		func() error { return m.detachStorage(obj, config) },
+		func() error { return m.collectGarbage(obj, config) },
+		func() error { return m.releaseAddress(obj) },
+	}
+	for _, step := range steps {
+		err := step()
+		if err == nil {
+			continue
+		}
+		if !force {
+			return err
+		}
+		m.logger.Errorf(obj, "Force deleting machine %s, leaving behind what failed to be removed: %v", obj.Spec.RequestedHostname, err)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// templateAction extracts the driver config of a machine into a new
+	// machine template. The input is the name of the template, or empty to
+	// use "<machine>-template".
+	templateAction = "template"
+
+	// secretRefPrefix marks a driver config value stored in a Secret in
+	// cattle-system, as "secret://<name>/<key>".
+	secretRefPrefix = "secret://"
+	// driverSecretLabel set to "true" allows a Secret in cattle-system to be
+	// referenced from driver configs. Secrets owned by the machine template
+	// of a machine can be referenced without it.
+	driverSecretLabel = "io.cattle.machine.driver_secret"
+
+	// credentialProfileAnnotation on a machine, or on its machine template,
+	// selects a profile within the referenced Secrets, such as a region or
+	// account. Keys "<profile>.<key>" then take precedence over "<key>", and
+	// the other keys of the profile set the config field they name.
+	credentialProfileAnnotation = "io.cattle.machine.credential_profile"
+)
+
+var (
+	// profileFields are the driver config fields selecting the credential
+	// profile of a machine that has no explicit one, for drivers whose
+	// credentials are scoped to e.g. a datacenter.
+	profileFields = map[string]string{
+		"vmwarevsphere": "datacenter",
+	}
+
+	invalidSecretKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+)
+
+// credentialProfile returns the credential profile of a machine: the one
+// selected by annotation, or the value of the profile field of its driver.
+func credentialProfile(obj *v3.Machine, config map[string]interface{}) string {
+	if profile := obj.Annotations[credentialProfileAnnotation]; profile != "" {
+		return profile
+	}
+	if obj.Status.MachineTemplateSpec == nil {
+		return ""
+	}
+	field, ok := profileFields[obj.Status.MachineTemplateSpec.Driver]
+	if !ok {
+		return ""
+	}
+	value, _ := config[field].(string)
+	return invalidSecretKeyChars.ReplaceAllString(strings.Trim(value, "/"), "-")
+}
+
+func (m *Lifecycle) template(obj *v3.Machine) *v3.Machine {
+	name, ok := action.Pending(obj, templateAction)
+	if !ok {
+		return obj
+	}
+
+	if name == "" {
+		name = obj.Name + "-template"
+	}
+
+	err := m.createTemplate(obj, name)
+	output := ""
+	if err == nil {
+		output = name
+		m.logger.Infof(obj, "Created machine template %s from machine %s", name, obj.Name)
+	}
+	action.Complete(obj, templateAction, output, err)
+	return obj
+}
+
+// createTemplate creates the machine template name from the resolved driver
+// config of obj. Instance specific fields are dropped and credentials are
+// moved into a Secret of the same name that the template refers to.
+func (m *Lifecycle) createTemplate(obj *v3.Machine, name string) error {
+	if obj.Status.MachineTemplateSpec == nil || obj.Status.MachineDriverConfig == "" {
+		return fmt.Errorf("machine %s has no driver config to convert", obj.Name)
+	}
+
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &config); err != nil {
+		return errors.Wrap(err, "failed to unmarshal machine config")
+	}
+
+	secret := &v1.Secret{
+		Data: map[string][]byte{},
+	}
+	secret.Name = name
+	secret.Namespace = policyNamespace
+	secret.Labels = map[string]string{
+		driverSecretLabel: "true",
+	}
+	for key, value := range config {
+		switch {
+		case dockermachine.IsInstanceField(key):
+			delete(config, key)
+		case dockermachine.IsCredentialField(key):
+			s := convert.ToString(value)
+			if s == "" || strings.HasPrefix(s, secretRefPrefix) {
+				continue
+			}
+			secret.Data[key] = []byte(s)
+			config[key] = secretRefPrefix + name + "/" + key
+		}
+	}
+
+	spec, err := convert.EncodeToMap(obj.Status.MachineTemplateSpec)
+	if err != nil {
+		return err
+	}
+
+	template := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": spec,
+			obj.Status.MachineTemplateSpec.Driver + "Config": config,
+		},
+	}
+
+	if len(secret.Data) > 0 {
+		if _, err := m.secrets.Secrets(policyNamespace).Create(secret); err != nil {
+			return errors.Wrapf(err, "failed to create secret %s", name)
+		}
+	}
+
+	if _, err := m.machineTemplateGenericClient.Create(template); err != nil {
+		if len(secret.Data) > 0 && !apierrors.IsAlreadyExists(err) {
+			m.secrets.Secrets(policyNamespace).Delete(name, nil)
+		}
+		return errors.Wrapf(err, "failed to create machine template %s", name)
+	}
+	return nil
+}
+
+// resolveSecretRefs replaces the secret references in a driver config with
+// the values they point to, in the selected credential profile, and records
+// the Secrets used on obj. Only Secrets that are labeled driverSecretLabel or
+// owned by the machine template of obj are read, whether the reference comes
+// from the template or from driver defaults, so other Secrets in
+// cattle-system cannot be read into a driver config.
+func (m *Lifecycle) resolveSecretRefs(obj *v3.Machine, config map[string]interface{}) error {
+	profile := credentialProfile(obj, config)
+	secrets := map[string]*v1.Secret{}
+	refFields := map[string]bool{}
+	for key, value := range config {
+		s, ok := value.(string)
+		if !ok || !strings.HasPrefix(s, secretRefPrefix) {
+			continue
+		}
+		refFields[key] = true
+
+		parts := strings.SplitN(strings.TrimPrefix(s, secretRefPrefix), "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid secret reference %q for field %s", s, key)
+		}
+
+		secret := secrets[parts[0]]
+		if secret == nil {
+			var err error
+			secret, err = m.secrets.Secrets(policyNamespace).Get(parts[0], metav1.GetOptions{})
+			if err != nil {
+				return errors.Wrapf(err, "failed to get secret %s for field %s", parts[0], key)
+			}
+			if !driverSecret(secret, obj.Spec.MachineTemplateName) {
+				return fmt.Errorf("secret %s for field %s is neither labeled %s=true nor owned by machine template %s",
+					parts[0], key, driverSecretLabel, obj.Spec.MachineTemplateName)
+			}
+			secrets[parts[0]] = secret
+		}
+		data, ok := secret.Data[profile+"."+parts[1]]
+		if !ok || profile == "" {
+			data, ok = secret.Data[parts[1]]
+		}
+		if !ok {
+			return fmt.Errorf("secret %s has no key %s for field %s", parts[0], parts[1], key)
+		}
+		config[key] = string(data)
+	}
+
+	if len(secrets) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if profile != "" {
+		for _, name := range names {
+			for key, data := range secrets[name].Data {
+				field := strings.TrimPrefix(key, profile+".")
+				if field != key && !refFields[field] {
+					config[field] = string(data)
+				}
+			}
+		}
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[credentialsAnnotation] = strings.Join(names, ",")
+	return nil
+}
+
+// driverSecret returns whether secret may be referenced from the driver
+// config of machines created from the machine template templateName.
+func driverSecret(secret *v1.Secret, templateName string) bool {
+	if secret.Labels[driverSecretLabel] == "true" {
+		return true
+	}
+	for _, owner := range secret.OwnerReferences {
+		if owner.Kind == v3.MachineTemplateGroupVersionKind.Kind && owner.Name == templateName && templateName != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package machine
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rancher/machine-controller/controller/action"
+	machineconfig "github.com/rancher/machine-controller/store/config"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// terraformAction exports a provisioned machine as a Terraform import
+	// block and a resource stub, so the instance can be adopted by Terraform
+	// without being recreated. The output is the HCL.
+	terraformAction = "terraform"
+
+	// terraformResourceAnnotation on a MachineDriver names the Terraform
+	// resource type of its instances and terraformIDAnnotation the import ID,
+	// with {Field} standing for a field of the docker-machine driver state,
+	// for drivers not in defaultTerraformResources.
+	terraformResourceAnnotation = "io.cattle.machine_driver.terraform_resource"
+	terraformIDAnnotation       = "io.cattle.machine_driver.terraform_id"
+)
+
+var (
+	defaultTerraformResources = map[string]string{
+		"amazonec2":    "aws_instance",
+		"azure":        "azurerm_linux_virtual_machine",
+		"digitalocean": "digitalocean_droplet",
+		"google":       "google_compute_instance",
+		"openstack":    "openstack_compute_instance_v2",
+	}
+	defaultTerraformIDs = map[string]string{
+		"amazonec2":    "{InstanceId}",
+		"azure":        "/subscriptions/{SubscriptionID}/resourceGroups/{ResourceGroup}/providers/Microsoft.Compute/virtualMachines/{MachineName}",
+		"digitalocean": "{DropletID}",
+		"google":       "projects/{Project}/zones/{Zone}/instances/{MachineName}",
+		"openstack":    "{MachineId}",
+	}
+	// terraformAttributes map the arguments of the resource stubs of known
+	// drivers to fields of the docker-machine driver state.
+	terraformAttributes = map[string]map[string]string{
+		"amazonec2": {
+			"ami":           "AMI",
+			"instance_type": "InstanceType",
+			"subnet_id":     "SubnetId",
+		},
+		"azure": {
+			"name":                "MachineName",
+			"resource_group_name": "ResourceGroup",
+			"location":            "Location",
+			"size":                "Size",
+		},
+		"digitalocean": {
+			"name":   "MachineName",
+			"image":  "Image",
+			"region": "Region",
+			"size":   "Size",
+		},
+		"google": {
+			"name":         "MachineName",
+			"zone":         "Zone",
+			"machine_type": "MachineType",
+		},
+		"openstack": {
+			"name":        "MachineName",
+			"flavor_name": "FlavorName",
+			"image_name":  "ImageName",
+		},
+	}
+
+	terraformPlaceholder      = regexp.MustCompile(`\{[A-Za-z0-9_]+\}`)
+	invalidTerraformNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+func (m *Lifecycle) terraform(obj *v3.Machine) *v3.Machine {
+	if _, ok := action.Pending(obj, terraformAction); !ok {
+		return obj
+	}
+
+	output, err := m.exportTerraform(obj)
+	action.Complete(obj, terraformAction, output, err)
+	return obj
+}
+
+// exportTerraform returns the import block and resource stub of the instance
+// of a machine, read from its docker-machine driver state.
+func (m *Lifecycle) exportTerraform(obj *v3.Machine) (string, error) {
+	if obj.Status.MachineTemplateSpec == nil || conditionStatus(obj, v3.MachineConditionProvisioned) != "True" {
+		return "", fmt.Errorf("machine %s is not provisioned", obj.Name)
+	}
+	driver := obj.Status.MachineTemplateSpec.Driver
+
+	resource, err := m.driverField(driver, terraformResourceAnnotation, defaultTerraformResources)
+	if err != nil {
+		return "", err
+	}
+	idFormat, err := m.driverField(driver, terraformIDAnnotation, defaultTerraformIDs)
+	if err != nil {
+		return "", err
+	}
+	if resource == "" || idFormat == "" {
+		return "", fmt.Errorf("machine driver %s has no known Terraform resource", driver)
+	}
+
+	config, err := machineconfig.NewMachineConfig(m.secretStore, obj)
+	if err != nil {
+		return "", err
+	}
+	defer config.Cleanup()
+	state, err := config.DriverConfig()
+	if err != nil {
+		return "", err
+	}
+	if state == nil {
+		return "", fmt.Errorf("machine %s has no driver state", obj.Name)
+	}
+
+	var missing []string
+	id := terraformPlaceholder.ReplaceAllStringFunc(idFormat, func(placeholder string) string {
+		field := strings.Trim(placeholder, "{}")
+		value := convert.ToString(state[field])
+		if value == "" {
+			missing = append(missing, field)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("driver state of machine %s has no %s", obj.Name, strings.Join(missing, ", "))
+	}
+
+	return renderTerraform(resource, terraformName(obj.Name), id, terraformArguments(driver, state)), nil
+}
+
+// terraformArguments returns the arguments of the resource stub of a driver
+// that are set in the driver state.
+func terraformArguments(driver string, state map[string]interface{}) map[string]string {
+	args := map[string]string{}
+	for arg, field := range terraformAttributes[driver] {
+		if value := convert.ToString(state[field]); value != "" {
+			args[arg] = value
+		}
+	}
+	return args
+}
+
+// terraformName turns a machine name into a Terraform resource name.
+func terraformName(name string) string {
+	name = invalidTerraformNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') || name[0] == '-' {
+		name = "machine_" + name
+	}
+	return name
+}
+
+func renderTerraform(resource, name, id string, args map[string]string) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "import {\n  to = %s.%s\n  id = %q\n}\n\n", resource, name, id)
+	fmt.Fprintf(b, "resource %q %q {\n", resource, name)
+
+	var keys []string
+	width := 0
+	for key := range args {
+		keys = append(keys, key)
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "  %-*s = %q\n", width, key, args[key])
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -8,29 +8,22 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/dockermachine"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-var regExHyphen = regexp.MustCompile("([a-z])([A-Z])")
-
-var (
-	RegExMachineDirEnv      = regexp.MustCompile("^" + machineDirEnvKey + ".*")
-	RegExMachinePluginToken = regexp.MustCompile("^" + "MACHINE_PLUGIN_TOKEN=" + ".*")
-	RegExMachineDriverName  = regexp.MustCompile("^" + "MACHINE_PLUGIN_DRIVER_NAME=" + ".*")
-)
-
 const (
 	errorCreatingMachine = "Error creating machine: "
-	machineDirEnvKey     = "MACHINE_STORAGE_PATH="
-	machineCmd           = "docker-machine"
+	// heartbeatAnnotation is refreshed while a machine is provisioned, so
+	// clients can tell a stuck provision from a slow one.
+	heartbeatAnnotation         = "io.cattle.machine.heartbeat"
+	defaultStatusUpdateInterval = 10 * time.Second
 )
 
 func buildCreateCommand(machine *v3.Machine, configMap map[string]interface{}) []string {
@@ -45,25 +38,8 @@ func buildCreateCommand(machine *v3.Machine, configMap map[string]interface{}) [
 	cmd = append(cmd, buildEngineOpts("--engine-registry-mirror", machine.Status.MachineTemplateSpec.EngineRegistryMirror)...)
 	cmd = append(cmd, buildEngineOpts("--engine-storage-driver", []string{machine.Status.MachineTemplateSpec.EngineStorageDriver})...)
 
-	for k, v := range configMap {
-		dmField := "--" + sDriver + "-" + strings.ToLower(regExHyphen.ReplaceAllString(k, "${1}-${2}"))
-		switch v.(type) {
-		case int64:
-			cmd = append(cmd, dmField, strconv.FormatInt(v.(int64), 10))
-		case string:
-			cmd = append(cmd, dmField, v.(string))
-		case bool:
-			if v.(bool) {
-				cmd = append(cmd, dmField, strconv.FormatBool(v.(bool)))
-			}
-		case []string:
-			for _, s := range v.([]string) {
-				cmd = append(cmd, dmField, s)
-			}
-		}
-	}
+	cmd = append(cmd, dockermachine.DriverFlags(sDriver, configMap)...)
 	logrus.Debugf("create cmd %v", cmd)
-	cmd = append(cmd, machine.Spec.RequestedHostname)
 	return cmd
 }
 
@@ -86,34 +62,6 @@ func mapToSlice(m map[string]string) []string {
 	return ret
 }
 
-func buildCommand(machineDir string, cmdArgs []string) *exec.Cmd {
-	command := exec.Command(machineCmd, cmdArgs...)
-	env := initEnviron(machineDir)
-	command.Env = env
-	return command
-}
-
-func initEnviron(machineDir string) []string {
-	env := os.Environ()
-	found := false
-	for idx, ev := range env {
-		if RegExMachineDirEnv.MatchString(ev) {
-			env[idx] = machineDirEnvKey + machineDir
-			found = true
-		}
-		if RegExMachinePluginToken.MatchString(ev) {
-			env[idx] = ""
-		}
-		if RegExMachineDriverName.MatchString(ev) {
-			env[idx] = ""
-		}
-	}
-	if !found {
-		env = append(env, machineDirEnvKey+machineDir)
-	}
-	return env
-}
-
 func startReturnOutput(command *exec.Cmd) (io.ReadCloser, io.ReadCloser, error) {
 	readerStdout, err := command.StdoutPipe()
 	if err != nil {
@@ -142,30 +90,97 @@ func getSSHKey(machineDir string, obj *v3.Machine) (string, error) {
 	return getSSHPrivateKey(machineDir, obj)
 }
 
-func (m *Lifecycle) reportStatus(stdoutReader io.Reader, stderrReader io.Reader, machine *v3.Machine) (*v3.Machine, error) {
-	scanner := bufio.NewScanner(stdoutReader)
-	for scanner.Scan() {
-		msg := scanner.Text()
-		logrus.Infof("stdout: %s", msg)
-		_, err := filterDockerMessage(msg, machine)
-		if err != nil {
-			return machine, err
+// reportStatus follows the output of docker-machine create. Progress messages
+// are coalesced into at most one update per status interval, and the heartbeat
+// annotation is refreshed at that interval even when the driver is silent.
+// Output on stdout and stderr is collected in log, the first line on stderr is
+// returned as error.
+func (m *Lifecycle) reportStatus(stdoutReader io.Reader, stderrReader io.Reader, machine *v3.Machine, log *provisionLog) (*v3.Machine, error) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdoutReader)
+		for scanner.Scan() {
+			lines <- scanner.Text()
 		}
-		m.logger.Info(machine, msg)
-		v3.MachineConditionProvisioned.Message(machine, msg)
-		// ignore update errors
-		if newObj, err := m.machineClient.Update(machine); err == nil {
-			machine = newObj
-		} else {
-			machine, _ = m.machineClient.Get(machine.Name, metav1.GetOptions{})
+	}()
+
+	// stderr is read while stdout is, so a driver writing a lot to it does
+	// not block.
+	var stderrErr error
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderrReader)
+		for scanner.Scan() {
+			msg := scanner.Text()
+			if stderrErr == nil {
+				stderrErr = errors.New(msg)
+			}
+			log.add(msg)
+		}
+	}()
+
+	ticker := time.NewTicker(m.statusInterval())
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case msg, ok := <-lines:
+			if !ok {
+				done = true
+				break
+			}
+			logrus.Infof("stdout: %s", msg)
+			log.add(msg)
+			_, err := filterDockerMessage(msg, machine)
+			if err != nil {
+				go drain(lines)
+				m.saveProvisionLog(machine, log)
+				return machine, err
+			}
+			m.logger.Info(machine, msg)
+			v3.MachineConditionProvisioned.Message(machine, msg)
+		case <-ticker.C:
+			m.saveProvisionLog(machine, log)
+			machine = m.updateStatus(machine)
 		}
 	}
-	scanner = bufio.NewScanner(stderrReader)
-	for scanner.Scan() {
-		msg := scanner.Text()
-		return machine, errors.New(msg)
+	<-stderrDone
+	m.saveProvisionLog(machine, log)
+	machine = m.updateStatus(machine)
+
+	return machine, stderrErr
+}
+
+func drain(lines <-chan string) {
+	for range lines {
+	}
+}
+
+// updateStatus persists the provisioning progress of machine together with a
+// fresh heartbeat.
+func (m *Lifecycle) updateStatus(machine *v3.Machine) *v3.Machine {
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+	machine.Annotations[heartbeatAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	// ignore update errors
+	if newObj, err := m.machineClient.Update(machine); err == nil {
+		return newObj
+	}
+	if newObj, err := m.machineClient.Get(machine.Name, metav1.GetOptions{}); err == nil {
+		return newObj
+	}
+	return machine
+}
+
+func (m *Lifecycle) statusInterval() time.Duration {
+	if m.statusUpdateInterval > 0 {
+		return m.statusUpdateInterval
 	}
-	return machine, nil
+	return defaultStatusUpdateInterval
 }
 
 func filterDockerMessage(msg string, machine *v3.Machine) (string, error) {
@@ -179,7 +194,7 @@ func filterDockerMessage(msg string, machine *v3.Machine) (string, error) {
 }
 
 func machineExists(machineDir string, name string) (bool, error) {
-	command := buildCommand(machineDir, []string{"ls", "-q"})
+	command := dockermachine.Command(machineDir, []string{"ls", "-q"})
 	r, err := command.StdoutPipe()
 	if err != nil {
 		return false, err
@@ -210,7 +225,8 @@ func machineExists(machineDir string, name string) (bool, error) {
 }
 
 func deleteMachine(machineDir string, machine *v3.Machine) error {
-	command := buildCommand(machineDir, []string{"rm", "-f", machine.Spec.RequestedHostname})
+	command := dockermachine.Command(machineDir, []string{"rm", "-f", machine.Spec.RequestedHostname})
+	workloadIdentityEnv(machine, command)
 	err := command.Start()
 	if err != nil {
 		return err
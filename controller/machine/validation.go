@@ -0,0 +1,154 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/rancher/machine-controller/policy"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var (
+	// MachineTemplateConditionConfigValid is true once the driver config of
+	// a machine template passed the DynamicSchema of its driver and false
+	// with the first violation as reason otherwise.
+	MachineTemplateConditionConfigValid condition.Cond = "ConfigValid"
+)
+
+// templateValidator validates the driver config of machine templates when
+// they are created or changed, so an invalid template is reported on the
+// template instead of failing each machine created from it. The defaults of
+// the schema count as set but are not written to the template, as changing
+// its config would change its revision and roll out its pool; they are set
+// on the config of each machine instead.
+type templateValidator struct {
+	lifecycle *Lifecycle
+}
+
+func (v *templateValidator) sync(key string, template *v3.MachineTemplate) error {
+	if template == nil || template.DeletionTimestamp != nil {
+		return nil
+	}
+
+	rawTemplate, err := v.lifecycle.machineTemplateGenericClient.Get(template.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	obj := rawTemplate.(*unstructured.Unstructured)
+
+	status, reason, err := v.validate(template, obj)
+	if err != nil {
+		return err
+	}
+
+	updated := template.DeepCopy()
+	setTemplateCondition(updated, MachineTemplateConditionConfigValid, status, reason)
+	conditions.SetTransitionTimes(template, updated)
+	if conditionsEqual(template.Status.Conditions, updated.Status.Conditions) {
+		return nil
+	}
+	data, err := json.Marshal(updated.Status.Conditions)
+	if err != nil {
+		return err
+	}
+	var conds []interface{}
+	if err := json.Unmarshal(data, &conds); err != nil {
+		return err
+	}
+	values.PutValue(obj.Object, conds, "status", "conditions")
+	_, err = v.lifecycle.machineTemplateGenericClient.Update(template.Name, obj)
+	return err
+}
+
+// validate checks the driver config of the raw machine template obj. It
+// returns the status and reason of MachineTemplateConditionConfigValid.
+func (v *templateValidator) validate(template *v3.MachineTemplate, obj *unstructured.Unstructured) (string, string, error) {
+	if v.lifecycle.multiTenancy {
+		return "Unknown", "Driver schemas are validated when machines are created", nil
+	}
+
+	driver := template.Spec.Driver
+	rawConfig, ok := values.GetValue(obj.Object, driver+"Config")
+	config := convert.ToMapInterface(rawConfig)
+	if !ok || config == nil {
+		return "False", "machine config not specified", nil
+	}
+
+	driverSchema, err := schemastore.Get(v.lifecycle.schemaClient, strings.ToLower(driver)+"config")
+	if apierrors.IsNotFound(err) {
+		return "Unknown", fmt.Sprintf("No schema for machine driver %s", driver), nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	// Fields the driver defaults or the schema defaults set are not required
+	// in the template, as they are set on its machines. The defaults of
+	// clusters and namespaces are only known for machines.
+	sources, err := v.lifecycle.loadDriverDefaults("", "", driver)
+	if err != nil {
+		return "", "", err
+	}
+	validated := map[string]interface{}{}
+	for key, value := range config {
+		validated[key] = value
+	}
+	mergeDriverDefaults(sources, validated)
+	applyFieldDefaults(driverSchema.Spec.ResourceFields, validated)
+	if err := policy.ValidateSchema(driverSchema, validated); err != nil {
+		return "False", err.Error(), nil
+	}
+	return "True", "", nil
+}
+
+// applyFieldDefaults sets the fields missing from config to the defaults of
+// the schema.
+func applyFieldDefaults(fields map[string]v3.Field, config map[string]interface{}) {
+	for name, field := range fields {
+		if _, ok := config[name]; ok {
+			continue
+		}
+		var value interface{}
+		switch field.Type {
+		case "int":
+			if field.Default.IntValue != 0 {
+				value = field.Default.IntValue
+			}
+		case "boolean":
+			if field.Default.BoolValue {
+				value = true
+			}
+		case "array[string]":
+			if len(field.Default.StringSliceValue) > 0 {
+				value = append([]string{}, field.Default.StringSliceValue...)
+			}
+		default:
+			if field.Default.StringValue != "" {
+				value = field.Default.StringValue
+			}
+		}
+		if value != nil {
+			config[name] = value
+		}
+	}
+}
+
+func conditionsEqual(a, b []v3.MachineTemplateCondition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+func TestApplyFieldDefaults(t *testing.T) {
+	fields := map[string]v3.Field{
+		"region":        {Type: "string", Default: v3.Values{StringValue: "us-east-1"}},
+		"diskSize":      {Type: "int", Default: v3.Values{IntValue: 40}},
+		"privateOnly":   {Type: "boolean", Default: v3.Values{BoolValue: true}},
+		"securityGroup": {Type: "array[string]", Default: v3.Values{StringSliceValue: []string{"default"}}},
+		"instanceType":  {Type: "string"},
+	}
+	tests := []struct {
+		name      string
+		config    map[string]interface{}
+		defaulted map[string]interface{}
+	}{
+		{
+			name:   "empty config",
+			config: map[string]interface{}{},
+			defaulted: map[string]interface{}{
+				"region": "us-east-1", "diskSize": 40, "privateOnly": true, "securityGroup": []string{"default"},
+			},
+		},
+		{
+			name:   "set fields are kept",
+			config: map[string]interface{}{"region": "eu-west-1", "diskSize": "", "privateOnly": false},
+			defaulted: map[string]interface{}{
+				"region": "eu-west-1", "diskSize": "", "privateOnly": false, "securityGroup": []string{"default"},
+			},
+		},
+	}
+	for _, test := range tests {
+		applyFieldDefaults(fields, test.config)
+		if !reflect.DeepEqual(test.config, test.defaulted) {
+			t.Errorf("%s: defaulted config is %v, want %v", test.name, test.config, test.defaulted)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/hook"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// zoneAuto as the value of the zone field of a driver config lets the
+	// controller pick the zone: the capacity hook of the driver reports the
+	// headroom of each zone, the machine is placed in the zone with the most
+	// and moved on to the next one when the provider is out of capacity.
+	zoneAuto = "auto"
+	// zoneFieldAnnotation on a MachineDriver names the driver config field
+	// selecting the zone, for drivers not in defaultZoneFields.
+	zoneFieldAnnotation = "io.cattle.machine_driver.zone_field"
+
+	capacityHook = "capacity"
+)
+
+var (
+	defaultZoneFields = map[string]string{
+		"amazonec2":    "zone",
+		"digitalocean": "region",
+		"exoscale":     "availabilityZone",
+		"google":       "zone",
+		"openstack":    "availabilityZone",
+		"packet":       "facilityCode",
+	}
+
+	insufficientCapacityRegexp = regexp.MustCompile(`(?i)insufficient\w*\s*capacity|ZONE_RESOURCE_POOL_EXHAUSTED|AllocationFailed|SkuNotAvailable|out of capacity`)
+)
+
+// ZoneCapacity is written by capacity hooks, as a list, for the zones a
+// machine can be placed in. Available is the number of machines of the
+// requested size the zone, and the quota of the account, still has room for.
+type ZoneCapacity struct {
+	Zone      string `json:"zone"`
+	Available int    `json:"available"`
+}
+
+// Zone returns the zone of a machine from its driver config, using the zone
+// field of driver, its MachineDriver, which may be nil.
+func Zone(obj *v3.Machine, driver *v3.MachineDriver) string {
+	if obj.Status.MachineTemplateSpec == nil || obj.Status.MachineDriverConfig == "" {
+		return ""
+	}
+	field := defaultZoneFields[obj.Status.MachineTemplateSpec.Driver]
+	if driver != nil && driver.Annotations[zoneFieldAnnotation] != "" {
+		field = driver.Annotations[zoneFieldAnnotation]
+	}
+	if field == "" {
+		return ""
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &config); err != nil {
+		return ""
+	}
+	return convert.ToString(config[field])
+}
+
+// autoZones returns the zone field of a machine whose driver config asks for
+// automatic placement, together with the zones to try in order.
+func (m *Lifecycle) autoZones(obj *v3.Machine, config map[string]interface{}) (string, []string, error) {
+	driver := obj.Status.MachineTemplateSpec.Driver
+	field, err := m.driverField(driver, zoneFieldAnnotation, defaultZoneFields)
+	if err != nil || field == "" || convert.ToString(config[field]) != zoneAuto {
+		return "", nil, err
+	}
+
+	h, err := hook.Lookup(m.configMapGetter, driver, capacityHook)
+	if err != nil {
+		return "", nil, err
+	}
+	if h == nil {
+		return "", nil, fmt.Errorf("machine driver %s has no %s hook for zone %s", driver, capacityHook, zoneAuto)
+	}
+
+	var capacity []ZoneCapacity
+	if err := h.Run(hook.Input{
+		Machine:  obj.Name,
+		Hostname: obj.Spec.RequestedHostname,
+		Driver:   driver,
+		Config:   config,
+	}, &capacity); err != nil {
+		return "", nil, err
+	}
+
+	sort.SliceStable(capacity, func(i, j int) bool {
+		return capacity[i].Available > capacity[j].Available
+	})
+	var zones []string
+	for _, c := range capacity {
+		if c.Available > 0 && c.Zone != "" {
+			zones = append(zones, c.Zone)
+		}
+	}
+	if len(zones) == 0 {
+		return "", nil, fmt.Errorf("no zone has capacity for machine %s", obj.Spec.RequestedHostname)
+	}
+	return field, zones, nil
+}
+
+func insufficientCapacity(err error) bool {
+	return insufficientCapacityRegexp.MatchString(err.Error())
+}
+
+// recordConfigField sets a field of the driver config of a machine to the
+// value it was created with, such as the zone it was placed in instead of
+// zoneAuto.
+func recordConfigField(obj *v3.Machine, field, value string) error {
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(obj.Status.MachineDriverConfig), &config); err != nil {
+		return errors.Wrap(err, "failed to unmarshal machine config")
+	}
+	config[field] = value
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal machine driver config")
+	}
+	obj.Status.MachineDriverConfig = string(data)
+	return nil
+}
@@ -0,0 +1,194 @@
+package machinedriver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// docExtensions are skipped when looking for the driver binary in an
+// archive, drivers often ship their README or checksums next to it.
+var docExtensions = map[string]bool{
+	".md":     true,
+	".txt":    true,
+	".asc":    true,
+	".sig":    true,
+	".sha256": true,
+	".sha512": true,
+	".md5":    true,
+}
+
+type archiveType string
+
+const (
+	archiveNone  archiveType = ""
+	archiveTar   archiveType = "tar"
+	archiveGzip  archiveType = "tar.gz"
+	archiveBzip2 archiveType = "tar.bz2"
+	archiveZip   archiveType = "zip"
+)
+
+// detectArchive returns the type of the archive in file from its content.
+func detectArchive(file string) (archiveType, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return archiveNone, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return archiveNone, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return archiveGzip, nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return archiveBzip2, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return archiveZip, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return archiveTar, nil
+	}
+	return archiveNone, nil
+}
+
+func isDriverBinary(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, "docker-machine-driver-") && !docExtensions[strings.ToLower(path.Ext(base))]
+}
+
+// extractDriver copies the only driver binary in the archive file to dest and
+// returns its name. Archives with no or several candidate binaries are
+// rejected.
+func extractDriver(file string, kind archiveType, dest func(name string) (io.WriteCloser, error)) (string, error) {
+	if kind == archiveZip {
+		return extractZip(file, dest)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	tr, err := tarReader(f, kind)
+	if err != nil {
+		return "", err
+	}
+	name, err := findTarDriver(tr)
+	if err != nil {
+		return "", err
+	}
+
+	// Read the archive again to copy the binary found by the first pass.
+	if tr, err = tarReader(f, kind); err != nil {
+		return "", err
+	}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return "", err
+		}
+		if header.Name == name {
+			return path.Base(name), copyTo(dest, path.Base(name), tr)
+		}
+	}
+}
+
+func tarReader(f *os.File, kind archiveType) (*tar.Reader, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case archiveGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract: %v", err)
+		}
+		return tar.NewReader(gz), nil
+	case archiveBzip2:
+		return tar.NewReader(bzip2.NewReader(f)), nil
+	}
+	return tar.NewReader(f), nil
+}
+
+func findTarDriver(tr *tar.Reader) (string, error) {
+	var candidates []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("failed to extract: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if isDriverBinary(header.Name) {
+			candidates = append(candidates, header.Name)
+		}
+	}
+	return oneCandidate(candidates)
+}
+
+func extractZip(file string, dest func(name string) (io.WriteCloser, error)) (string, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract: %v", err)
+	}
+	defer zr.Close()
+
+	var candidates []string
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !isDriverBinary(f.Name) {
+			continue
+		}
+		candidates = append(candidates, f.Name)
+		files[f.Name] = f
+	}
+	name, err := oneCandidate(candidates)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := files[name].Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return path.Base(name), copyTo(dest, path.Base(name), r)
+}
+
+func oneCandidate(candidates []string) (string, error) {
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("failed to find machine driver in archive. There must be a file of form docker-machine-driver*")
+	case 1:
+		return candidates[0], nil
+	}
+	return "", fmt.Errorf("archive contains several machine driver binaries: %s", strings.Join(candidates, ", "))
+}
+
+func copyTo(dest func(name string) (io.WriteCloser, error), name string, r io.Reader) error {
+	w, err := dest(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
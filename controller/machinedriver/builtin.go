@@ -0,0 +1,50 @@
+package machinedriver
+
+import (
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// builtinDriver is a driver compiled into docker-machine.
+type builtinDriver struct {
+	name        string
+	description string
+	active      bool
+}
+
+// builtinDrivers are seeded as MachineDrivers on start. The drivers of the
+// major clouds are active, the others have to be activated by an admin.
+var builtinDrivers = []builtinDriver{
+	{name: "amazonec2", description: "Amazon Web Services EC2", active: true},
+	{name: "azure", description: "Microsoft Azure", active: true},
+	{name: "digitalocean", description: "DigitalOcean", active: true},
+	{name: "exoscale", description: "Exoscale"},
+	{name: "generic", description: "Existing host reachable over SSH"},
+	{name: "google", description: "Google Compute Engine"},
+	{name: "openstack", description: "OpenStack"},
+	{name: "rackspace", description: "Rackspace"},
+	{name: "softlayer", description: "IBM SoftLayer"},
+	{name: "vmwarevcloudair", description: "VMware vCloud Air"},
+	{name: "vmwarevsphere", description: "VMware vSphere", active: true},
+}
+
+// seedBuiltinDrivers creates the MachineDrivers of the builtin drivers that do
+// not exist yet. Existing drivers are never changed, so an admin deactivating
+// a builtin driver sticks; a deleted one comes back on the next start.
+func seedBuiltinDrivers(client v3.MachineDriverInterface) {
+	for _, builtin := range builtinDrivers {
+		obj := &v3.MachineDriver{
+			Spec: v3.MachineDriverSpec{
+				Description: builtin.description,
+				Builtin:     true,
+				Active:      builtin.active,
+			},
+		}
+		obj.Name = builtin.name
+		if created, err := createMissing(client, obj); err != nil {
+			logrus.Errorf("Failed to seed builtin machine driver %s: %v", builtin.name, err)
+		} else if created {
+			logrus.Infof("Seeded builtin machine driver %s", builtin.name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package machinedriver
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// removeBinaries deletes everything on disk for a removed driver: its
+// installed binary and the download cache of its current and last staged
+// versions. It runs from Remove, so the finalizer of the lifecycle keeps the
+// MachineDriver around and the cleanup is retried until it succeeds. Files
+// another MachineDriver shares, the same cache entry or an installed binary of
+// the same name, are left alone. Builtin drivers ship with the image and are
+// never removed.
+func (m *lifecycle) removeBinaries(obj *v3.MachineDriver) error {
+	if obj.Spec.Builtin {
+		return nil
+	}
+	if m.installer.pending(obj.Name) {
+		return fmt.Errorf("machine driver %s is still being installed", obj.Name)
+	}
+
+	keys, names, err := m.binariesInUse(obj.Name)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, key := range []string{m.drivers(obj).CacheKey(), obj.Annotations[stagedAnnotation]} {
+		if key == "" || seen[key] || keys[key] {
+			continue
+		}
+		seen[key] = true
+
+		prefix := cacheFile(key)
+		name, err := isInstalled(prefix)
+		if err != nil {
+			return err
+		}
+		files := []string{prefix + ".error", prefix}
+		if name != "" {
+			files = append([]string{prefix + "-" + name}, files...)
+			if !names[name] {
+				logrus.Infof("Removing driver binary %s of machine driver %s", name, obj.Name)
+				files = append([]string{path.Join(binDir(), name)}, files...)
+			}
+		}
+		for _, file := range files {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "failed to remove %s of machine driver %s", file, obj.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// binariesInUse returns the cache keys and the names of the binaries of the
+// machine drivers other than the named one.
+func (m *lifecycle) binariesInUse(name string) (map[string]bool, map[string]bool, error) {
+	drivers, err := listDrivers(m.machineDriverClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, names := map[string]bool{}, map[string]bool{}
+	for i := range drivers {
+		other := &drivers[i]
+		if other.Name == name {
+			continue
+		}
+		driver := m.drivers(other)
+		if other.Spec.Builtin {
+			names[driver.Name()] = true
+			continue
+		}
+		for _, key := range []string{driver.CacheKey(), other.Annotations[stagedAnnotation]} {
+			if key == "" {
+				continue
+			}
+			keys[key] = true
+			if binary, _ := isInstalled(cacheFile(key)); binary != "" {
+				names[binary] = true
+			}
+		}
+	}
+	return keys, names, nil
+}
@@ -0,0 +1,130 @@
+package machinedriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rancher/machine-controller/metrics"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	driverBinaries = metrics.NewGaugeVec("machine_controller_driver_binaries",
+		"Driver binaries found by the startup consistency check, by state", "state")
+)
+
+type consistencySummary struct {
+	ok, reinstalled, failed, unknown, brokenLinks int
+}
+
+// checkInstalledDrivers reconciles the driver binaries in the bin directory
+// against the registered MachineDrivers: missing binaries are reinstalled,
+// broken symlinks removed and binaries no driver claims are reported.
+func checkInstalledDrivers(client v3.MachineDriverInterface) {
+	drivers, err := listDrivers(client)
+	if err != nil {
+		logrus.Errorf("Driver consistency check failed to list machine drivers: %v", err)
+		return
+	}
+
+	summary := consistencySummary{}
+	known := map[string]bool{}
+
+	removeBrokenLinks(&summary)
+
+	for _, obj := range drivers {
+		driver := newDriver(&obj)
+		if obj.Spec.Builtin {
+			known[driver.Name()] = true
+			continue
+		}
+
+		name, err := isInstalled(driver.cacheFile())
+		if err == nil && name != "" {
+			driver.name = name
+			known[name] = true
+			if _, err := os.Stat(path.Join(binDir(), name)); err == nil {
+				summary.ok++
+				continue
+			}
+		}
+
+		logrus.Infof("Driver binary for machine driver %s is missing, reinstalling", obj.Name)
+		if err := driver.Stage(); err != nil {
+			logrus.Errorf("Failed to stage machine driver %s: %v", obj.Name, err)
+			summary.failed++
+			continue
+		}
+		known[driver.Name()] = true
+		if err := driver.Install(); err != nil {
+			logrus.Errorf("Failed to install machine driver %s: %v", obj.Name, err)
+			summary.failed++
+			continue
+		}
+		summary.reinstalled++
+	}
+
+	files, err := ioutil.ReadDir(binDir())
+	if err != nil {
+		logrus.Errorf("Driver consistency check failed to read %s: %v", binDir(), err)
+		return
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "docker-machine-driver-") || known[file.Name()] {
+			continue
+		}
+		logrus.Warnf("Driver binary %s is not registered by any machine driver", path.Join(binDir(), file.Name()))
+		summary.unknown++
+	}
+
+	logrus.Infof("Driver consistency check: %d ok, %d reinstalled, %d failed, %d unknown, %d broken links removed",
+		summary.ok, summary.reinstalled, summary.failed, summary.unknown, summary.brokenLinks)
+	driverBinaries.Set(float64(summary.ok), "ok")
+	driverBinaries.Set(float64(summary.reinstalled), "reinstalled")
+	driverBinaries.Set(float64(summary.failed), "failed")
+	driverBinaries.Set(float64(summary.unknown), "unknown")
+	driverBinaries.Set(float64(summary.brokenLinks), "broken_link")
+}
+
+// listDrivers lists all machine drivers in pages.
+func listDrivers(client v3.MachineDriverInterface) ([]v3.MachineDriver, error) {
+	var drivers []v3.MachineDriver
+	opts := metav1.ListOptions{Limit: schemastore.PageSize}
+	for {
+		list, err := client.List(opts)
+		if err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, list.Items...)
+		if list.Continue == "" {
+			return drivers, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+func removeBrokenLinks(summary *consistencySummary) {
+	files, err := ioutil.ReadDir(binDir())
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 || !strings.HasPrefix(file.Name(), "docker-machine-driver-") {
+			continue
+		}
+		p := path.Join(binDir(), file.Name())
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		logrus.Warnf("Removing broken driver symlink %s", p)
+		if err := os.Remove(p); err == nil {
+			summary.brokenLinks++
+		}
+	}
+}
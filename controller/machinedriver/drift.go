@@ -0,0 +1,108 @@
+package machinedriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	schemaResyncInterval = 5 * time.Minute
+)
+
+// driftReconciler repairs the generated schemas of drivers that were edited or
+// deleted by hand. The resource fields of a schema are restored from the
+// schema revision the driver records as current; a deleted schema is
+// generated again by activating the driver.
+type driftReconciler struct {
+	lifecycle *lifecycle
+}
+
+func (d *driftReconciler) run() {
+	for range time.Tick(schemaResyncInterval) {
+		drivers, err := listDrivers(d.lifecycle.machineDriverClient)
+		if err != nil {
+			logrus.Errorf("Schema resync failed to list machine drivers: %v", err)
+			continue
+		}
+		for i := range drivers {
+			obj := &drivers[i]
+			if obj.DeletionTimestamp != nil || d.lifecycle.installer.pending(obj.Name) ||
+				!MachineDriverConditionSchemaCreated.IsTrue(obj) {
+				continue
+			}
+			if err := d.reconcile(obj); err != nil {
+				logrus.Errorf("Schema resync of machine driver %s failed: %v", obj.Name, err)
+			}
+		}
+	}
+}
+
+func (d *driftReconciler) reconcile(obj *v3.MachineDriver) error {
+	fields, err := d.desiredFields(obj)
+	if err != nil {
+		return err
+	}
+
+	name := obj.Name + "config"
+	for _, ns := range d.lifecycle.schemaNamespaces(obj) {
+		client := d.lifecycle.schemaClientFor(ns)
+		live, err := schemastore.Get(client, name)
+		if errors.IsNotFound(err) {
+			// The schema or one of its parts was deleted. Update creates
+			// missing parts again, the schema itself is generated again.
+			if _, err := client.Get(name, metav1.GetOptions{}); fields == nil || errors.IsNotFound(err) {
+				logrus.Infof("Schema %s of machine driver %s was deleted, generating it again", name, obj.Name)
+				d.lifecycle.installer.start(obj.Name, true)
+				return nil
+			}
+		} else if err != nil {
+			return err
+		} else if fields == nil || reflect.DeepEqual(live.Spec.ResourceFields, fields) {
+			continue
+		}
+
+		logrus.Infof("Restoring drifted fields of schema %s of machine driver %s", name, obj.Name)
+		schema := &v3.DynamicSchema{}
+		schema.Name = name
+		schema.Spec.ResourceFields = fields
+		if err := schemastore.Update(client, schema); err != nil {
+			return err
+		}
+	}
+
+	d.lifecycle.syncMetadata(obj)
+	return nil
+}
+
+// desiredFields returns the resource fields of the current schema revision of
+// a driver, or nil if it is not stored.
+func (d *driftReconciler) desiredFields(obj *v3.MachineDriver) (map[string]v3.Field, error) {
+	current := obj.Annotations[schemaRevisionAnnotation]
+	if current == "" {
+		return nil, nil
+	}
+	revisions, err := d.lifecycle.schemaRevisions(obj)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		if strconv.Itoa(revisionNumber(&revisions[i])) != current {
+			continue
+		}
+		fields := map[string]v3.Field{}
+		if err := json.Unmarshal([]byte(revisions[i].Data[revisionFieldsKey]), &fields); err != nil {
+			return nil, fmt.Errorf("failed to parse schema revision %s: %v", revisions[i].Name, err)
+		}
+		return fields, nil
+	}
+	return nil, nil
+}
@@ -14,24 +14,83 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
 	"strings"
 
+	cli "github.com/docker/machine/libmachine/mcnflag"
 	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/download"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/sirupsen/logrus"
 )
 
-type Driver struct {
-	builtin bool
-	url     string
-	hash    string
-	name    string
+const (
+	// checksumTypeAnnotation on a MachineDriver names the hash algorithm of
+	// Spec.Checksum: md5, sha1, sha256 or sha512. Without it the algorithm is
+	// detected from the length of the checksum.
+	checksumTypeAnnotation = "io.cattle.machine_driver.checksum_type"
+)
+
+// Driver stages and installs the binary of a MachineDriver. The lifecycle
+// only uses drivers through this interface, see DriverFactory.
+type Driver interface {
+	// Name is the name of the binary, known once the driver is staged.
+	Name() string
+	// CacheKey identifies the binary of the driver in the cache, it changes
+	// with the URL and checksum.
+	CacheKey() string
+	Stage() error
+	Install() error
+	ClearError()
+	// CreateFlags returns the create flags of the installed binary, which
+	// is run within limits to list them.
+	CreateFlags(limits dockermachine.Limits) ([]cli.Flag, error)
+	// Binary returns the checksum and, if it reports one, the version of the
+	// installed binary.
+	Binary() (checksum, version string, err error)
+}
+
+// DriverFactory returns the driver of a MachineDriver.
+type DriverFactory func(obj *v3.MachineDriver) Driver
+
+// DriverFor returns the driver downloading the binary of a MachineDriver from
+// its URL. It is the DriverFactory of the controller.
+func DriverFor(obj *v3.MachineDriver) Driver {
+	return newDriver(obj)
+}
+
+type dynamicDriver struct {
+	builtin  bool
+	url      string
+	hash     string
+	hashType string
+	name     string
+}
+
+// checksumError is returned when a downloaded driver does not match its
+// checksum.
+type checksumError struct {
+	got, expected, hashType string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%s hash does not match, got %s, expected %s", e.hashType, e.got, e.expected)
+}
+
+// newDriver returns the driver of a MachineDriver.
+func newDriver(obj *v3.MachineDriver) *dynamicDriver {
+	d := newDynamicDriver(obj.Spec.Builtin, obj.Name, obj.Spec.URL, obj.Spec.Checksum)
+	d.hashType = obj.Annotations[checksumTypeAnnotation]
+	return d
+}
+
+func NewDriver(builtin bool, name, url, hash string) Driver {
+	return newDynamicDriver(builtin, name, url, hash)
 }
 
-func NewDriver(builtin bool, name, url, hash string) *Driver {
-	d := &Driver{
+func newDynamicDriver(builtin bool, name, url, hash string) *dynamicDriver {
+	d := &dynamicDriver{
 		builtin: builtin,
 		name:    name,
 		url:     url,
@@ -43,23 +102,43 @@ func NewDriver(builtin bool, name, url, hash string) *Driver {
 	return d
 }
 
-func (d *Driver) Name() string {
+func (d *dynamicDriver) Name() string {
 	return d.name
 }
 
-func (d *Driver) Hash() string {
+func (d *dynamicDriver) Hash() string {
 	return d.hash
 }
 
-func (d *Driver) Checksum() string {
+func (d *dynamicDriver) Checksum() string {
 	return d.name
 }
 
-func (d *Driver) FriendlyName() string {
+func (d *dynamicDriver) FriendlyName() string {
 	return strings.TrimPrefix(d.name, "docker-machine-driver-")
 }
 
-func (d *Driver) Remove() error {
+func (d *dynamicDriver) CreateFlags(limits dockermachine.Limits) ([]cli.Flag, error) {
+	return getCreateFlagsForDriver(d.FriendlyName(), limits)
+}
+
+func (d *dynamicDriver) Binary() (string, string, error) {
+	p, err := dockermachine.DriverBinary(d.FriendlyName())
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", "", err
+	}
+	digest, err := digestOf(p, info)
+	if err != nil {
+		return "", "", err
+	}
+	return digest.checksum, digest.version, nil
+}
+
+func (d *dynamicDriver) Remove() error {
 	cacheFilePrefix := d.cacheFile()
 	content, err := ioutil.ReadFile(cacheFilePrefix)
 	if os.IsNotExist(err) {
@@ -78,7 +157,7 @@ func (d *Driver) Remove() error {
 	return nil
 }
 
-func (d *Driver) Stage() error {
+func (d *dynamicDriver) Stage() error {
 	if err := d.getError(); err != nil {
 		return err
 	}
@@ -86,7 +165,7 @@ func (d *Driver) Stage() error {
 	return d.setError(d.stage())
 }
 
-func (d *Driver) setError(err error) error {
+func (d *dynamicDriver) setError(err error) error {
 	errFile := d.cacheFile() + ".error"
 
 	if err != nil {
@@ -96,7 +175,7 @@ func (d *Driver) setError(err error) error {
 	return err
 }
 
-func (d *Driver) getError() error {
+func (d *dynamicDriver) getError() error {
 	errFile := d.cacheFile() + ".error"
 
 	if content, err := ioutil.ReadFile(errFile); err == nil {
@@ -108,12 +187,12 @@ func (d *Driver) getError() error {
 	return nil
 }
 
-func (d *Driver) ClearError() {
+func (d *dynamicDriver) ClearError() {
 	errFile := d.cacheFile() + ".error"
 	os.Remove(errFile)
 }
 
-func (d *Driver) stage() error {
+func (d *dynamicDriver) stage() error {
 	if d.builtin {
 		return nil
 	}
@@ -133,7 +212,7 @@ func (d *Driver) stage() error {
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	hasher, err := getHasher(d.hash)
+	hasher, hashType, err := getHasher(d.hashType, d.hash)
 	if err != nil {
 		return err
 	}
@@ -148,7 +227,11 @@ func (d *Driver) stage() error {
 	}
 
 	if got, ok := compare(hasher, d.hash); !ok {
-		return fmt.Errorf("hash does not match, got %s, expected %s", got, d.hash)
+		return &checksumError{
+			got:      got,
+			expected: d.hash,
+			hashType: hashType,
+		}
 	}
 
 	if err := tempFile.Close(); err != nil {
@@ -164,7 +247,7 @@ func (d *Driver) stage() error {
 	return nil
 }
 
-func (d *Driver) Install() error {
+func (d *dynamicDriver) Install() error {
 	if d.builtin {
 		return nil
 	}
@@ -208,18 +291,16 @@ func isElf(input string) bool {
 	return bytes.Compare(elf, []byte{0x7f, 0x45, 0x4c, 0x46}) == 0
 }
 
-func (d *Driver) copyBinary(cacheFile, input string) (string, error) {
-	temp, err := ioutil.TempDir("", "machine-driver-extract")
-	if err != nil {
+func (d *dynamicDriver) copyBinary(cacheFile, input string) (string, error) {
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
 		return "", err
 	}
-	defer os.RemoveAll(temp)
-
-	file := ""
-	driverName := ""
+	dest := func(name string) (io.WriteCloser, error) {
+		return os.Create(cacheFile + "-" + name)
+	}
 
+	var driverName string
 	if isElf(input) {
-		file = input
 		u, err := url.Parse(d.url)
 		if err != nil {
 			return "", err
@@ -228,58 +309,32 @@ func (d *Driver) copyBinary(cacheFile, input string) (string, error) {
 		if !strings.HasPrefix(driverName, "docker-machine-driver-") {
 			return "", fmt.Errorf("invalid URL %s, path should be of the format docker-machine-driver-*", d.url)
 		}
+		f, err := os.Open(input)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if err := copyTo(dest, driverName, f); err != nil {
+			return "", err
+		}
 	} else {
-		if err := exec.Command("tar", "xvf", input, "-C", temp).Run(); err != nil {
-			if err := exec.Command("unzip", "-o", input, "-d", temp).Run(); err != nil {
-				return "", fmt.Errorf("failed to extract")
-			}
+		kind, err := detectArchive(input)
+		if err != nil {
+			return "", err
 		}
-	}
-
-	filepath.Walk(temp, filepath.WalkFunc(func(p string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+		if kind == archiveNone {
+			return "", fmt.Errorf("failed to extract: %s is neither a binary nor a tar, tar.gz, tar.bz2 or zip archive", d.url)
 		}
-
-		if strings.HasPrefix(path.Base(p), "docker-machine-driver-") {
-			file = p
+		if driverName, err = extractDriver(input, kind, dest); err != nil {
+			return "", err
 		}
-
-		return nil
-	}))
-
-	if file == "" {
-		return "", fmt.Errorf("failed to find machine driver in archive. There must be a file of form docker-machine-driver*")
-	}
-
-	if driverName == "" {
-		driverName = path.Base(file)
-	}
-	f, err := os.Open(file)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
-		return "", err
-	}
-
-	dest, err := os.Create(cacheFile + "-" + driverName)
-	if err != nil {
-		return "", err
-	}
-	defer dest.Close()
-
-	if _, err := io.Copy(dest, f); err != nil {
-		return "", err
 	}
 
 	logrus.Infof("Found driver %s", driverName)
 	return driverName, ioutil.WriteFile(cacheFile, []byte(driverName), 0644)
 }
 
-func (d *Driver) srcBinName() string {
+func (d *dynamicDriver) srcBinName() string {
 	return d.cacheFile() + "-" + d.name
 }
 
@@ -302,38 +357,79 @@ func compare(hash hash.Hash, value string) (string, bool) {
 	return got, got == expected
 }
 
-func getHasher(hash string) (hash.Hash, error) {
-	switch len(hash) {
-	case 0:
-		return nil, nil
-	case 32:
-		return md5.New(), nil
-	case 40:
-		return sha1.New(), nil
-	case 64:
-		return sha256.New(), nil
-	case 128:
-		return sha512.New(), nil
+var hashLengths = map[string]int{
+	"md5":    32,
+	"sha1":   40,
+	"sha256": 64,
+	"sha512": 128,
+}
+
+// getHasher returns the hash of the given type, or detected from the length of
+// the checksum if hashType is empty, together with the type.
+func getHasher(hashType, hash string) (hash.Hash, string, error) {
+	hash = strings.TrimSpace(hash)
+	if len(hash) == 0 {
+		return nil, "", nil
+	}
+
+	hashType = strings.ToLower(hashType)
+	if hashType == "" {
+		for t, length := range hashLengths {
+			if len(hash) == length {
+				hashType = t
+			}
+		}
+		if hashType == "" {
+			return nil, "", fmt.Errorf("invalid hash format: %s", hash)
+		}
 	}
 
-	return nil, fmt.Errorf("invalid hash format: %s", hash)
+	length, ok := hashLengths[hashType]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported hash type %s", hashType)
+	}
+	if len(hash) != length {
+		return nil, "", fmt.Errorf("invalid %s hash: %s", hashType, hash)
+	}
+
+	switch hashType {
+	case "md5":
+		return md5.New(), hashType, nil
+	case "sha1":
+		return sha1.New(), hashType, nil
+	case "sha256":
+		return sha256.New(), hashType, nil
+	}
+	return sha512.New(), hashType, nil
 }
 
-func (d *Driver) download(dest io.Writer) error {
+func (d *dynamicDriver) download(dest io.Writer) error {
 	logrus.Infof("Download %s", d.url)
-	resp, err := http.Get(d.url)
+	if strings.HasPrefix(d.url, "file://") {
+		return copyLocal(d.url, dest)
+	}
+	resp, err := download.Client().Get(d.url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", d.url, resp.Status)
+	}
 
 	_, err = io.Copy(dest, resp.Body)
 	return err
 }
 
-func (d *Driver) cacheFile() string {
-	key := sha256Bytes([]byte(d.url + d.hash))
+func (d *dynamicDriver) CacheKey() string {
+	return sha256Bytes([]byte(d.url + d.hash))
+}
+
+func (d *dynamicDriver) cacheFile() string {
+	return cacheFile(d.CacheKey())
+}
 
+func cacheFile(key string) string {
 	base := os.Getenv("CATTLE_HOME")
 	if base == "" {
 		base = "/var/lib/rancher"
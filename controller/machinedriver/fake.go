@@ -0,0 +1,136 @@
+package machinedriver
+
+import (
+	"sync"
+
+	cli "github.com/docker/machine/libmachine/mcnflag"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// FakeDrivers hands out a FakeDriver per MachineDriver. It lets the
+// lifecycle be exercised without network access or driver binaries.
+type FakeDrivers struct {
+	// New, if set, is called with each FakeDriver when it is created, to
+	// set the flags, checksum or errors it returns.
+	New func(obj *v3.MachineDriver, driver *FakeDriver)
+
+	lock    sync.Mutex
+	drivers map[string]*FakeDriver
+}
+
+// Factory returns a DriverFactory handing out the FakeDriver of each
+// MachineDriver, created on first use.
+func (f *FakeDrivers) Factory() DriverFactory {
+	return func(obj *v3.MachineDriver) Driver {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.drivers == nil {
+			f.drivers = map[string]*FakeDriver{}
+		}
+		driver, ok := f.drivers[obj.Name]
+		if !ok {
+			driver = &FakeDriver{}
+			if f.New != nil {
+				f.New(obj, driver)
+			}
+			f.drivers[obj.Name] = driver
+		}
+		driver.update(obj)
+		return driver
+	}
+}
+
+// Driver returns the FakeDriver of the named MachineDriver, nil if none was
+// handed out yet.
+func (f *FakeDrivers) Driver(name string) *FakeDriver {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.drivers[name]
+}
+
+// FakeDriver is a Driver that downloads and installs nothing. The errors and
+// flags it returns are set by the caller, the calls it records read by it.
+type FakeDriver struct {
+	// DriverName is returned by Name, "docker-machine-driver-" followed by
+	// the name of the MachineDriver if empty.
+	DriverName string
+	// Key is returned by CacheKey, the URL and checksum of the MachineDriver
+	// the driver was last handed out for if empty.
+	Key string
+	// Flags are returned by CreateFlags, Checksum and Version by Binary.
+	Flags    []cli.Flag
+	Checksum string
+	Version  string
+
+	StageError   error
+	InstallError error
+	FlagsError   error
+
+	lock       sync.Mutex
+	name       string
+	defaultKey string
+	calls      []string
+}
+
+func (f *FakeDriver) update(obj *v3.MachineDriver) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.name = obj.Name
+	f.defaultKey = obj.Spec.URL + obj.Spec.Checksum
+}
+
+// Calls returns the methods of f that were called, in order.
+func (f *FakeDriver) Calls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *FakeDriver) Name() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.DriverName != "" {
+		return f.DriverName
+	}
+	return "docker-machine-driver-" + f.name
+}
+
+func (f *FakeDriver) CacheKey() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Key != "" {
+		return f.Key
+	}
+	return f.defaultKey
+}
+
+func (f *FakeDriver) Stage() error {
+	f.record("Stage")
+	return f.StageError
+}
+
+func (f *FakeDriver) Install() error {
+	f.record("Install")
+	return f.InstallError
+}
+
+func (f *FakeDriver) ClearError() {
+	f.record("ClearError")
+}
+
+func (f *FakeDriver) CreateFlags(limits dockermachine.Limits) ([]cli.Flag, error) {
+	f.record("CreateFlags")
+	return f.Flags, f.FlagsError
+}
+
+func (f *FakeDriver) Binary() (string, string, error) {
+	f.record("Binary")
+	return f.Checksum, f.Version, nil
+}
+
+func (f *FakeDriver) record(call string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+}
@@ -0,0 +1,124 @@
+package machinedriver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// whitelistFieldsAnnotation and blacklistFieldsAnnotation on a
+	// MachineDriver list the generated schema fields, comma separated, that
+	// are exposed and hidden. Entries are field names or glob patterns such
+	// as swarm*. With a whitelist only the listed fields are published; the
+	// blacklist removes fields from what is left.
+	whitelistFieldsAnnotation = "io.cattle.machine_driver.whitelist_fields"
+	blacklistFieldsAnnotation = "io.cattle.machine_driver.blacklist_fields"
+	// sensitiveFieldsAnnotation on a MachineDriver lists string fields,
+	// comma separated, to publish as password fields in addition to the ones
+	// that look like credentials by name. Entries prefixed with - are
+	// published as plain strings instead. Entries may be glob patterns.
+	sensitiveFieldsAnnotation = "io.cattle.machine_driver.sensitive_fields"
+	// fieldFilterAnnotation records the lists the schema of a driver was
+	// generated with, so the schema is generated again when they change.
+	fieldFilterAnnotation = "io.cattle.machine_driver.field_filter"
+)
+
+// filterFields removes the fields the white and black lists of a driver do
+// not expose from resourceFields.
+func filterFields(obj *v3.MachineDriver, resourceFields map[string]v3.Field) error {
+	whitelist, err := fieldPatterns(obj, whitelistFieldsAnnotation)
+	if err != nil {
+		return err
+	}
+	blacklist, err := fieldPatterns(obj, blacklistFieldsAnnotation)
+	if err != nil {
+		return err
+	}
+
+	for name := range resourceFields {
+		if (len(whitelist) > 0 && !matchField(whitelist, name)) || matchField(blacklist, name) {
+			delete(resourceFields, name)
+		}
+	}
+	return nil
+}
+
+func fieldPatterns(obj *v3.MachineDriver, annotation string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(obj.Annotations[annotation], ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s annotation: %v", pattern, annotation, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func matchField(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// markSensitiveFields applies the sensitive field list of a driver to the
+// types of the string fields in resourceFields.
+func markSensitiveFields(obj *v3.MachineDriver, resourceFields map[string]v3.Field) error {
+	patterns, err := fieldPatterns(obj, sensitiveFieldsAnnotation)
+	if err != nil {
+		return err
+	}
+	var sensitive, plain []string
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "-") {
+			plain = append(plain, strings.TrimPrefix(pattern, "-"))
+		} else {
+			sensitive = append(sensitive, pattern)
+		}
+	}
+
+	for name, field := range resourceFields {
+		if field.Type != "string" && field.Type != "password" {
+			continue
+		}
+		switch {
+		case matchField(plain, name):
+			field.Type = "string"
+		case matchField(sensitive, name):
+			field.Type = "password"
+		}
+		resourceFields[name] = field
+	}
+	return nil
+}
+
+// fieldFilter returns the white, black, sensitive and required field lists of
+// a driver as recorded in fieldFilterAnnotation.
+func fieldFilter(obj *v3.MachineDriver) string {
+	lists := []string{
+		strings.TrimSpace(obj.Annotations[whitelistFieldsAnnotation]),
+		strings.TrimSpace(obj.Annotations[blacklistFieldsAnnotation]),
+		strings.TrimSpace(obj.Annotations[sensitiveFieldsAnnotation]),
+	}
+	if required, ok := obj.Annotations[requiredFieldsAnnotation]; ok {
+		lists = append(lists, "required="+strings.TrimSpace(required))
+	}
+	// Trailing empty lists are left out, so adding a list does not change
+	// the recorded value of drivers that do not use it.
+	for len(lists) > 0 && lists[len(lists)-1] == "" {
+		lists = lists[:len(lists)-1]
+	}
+	if len(lists) == 1 {
+		return lists[0] + ";"
+	}
+	return strings.Join(lists, ";")
+}
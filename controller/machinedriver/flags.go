@@ -0,0 +1,113 @@
+package machinedriver
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	cli "github.com/docker/machine/libmachine/mcnflag"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// schemaPolicyAnnotation selects what happens when some flags of a driver
+	// cannot be converted: "strict", the default, fails the registration and
+	// "lenient" publishes the converted fields and marks the driver Degraded.
+	schemaPolicyAnnotation = "io.cattle.machine_driver.schema_policy"
+	schemaPolicyStrict     = "strict"
+	schemaPolicyLenient    = "lenient"
+
+	maxConditionReason = 1024
+)
+
+var (
+	MachineDriverConditionFlagsConverted condition.Cond = "FlagsConverted"
+	MachineDriverConditionDegraded       condition.Cond = "Degraded"
+)
+
+// flagError is a driver flag that could not be converted to a schema field.
+type flagError struct {
+	flag     string
+	flagType string
+	err      error
+}
+
+// flagErrors are all conversion failures of the flags of a driver.
+type flagErrors []flagError
+
+func (e flagErrors) Error() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "failed to convert %d driver flags: ", len(e))
+	for i, flagErr := range e {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		fmt.Fprintf(buf, "%s (%s): %v", flagErr.flag, flagErr.flagType, flagErr.err)
+	}
+	return buf.String()
+}
+
+// flagsToFields converts the create flags of a driver to schema fields and
+// returns the fields of the convertible flags together with the failures.
+func flagsToFields(flags []cli.Flag) (map[string]v3.Field, flagErrors) {
+	var errs flagErrors
+	resourceFields := map[string]v3.Field{}
+	for _, flag := range flags {
+		name, field, err := flagToField(flag)
+		if err != nil {
+			errs = append(errs, flagError{
+				flag:     flag.String(),
+				flagType: fmt.Sprint(reflect.TypeOf(flag)),
+				err:      err,
+			})
+			continue
+		}
+		resourceFields[name] = field
+	}
+	return resourceFields, errs
+}
+
+// checkFlagErrors applies the schema policy of a driver to its flag conversion
+// failures and returns an error if the schema must not be published.
+func checkFlagErrors(obj *v3.MachineDriver, errs flagErrors) error {
+	setFlagsConverted(obj, errs)
+
+	policy := obj.Annotations[schemaPolicyAnnotation]
+	switch policy {
+	case "", schemaPolicyStrict:
+		if len(errs) > 0 {
+			return errs
+		}
+	case schemaPolicyLenient:
+	default:
+		return fmt.Errorf("invalid %s annotation %q, must be %s or %s", schemaPolicyAnnotation, policy,
+			schemaPolicyStrict, schemaPolicyLenient)
+	}
+
+	if len(errs) == 0 {
+		MachineDriverConditionDegraded.False(obj)
+		MachineDriverConditionDegraded.Reason(obj, "")
+	} else {
+		MachineDriverConditionDegraded.True(obj)
+		MachineDriverConditionDegraded.Reason(obj, fmt.Sprintf("%d driver flags are not published", len(errs)))
+	}
+	return nil
+}
+
+// setFlagsConverted reports the flag conversion failures of a driver in its
+// FlagsConverted condition.
+func setFlagsConverted(obj *v3.MachineDriver, errs flagErrors) {
+	if len(errs) == 0 {
+		MachineDriverConditionFlagsConverted.True(obj)
+		MachineDriverConditionFlagsConverted.Reason(obj, "")
+		return
+	}
+
+	reason := errs.Error()
+	if len(reason) > maxConditionReason {
+		reason = reason[:maxConditionReason]
+	}
+	MachineDriverConditionFlagsConverted.False(obj)
+	MachineDriverConditionFlagsConverted.Reason(obj, reason)
+}
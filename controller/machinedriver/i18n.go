@@ -0,0 +1,69 @@
+package machinedriver
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// translationsAnnotation holds the per language display strings of the
+	// driver fields, e.g. {"de": {"region": {"displayName": "Region"}}}.
+	translationsAnnotation = "io.cattle.machine_driver.translations"
+	// i18nAnnotationPrefix is suffixed with a language tag on the generated
+	// schema and holds the translated strings of its fields for that language.
+	i18nAnnotationPrefix = "io.cattle.machine_driver.i18n."
+)
+
+type fieldTranslation struct {
+	DisplayName string `json:"displayName,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// translationAnnotations returns the schema annotations carrying the
+// translations of the given fields, one annotation per language. Missing
+// descriptions fall back to the untranslated field description.
+func translationAnnotations(obj *v3.MachineDriver, resourceFields map[string]v3.Field) (map[string]string, error) {
+	data := obj.Annotations[translationsAnnotation]
+	if data == "" {
+		return nil, nil
+	}
+
+	translations := map[string]map[string]fieldTranslation{}
+	if err := json.Unmarshal([]byte(data), &translations); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s annotation", translationsAnnotation)
+	}
+
+	var languages []string
+	for lang := range translations {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	annotations := map[string]string{}
+	for _, lang := range languages {
+		merged := map[string]fieldTranslation{}
+		for name, translation := range translations[lang] {
+			field, ok := resourceFields[name]
+			if !ok {
+				logrus.Warnf("Ignoring %s translation for unknown field %s of machine driver %s", lang, name, obj.Name)
+				continue
+			}
+			if translation.Description == "" {
+				translation.Description = field.Description
+			}
+			merged[name] = translation
+		}
+
+		bytes, err := json.Marshal(merged)
+		if err != nil {
+			return nil, err
+		}
+		annotations[i18nAnnotationPrefix+lang] = string(bytes)
+	}
+
+	return annotations, nil
+}
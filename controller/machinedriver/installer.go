@@ -0,0 +1,112 @@
+package machinedriver
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	initialInstallBackoff = 5 * time.Second
+	maxInstallBackoff     = 10 * time.Minute
+)
+
+// installer activates drivers in the background, so a slow download does not
+// hold up the lifecycle handlers of other drivers. Failed attempts are retried
+// with exponential backoff until they succeed or the driver is removed; the
+// progress is reported in the conditions of the driver.
+type installer struct {
+	sync.Mutex
+	lifecycle *lifecycle
+	running   map[string]bool
+}
+
+func newInstaller(lifecycle *lifecycle) *installer {
+	return &installer{
+		lifecycle: lifecycle,
+		running:   map[string]bool{},
+	}
+}
+
+// start activates the named driver unless that is already in progress. If
+// update is set existing schemas of the driver are replaced.
+func (i *installer) start(name string, update bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.running[name] {
+		return
+	}
+	i.running[name] = true
+	go i.run(name, update)
+}
+
+func (i *installer) pending(name string) bool {
+	i.Lock()
+	defer i.Unlock()
+	return i.running[name]
+}
+
+func (i *installer) run(name string, update bool) {
+	defer func() {
+		i.Lock()
+		delete(i.running, name)
+		i.Unlock()
+	}()
+
+	backoff := initialInstallBackoff
+	for {
+		done, err := i.attempt(name, update)
+		if done {
+			return
+		}
+		logrus.Errorf("Failed to activate machine driver %s, retrying in %v: %v", name, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxInstallBackoff {
+			backoff = maxInstallBackoff
+		}
+	}
+}
+
+// attempt activates the current version of the named driver and saves its
+// conditions. done is set once there is nothing left to retry.
+func (i *installer) attempt(name string, update bool) (bool, error) {
+	client := i.lifecycle.machineDriverClient
+	obj, err := client.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if obj.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	orig := obj
+	obj = obj.DeepCopy()
+	staged := obj.Annotations[stagedAnnotation]
+	// Retry the download instead of returning the error of the last attempt.
+	i.lifecycle.drivers(obj).ClearError()
+	_, activateErr := i.lifecycle.activate(obj, update)
+	conditions.SetTransitionTimes(orig, obj)
+
+	if !reflect.DeepEqual(orig, obj) {
+		if _, err := client.Update(obj); err != nil {
+			return false, err
+		}
+	}
+	if activateErr != nil {
+		return false, activateErr
+	}
+
+	if current := obj.Annotations[stagedAnnotation]; staged != "" && staged != current {
+		removeStaged(staged, current)
+	}
+	logrus.Infof("Activated machine driver %s", name)
+	return true, nil
+}
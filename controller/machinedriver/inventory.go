@@ -0,0 +1,186 @@
+package machinedriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	versionTimeout = 5 * time.Second
+)
+
+var (
+	urlVersionRegexp = regexp.MustCompile(`v?[0-9]+\.[0-9]+(\.[0-9]+)?`)
+
+	// digests caches the checksum and version of binaries by path, size and
+	// modification time, so the inventory does not reread them every time.
+	digestsLock = sync.Mutex{}
+	digests     = map[string]digest{}
+)
+
+type digest struct {
+	checksum, version string
+}
+
+// Binary is a driver binary installed on the controller host.
+type Binary struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	// Version is reported by docker-machine itself; for plugin binaries,
+	// which cannot be queried outside of docker-machine, it is taken from the
+	// download URL of the declaring MachineDriver.
+	Version  string `json:"version,omitempty"`
+	Modified string `json:"modified"`
+	LastUsed string `json:"lastUsed,omitempty"`
+	// Drivers are the MachineDrivers served by the binary, none if the
+	// binary is not declared by any.
+	Drivers []string `json:"drivers,omitempty"`
+}
+
+// Inventory lists the driver binaries installed on the controller host,
+// including docker-machine for the builtin drivers, and relates them to the
+// declared MachineDrivers.
+func Inventory(drivers []*v3.MachineDriver) ([]Binary, error) {
+	binaries := map[string]*Binary{}
+	versions := map[string]string{}
+
+	for _, obj := range drivers {
+		var binaryPath string
+		if obj.Spec.Builtin {
+			p, err := dockermachine.DriverBinary(obj.Name)
+			if err != nil {
+				continue
+			}
+			binaryPath = p
+		} else {
+			driver := newDriver(obj)
+			name, err := isInstalled(driver.cacheFile())
+			if err != nil || name == "" {
+				continue
+			}
+			binaryPath = path.Join(binDir(), name)
+			if v := urlVersionRegexp.FindString(path.Base(obj.Spec.URL)); v != "" {
+				versions[binaryPath] = v
+			}
+		}
+
+		binary := binaries[binaryPath]
+		if binary == nil {
+			binary = &Binary{Path: binaryPath}
+			binaries[binaryPath] = binary
+		}
+		binary.Drivers = append(binary.Drivers, obj.Name)
+	}
+
+	files, err := ioutil.ReadDir(binDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		p := path.Join(binDir(), file.Name())
+		if strings.HasPrefix(file.Name(), "docker-machine-driver-") && binaries[p] == nil {
+			binaries[p] = &Binary{Path: p}
+		}
+	}
+
+	var result []Binary
+	for p, binary := range binaries {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		d, err := digestOf(p, info)
+		if err != nil {
+			continue
+		}
+
+		binary.Name = path.Base(p)
+		binary.Size = info.Size()
+		binary.Modified = info.ModTime().UTC().Format(time.RFC3339)
+		binary.Checksum = d.checksum
+		binary.Version = d.version
+		if binary.Version == "" {
+			binary.Version = versions[p]
+		}
+
+		var lastUsed time.Time
+		users := binary.Drivers
+		if len(users) == 0 {
+			users = []string{strings.TrimPrefix(binary.Name, "docker-machine-driver-")}
+		}
+		for _, driver := range users {
+			if t, ok := dockermachine.LastUsed(driver); ok && t.After(lastUsed) {
+				lastUsed = t
+			}
+		}
+		if !lastUsed.IsZero() {
+			binary.LastUsed = lastUsed.UTC().Format(time.RFC3339)
+		}
+
+		sort.Strings(binary.Drivers)
+		result = append(result, *binary)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func digestOf(p string, info os.FileInfo) (digest, error) {
+	key := fmt.Sprintf("%s:%d:%d", p, info.ModTime().UnixNano(), info.Size())
+	digestsLock.Lock()
+	d, ok := digests[key]
+	digestsLock.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return d, err
+	}
+	d.checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if path.Base(p) == "docker-machine" {
+		d.version = binaryVersion(p)
+	}
+
+	digestsLock.Lock()
+	digests[key] = d
+	digestsLock.Unlock()
+	return d, nil
+}
+
+func binaryVersion(p string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, p, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
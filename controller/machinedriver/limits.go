@@ -0,0 +1,77 @@
+package machinedriver
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/sandbox"
+)
+
+// limitedExecutor starts a driver plugin like the default localbinary
+// executor, but with resource limits and the sandbox applied.
+type limitedExecutor struct {
+	driverName string
+	binaryPath string
+	limits     dockermachine.Limits
+	cmd        *exec.Cmd
+}
+
+func newLimitedExecutor(driverName string, limits dockermachine.Limits) (*limitedExecutor, error) {
+	binaryPath, err := dockermachine.DriverBinary(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &limitedExecutor{
+		driverName: driverName,
+		binaryPath: binaryPath,
+		limits:     limits,
+	}, nil
+}
+
+func (e *limitedExecutor) Start() (*bufio.Scanner, *bufio.Scanner, error) {
+	e.cmd = exec.Command(e.binaryPath)
+	e.cmd.Env = append(dockermachine.Environ(),
+		localbinary.PluginEnvKey+"="+localbinary.PluginEnvVal,
+		localbinary.PluginEnvDriverName+"="+e.driverName)
+	sandbox.Apply(e.cmd)
+	e.limits.Apply(e.cmd)
+
+	stdout, err := e.cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error getting cmd stdout pipe: %s", err)
+	}
+	stderr, err := e.cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error getting cmd stderr pipe: %s", err)
+	}
+
+	if err := e.cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("Error starting plugin binary: %s", err)
+	}
+
+	return bufio.NewScanner(stdout), bufio.NewScanner(stderr), nil
+}
+
+func (e *limitedExecutor) Close() error {
+	if err := e.cmd.Wait(); err != nil {
+		return fmt.Errorf("Error waiting for binary close: %s", err)
+	}
+	return nil
+}
+
+// checkDriverBinary fails unless the binary serving driver is in the allow
+// list, if one is enforced.
+func (m *lifecycle) checkDriverBinary(driver string) error {
+	if m.allowedBinaries == nil {
+		return nil
+	}
+	binary, err := dockermachine.DriverBinary(driver)
+	if err != nil {
+		return err
+	}
+	return m.allowedBinaries.Check(binary)
+}
@@ -0,0 +1,46 @@
+package machinedriver
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localDir is the directory, such as a mounted volume, drivers with a file://
+// URL may be installed from. file:// URLs are refused if it is empty.
+var localDir string
+
+// copyLocal copies the driver at a file:// URL within localDir to dest.
+func copyLocal(driverURL string, dest io.Writer) error {
+	if localDir == "" {
+		return fmt.Errorf("refusing to install driver from %s, no local driver directory is configured", driverURL)
+	}
+	u, err := url.Parse(driverURL)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(localDir)
+	if err != nil {
+		return err
+	}
+	p, err := filepath.EvalSymlinks(filepath.Clean(u.Path))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to install driver from %s, it is outside of %s", driverURL, localDir)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dest, f)
+	return err
+}
@@ -0,0 +1,61 @@
+package machinedriver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// schemaLockTimeout bounds the wait for the update of a schema by another
+	// driver, so an update that hangs fails the ones queued behind it, which
+	// are retried, instead of stalling them.
+	schemaLockTimeout = 2 * time.Minute
+)
+
+// keyedLock serializes work per key, such as the schema being written, so
+// unrelated keys do not wait for each other.
+type keyedLock struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	held chan struct{}
+	refs int
+}
+
+// Lock locks key and returns the function unlocking it, or an error if key
+// is not unlocked within timeout.
+func (k *keyedLock) Lock(key string, timeout time.Duration) (func(), error) {
+	k.lock.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyLock{}
+	}
+	l := k.locks[key]
+	if l == nil {
+		l = &keyLock{held: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.lock.Unlock()
+
+	release := func() {
+		k.lock.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.lock.Unlock()
+	}
+
+	select {
+	case l.held <- struct{}{}:
+	case <-time.After(timeout):
+		release()
+		return nil, fmt.Errorf("timed out waiting for the update of %s", key)
+	}
+	return func() {
+		<-l.held
+		release()
+	}, nil
+}
@@ -0,0 +1,95 @@
+package machinedriver
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedLockSerializesKey(t *testing.T) {
+	locks := &keyedLock{}
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		holders int
+		most    int
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.Lock("machineconfig", time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			if holders++; holders > most {
+				most = holders
+			}
+			lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			holders--
+			lock.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if most != 1 {
+		t.Errorf("%d holders of the same key at once, want 1", most)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d keys are left after all were unlocked", len(locks.locks))
+	}
+}
+
+func TestKeyedLockKeysAreIndependent(t *testing.T) {
+	locks := &keyedLock{}
+	unlock, err := locks.Lock("machineconfig", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	done := make(chan error)
+	go func() {
+		unlockOther, err := locks.Lock("machinetemplateconfig", time.Second)
+		if err == nil {
+			unlockOther()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("locking another key waited for the held one")
+	}
+}
+
+func TestKeyedLockTimesOut(t *testing.T) {
+	locks := &keyedLock{}
+	unlock, err := locks.Lock("machineconfig", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := locks.Lock("machineconfig", 20*time.Millisecond); err == nil {
+		t.Fatal("locking a held key did not time out")
+	}
+	unlock()
+
+	// The timed out acquire must not leave the key locked.
+	unlock, err = locks.Lock("machineconfig", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("key is still locked after it was unlocked: %v", err)
+	}
+	unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("%d keys are left after all were unlocked", len(locks.locks))
+	}
+}
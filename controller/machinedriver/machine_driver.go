@@ -1,63 +1,242 @@
 package machinedriver
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
-	"sync"
-
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/rancher/machine-controller/controller/machine"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/download"
+	"github.com/rancher/machine-controller/policy"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/norman/condition"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
-	schemaLock = sync.Mutex{}
+	// schemaLocks serializes the updates of each parent schema the driver
+	// config fields are embedded in.
+	schemaLocks = keyedLock{}
+
+	MachineDriverConditionChecksumVerified condition.Cond = "ChecksumVerified"
+	MachineDriverConditionDownloaded       condition.Cond = "Downloaded"
+	MachineDriverConditionInstalled        condition.Cond = "Installed"
+	MachineDriverConditionSchemaCreated    condition.Cond = "SchemaCreated"
+	MachineDriverConditionActive           condition.Cond = "Active"
 )
 
 const (
 	driverNameLabel = "io.cattle.machine_driver.name"
+	// namespacesAnnotation lists the tenant namespaces a driver's schema is
+	// published to in multi-tenancy mode.
+	namespacesAnnotation   = "io.cattle.machine_driver.namespaces"
+	defaultSchemaNamespace = "cattle-system"
+
+	maxPatchAttempts = 5
 )
 
-func Register(management *config.ManagementContext) {
+// Register starts the MachineDriver controllers. drivers returns the drivers
+// the binaries of MachineDrivers are staged and installed with, normally
+// DriverFor.
+func Register(management *config.ManagementContext, opts options.Options, drivers DriverFactory) {
+	allowedBinaries, err := policy.NewBinaryAllowList(management.K8sClient.CoreV1(), opts.DriverAllowListKey)
+	if err != nil {
+		logrus.Fatalf("Invalid driver allow list key: %v", err)
+	}
+
+	var ca []byte
+	if opts.DriverDownloadCA != "" {
+		ca, err = download.LoadCA(management.K8sClient.CoreV1(), management.K8sClient.CoreV1(), opts.DriverDownloadCA)
+		if err != nil {
+			logrus.Fatalf("Invalid driver download CA bundle: %v", err)
+		}
+	}
+	var cert *tls.Certificate
+	if opts.Download.ClientCertificate != "" {
+		cert, err = download.LoadCertificate(management.K8sClient.CoreV1(), opts.Download.ClientCertificate)
+		if err != nil {
+			logrus.Fatalf("Invalid driver download client certificate: %v", err)
+		}
+	}
+	if err := download.Configure(opts.Download, ca, cert); err != nil {
+		logrus.Fatalf("Invalid driver download settings: %v", err)
+	}
+
+	localDir = opts.DriverLocalDir
+
 	machineDriverLifecycle := &lifecycle{
 		machineDriverClient: management.Management.MachineDrivers(""),
 		schemaClient:        management.Management.DynamicSchemas(""),
+		restClient:          management.Management.RESTClient(),
+		secrets:             management.K8sClient.CoreV1(),
+		configMaps:          management.K8sClient.CoreV1(),
+		machineIndexer:      management.Management.Machines("").Controller().Informer().GetIndexer(),
+		multiTenancy:        opts.MultiTenancy,
+		allowedBinaries:     allowedBinaries,
+		drivers:             drivers,
 	}
+	machineDriverLifecycle.installer = newInstaller(machineDriverLifecycle)
+	machineDriverLifecycle.verifier = newVerifier(machineDriverLifecycle)
 	management.Management.MachineDrivers("").AddLifecycle("machine-driver-controller", machineDriverLifecycle)
+
+	go checkInstalledDrivers(machineDriverLifecycle.machineDriverClient)
+	drift := &driftReconciler{
+		lifecycle: machineDriverLifecycle,
+	}
+	go drift.run()
+	if opts.DriverStaleAfter > 0 {
+		evictor := &staleEvictor{
+			client:     machineDriverLifecycle.machineDriverClient,
+			machines:   machineDriverLifecycle.machineIndexer,
+			after:      opts.DriverStaleAfter,
+			deactivate: opts.DriverStaleDeactivate,
+		}
+		go evictor.run()
+	}
+	if opts.SeedBuiltinDrivers {
+		go seedBuiltinDrivers(machineDriverLifecycle.machineDriverClient)
+	}
+	if opts.DriverCatalog != "" {
+		go seedCatalog(machineDriverLifecycle.machineDriverClient, opts.DriverCatalog, opts.DriverCatalogKey)
+	}
 }
 
 type lifecycle struct {
 	machineDriverClient v3.MachineDriverInterface
 	schemaClient        v3.DynamicSchemaInterface
+	restClient          rest.Interface
+	secrets             typedv1.SecretsGetter
+	configMaps          typedv1.ConfigMapsGetter
+	machineIndexer      cache.Indexer
+	multiTenancy        bool
+	allowedBinaries     *policy.BinaryAllowList
+	installer           *installer
+	verifier            *verifier
+	drivers             DriverFactory
+}
+
+// schemaNamespaces returns the namespaces the schemas of a driver are
+// published to. "" stands for cluster scope.
+func (m *lifecycle) schemaNamespaces(obj *v3.MachineDriver) []string {
+	if !m.multiTenancy {
+		return []string{""}
+	}
+
+	var namespaces []string
+	for _, ns := range strings.Split(obj.Annotations[namespacesAnnotation], ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{defaultSchemaNamespace}
+	}
+	return namespaces
+}
+
+func (m *lifecycle) schemaClientFor(namespace string) schemastore.Client {
+	if namespace == "" {
+		return m.schemaClient
+	}
+	return schemastore.NewNamespacedClient(m.restClient, namespace)
 }
 
 func (m *lifecycle) Create(obj *v3.MachineDriver) (*v3.MachineDriver, error) {
+	orig := obj.DeepCopy()
+	defer conditions.SetTransitionTimes(orig, obj)
+
 	// if machine driver was created, we also activate the driver by default
-	driver := NewDriver(obj.Spec.Builtin, obj.Name, obj.Spec.URL, obj.Spec.Checksum)
-	if err := driver.Stage(); err != nil {
-		return nil, err
+	MachineDriverConditionDownloaded.Unknown(obj)
+	MachineDriverConditionDownloaded.Reason(obj, "Pending")
+	m.installer.start(obj.Name, false)
+	return obj, nil
+}
+
+// activate stages and installs the driver binary of obj and publishes the
+// schema generated from its flags. Existing schemas are only replaced if
+// update is set.
+func (m *lifecycle) activate(obj *v3.MachineDriver, update bool) (*v3.MachineDriver, error) {
+	driver := m.drivers(obj)
+	err := driver.Stage()
+	if checksumErr, ok := err.(*checksumError); ok {
+		logrus.Errorf("Machine driver %s: %v", obj.Name, checksumErr)
+		MachineDriverConditionChecksumVerified.False(obj)
+		MachineDriverConditionChecksumVerified.Reason(obj, checksumErr.Error())
+	}
+	if err := setCondition(obj, MachineDriverConditionDownloaded, err); err != nil {
+		return obj, err
+	}
+	if obj.Spec.Checksum != "" && !obj.Spec.Builtin {
+		MachineDriverConditionChecksumVerified.True(obj)
+		MachineDriverConditionChecksumVerified.Reason(obj, "")
 	}
 
-	if err := driver.Install(); err != nil {
+	driverName := strings.TrimPrefix(driver.Name(), "docker-machine-driver-")
+	err = driver.Install()
+	if err != nil {
 		logrus.Errorf("Failed to download/install driver %s: %v", driver.Name(), err)
-		return nil, err
+	} else if err = m.checkDriverBinary(driverName); err != nil {
+		logrus.Errorf("Refusing to run driver %s: %v", driver.Name(), err)
+	}
+	if err := setCondition(obj, MachineDriverConditionInstalled, err); err != nil {
+		return obj, err
 	}
 
-	driverName := strings.TrimPrefix(driver.Name(), "docker-machine-driver-")
-	flags, err := getCreateFlagsForDriver(driverName)
+	err = m.publish(obj, driver, update)
+	if err := setCondition(obj, MachineDriverConditionSchemaCreated, err); err != nil {
+		return obj, err
+	}
+	if err := setActive(obj, m.embed(obj)); err != nil {
+		return obj, err
+	}
+
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[stagedAnnotation] = driver.CacheKey()
+	return obj, nil
+}
+
+// publish generates the schema of a driver from the flags of its installed
+// binary and publishes it to the schema namespaces of the driver.
+func (m *lifecycle) publish(obj *v3.MachineDriver, driver Driver, update bool) error {
+	limits, err := dockermachine.ParseLimits(obj.Annotations[dockermachine.LimitsAnnotation])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	resourceFields := map[string]v3.Field{}
-	for _, flag := range flags {
-		name, field, err := flagToField(flag)
-		if err != nil {
-			return nil, err
-		}
-		resourceFields[name] = field
+	flags, err := driver.CreateFlags(limits)
+	if err != nil {
+		return err
+	}
+	resourceFields, flagErrs := flagsToFields(flags)
+	if len(flagErrs) > 0 {
+		logrus.Errorf("Machine driver %s: %v", obj.Name, flagErrs)
+	}
+	if err := checkFlagErrors(obj, flagErrs); err != nil {
+		return err
+	}
+	markRequiredFields(obj, resourceFields)
+	if err := applyFieldOverrides(obj, resourceFields); err != nil {
+		return err
+	}
+	if err := filterFields(obj, resourceFields); err != nil {
+		return err
+	}
+	if err := markSensitiveFields(obj, resourceFields); err != nil {
+		return err
 	}
 	dynamicSchema := &v3.DynamicSchema{
 		Spec: v3.DynamicSchemaSpec{
@@ -73,59 +252,215 @@ func (m *lifecycle) Create(obj *v3.MachineDriver) (*v3.MachineDriver, error) {
 			Name:       obj.Name,
 		},
 	}
-	dynamicSchema.Labels = map[string]string{}
-	dynamicSchema.Labels[driverNameLabel] = obj.Name
-	_, err = m.schemaClient.Create(dynamicSchema)
-	if err != nil && !errors.IsAlreadyExists(err) {
-		return nil, err
+	dynamicSchema.Labels = schemaLabels(obj)
+	dynamicSchema.Annotations, err = schemaMetadata(obj)
+	if err != nil {
+		return err
 	}
-	if err := m.createOrUpdateMachineForEmbeddedType(dynamicSchema.Name, obj.Name+"Config", obj.Spec.Active); err != nil {
-		return nil, err
+	translations, err := translationAnnotations(obj, resourceFields)
+	if err != nil {
+		return err
 	}
-	return obj, nil
+	for k, v := range translations {
+		dynamicSchema.Annotations[k] = v
+	}
+	bounds, err := fieldBounds(obj, resourceFields)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(bounds)
+	if err != nil {
+		return err
+	}
+	dynamicSchema.Annotations[policy.BoundsAnnotation] = string(data)
+	rules, err := fieldRules(obj, resourceFields)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	dynamicSchema.Annotations[policy.RulesAnnotation] = string(data)
+	binary, err := installedBinary(obj, driver)
+	if err != nil {
+		logrus.Warnf("Failed to checksum driver binary of machine driver %s: %v", obj.Name, err)
+	} else {
+		dynamicSchema.Annotations[driverChecksumAnnotation] = binary.Checksum
+		if binary.Version != "" {
+			dynamicSchema.Annotations[driverVersionAnnotation] = binary.Version
+		}
+	}
+	recordSchemaMetrics(dynamicSchema)
+	for _, ns := range m.schemaNamespaces(obj) {
+		client := m.schemaClientFor(ns)
+		schema := dynamicSchema.DeepCopy()
+		schema.Namespace = ns
+		if err := publishSchema(client, schema, update); err != nil {
+			return err
+		}
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[fieldFilterAnnotation] = fieldFilter(obj)
+	if err := m.migrateSchema(obj, binary, resourceFields); err != nil {
+		logrus.Warnf("Failed to compare schema revisions of machine driver %s: %v", obj.Name, err)
+	}
+	revision, err := m.recordSchemaRevision(obj, resourceFields, binary)
+	if err != nil {
+		logrus.Warnf("Failed to record schema revision of machine driver %s: %v", obj.Name, err)
+	} else {
+		obj.Annotations[schemaRevisionAnnotation] = strconv.Itoa(revision)
+	}
+	return nil
+}
+
+// embed adds the driver config field to the machine schemas of the schema
+// namespaces of an active driver, and removes it for an inactive one.
+func (m *lifecycle) embed(obj *v3.MachineDriver) error {
+	for _, ns := range m.schemaNamespaces(obj) {
+		if err := m.createOrUpdateMachineForEmbeddedType(ns, obj.Name+"config", obj.Name+"Config", obj.Spec.Active); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishSchema(client schemastore.Client, schema *v3.DynamicSchema, update bool) error {
+	if !update {
+		return schemastore.Create(client, schema)
+	}
+	err := schemastore.Update(client, schema)
+	if errors.IsNotFound(err) {
+		return schemastore.Create(client, schema)
+	}
+	return err
+}
+
+// setCondition records the outcome of the step behind cond. The condition is
+// only touched when it changes, so a step failing the same way over and over
+// does not update the driver on every attempt.
+func setCondition(obj *v3.MachineDriver, cond condition.Cond, err error) error {
+	if err != nil {
+		if !cond.IsFalse(obj) || cond.GetReason(obj) != err.Error() {
+			cond.False(obj)
+			cond.Reason(obj, err.Error())
+		}
+		return err
+	}
+	if !cond.IsTrue(obj) || cond.GetReason(obj) != "" {
+		cond.True(obj)
+		cond.Reason(obj, "")
+	}
+	return nil
+}
+
+// setActive records the outcome of embedding the driver config in the machine
+// schemas. An inactive driver is not a failure, its Active condition is
+// Unknown.
+func setActive(obj *v3.MachineDriver, err error) error {
+	if err != nil || obj.Spec.Active {
+		return setCondition(obj, MachineDriverConditionActive, err)
+	}
+	if !MachineDriverConditionActive.IsUnknown(obj) || MachineDriverConditionActive.GetReason(obj) != "Inactive" {
+		MachineDriverConditionActive.Unknown(obj)
+		MachineDriverConditionActive.Reason(obj, "Inactive")
+	}
+	return nil
 }
 
 func (m *lifecycle) Updated(obj *v3.MachineDriver) (*v3.MachineDriver, error) {
 	// YOU MUST CALL DEEPCOPY
-	if err := m.createOrUpdateMachineForEmbeddedType(obj.Name+"config", obj.Name+"Config", obj.Spec.Active); err != nil {
-		return nil, err
+	if m.installer.pending(obj.Name) {
+		// The installer saves the driver once the activation is done.
+		return nil, nil
+	}
+	orig := obj.DeepCopy()
+	if err := setActive(obj, m.embed(obj)); err != nil {
+		conditions.SetTransitionTimes(orig, obj)
+		return obj, err
+	}
+	if m.restage(obj) {
+		conditions.SetTransitionTimes(orig, obj)
+		return obj, nil
+	}
+	m.syncMetadata(obj)
+	obj, verified := m.verify(obj)
+	obj, rolledBack := m.rollback(obj)
+	if verified || rolledBack || !reflect.DeepEqual(orig.Status, obj.Status) {
+		conditions.SetTransitionTimes(orig, obj)
+		return obj, nil
 	}
 	return nil, nil
 }
 
 func (m *lifecycle) Remove(obj *v3.MachineDriver) (*v3.MachineDriver, error) {
-	schemas, err := m.schemaClient.List(metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("%s=%s", driverNameLabel, obj.Name),
-	})
-	if err != nil {
-		return nil, err
+	if machines, err := m.machineIndexer.ByIndex(machine.MachineByDriverIndex, obj.Name); err == nil && len(machines) > 0 {
+		logrus.Warnf("Removing machine driver %s still used by %d machines", obj.Name, len(machines))
 	}
-	for _, schema := range schemas.Items {
-		logrus.Infof("Deleting schema %s", schema.Name)
-		if err := m.schemaClient.Delete(schema.Name, &metav1.DeleteOptions{}); err != nil {
+	for _, ns := range m.schemaNamespaces(obj) {
+		if err := m.removeSchemas(ns, obj); err != nil {
 			return nil, err
 		}
-		logrus.Infof("Deleting schema %s done", schema.Name)
 	}
-	if err := m.createOrUpdateMachineForEmbeddedType(obj.Name+"config", obj.Name+"Config", false); err != nil {
+	if err := m.removeBinaries(obj); err != nil {
 		return nil, err
 	}
 	return obj, nil
 }
 
-func (m *lifecycle) createOrUpdateMachineForEmbeddedType(embeddedType, fieldName string, embedded bool) error {
-	schemaLock.Lock()
-	defer schemaLock.Unlock()
+func (m *lifecycle) removeSchemas(namespace string, obj *v3.MachineDriver) error {
+	client := m.schemaClientFor(namespace)
+	schemas, err := schemastore.ListAll(client, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", driverNameLabel, obj.Name),
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range schemas {
+		logrus.Infof("Deleting schema %s", name)
+		if err := client.Delete(name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		deleteSchemaMetrics(name)
+		logrus.Infof("Deleting schema %s done", name)
+	}
+	return m.createOrUpdateMachineForEmbeddedType(namespace, obj.Name+"config", obj.Name+"Config", false)
+}
+
+func (m *lifecycle) createOrUpdateMachineForEmbeddedType(namespace, embeddedType, fieldName string, embedded bool) error {
+	if err := m.createOrUpdateMachineForEmbeddedTypeWithParents(namespace, embeddedType, fieldName, "machineconfig", "machine", embedded); err != nil {
+		return err
+	}
+
+	return m.createOrUpdateMachineForEmbeddedTypeWithParents(namespace, embeddedType, fieldName, "machinetemplateconfig", "machineTemplate", embedded)
+}
 
-	if err := m.createOrUpdateMachineForEmbeddedTypeWithParents(embeddedType, fieldName, "machineconfig", "machine", embedded); err != nil {
+// createOrUpdateMachineForEmbeddedTypeWithParents adds or removes the driver
+// config field of a parent schema. Other controllers edit these schemas too, so
+// existing schemas are only changed with JSON patches scoped to our field,
+// retried on conflicts.
+func (m *lifecycle) createOrUpdateMachineForEmbeddedTypeWithParents(namespace, embeddedType, fieldName, schemaID, parentID string, embedded bool) error {
+	unlock, err := schemaLocks.Lock(namespace+"/"+schemaID, schemaLockTimeout)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	return m.createOrUpdateMachineForEmbeddedTypeWithParents(embeddedType, fieldName, "machinetemplateconfig", "machineTemplate", embedded)
+	for i := 0; i < maxPatchAttempts; i++ {
+		err = m.patchMachineForEmbeddedType(namespace, embeddedType, fieldName, schemaID, parentID, embedded)
+		if !errors.IsConflict(err) && !errors.IsInvalid(err) && !errors.IsAlreadyExists(err) {
+			return err
+		}
+		logrus.Debugf("Retrying update of schema %s: %v", schemaID, err)
+	}
+	return err
 }
 
-func (m *lifecycle) createOrUpdateMachineForEmbeddedTypeWithParents(embeddedType, fieldName, schemaID, parentID string, embedded bool) error {
-	machineSchema, err := m.schemaClient.Get(schemaID, metav1.GetOptions{})
+func (m *lifecycle) patchMachineForEmbeddedType(namespace, embeddedType, fieldName, schemaID, parentID string, embedded bool) error {
+	client := m.schemaClientFor(namespace)
+	machineSchema, err := client.Get(schemaID, metav1.GetOptions{})
 	if err != nil && !errors.IsNotFound(err) {
 		return err
 	} else if errors.IsNotFound(err) {
@@ -134,7 +469,7 @@ func (m *lifecycle) createOrUpdateMachineForEmbeddedTypeWithParents(embeddedType
 			resourceField[fieldName] = v3.Field{
 				Create:   true,
 				Nullable: true,
-				Update:   false,
+				Update:   true,
 				Type:     embeddedType,
 			}
 		}
@@ -143,43 +478,40 @@ func (m *lifecycle) createOrUpdateMachineForEmbeddedTypeWithParents(embeddedType
 		dynamicSchema.Spec.ResourceFields = resourceField
 		dynamicSchema.Spec.Embed = true
 		dynamicSchema.Spec.EmbedType = parentID
-		_, err := m.schemaClient.Create(dynamicSchema)
+		_, err := client.Create(dynamicSchema)
 		if err != nil {
 			return err
 		}
+		recordSchemaMetrics(dynamicSchema)
 		return nil
 	}
-	shouldUpdate := false
-	if embedded {
-		if machineSchema.Spec.ResourceFields == nil {
-			machineSchema.Spec.ResourceFields = map[string]v3.Field{}
-		}
-		if _, ok := machineSchema.Spec.ResourceFields[fieldName]; !ok {
-			// if embedded we add the type to schema
-			logrus.Infof("uploading %s to machine schema", fieldName)
-			machineSchema.Spec.ResourceFields[fieldName] = v3.Field{
-				Create:   true,
-				Nullable: true,
-				Update:   true,
-				Type:     embeddedType,
-			}
-			shouldUpdate = true
-		}
-	} else {
+
+	var ops []schemastore.PatchOp
+	field, exists := machineSchema.Spec.ResourceFields[fieldName]
+	if embedded && !exists {
+		// if embedded we add the type to schema
+		logrus.Infof("uploading %s to machine schema", fieldName)
+		ops = schemastore.AddFieldOps(machineSchema, fieldName, v3.Field{
+			Create:   true,
+			Nullable: true,
+			Update:   true,
+			Type:     embeddedType,
+		})
+	} else if !embedded && exists {
 		// if not we delete it from schema
-		if _, ok := machineSchema.Spec.ResourceFields[fieldName]; ok {
-			logrus.Infof("deleting %s from machine schema", fieldName)
-			delete(machineSchema.Spec.ResourceFields, fieldName)
-			shouldUpdate = true
-		}
+		logrus.Infof("deleting %s from machine schema", fieldName)
+		ops = schemastore.RemoveFieldOps(fieldName, field)
 	}
 
-	if shouldUpdate {
-		_, err = m.schemaClient.Update(machineSchema)
-		if err != nil {
+	if len(ops) > 0 {
+		if err := schemastore.JSONPatch(m.restClient, namespace, schemaID, ops); err != nil {
+			return err
+		}
+		if machineSchema, err = client.Get(schemaID, metav1.GetOptions{}); err != nil {
 			return err
 		}
 	}
+	recordSchemaMetrics(machineSchema)
 
 	return nil
 }
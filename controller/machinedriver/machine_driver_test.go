@@ -0,0 +1,324 @@
+package machinedriver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	cli "github.com/docker/machine/libmachine/mcnflag"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+type fakeMachineDrivers struct {
+	v3.MachineDriverInterface
+	lock sync.Mutex
+	objs map[string]*v3.MachineDriver
+}
+
+func (f *fakeMachineDrivers) Get(name string, opts metav1.GetOptions) (*v3.MachineDriver, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	obj, ok := f.objs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "machinedrivers"}, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (f *fakeMachineDrivers) Update(obj *v3.MachineDriver) (*v3.MachineDriver, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.objs[obj.Name] = obj.DeepCopy()
+	return obj, nil
+}
+
+type fakeSchemas struct {
+	v3.DynamicSchemaInterface
+	lock sync.Mutex
+	objs map[string]*v3.DynamicSchema
+}
+
+func (f *fakeSchemas) Create(obj *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.objs[obj.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "dynamicschemas"}, obj.Name)
+	}
+	f.objs[obj.Name] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeSchemas) Get(name string, opts metav1.GetOptions) (*v3.DynamicSchema, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	obj, ok := f.objs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (f *fakeSchemas) Update(obj *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.objs[obj.Name]; !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, obj.Name)
+	}
+	f.objs[obj.Name] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeSchemas) Delete(name string, options *metav1.DeleteOptions) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.objs, name)
+	return nil
+}
+
+func (f *fakeSchemas) List(opts metav1.ListOptions) (*v3.DynamicSchemaList, error) {
+	return &v3.DynamicSchemaList{}, nil
+}
+
+// fakeConfigMaps holds no schema revisions and accepts new ones.
+type fakeConfigMaps struct {
+	typedv1.ConfigMapInterface
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) typedv1.ConfigMapInterface {
+	return f
+}
+
+func (f *fakeConfigMaps) List(opts metav1.ListOptions) (*v1.ConfigMapList, error) {
+	return &v1.ConfigMapList{}, nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return cm, nil
+}
+
+func newTestLifecycle(drivers *FakeDrivers, objs ...*v3.MachineDriver) (*lifecycle, *fakeMachineDrivers, *fakeSchemas) {
+	client := &fakeMachineDrivers{objs: map[string]*v3.MachineDriver{}}
+	for _, obj := range objs {
+		client.objs[obj.Name] = obj
+	}
+	// The machine schemas embed the drivers already, as patching them needs
+	// a REST client.
+	schemas := &fakeSchemas{objs: map[string]*v3.DynamicSchema{}}
+	for _, id := range []string{"machineconfig", "machinetemplateconfig"} {
+		machineSchema := &v3.DynamicSchema{}
+		machineSchema.Name = id
+		machineSchema.Spec.ResourceFields = map[string]v3.Field{}
+		for _, obj := range objs {
+			machineSchema.Spec.ResourceFields[obj.Name+"Config"] = v3.Field{Type: obj.Name + "config"}
+		}
+		schemas.objs[id] = machineSchema
+	}
+	m := &lifecycle{
+		machineDriverClient: client,
+		schemaClient:        schemas,
+		configMaps:          &fakeConfigMaps{},
+		drivers:             drivers.Factory(),
+	}
+	m.installer = newInstaller(m)
+	m.verifier = newVerifier(m)
+	return m, client, schemas
+}
+
+func waitInstalled(t *testing.T, m *lifecycle, name string) {
+	for deadline := time.Now().Add(10 * time.Second); m.installer.pending(name); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("activation of %s did not finish", name)
+		}
+	}
+}
+
+func testDriver(name, url string) *v3.MachineDriver {
+	obj := &v3.MachineDriver{}
+	obj.Name = name
+	obj.Spec.URL = url
+	obj.Spec.Active = true
+	return obj
+}
+
+func TestCreateActivatesThroughDriver(t *testing.T) {
+	flag := &cli.StringFlag{Name: "fake-region", Usage: "Region"}
+	drivers := &FakeDrivers{
+		New: func(obj *v3.MachineDriver, driver *FakeDriver) {
+			driver.Flags = []cli.Flag{flag}
+			driver.Checksum = "0123abcd"
+		},
+	}
+	a := testDriver("a", "https://example.com/a/v1.0.0/docker-machine-driver-a")
+	b := testDriver("b", "https://example.com/b/v2.0.0/docker-machine-driver-b")
+	m, client, schemas := newTestLifecycle(drivers, a.DeepCopy(), b.DeepCopy())
+
+	for _, obj := range []*v3.MachineDriver{a, b} {
+		if _, err := m.Create(obj.DeepCopy()); err != nil {
+			t.Fatal(err)
+		}
+		waitInstalled(t, m, obj.Name)
+	}
+
+	fieldName, _, err := flagToField(flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range []*v3.MachineDriver{a, b} {
+		driver := drivers.Driver(obj.Name)
+		if got := driver.Name(); got != "docker-machine-driver-"+obj.Name {
+			t.Errorf("driver %s is named %s", obj.Name, got)
+		}
+		saved, _ := client.Get(obj.Name, metav1.GetOptions{})
+		for _, cond := range []string{"Downloaded", "Installed", "SchemaCreated"} {
+			if status := conditionOf(saved, cond); status != "True" {
+				t.Errorf("driver %s has condition %s %q, want True", obj.Name, cond, status)
+			}
+		}
+		if got := saved.Annotations[stagedAnnotation]; got != obj.Spec.URL {
+			t.Errorf("driver %s was staged as %q, want %q", obj.Name, got, obj.Spec.URL)
+		}
+		schema, err := schemas.Get(obj.Name+"config", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("schema of driver %s: %v", obj.Name, err)
+		}
+		if _, ok := schema.Spec.ResourceFields[fieldName]; !ok {
+			t.Errorf("schema of driver %s has no field %s: %v", obj.Name, fieldName, schema.Spec.ResourceFields)
+		}
+		if got := schema.Annotations[driverChecksumAnnotation]; got != "0123abcd" {
+			t.Errorf("schema of driver %s has checksum %q", obj.Name, got)
+		}
+	}
+	if drivers.Driver("a") == drivers.Driver("b") {
+		t.Error("drivers a and b share a FakeDriver")
+	}
+}
+
+func TestUpdatedRestagesChangedURL(t *testing.T) {
+	drivers := &FakeDrivers{}
+	obj := testDriver("a", "https://example.com/a/v1.0.0/docker-machine-driver-a")
+	m, client, _ := newTestLifecycle(drivers, obj.DeepCopy())
+	if _, err := m.Create(obj.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	waitInstalled(t, m, obj.Name)
+
+	saved, _ := client.Get(obj.Name, metav1.GetOptions{})
+	if _, err := m.Updated(saved.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if m.installer.pending(obj.Name) {
+		t.Fatal("unchanged driver is staged again")
+	}
+
+	saved.Spec.URL = "https://example.com/a/v1.1.0/docker-machine-driver-a"
+	client.Update(saved)
+	if _, err := m.Updated(saved.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	waitInstalled(t, m, obj.Name)
+
+	saved, _ = client.Get(obj.Name, metav1.GetOptions{})
+	if got := saved.Annotations[stagedAnnotation]; got != saved.Spec.URL {
+		t.Errorf("driver was staged as %q, want %q", got, saved.Spec.URL)
+	}
+	stages := 0
+	for _, call := range drivers.Driver(obj.Name).Calls() {
+		if call == "Stage" {
+			stages++
+		}
+	}
+	if stages != 2 {
+		t.Errorf("driver was staged %d times, want 2", stages)
+	}
+}
+
+func conditionOf(obj *v3.MachineDriver, cond string) string {
+	for _, c := range obj.Status.Conditions {
+		if c.Type == cond {
+			return string(c.Status)
+		}
+	}
+	return ""
+}
+
+func TestParentSchemaPatchRetriesConflicts(t *testing.T) {
+	conflict := `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Conflict", "code": 409}`
+	forbidden := `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Forbidden", "code": 403}`
+	tests := []struct {
+		name      string
+		failures  []string
+		codes     []int
+		patches   int
+		succeeded bool
+	}{
+		{name: "no conflict", patches: 1, succeeded: true},
+		{name: "conflict once", failures: []string{conflict}, codes: []int{409}, patches: 2, succeeded: true},
+		{
+			name:     "conflicts persist",
+			failures: []string{conflict, conflict, conflict, conflict, conflict},
+			codes:    []int{409, 409, 409, 409, 409},
+			patches:  maxPatchAttempts,
+		},
+		{name: "other errors are not retried", failures: []string{forbidden}, codes: []int{403}, patches: 1},
+	}
+	for _, test := range tests {
+		m, _, schemas := newTestLifecycle(&FakeDrivers{})
+		patches := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if patches++; patches <= len(test.failures) {
+				w.WriteHeader(test.codes[patches-1])
+				w.Write([]byte(test.failures[patches-1]))
+				return
+			}
+			schema, _ := schemas.Get("machineconfig", metav1.GetOptions{})
+			schema.Spec.ResourceFields["aConfig"] = v3.Field{Type: "aconfig"}
+			schemas.Update(schema)
+			w.Write([]byte("{}"))
+		}))
+		m.restClient = newTestRESTClient(t, server)
+
+		err := m.createOrUpdateMachineForEmbeddedTypeWithParents("", "aconfig", "aConfig", "machineconfig", "machine", true)
+		server.Close()
+		if patches != test.patches {
+			t.Errorf("%s: patched %d times, want %d", test.name, patches, test.patches)
+		}
+		if test.succeeded && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.succeeded && err == nil {
+			t.Errorf("%s: failed patches are not returned", test.name)
+		}
+		schema, _ := schemas.Get("machineconfig", metav1.GetOptions{})
+		if _, ok := schema.Spec.ResourceFields["aConfig"]; ok != test.succeeded {
+			t.Errorf("%s: machineconfig has the field %v, want %v", test.name, ok, test.succeeded)
+		}
+	}
+}
+
+// newTestRESTClient returns a REST client talking to server.
+func newTestRESTClient(t *testing.T, server *httptest.Server) rest.Interface {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gv := v3.DynamicSchemaGroupVersionKind.GroupVersion()
+	client, err := rest.NewRESTClient(u, "", rest.ContentConfig{
+		GroupVersion:         &gv,
+		NegotiatedSerializer: scheme.Codecs,
+	}, 0, 0, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
@@ -0,0 +1,153 @@
+package machinedriver
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// linksAnnotation holds a comma separated list of documentation URLs for
+	// a driver. It is set by admins on the MachineDriver and copied to the
+	// generated schema together with the driver description.
+	linksAnnotation       = "io.cattle.machine_driver.links"
+	descriptionAnnotation = "io.cattle.machine_driver.description"
+	// uiURLAnnotation on a generated schema is the URL of the UI component of
+	// the driver, from the uiUrl of the MachineDriver. iconURLAnnotation is set
+	// by admins on the MachineDriver and copied to the schema as well.
+	uiURLAnnotation   = "io.cattle.machine_driver.ui_url"
+	iconURLAnnotation = "io.cattle.machine_driver.icon_url"
+	// uiLabel marks the schemas of drivers that ship a UI component, so the
+	// UI can list them with a label selector.
+	uiLabel = "io.cattle.machine_driver.ui"
+
+	maxDescriptionLength = 1024
+)
+
+// schemaMetadata returns the annotations describing the driver that are set on
+// its generated schema.
+func schemaMetadata(obj *v3.MachineDriver) (map[string]string, error) {
+	annotations := map[string]string{}
+
+	description := strings.TrimSpace(obj.Spec.Description)
+	if len(description) > maxDescriptionLength {
+		return nil, fmt.Errorf("description of machine driver %s is longer than %d characters", obj.Name, maxDescriptionLength)
+	}
+	if description != "" {
+		annotations[descriptionAnnotation] = description
+	}
+
+	var links []string
+	for _, link := range strings.Split(obj.Annotations[linksAnnotation], ",") {
+		link = strings.TrimSpace(link)
+		if link == "" {
+			continue
+		}
+		if err := validateURL(link); err != nil {
+			return nil, fmt.Errorf("invalid documentation link for machine driver %s: %v", obj.Name, err)
+		}
+		links = append(links, link)
+	}
+	if len(links) > 0 {
+		annotations[linksAnnotation] = strings.Join(links, ",")
+	}
+
+	for key, value := range map[string]string{
+		uiURLAnnotation:   obj.Spec.UIURL,
+		iconURLAnnotation: obj.Annotations[iconURLAnnotation],
+	} {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if err := validateURL(value); err != nil {
+			return nil, fmt.Errorf("invalid %s for machine driver %s: %v", key, obj.Name, err)
+		}
+		annotations[key] = value
+	}
+
+	return annotations, nil
+}
+
+// schemaLabels returns the labels of the generated schema of a driver.
+func schemaLabels(obj *v3.MachineDriver) map[string]string {
+	labels := map[string]string{
+		driverNameLabel: obj.Name,
+	}
+	if strings.TrimSpace(obj.Spec.UIURL) != "" {
+		labels[uiLabel] = "true"
+	}
+	return labels
+}
+
+// syncMetadata updates the metadata of the published schemas of a driver after
+// the description, documentation links, UI or icon URL of the driver changed,
+// which does not stage the driver again.
+func (m *lifecycle) syncMetadata(obj *v3.MachineDriver) {
+	annotations, err := schemaMetadata(obj)
+	if err != nil {
+		logrus.Errorf("Failed to update schema metadata: %v", err)
+		return
+	}
+	labels := schemaLabels(obj)
+
+	for _, ns := range m.schemaNamespaces(obj) {
+		client := m.schemaClientFor(ns)
+		schema, err := client.Get(obj.Name+"config", metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			logrus.Errorf("Failed to get schema of machine driver %s: %v", obj.Name, err)
+			continue
+		}
+
+		updated := schema.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		for _, key := range []string{descriptionAnnotation, linksAnnotation, uiURLAnnotation, iconURLAnnotation} {
+			if value, ok := annotations[key]; ok {
+				updated.Annotations[key] = value
+			} else {
+				delete(updated.Annotations, key)
+			}
+		}
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			updated.Labels[key] = value
+		}
+		if labels[uiLabel] == "" {
+			delete(updated.Labels, uiLabel)
+		}
+
+		if reflect.DeepEqual(schema.Annotations, updated.Annotations) && reflect.DeepEqual(schema.Labels, updated.Labels) {
+			continue
+		}
+		logrus.Infof("Updating metadata of schema %s", schema.Name)
+		if _, err := client.Update(updated); err != nil {
+			logrus.Errorf("Failed to update metadata of schema %s: %v", schema.Name, err)
+		}
+	}
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s must be an http or https URL", value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s has no host", value)
+	}
+	return nil
+}
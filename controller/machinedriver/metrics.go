@@ -0,0 +1,30 @@
+package machinedriver
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/machine-controller/metrics"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+var (
+	schemaFieldCount = metrics.NewGaugeVec("machine_controller_schema_fields",
+		"Number of resource fields in a generated dynamic schema", "schema")
+	schemaSizeBytes = metrics.NewGaugeVec("machine_controller_schema_size_bytes",
+		"Serialized size of the spec of a dynamic schema", "schema")
+)
+
+func recordSchemaMetrics(schema *v3.DynamicSchema) {
+	schemaFieldCount.Set(float64(len(schema.Spec.ResourceFields)), schema.Name)
+
+	bytes, err := json.Marshal(schema.Spec)
+	if err != nil {
+		return
+	}
+	schemaSizeBytes.Set(float64(len(bytes)), schema.Name)
+}
+
+func deleteSchemaMetrics(name string) {
+	schemaFieldCount.Delete(name)
+	schemaSizeBytes.Delete(name)
+}
@@ -0,0 +1,143 @@
+package machinedriver
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/policy"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	fieldOverridesAnnotation = "io.cattle.machine_driver.field_overrides"
+)
+
+// fieldOverride holds the admin supplied changes to a generated schema field.
+// Only the attributes that are set replace the values derived from the driver
+// flag. Rules have no attribute on the field and are recorded on the schema.
+type fieldOverride struct {
+	Description  *string  `json:"description,omitempty"`
+	Required     *bool    `json:"required,omitempty"`
+	Create       *bool    `json:"create,omitempty"`
+	Update       *bool    `json:"update,omitempty"`
+	Min          *int64   `json:"min,omitempty"`
+	Max          *int64   `json:"max,omitempty"`
+	MinLength    *int64   `json:"minLength,omitempty"`
+	MaxLength    *int64   `json:"maxLength,omitempty"`
+	Options      []string `json:"options,omitempty"`
+	ValidChars   *string  `json:"validChars,omitempty"`
+	InvalidChars *string  `json:"invalidChars,omitempty"`
+
+	Rules []policy.FieldRule `json:"rules,omitempty"`
+}
+
+func getFieldOverrides(obj *v3.MachineDriver) (map[string]fieldOverride, error) {
+	overrides := map[string]fieldOverride{}
+
+	data := obj.Annotations[fieldOverridesAnnotation]
+	if data == "" {
+		return overrides, nil
+	}
+
+	if err := json.Unmarshal([]byte(data), &overrides); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s annotation", fieldOverridesAnnotation)
+	}
+	return overrides, nil
+}
+
+func applyFieldOverrides(obj *v3.MachineDriver, resourceFields map[string]v3.Field) error {
+	overrides, err := getFieldOverrides(obj)
+	if err != nil {
+		return err
+	}
+
+	for name, override := range overrides {
+		field, ok := resourceFields[name]
+		if !ok {
+			logrus.Warnf("Ignoring override for unknown field %s of machine driver %s", name, obj.Name)
+			continue
+		}
+		resourceFields[name] = override.apply(field)
+	}
+	return nil
+}
+
+// fieldBounds returns the bounds the overrides of a driver set, recorded in
+// policy.BoundsAnnotation of its schema so bounds of zero are enforced too.
+func fieldBounds(obj *v3.MachineDriver, resourceFields map[string]v3.Field) (map[string]policy.Bounds, error) {
+	overrides, err := getFieldOverrides(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := map[string]policy.Bounds{}
+	for name, override := range overrides {
+		if _, ok := resourceFields[name]; !ok || (override.Min == nil && override.Max == nil) {
+			continue
+		}
+		bounds[name] = policy.Bounds{Min: override.Min, Max: override.Max}
+	}
+	return bounds, nil
+}
+
+// fieldRules returns the rules the overrides of a driver set, recorded in
+// policy.RulesAnnotation of its schema. A rule that does not compile fails
+// the schema, like an override that does not parse.
+func fieldRules(obj *v3.MachineDriver, resourceFields map[string]v3.Field) (map[string][]policy.FieldRule, error) {
+	overrides, err := getFieldOverrides(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := map[string][]policy.FieldRule{}
+	for name, override := range overrides {
+		if _, ok := resourceFields[name]; !ok || len(override.Rules) == 0 {
+			continue
+		}
+		for _, rule := range override.Rules {
+			if _, err := policy.CompileFieldRule(resourceFields, rule); err != nil {
+				return nil, errors.Wrapf(err, "invalid rule %q of field %s", rule.Rule, name)
+			}
+		}
+		rules[name] = override.Rules
+	}
+	return rules, nil
+}
+
+func (o fieldOverride) apply(field v3.Field) v3.Field {
+	if o.Description != nil {
+		field.Description = *o.Description
+	}
+	if o.Required != nil {
+		field.Required = *o.Required
+	}
+	if o.Create != nil {
+		field.Create = *o.Create
+	}
+	if o.Update != nil {
+		field.Update = *o.Update
+	}
+	if o.Min != nil {
+		field.Min = *o.Min
+	}
+	if o.Max != nil {
+		field.Max = *o.Max
+	}
+	if o.MinLength != nil {
+		field.MinLength = *o.MinLength
+	}
+	if o.MaxLength != nil {
+		field.MaxLength = *o.MaxLength
+	}
+	if o.Options != nil {
+		field.Options = o.Options
+	}
+	if o.ValidChars != nil {
+		field.ValidChars = *o.ValidChars
+	}
+	if o.InvalidChars != nil {
+		field.InvalidChars = *o.InvalidChars
+	}
+	return field
+}
@@ -0,0 +1,58 @@
+package machinedriver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/machine-controller/policy"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+func TestFieldRules(t *testing.T) {
+	resourceFields := map[string]v3.Field{
+		"rootSize":     {Type: "int"},
+		"instanceType": {Type: "string"},
+	}
+	tests := []struct {
+		name      string
+		overrides string
+		rules     map[string][]policy.FieldRule
+		err       bool
+	}{
+		{
+			name:      "rules of known fields",
+			overrides: `{"rootSize": {"min": 8, "rules": [{"rule": "self >= 40 || instanceType.startsWith('t2.')"}]}, "zone": {"rules": [{"rule": "true"}]}}`,
+			rules: map[string][]policy.FieldRule{
+				"rootSize": {{Rule: "self >= 40 || instanceType.startsWith('t2.')"}},
+			},
+		},
+		{
+			name:      "rule referring to an unknown field",
+			overrides: `{"rootSize": {"rules": [{"rule": "self >= diskSize"}]}}`,
+			err:       true,
+		},
+		{
+			name:      "rule that does not parse",
+			overrides: `{"rootSize": {"rules": [{"rule": "self >="}]}}`,
+			err:       true,
+		},
+	}
+	for _, test := range tests {
+		obj := &v3.MachineDriver{}
+		obj.Annotations = map[string]string{fieldOverridesAnnotation: test.overrides}
+		rules, err := fieldRules(obj, resourceFields)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("%s: rules are %v, want %v", test.name, rules, test.rules)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package machinedriver
+
+import (
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// requiredFieldsAnnotation on a MachineDriver lists the generated schema
+	// fields, comma separated, a driver config must set. It replaces the
+	// builtin list of the driver, if any.
+	requiredFieldsAnnotation = "io.cattle.machine_driver.required_fields"
+)
+
+// defaultRequiredFields are the fields the builtin drivers cannot create a
+// machine without. Credentials that can come from an AWS role, a GCP workload
+// identity or an Azure certificate are left out.
+var defaultRequiredFields = map[string][]string{
+	"amazonec2":       {"region"},
+	"azure":           {"subscriptionId"},
+	"digitalocean":    {"accessToken"},
+	"exoscale":        {"apiKey", "apiSecretKey"},
+	"google":          {"project"},
+	"openstack":       {"authUrl"},
+	"packet":          {"apiKey", "projectId"},
+	"rackspace":       {"username", "apiKey", "region"},
+	"softlayer":       {"user", "apiKey"},
+	"vmwarevcloudair": {"username", "password"},
+	"vmwarevsphere":   {"vcenter", "username", "password"},
+}
+
+// requiredFields returns the fields a config of the driver must set.
+func requiredFields(obj *v3.MachineDriver) []string {
+	data, ok := obj.Annotations[requiredFieldsAnnotation]
+	if !ok {
+		return defaultRequiredFields[obj.Name]
+	}
+	var fields []string
+	for _, name := range strings.Split(data, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// markRequiredFields marks the required fields of a driver in resourceFields.
+func markRequiredFields(obj *v3.MachineDriver, resourceFields map[string]v3.Field) {
+	for _, name := range requiredFields(obj) {
+		if field, ok := resourceFields[name]; ok {
+			field.Required = true
+			resourceFields[name] = field
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package machinedriver
+
+import (
+	"os"
+	"path"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// stagedAnnotation records the cache key of the binary the schema of a
+	// driver was generated from. When the URL or checksum of the driver
+	// changes so does the key, and the driver is staged again.
+	stagedAnnotation = "io.cattle.machine_driver.staged"
+)
+
+// restage activates a driver again in the background if its URL or checksum
+// changed, or its last activation failed, which replaces its binary and its
+// schema with one generated from the new flags. A change of its white, black,
+// sensitive or required field lists activates it again from the cached binary,
+// to generate its schema again. It returns whether obj was changed.
+func (m *lifecycle) restage(obj *v3.MachineDriver) bool {
+	if activationFailed(obj) {
+		m.installer.start(obj.Name, true)
+		return false
+	}
+	if fieldFilter(obj) != obj.Annotations[fieldFilterAnnotation] {
+		logrus.Infof("Field lists of machine driver %s changed, publishing its schema again", obj.Name)
+		m.installer.start(obj.Name, true)
+		return false
+	}
+	if obj.Spec.Builtin {
+		return false
+	}
+
+	driver := m.drivers(obj)
+	staged := obj.Annotations[stagedAnnotation]
+	if staged == driver.CacheKey() {
+		return false
+	}
+	if staged == "" {
+		// Drivers activated before the key was recorded are assumed current.
+		if obj.Annotations == nil {
+			obj.Annotations = map[string]string{}
+		}
+		obj.Annotations[stagedAnnotation] = driver.CacheKey()
+		return true
+	}
+
+	logrus.Infof("URL or checksum of machine driver %s changed, staging it again", obj.Name)
+	m.installer.start(obj.Name, true)
+	return false
+}
+
+// activationFailed returns whether a step of the last activation of a driver
+// failed, or has not completed yet.
+func activationFailed(obj *v3.MachineDriver) bool {
+	for _, cond := range obj.Status.Conditions {
+		switch condition.Cond(cond.Type) {
+		case MachineDriverConditionDownloaded, MachineDriverConditionInstalled, MachineDriverConditionSchemaCreated:
+			if cond.Status != "True" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeStaged removes the binary cached under key, and its installed copy
+// unless the binary cached under current was installed over it.
+func removeStaged(key, current string) {
+	prefix := cacheFile(key)
+	name, err := isInstalled(prefix)
+	if err != nil || name == "" {
+		return
+	}
+
+	if installed, _ := isInstalled(cacheFile(current)); name != installed {
+		logrus.Infof("Removing replaced driver binary %s", name)
+		os.Remove(path.Join(binDir(), name))
+	}
+	os.Remove(prefix + "-" + name)
+	os.Remove(prefix + ".error")
+	os.Remove(prefix)
+}
@@ -0,0 +1,176 @@
+package machinedriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	schemastore "github.com/rancher/machine-controller/store/schema"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// rollbackAction restores the resource fields of a driver schema from a
+	// revision. The input is the revision number, or empty for the revision
+	// before the current one.
+	rollbackAction = "rollback"
+
+	// schemaRevisionAnnotation on a MachineDriver is the revision its schema
+	// currently has.
+	schemaRevisionAnnotation = "io.cattle.machine_driver.schema_revision"
+	revisionOfLabel          = "io.cattle.machine_driver.schema_revision_of"
+	revisionLabel            = "io.cattle.machine_driver.schema_revision"
+	revisionNamespace        = "cattle-system"
+	revisionFieldsKey        = "resourceFields"
+	maxSchemaRevisions       = 5
+)
+
+// schemaRevisions returns the stored revisions of a driver schema, oldest
+// first.
+func (m *lifecycle) schemaRevisions(obj *v3.MachineDriver) ([]v1.ConfigMap, error) {
+	revisions, err := m.configMaps.ConfigMaps(revisionNamespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", revisionOfLabel, obj.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := revisions.Items
+	sort.Slice(items, func(i, j int) bool {
+		return revisionNumber(&items[i]) < revisionNumber(&items[j])
+	})
+	return items, nil
+}
+
+func revisionNumber(cm *v1.ConfigMap) int {
+	n, _ := strconv.Atoi(cm.Labels[revisionLabel])
+	return n
+}
+
+// recordSchemaRevision stores the generated resource fields of a driver, and
+// the binary they were generated from, as a new revision, keeps the last
+// maxSchemaRevisions and returns its number.
+func (m *lifecycle) recordSchemaRevision(obj *v3.MachineDriver, fields map[string]v3.Field, binary driverBinary) (int, error) {
+	revisions, err := m.schemaRevisions(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	next := 1
+	if len(revisions) > 0 {
+		next = revisionNumber(&revisions[len(revisions)-1]) + 1
+	}
+
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			revisionFieldsKey: string(data),
+		},
+	}
+	setBinaryData(cm, binary)
+	cm.Name = fmt.Sprintf("%sconfig-rev-%d", obj.Name, next)
+	cm.Namespace = revisionNamespace
+	cm.Labels = map[string]string{
+		revisionOfLabel: obj.Name,
+		revisionLabel:   strconv.Itoa(next),
+	}
+	cm.OwnerReferences = []metav1.OwnerReference{
+		{
+			UID:        obj.UID,
+			Kind:       obj.Kind,
+			APIVersion: obj.APIVersion,
+			Name:       obj.Name,
+		},
+	}
+	if _, err := m.configMaps.ConfigMaps(revisionNamespace).Create(cm); err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(revisions)+1-maxSchemaRevisions; i++ {
+		if err := m.configMaps.ConfigMaps(revisionNamespace).Delete(revisions[i].Name, nil); err != nil {
+			logrus.Warnf("Failed to prune schema revision %s: %v", revisions[i].Name, err)
+		}
+	}
+	return next, nil
+}
+
+func (m *lifecycle) rollback(obj *v3.MachineDriver) (*v3.MachineDriver, bool) {
+	input, ok := action.Pending(obj, rollbackAction)
+	if !ok {
+		return obj, false
+	}
+
+	revision, err := m.rollbackSchema(obj, input)
+	output := ""
+	if err == nil {
+		output = strconv.Itoa(revision)
+		obj.Annotations[schemaRevisionAnnotation] = output
+		logrus.Infof("Rolled back schema of machine driver %s to revision %d", obj.Name, revision)
+	} else {
+		logrus.Errorf("Rollback of machine driver %s failed: %v", obj.Name, err)
+	}
+	action.Complete(obj, rollbackAction, output, err)
+	return obj, true
+}
+
+func (m *lifecycle) rollbackSchema(obj *v3.MachineDriver, input string) (int, error) {
+	revisions, err := m.schemaRevisions(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	var target *v1.ConfigMap
+	if input == "" {
+		current, err := strconv.Atoi(obj.Annotations[schemaRevisionAnnotation])
+		if err != nil && len(revisions) > 0 {
+			current = revisionNumber(&revisions[len(revisions)-1])
+		}
+		for i := range revisions {
+			if revisionNumber(&revisions[i]) < current {
+				target = &revisions[i]
+			}
+		}
+	} else {
+		for i := range revisions {
+			if strconv.Itoa(revisionNumber(&revisions[i])) == input {
+				target = &revisions[i]
+			}
+		}
+	}
+	if target == nil {
+		return 0, fmt.Errorf("no schema revision %q to roll back to", input)
+	}
+
+	fields := map[string]v3.Field{}
+	if err := json.Unmarshal([]byte(target.Data[revisionFieldsKey]), &fields); err != nil {
+		return 0, errors.Wrapf(err, "failed to parse schema revision %s", target.Name)
+	}
+
+	for _, ns := range m.schemaNamespaces(obj) {
+		schema := &v3.DynamicSchema{}
+		schema.Name = obj.Name + "config"
+		schema.Spec.ResourceFields = fields
+		if checksum := target.Data[revisionChecksumKey]; checksum != "" {
+			schema.Annotations = map[string]string{
+				driverChecksumAnnotation: checksum,
+			}
+			if version := target.Data[revisionVersionKey]; version != "" {
+				schema.Annotations[driverVersionAnnotation] = version
+			}
+		}
+		if err := schemastore.Update(m.schemaClientFor(ns), schema); err != nil {
+			return 0, err
+		}
+	}
+	return revisionNumber(target), nil
+}
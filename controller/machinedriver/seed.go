@@ -0,0 +1,80 @@
+package machinedriver
+
+import (
+	"github.com/rancher/machine-controller/catalog"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// catalogAnnotation, catalogDigestAnnotation and binaryDigestAnnotation
+	// record where a seeded MachineDriver came from: the catalog index URL,
+	// the sha256 digest of the index and the checksum of the driver binary.
+	catalogAnnotation       = "io.cattle.machine_driver.catalog"
+	catalogDigestAnnotation = "io.cattle.machine_driver.catalog_digest"
+	binaryDigestAnnotation  = "io.cattle.machine_driver.binary_digest"
+)
+
+// seedCatalog creates the MachineDrivers of a catalog that do not exist yet.
+// Existing drivers are never changed.
+func seedCatalog(client v3.MachineDriverInterface, indexURL, key string) {
+	var publicKey ed25519.PublicKey
+	if key == "" {
+		logrus.Warnf("No key configured for driver catalog %s, its signature is not verified", indexURL)
+	} else {
+		var err error
+		if publicKey, err = catalog.ParsePublicKey(key); err != nil {
+			logrus.Errorf("Not seeding driver catalog %s: %v", indexURL, err)
+			return
+		}
+	}
+
+	index, digest, err := catalog.Fetch(indexURL, publicKey)
+	if err != nil {
+		logrus.Errorf("Not seeding driver catalog %s: %v", indexURL, err)
+		return
+	}
+
+	for _, entry := range index.Drivers {
+		obj := &v3.MachineDriver{
+			Spec: v3.MachineDriverSpec{
+				Description: entry.Description,
+				URL:         entry.URL,
+				Checksum:    entry.Checksum,
+				Builtin:     entry.Builtin,
+				Active:      entry.Active,
+			},
+		}
+		obj.Name = entry.Name
+		obj.Annotations = map[string]string{
+			catalogAnnotation:       indexURL,
+			catalogDigestAnnotation: digest,
+			binaryDigestAnnotation:  entry.Checksum,
+		}
+		if created, err := createMissing(client, obj); err != nil {
+			logrus.Errorf("Failed to seed machine driver %s from %s: %v", entry.Name, indexURL, err)
+		} else if created {
+			logrus.Infof("Seeded machine driver %s from %s", entry.Name, indexURL)
+		}
+	}
+}
+
+// createMissing creates obj unless a MachineDriver of the same name exists,
+// and returns whether it did.
+func createMissing(client v3.MachineDriverInterface, obj *v3.MachineDriver) (bool, error) {
+	if _, err := client.Get(obj.Name, metav1.GetOptions{}); err == nil {
+		return false, nil
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if _, err := client.Create(obj); errors.IsAlreadyExists(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package machinedriver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/rancher/machine-controller/controller/machine"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// lastUsedAnnotation records when a driver was last used for a machine
+	// operation or flag extraction, persisting the usage tracked on the
+	// controller host.
+	lastUsedAnnotation = "io.cattle.machine_driver.last_used"
+
+	staleCheckInterval = time.Hour
+)
+
+var (
+	MachineDriverConditionUsed condition.Cond = "Used"
+)
+
+// staleEvictor flags, and optionally deactivates, drivers no machine uses that
+// have not been used for a while.
+type staleEvictor struct {
+	client     v3.MachineDriverInterface
+	machines   cache.Indexer
+	after      time.Duration
+	deactivate bool
+}
+
+func (e *staleEvictor) run() {
+	for {
+		time.Sleep(staleCheckInterval)
+		drivers, err := listDrivers(e.client)
+		if err != nil {
+			logrus.Errorf("Stale driver check failed to list machine drivers: %v", err)
+			continue
+		}
+		for i := range drivers {
+			if err := e.check(&drivers[i]); err != nil {
+				logrus.Errorf("Stale driver check of machine driver %s failed: %v", drivers[i].Name, err)
+			}
+		}
+	}
+}
+
+func (e *staleEvictor) check(orig *v3.MachineDriver) error {
+	lastUsed := lastUsed(orig)
+	lastUsedValue := lastUsed.UTC().Format(time.RFC3339)
+
+	machines, err := e.machines.ByIndex(machine.MachineByDriverIndex, orig.Name)
+	if err != nil {
+		return err
+	}
+	stale := len(machines) == 0 && time.Since(lastUsed) > e.after
+
+	unchanged := orig.Annotations[lastUsedAnnotation] == lastUsedValue &&
+		(stale && MachineDriverConditionUsed.IsFalse(orig) || !stale && MachineDriverConditionUsed.IsTrue(orig))
+	if unchanged && !(stale && e.deactivate && orig.Spec.Active) {
+		return nil
+	}
+
+	obj := orig.DeepCopy()
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[lastUsedAnnotation] = lastUsedValue
+	if !stale {
+		MachineDriverConditionUsed.True(obj)
+		MachineDriverConditionUsed.Reason(obj, "")
+	} else {
+		MachineDriverConditionUsed.False(obj)
+		MachineDriverConditionUsed.Reason(obj, fmt.Sprintf("unused since %s", lastUsed.UTC().Format(time.RFC3339)))
+		if e.deactivate && obj.Spec.Active {
+			logrus.Infof("Deactivating machine driver %s, unused since %s", obj.Name, lastUsed.UTC().Format(time.RFC3339))
+			obj.Spec.Active = false
+		}
+	}
+
+	conditions.SetTransitionTimes(orig, obj)
+	_, err = e.client.Update(obj)
+	return err
+}
+
+// lastUsed returns the latest of the usage recorded on the driver, the usage
+// tracked on this host and the creation of the driver.
+func lastUsed(obj *v3.MachineDriver) time.Time {
+	last := obj.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, obj.Annotations[lastUsedAnnotation]); err == nil && t.After(last) {
+		last = t
+	}
+	if t, ok := dockermachine.LastUsed(strings.TrimPrefix(obj.Name, "docker-machine-driver-")); ok && t.After(last) {
+		last = t
+	}
+	return last
+}
@@ -0,0 +1,29 @@
+package machinedriver
+
+import (
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+const (
+	// StateActive is the state of an active machine driver without failed
+	// conditions.
+	StateActive = "active"
+	// StateInactive is the state of a machine driver that is not active.
+	StateInactive = "inactive"
+	// StateFailed is the state of a machine driver with a failed condition.
+	StateFailed = "failed"
+)
+
+// State returns the state of a machine driver, as reported by its events and
+// the query view, and the reason of the condition that failed, if any.
+func State(obj *v3.MachineDriver) (string, string) {
+	for _, cond := range obj.Status.Conditions {
+		if cond.Status == "False" {
+			return StateFailed, cond.Reason
+		}
+	}
+	if obj.Spec.Active {
+		return StateActive, ""
+	}
+	return StateInactive, ""
+}
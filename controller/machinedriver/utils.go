@@ -5,10 +5,13 @@ import (
 	"net/rpc"
 	"reflect"
 	"strings"
+	"unicode"
 
 	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
 	rpcdriver "github.com/docker/machine/libmachine/drivers/rpc"
 	cli "github.com/docker/machine/libmachine/mcnflag"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/machine-controller/sandbox"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/sirupsen/logrus"
 )
@@ -23,20 +26,25 @@ func flagToField(flag cli.Flag) (string, v3.Field, error) {
 	if err != nil {
 		return name, field, err
 	}
+	field.Update = dockermachine.IsUpdatableField(name)
 
 	switch v := flag.(type) {
 	case *cli.StringFlag:
-		field.Description = v.Usage
+		if dockermachine.IsCredentialField(name) {
+			field.Type = "password"
+		}
+		field.Description = flagDescription(name, v.Usage)
 		field.Default.StringValue = v.Value
 	case *cli.IntFlag:
-		field.Description = v.Usage
+		field.Type = "int"
+		field.Description = flagDescription(name, v.Usage)
 		field.Default.IntValue = v.Value
 	case *cli.BoolFlag:
 		field.Type = "boolean"
-		field.Description = v.Usage
+		field.Description = flagDescription(name, v.Usage)
 	case *cli.StringSliceFlag:
 		field.Type = "array[string]"
-		field.Description = v.Usage
+		field.Description = flagDescription(name, v.Usage)
 		field.Default.StringSliceValue = v.Value
 	default:
 		return name, field, fmt.Errorf("unknown type of flag %v: %v", flag, reflect.TypeOf(flag))
@@ -45,6 +53,26 @@ func flagToField(flag cli.Flag) (string, v3.Field, error) {
 	return name, field, nil
 }
 
+// flagDescription returns the usage text of a flag as field description, or a
+// description derived from the field name for flags without one.
+func flagDescription(name, usage string) string {
+	if usage = strings.TrimSpace(usage); usage != "" {
+		return usage
+	}
+	description := ""
+	for i, r := range name {
+		switch {
+		case i == 0:
+			description += strings.ToUpper(string(r))
+		case unicode.IsUpper(r):
+			description += " " + strings.ToLower(string(r))
+		default:
+			description += string(r)
+		}
+	}
+	return description
+}
+
 func toLowerCamelCase(machineFlagName string) (string, error) {
 	parts := strings.SplitN(machineFlagName, "-", 2)
 	if len(parts) != 2 {
@@ -58,12 +86,20 @@ func toLowerCamelCase(machineFlagName string) (string, error) {
 	return flagName, nil
 }
 
-func getCreateFlagsForDriver(driver string) ([]cli.Flag, error) {
+func getCreateFlagsForDriver(driver string, limits dockermachine.Limits) ([]cli.Flag, error) {
 	logrus.Debug("Starting binary ", driver)
+	dockermachine.MarkUsed(driver)
 	p, err := localbinary.NewPlugin(driver)
 	if err != nil {
 		return nil, err
 	}
+	if !limits.IsZero() || sandbox.Enabled() {
+		executor, err := newLimitedExecutor(driver, limits)
+		if err != nil {
+			return nil, err
+		}
+		p.Executor = executor
+	}
 	go func() {
 		err := p.Serve()
 		if err != nil {
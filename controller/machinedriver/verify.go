@@ -0,0 +1,227 @@
+package machinedriver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/controller/action"
+	"github.com/rancher/machine-controller/controller/conditions"
+	"github.com/rancher/machine-controller/dockermachine"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// verifyAction provisions and destroys a throwaway machine. Its input is
+	// the name of a Secret in cattle-system holding the driver config, keyed
+	// by field name.
+	verifyAction = "verify"
+
+	verifySecretNamespace = "cattle-system"
+	maxActionOutput       = 4096
+	// verifyTimeout limits the create and SSH check of the throwaway machine,
+	// verifyRemoveTimeout its removal, which is attempted in any case.
+	verifyTimeout       = 20 * time.Minute
+	verifyRemoveTimeout = 10 * time.Minute
+)
+
+var (
+	MachineDriverConditionVerified condition.Cond = "Verified"
+)
+
+// verifier runs verifications in the background, as creating a machine takes
+// minutes and must not hold up the lifecycle handlers of other drivers. The
+// result is saved on the driver when the verification is done.
+type verifier struct {
+	sync.Mutex
+	lifecycle *lifecycle
+	running   map[string]bool
+}
+
+func newVerifier(lifecycle *lifecycle) *verifier {
+	return &verifier{
+		lifecycle: lifecycle,
+		running:   map[string]bool{},
+	}
+}
+
+// start verifies the named driver with the config in secretName unless a
+// verification of it is already running, and returns whether it started one.
+func (v *verifier) start(name, secretName string) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.running[name] {
+		return false
+	}
+	v.running[name] = true
+	go v.run(name, secretName)
+	return true
+}
+
+func (v *verifier) run(name, secretName string) {
+	defer func() {
+		v.Lock()
+		delete(v.running, name)
+		v.Unlock()
+	}()
+
+	client := v.lifecycle.machineDriverClient
+	obj, err := client.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		logrus.Errorf("Failed to get machine driver %s to verify: %v", name, err)
+		return
+	}
+
+	logrus.Infof("Verifying machine driver %s", name)
+	output, verifyErr := v.lifecycle.testDrive(obj, secretName)
+	if len(output) > maxActionOutput {
+		output = output[len(output)-maxActionOutput:]
+	}
+	if verifyErr != nil {
+		logrus.Errorf("Verification of machine driver %s failed: %v", name, verifyErr)
+	} else {
+		logrus.Infof("Verification of machine driver %s succeeded", name)
+	}
+
+	for i := 0; i < maxPatchAttempts; i++ {
+		obj, err = client.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return
+		} else if err != nil {
+			break
+		}
+		if input, ok := action.Pending(obj, verifyAction); !ok || input != secretName {
+			return
+		}
+		orig := obj
+		obj = obj.DeepCopy()
+		action.Complete(obj, verifyAction, output, verifyErr)
+		if verifyErr != nil {
+			MachineDriverConditionVerified.False(obj)
+			MachineDriverConditionVerified.Reason(obj, verifyErr.Error())
+		} else {
+			MachineDriverConditionVerified.True(obj)
+			MachineDriverConditionVerified.Reason(obj, "")
+		}
+		conditions.SetTransitionTimes(orig, obj)
+		if _, err = client.Update(obj); !apierrors.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		logrus.Errorf("Failed to save verification of machine driver %s: %v", name, err)
+	}
+}
+
+// verify starts the requested verification of a driver and returns whether
+// obj was changed.
+func (m *lifecycle) verify(obj *v3.MachineDriver) (*v3.MachineDriver, bool) {
+	secretName, ok := action.Pending(obj, verifyAction)
+	if !ok || !m.verifier.start(obj.Name, secretName) {
+		return obj, false
+	}
+	MachineDriverConditionVerified.Unknown(obj)
+	MachineDriverConditionVerified.Reason(obj, "Verifying")
+	return obj, true
+}
+
+// testDrive creates a machine with the config from the given secret, checks
+// that it is reachable over SSH and removes it again.
+func (m *lifecycle) testDrive(obj *v3.MachineDriver, secretName string) (string, error) {
+	secret, err := m.secrets.Secrets(verifySecretNamespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get driver config secret %s", secretName)
+	}
+
+	driver := m.drivers(obj)
+	if err := driver.Stage(); err != nil {
+		return "", errors.Wrap(err, "failed to stage driver")
+	}
+	driverName := strings.TrimPrefix(driver.Name(), "docker-machine-driver-")
+	if err := m.checkDriverBinary(driverName); err != nil {
+		return "", err
+	}
+	limits, err := dockermachine.ParseLimits(obj.Annotations[dockermachine.LimitsAnnotation])
+	if err != nil {
+		return "", err
+	}
+
+	config := map[string]interface{}{}
+	for k, v := range secret.Data {
+		config[k] = string(v)
+	}
+
+	dockermachine.MarkUsed(driverName)
+	machineDir, err := ioutil.TempDir("", "machine-driver-verify")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(machineDir)
+
+	name := fmt.Sprintf("verify-%s-%s", obj.Name, strconv.FormatInt(time.Now().Unix(), 36))
+	output := &bytes.Buffer{}
+
+	deadline := time.Now().Add(verifyTimeout)
+	createArgs := append([]string{"create", "-d", driverName}, dockermachine.DriverFlags(driverName, config)...)
+	createArgs = append(createArgs, name)
+	err = runVerifyCommand(output, machineDir, limits, deadline, createArgs...)
+	if err == nil {
+		err = runVerifyCommand(output, machineDir, limits, deadline, "ssh", name, "true")
+		if err != nil {
+			err = errors.Wrap(err, "ssh check failed")
+		}
+	} else {
+		err = errors.Wrap(err, "create failed")
+	}
+
+	deadline = time.Now().Add(verifyRemoveTimeout)
+	if rmErr := runVerifyCommand(output, machineDir, limits, deadline, "rm", "-f", name); rmErr != nil && err == nil {
+		err = errors.Wrap(rmErr, "remove failed")
+	}
+
+	return output.String(), err
+}
+
+// runVerifyCommand runs docker-machine with args, killing it at deadline, and
+// appends its output to output.
+func runVerifyCommand(output *bytes.Buffer, machineDir string, limits dockermachine.Limits, deadline time.Time, args ...string) error {
+	cmd := dockermachine.LimitedCommand(machineDir, args, limits)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("docker-machine %s timed out", args[0])
+	}
+	fmt.Fprintf(output, "$ docker-machine %s (%v)\n%s", args[0], time.Since(start), out)
+	return err
+}
@@ -0,0 +1,209 @@
+package machinedriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// driverChecksumAnnotation and driverVersionAnnotation on a generated
+	// schema are the sha256 checksum and, where known, the version of the
+	// driver binary the schema was generated from.
+	driverChecksumAnnotation = "io.cattle.machine_driver.driver_checksum"
+	driverVersionAnnotation  = "io.cattle.machine_driver.driver_version"
+	// schemaMigrationAnnotation on a MachineDriver reports, as a JSON
+	// schemaMigration, how the schema changed the last time the driver
+	// binary changed.
+	schemaMigrationAnnotation = "io.cattle.machine_driver.schema_migration"
+
+	revisionChecksumKey = "driverChecksum"
+	revisionVersionKey  = "driverVersion"
+)
+
+var (
+	MachineDriverConditionSchemaCompatible condition.Cond = "SchemaCompatible"
+)
+
+// driverBinary identifies the binary a schema was generated from.
+type driverBinary struct {
+	Checksum string
+	Version  string
+}
+
+// schemaMigration lists the fields a new driver binary added, removed and
+// changed compared to the schema of the binary before it.
+type schemaMigration struct {
+	FromVersion  string        `json:"fromVersion,omitempty"`
+	ToVersion    string        `json:"toVersion,omitempty"`
+	FromChecksum string        `json:"fromChecksum"`
+	ToChecksum   string        `json:"toChecksum"`
+	FromRevision int           `json:"fromRevision"`
+	Time         string        `json:"time"`
+	Added        []string      `json:"added,omitempty"`
+	Removed      []string      `json:"removed,omitempty"`
+	Changed      []fieldChange `json:"changed,omitempty"`
+}
+
+type fieldChange struct {
+	Field   string   `json:"field"`
+	Changes []string `json:"changes"`
+}
+
+// installedBinary returns the checksum and version of the installed binary of
+// a driver. The version of plugin binaries is taken from their download URL.
+func installedBinary(obj *v3.MachineDriver, driver Driver) (driverBinary, error) {
+	checksum, version, err := driver.Binary()
+	if err != nil {
+		return driverBinary{}, err
+	}
+	binary := driverBinary{
+		Checksum: checksum,
+		Version:  version,
+	}
+	if binary.Version == "" && !obj.Spec.Builtin {
+		binary.Version = urlVersionRegexp.FindString(path.Base(obj.Spec.URL))
+	}
+	return binary, nil
+}
+
+// migrateSchema compares the fields generated from a driver binary with the
+// latest schema revision. If that revision was generated from another binary
+// the differences are recorded in schemaMigrationAnnotation and the
+// SchemaCompatible condition of the driver.
+func (m *lifecycle) migrateSchema(obj *v3.MachineDriver, binary driverBinary, fields map[string]v3.Field) error {
+	if binary.Checksum == "" {
+		return nil
+	}
+	revisions, err := m.schemaRevisions(obj)
+	if err != nil || len(revisions) == 0 {
+		return err
+	}
+	latest := &revisions[len(revisions)-1]
+	if latest.Data[revisionChecksumKey] == "" || latest.Data[revisionChecksumKey] == binary.Checksum {
+		return nil
+	}
+
+	previous := map[string]v3.Field{}
+	if err := json.Unmarshal([]byte(latest.Data[revisionFieldsKey]), &previous); err != nil {
+		return fmt.Errorf("failed to parse schema revision %s: %v", latest.Name, err)
+	}
+	migration := diffFields(previous, fields)
+	migration.FromVersion = latest.Data[revisionVersionKey]
+	migration.ToVersion = binary.Version
+	migration.FromChecksum = latest.Data[revisionChecksumKey]
+	migration.ToChecksum = binary.Checksum
+	migration.FromRevision = revisionNumber(latest)
+	migration.Time = time.Now().UTC().Format(time.RFC3339)
+
+	data, err := json.Marshal(migration)
+	if err != nil {
+		return err
+	}
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[schemaMigrationAnnotation] = string(data)
+
+	if len(migration.Removed) > 0 || len(migration.Changed) > 0 {
+		logrus.Warnf("Machine driver %s upgraded to %s: %s", obj.Name, versionOf(binary), migration.summary())
+		MachineDriverConditionSchemaCompatible.False(obj)
+	} else {
+		logrus.Infof("Machine driver %s upgraded to %s: %s", obj.Name, versionOf(binary), migration.summary())
+		MachineDriverConditionSchemaCompatible.True(obj)
+	}
+	MachineDriverConditionSchemaCompatible.Reason(obj, migration.summary())
+	return nil
+}
+
+// diffFields returns the fields added, removed and changed from previous to
+// current.
+func diffFields(previous, current map[string]v3.Field) *schemaMigration {
+	migration := &schemaMigration{}
+	for name, field := range current {
+		old, ok := previous[name]
+		if !ok {
+			migration.Added = append(migration.Added, name)
+		} else if changes := fieldChanges(old, field); len(changes) > 0 {
+			migration.Changed = append(migration.Changed, fieldChange{Field: name, Changes: changes})
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			migration.Removed = append(migration.Removed, name)
+		}
+	}
+	sort.Strings(migration.Added)
+	sort.Strings(migration.Removed)
+	sort.Slice(migration.Changed, func(i, j int) bool {
+		return migration.Changed[i].Field < migration.Changed[j].Field
+	})
+	return migration
+}
+
+// fieldChanges describes how a field changed in ways that can break existing
+// configs. Descriptions are left out.
+func fieldChanges(old, field v3.Field) []string {
+	var changes []string
+	if old.Type != field.Type {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", old.Type, field.Type))
+	}
+	if !reflect.DeepEqual(old.Default, field.Default) {
+		changes = append(changes, "default")
+	}
+	if old.Required != field.Required {
+		changes = append(changes, fmt.Sprintf("required %t -> %t", old.Required, field.Required))
+	}
+	if !reflect.DeepEqual(old.Options, field.Options) {
+		changes = append(changes, "options")
+	}
+	return changes
+}
+
+func (s *schemaMigration) summary() string {
+	var parts []string
+	if len(s.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(s.Added, ", "))
+	}
+	if len(s.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(s.Removed, ", "))
+	}
+	if len(s.Changed) > 0 {
+		var changed []string
+		for _, c := range s.Changed {
+			changed = append(changed, fmt.Sprintf("%s (%s)", c.Field, strings.Join(c.Changes, ", ")))
+		}
+		parts = append(parts, "changed "+strings.Join(changed, ", "))
+	}
+	if len(parts) == 0 {
+		return "fields unchanged"
+	}
+	return strings.Join(parts, "; ")
+}
+
+func versionOf(binary driverBinary) string {
+	if binary.Version != "" {
+		return binary.Version
+	}
+	return binary.Checksum
+}
+
+// setBinaryData records the binary a schema revision was generated from.
+func setBinaryData(cm *v1.ConfigMap, binary driverBinary) {
+	if binary.Checksum == "" {
+		return
+	}
+	cm.Data[revisionChecksumKey] = binary.Checksum
+	if binary.Version != "" {
+		cm.Data[revisionVersionKey] = binary.Version
+	}
+}
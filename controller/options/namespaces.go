@@ -0,0 +1,52 @@
+package options
+
+import (
+	"path"
+	"strings"
+)
+
+// NamespaceScope limits the namespaces whose machines a controller manages.
+// Entries are namespace names or glob patterns such as team-*. Without Allow
+// every namespace not in Deny is managed.
+type NamespaceScope struct {
+	Allow []string
+	Deny  []string
+}
+
+// ParseList splits a comma separated list of the values of a flag.
+func ParseList(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Validate returns an error if a pattern of the scope is malformed.
+func (s NamespaceScope) Validate() error {
+	for _, pattern := range append(append([]string{}, s.Allow...), s.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contains returns whether machines in namespace are managed.
+func (s NamespaceScope) Contains(namespace string) bool {
+	if matchNamespace(s.Deny, namespace) {
+		return false
+	}
+	return len(s.Allow) == 0 || matchNamespace(s.Allow, namespace)
+}
+
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package options
+
+import (
+	"time"
+
+	"github.com/rancher/machine-controller/cloudevents"
+	"github.com/rancher/machine-controller/download"
+	"github.com/rancher/machine-controller/sandbox"
+)
+
+// Options are the startup settings shared by all controllers.
+type Options struct {
+	// MultiTenancy publishes driver schemas into tenant namespaces instead
+	// of cluster scope. The DynamicSchema CRD must then be namespaced.
+	MultiTenancy bool
+	// SchemaOnly manages machine drivers and schemas but leaves machines to
+	// another provisioner.
+	SchemaOnly bool
+	// StatusUpdateInterval is the minimum interval between status updates
+	// of a machine while it is provisioned.
+	StatusUpdateInterval time.Duration
+	// SeedBuiltinDrivers creates the MachineDrivers of the drivers built
+	// into docker-machine that do not exist yet.
+	SeedBuiltinDrivers bool
+	// DriverCatalog is the URL of a catalog index to seed machine drivers
+	// from, DriverCatalogKey the base64 ed25519 key its signature is
+	// verified with.
+	DriverCatalog    string
+	DriverCatalogKey string
+	// DriverAllowListKey, if set, limits the driver binaries the controller
+	// executes to the checksums in the allow list ConfigMap signed with this
+	// base64 ed25519 key.
+	DriverAllowListKey string
+	// DriverStaleAfter, if set, marks drivers no machine uses as stale
+	// once they have not been used for this long, and deactivates them if
+	// DriverStaleDeactivate is set.
+	DriverStaleAfter      time.Duration
+	DriverStaleDeactivate bool
+	// DriverDownloadCA references a PEM CA bundle, as secret/<name> or
+	// configmap/<name> in cattle-system, trusted for driver downloads.
+	DriverDownloadCA string
+	// Download configures the HTTP client drivers and catalogs are
+	// downloaded with.
+	Download download.Options
+	// DriverLocalDir is the directory drivers with a file:// URL may be
+	// installed from, for air-gapped installations.
+	DriverLocalDir string
+	// SSHKeyType is the key type machines get SSH keys of unless their
+	// template selects one: rsa-4096, ed25519 or ecdsa. Empty keeps the
+	// key docker-machine generates.
+	SSHKeyType string
+	// MaxConcurrentProvisions limits how many machines are provisioned at
+	// once, zero for no limit. Drivers can have a lower limit of their own.
+	MaxConcurrentProvisions int
+	// ProvisioningRetries is how often a failed create of a machine is
+	// retried, with exponential backoff, unless the machine or its template
+	// sets its own limit.
+	ProvisioningRetries int
+	// RequireApproval holds the cloud create of every machine until it is
+	// approved, unless the machine or its template opts out.
+	// ApprovalWebhook, if set, is sent a request for each machine waiting
+	// for approval.
+	RequireApproval bool
+	ApprovalWebhook string
+	// MachineStateNamespace is the namespace of the Secrets holding the
+	// docker-machine state of machines, cattle-system if empty.
+	MachineStateNamespace string
+	// Namespaces limits the namespaces whose machines and machine pools the
+	// controller manages, so several controllers can split the tenants of a
+	// cluster between them.
+	Namespaces NamespaceScope
+	// DriverEnv names the environment variables of the controller passed
+	// to docker-machine and driver plugins in addition to the proxy, locale
+	// and CA settings that always are.
+	DriverEnv []string
+	// Events publishes the lifecycle transitions of machines and machine
+	// drivers as CloudEvents.
+	Events cloudevents.Options
+	// Sandbox confines docker-machine and the driver plugins it starts.
+	Sandbox sandbox.Options
+}
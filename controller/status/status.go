@@ -0,0 +1,197 @@
+package status
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/rancher/machine-controller/controller/machine"
+	"github.com/rancher/machine-controller/controller/machinedriver"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	Namespace = "cattle-system"
+	// ConfigMap is the singleton holding the Summary, as JSON, in its
+	// status key and the driver binaries installed on the controller host in
+	// its inventory key.
+	ConfigMap    = "machine-controller-status"
+	statusKey    = "status"
+	inventoryKey = "inventory"
+
+	interval  = time.Minute
+	maxErrors = 20
+)
+
+// Summary is the fleet state as seen by the controller.
+type Summary struct {
+	Time    string `json:"time"`
+	Drivers struct {
+		Active   int `json:"active"`
+		Inactive int `json:"inactive"`
+		Failed   int `json:"failed"`
+	} `json:"drivers"`
+	// Machines counts machines by driver and phase.
+	Machines map[string]map[string]int `json:"machines"`
+	// Errors are the most recent failed conditions, newest first.
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Error is a failed condition of a machine or machine driver.
+type Error struct {
+	Object    string `json:"object"`
+	Condition string `json:"condition"`
+	Time      string `json:"time"`
+	Message   string `json:"message"`
+}
+
+type statusWriter struct {
+	machines   v3.MachineLister
+	drivers    v3.MachineDriverLister
+	configMaps typedv1.ConfigMapsGetter
+}
+
+// Register periodically writes the Summary to the status ConfigMap. The
+// summary is built from the informer caches, not by listing from the API.
+func Register(management *config.ManagementContext) {
+	w := &statusWriter{
+		machines:   management.Management.Machines("").Controller().Lister(),
+		drivers:    management.Management.MachineDrivers("").Controller().Lister(),
+		configMaps: management.K8sClient.CoreV1(),
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := w.write(); err != nil {
+				logrus.Errorf("Failed to update %s/%s: %v", Namespace, ConfigMap, err)
+			}
+		}
+	}()
+}
+
+func (w *statusWriter) summarize() (*Summary, error) {
+	summary := &Summary{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Machines: map[string]map[string]int{},
+	}
+
+	drivers, err := w.drivers.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, driver := range drivers {
+		failed := false
+		for _, cond := range driver.Status.Conditions {
+			if cond.Status == "False" {
+				failed = true
+				summary.Errors = append(summary.Errors, Error{
+					Object:    "machinedriver/" + driver.Name,
+					Condition: cond.Type,
+					Time:      cond.LastUpdateTime,
+					Message:   cond.Reason,
+				})
+			}
+		}
+		switch {
+		case failed:
+			summary.Drivers.Failed++
+		case driver.Spec.Active:
+			summary.Drivers.Active++
+		default:
+			summary.Drivers.Inactive++
+		}
+	}
+
+	machines, err := w.machines.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range machines {
+		driver := ""
+		if obj.Status.MachineTemplateSpec != nil {
+			driver = obj.Status.MachineTemplateSpec.Driver
+		}
+		if summary.Machines[driver] == nil {
+			summary.Machines[driver] = map[string]int{}
+		}
+		summary.Machines[driver][machine.Phase(obj)]++
+
+		for _, cond := range obj.Status.Conditions {
+			if cond.Status == "False" {
+				summary.Errors = append(summary.Errors, Error{
+					Object:    "machine/" + obj.Namespace + "/" + obj.Name,
+					Condition: string(cond.Type),
+					Time:      cond.LastUpdateTime,
+					Message:   cond.Message,
+				})
+			}
+		}
+	}
+
+	sort.Slice(summary.Errors, func(i, j int) bool {
+		return summary.Errors[i].Time > summary.Errors[j].Time
+	})
+	if len(summary.Errors) > maxErrors {
+		summary.Errors = summary.Errors[:maxErrors]
+	}
+	return summary, nil
+}
+
+func (w *statusWriter) inventory() ([]machinedriver.Binary, error) {
+	drivers, err := w.drivers.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return machinedriver.Inventory(drivers)
+}
+
+func (w *statusWriter) write() error {
+	summary, err := w.summarize()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	binaries, err := w.inventory()
+	if err != nil {
+		return err
+	}
+	inventory, err := json.Marshal(binaries)
+	if err != nil {
+		return err
+	}
+
+	client := w.configMaps.ConfigMaps(Namespace)
+	cm, err := client.Get(ConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			Data: map[string]string{
+				statusKey:    string(data),
+				inventoryKey: string(inventory),
+			},
+		}
+		cm.Name = ConfigMap
+		cm.Namespace = Namespace
+		_, err = client.Create(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[statusKey] = string(data)
+	cm.Data[inventoryKey] = string(inventory)
+	_, err = client.Update(cm)
+	return err
+}
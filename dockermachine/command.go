@@ -0,0 +1,81 @@
+package dockermachine
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	"github.com/rancher/machine-controller/sandbox"
+	"github.com/rancher/norman/types/convert"
+)
+
+var regExHyphen = regexp.MustCompile("([a-z])([A-Z])")
+
+const (
+	machineDirEnvKey = "MACHINE_STORAGE_PATH="
+	machineCmd       = "docker-machine"
+)
+
+// Command returns a docker-machine command using machineDir as its storage
+// path, running in the configured sandbox with an isolated environment.
+func Command(machineDir string, cmdArgs []string) *exec.Cmd {
+	command := exec.Command(machineCmd, cmdArgs...)
+	command.Env = isolatedEnviron(machineDir)
+	sandbox.Apply(command)
+	return command
+}
+
+// DriverBinary returns the path of the binary serving a driver plugin, which
+// is docker-machine itself for the core drivers.
+func DriverBinary(driver string) (string, error) {
+	binary := "docker-machine-driver-" + driver
+	for _, coreDriver := range localbinary.CoreDrivers {
+		if coreDriver == driver {
+			binary = machineCmd
+		}
+	}
+	return exec.LookPath(binary)
+}
+
+// FlagName returns the name, without the leading "--", of the docker-machine
+// create flag of a driver config field, e.g. amazonec2-private-address-only
+// for the privateAddressOnly field of amazonec2.
+func FlagName(driver, field string) string {
+	return driver + "-" + strings.ToLower(regExHyphen.ReplaceAllString(field, "${1}-${2}"))
+}
+
+// DriverFlags renders a driver config, keyed by lower camel case field name,
+// into docker-machine create flags for the given driver.
+func DriverFlags(driver string, configMap map[string]interface{}) []string {
+	var cmd []string
+	for k, v := range configMap {
+		dmField := "--" + FlagName(driver, k)
+		switch v := v.(type) {
+		case int:
+			cmd = append(cmd, dmField, strconv.Itoa(v))
+		case int64:
+			cmd = append(cmd, dmField, strconv.FormatInt(v, 10))
+		case float64:
+			// Numbers of configs decoded from JSON.
+			cmd = append(cmd, dmField, strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			cmd = append(cmd, dmField, v)
+		case bool:
+			// Bool flags take no value, one would end the flags.
+			if v {
+				cmd = append(cmd, dmField)
+			}
+		case []string:
+			for _, s := range v {
+				cmd = append(cmd, dmField, s)
+			}
+		case []interface{}:
+			for _, s := range v {
+				cmd = append(cmd, dmField, convert.ToString(s))
+			}
+		}
+	}
+	return cmd
+}
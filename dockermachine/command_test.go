@@ -0,0 +1,31 @@
+package dockermachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDriverFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		flags  []string
+	}{
+		{"string", map[string]interface{}{"region": "us-west-2"}, []string{"--amazonec2-region", "us-west-2"}},
+		{"camel case", map[string]interface{}{"instanceType": "t2.micro"}, []string{"--amazonec2-instance-type", "t2.micro"}},
+		{"true bool", map[string]interface{}{"privateAddressOnly": true}, []string{"--amazonec2-private-address-only"}},
+		{"false bool", map[string]interface{}{"privateAddressOnly": false}, nil},
+		{"int", map[string]interface{}{"rootSize": 16}, []string{"--amazonec2-root-size", "16"}},
+		{"int64", map[string]interface{}{"rootSize": int64(16)}, []string{"--amazonec2-root-size", "16"}},
+		{"json number", map[string]interface{}{"rootSize": float64(16)}, []string{"--amazonec2-root-size", "16"}},
+		{"json fraction", map[string]interface{}{"spotPrice": 0.5}, []string{"--amazonec2-spot-price", "0.5"}},
+		{"string list", map[string]interface{}{"tags": []string{"a", "b"}}, []string{"--amazonec2-tags", "a", "--amazonec2-tags", "b"}},
+		{"json list", map[string]interface{}{"tags": []interface{}{"a", 1}}, []string{"--amazonec2-tags", "a", "--amazonec2-tags", "1"}},
+		{"empty list", map[string]interface{}{"tags": []interface{}{}}, nil},
+	}
+	for _, test := range tests {
+		if flags := DriverFlags("amazonec2", test.config); !reflect.DeepEqual(flags, test.flags) {
+			t.Errorf("%s: got %q, want %q", test.name, flags, test.flags)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package dockermachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ScratchDir is the directory in the storage path of a machine holding
+	// the home and temporary directories of its docker-machine invocations.
+	// It is not part of the stored machine state.
+	ScratchDir = ".exec"
+)
+
+var (
+	// defaultEnv are the environment variables of the controller that
+	// docker-machine and driver plugins inherit. Everything else, such as
+	// cloud credentials of the controller itself, is withheld from them.
+	defaultEnv = []string{
+		"PATH", "TZ", "LANG", "LC_ALL",
+		"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+		"SSL_CERT_FILE", "SSL_CERT_DIR",
+		"MACHINE_DEBUG",
+	}
+
+	envLock  sync.RWMutex
+	extraEnv []string
+)
+
+// ConfigureEnv sets the names of the environment variables passed to
+// docker-machine and driver plugins in addition to defaultEnv.
+func ConfigureEnv(names []string) {
+	envLock.Lock()
+	defer envLock.Unlock()
+	extraEnv = append([]string{}, names...)
+}
+
+// Environ returns the environment variables of the controller that
+// docker-machine and driver plugins inherit.
+func Environ() []string {
+	envLock.RLock()
+	names := append(append([]string{}, defaultEnv...), extraEnv...)
+	envLock.RUnlock()
+
+	var env []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// isolatedEnviron returns the environment of a docker-machine invocation
+// using machineDir as its storage path. Every invocation gets a home and
+// temporary directory of its own, so concurrent operations never share
+// mutable state.
+func isolatedEnviron(machineDir string) []string {
+	home := machineDir
+	dir := filepath.Join(machineDir, ScratchDir)
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		home, err = ioutil.TempDir(dir, "")
+		if err != nil {
+			logrus.Warnf("Failed to create home directory in %s: %v", dir, err)
+			home = machineDir
+		}
+	} else {
+		logrus.Warnf("Failed to create home directory in %s: %v", dir, err)
+	}
+
+	tmp := home
+	if home != machineDir {
+		tmp = filepath.Join(home, "tmp")
+		if err := os.MkdirAll(tmp, 0700); err != nil {
+			tmp = home
+		}
+	}
+
+	return append(Environ(),
+		machineDirEnvKey+machineDir,
+		"HOME="+home,
+		"TMPDIR="+tmp,
+	)
+}
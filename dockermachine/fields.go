@@ -0,0 +1,56 @@
+package dockermachine
+
+import (
+	"strings"
+)
+
+var (
+	credentialFieldPatterns = []string{
+		"password",
+		"secret",
+		"token",
+		"accesskey",
+		"apikey",
+		"privatekey",
+		"credential",
+	}
+	instanceFieldPatterns = []string{
+		"sshkeypath",
+		"keypairname",
+		"instanceid",
+		"ipaddress",
+		"hostname",
+	}
+	updatableFieldPatterns = []string{
+		"tags",
+		"labels",
+	}
+)
+
+// IsCredentialField reports whether a lower camel case driver config field
+// name looks like it holds a credential, e.g. accessKey or clientSecret.
+func IsCredentialField(name string) bool {
+	return matchesAny(name, credentialFieldPatterns)
+}
+
+// IsInstanceField reports whether a driver config field is tied to a single
+// instance, e.g. sshKeypath, and must not be copied to other machines.
+func IsInstanceField(name string) bool {
+	return matchesAny(name, instanceFieldPatterns)
+}
+
+// IsUpdatableField reports whether a driver config field only carries
+// metadata, e.g. tags, that can safely be edited on an existing machine.
+func IsUpdatableField(name string) bool {
+	return matchesAny(name, updatableFieldPatterns)
+}
+
+func matchesAny(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if strings.Contains(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
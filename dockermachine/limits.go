@@ -0,0 +1,97 @@
+package dockermachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LimitsAnnotation on a MachineDriver holds the Limits applied to the
+	// processes of the driver, as JSON.
+	LimitsAnnotation = "io.cattle.machine_driver.resource_limits"
+)
+
+// Limits constrain a docker-machine or driver process and everything it
+// spawns, such as the driver plugin started by docker-machine create.
+type Limits struct {
+	// MemoryMB limits the virtual memory of each process.
+	MemoryMB int64 `json:"memoryMB,omitempty"`
+	// CPUSeconds limits the CPU time of each process.
+	CPUSeconds int64 `json:"cpuSeconds,omitempty"`
+	// Timeout limits the wall time of the command, e.g. "30m".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ParseLimits parses the value of LimitsAnnotation. An empty value means no
+// limits.
+func ParseLimits(data string) (Limits, error) {
+	limits := Limits{}
+	if data == "" {
+		return limits, nil
+	}
+	if err := json.Unmarshal([]byte(data), &limits); err != nil {
+		return limits, errors.Wrapf(err, "failed to parse %s annotation", LimitsAnnotation)
+	}
+	if _, err := limits.timeout(); err != nil {
+		return limits, err
+	}
+	return limits, nil
+}
+
+func (l Limits) timeout() (time.Duration, error) {
+	if l.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(l.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout %q", l.Timeout)
+	}
+	return d, nil
+}
+
+// IsZero reports whether no limit is set.
+func (l Limits) IsZero() bool {
+	return l.MemoryMB <= 0 && l.CPUSeconds <= 0 && l.Timeout == ""
+}
+
+// Apply rewrites cmd, which must not have been started, to run with the
+// limits through the shell's ulimit and coreutils' timeout.
+func (l Limits) Apply(cmd *exec.Cmd) {
+	if l.IsZero() {
+		return
+	}
+
+	script := ""
+	if l.MemoryMB > 0 {
+		script += fmt.Sprintf("ulimit -v %d || exit 1; ", l.MemoryMB*1024)
+	}
+	if l.CPUSeconds > 0 {
+		script += fmt.Sprintf("ulimit -t %d || exit 1; ", l.CPUSeconds)
+	}
+	script += "exec "
+	if d, _ := l.timeout(); d > 0 {
+		if d < time.Second {
+			d = time.Second
+		}
+		script += fmt.Sprintf("timeout %d ", int64(d/time.Second))
+	}
+	script += `"$0" "$@"`
+
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		shell = "/bin/sh"
+	}
+	cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = shell
+}
+
+// LimitedCommand is Command with limits applied.
+func LimitedCommand(machineDir string, cmdArgs []string, limits Limits) *exec.Cmd {
+	cmd := Command(machineDir, cmdArgs)
+	limits.Apply(cmd)
+	return cmd
+}
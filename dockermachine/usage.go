@@ -0,0 +1,49 @@
+package dockermachine
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// usageDir holds an empty file per driver whose modification time is when
+// the driver was last used.
+func usageDir() string {
+	base := os.Getenv("CATTLE_HOME")
+	if base == "" {
+		base = "/var/lib/rancher"
+	}
+	return filepath.Join(base, "machine-drivers", "last-used")
+}
+
+// MarkUsed records that the plugin of driver was just started, for a
+// machine operation or flag extraction.
+func MarkUsed(driver string) {
+	file := filepath.Join(usageDir(), driver)
+	now := time.Now()
+	if err := os.Chtimes(file, now, now); err == nil {
+		return
+	}
+
+	if err := os.MkdirAll(usageDir(), 0755); err != nil {
+		logrus.Debugf("Failed to record usage of driver %s: %v", driver, err)
+		return
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		logrus.Debugf("Failed to record usage of driver %s: %v", driver, err)
+		return
+	}
+	f.Close()
+}
+
+// LastUsed returns when driver was last used, or false if never on this host.
+func LastUsed(driver string) (time.Time, bool) {
+	info, err := os.Stat(filepath.Join(usageDir(), driver))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
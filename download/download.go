@@ -0,0 +1,230 @@
+// Package download provides the HTTP client machine driver binaries and
+// catalogs are downloaded with. It goes through the proxies configured in the
+// standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables and
+// trusts an optional CA bundle on top of the system roots. Its timeouts, TLS
+// settings and User-Agent can be set with Options.
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	Namespace = "cattle-system"
+	// CAKey is the key of the PEM CA bundle in the referenced Secret or
+	// ConfigMap.
+	CAKey = "ca.crt"
+
+	defaultDialTimeout  = 30 * time.Second
+	defaultMaxIdleConns = 100
+)
+
+var (
+	clientLock = sync.Mutex{}
+	client     = newClient(Options{}, &tls.Config{})
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+	}
+)
+
+// Options configure the client.
+type Options struct {
+	// DialTimeout limits how long connecting to a server takes, 30s if
+	// zero.
+	DialTimeout time.Duration
+	// ReadTimeout limits how long a read from a connection may block, so
+	// stalled downloads fail instead of hanging. No limit if zero.
+	ReadTimeout time.Duration
+	// MaxIdleConns limits the idle connections kept open, 100 if zero.
+	MaxIdleConns int
+	// UserAgent is sent with every request that does not set its own.
+	// Go's default if empty.
+	UserAgent string
+	// TLSMinVersion is the minimum TLS version accepted: 1.0, 1.1 or 1.2.
+	// Go's default if empty.
+	TLSMinVersion string
+	// ClientCertificate names a kubernetes.io/tls Secret in cattle-system
+	// whose certificate is presented to servers asking for one.
+	ClientCertificate string
+}
+
+// Client returns the client to download with.
+func Client() *http.Client {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	return client
+}
+
+// Configure sets up the client with opts, presenting cert, if not nil, as its
+// client certificate and trusting the PEM certificates in ca in addition to
+// the system roots.
+func Configure(opts Options, ca []byte, cert *tls.Certificate) error {
+	tlsConfig := &tls.Config{}
+	if opts.TLSMinVersion != "" {
+		version, ok := tlsVersions[opts.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("unsupported TLS version %q, must be 1.0, 1.1 or 1.2", opts.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	var pool *x509.CertPool
+	if len(ca) > 0 {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in CA bundle")
+		}
+	}
+
+	tlsConfig.RootCAs = pool
+
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	client = newClient(opts, tlsConfig)
+	return nil
+}
+
+// LoadCA returns the CA bundle referenced as "secret/<name>" or
+// "configmap/<name>" in cattle-system.
+func LoadCA(secrets typedv1.SecretsGetter, configMaps typedv1.ConfigMapsGetter, ref string) ([]byte, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid CA bundle reference %q, must be secret/<name> or configmap/<name>", ref)
+	}
+
+	var data []byte
+	switch strings.ToLower(parts[0]) {
+	case "secret":
+		secret, err := secrets.Secrets(Namespace).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get CA bundle %s", ref)
+		}
+		data = secret.Data[CAKey]
+	case "configmap":
+		cm, err := configMaps.ConfigMaps(Namespace).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get CA bundle %s", ref)
+		}
+		data = []byte(cm.Data[CAKey])
+	default:
+		return nil, fmt.Errorf("invalid CA bundle reference %q, must be secret/<name> or configmap/<name>", ref)
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("CA bundle %s has no %s key", ref, CAKey)
+	}
+	return data, nil
+}
+
+// LoadCertificate returns the certificate and key of the named
+// kubernetes.io/tls Secret in cattle-system.
+func LoadCertificate(secrets typedv1.SecretsGetter, name string) (*tls.Certificate, error) {
+	secret, err := secrets.Secrets(Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get client certificate %s", name)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid client certificate %s", name)
+	}
+	return &cert, nil
+}
+
+func newClient(opts Options, tlsConfig *tls.Config) *http.Client {
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	maxIdleConns := opts.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if opts.ReadTimeout > 0 {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &timeoutConn{Conn: conn, timeout: opts.ReadTimeout}, nil
+		}
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          maxIdleConns,
+	}
+	if opts.UserAgent != "" {
+		transport = &userAgentTransport{RoundTripper: transport, userAgent: opts.UserAgent}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// timeoutConn fails reads that block for longer than timeout.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// userAgentTransport sets the User-Agent of requests without one.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		r2 := *req
+		r2.Header = cloneHeader(req.Header)
+		r2.Header.Set("User-Agent", t.userAgent)
+		req = &r2
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
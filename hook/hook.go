@@ -0,0 +1,107 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	Namespace = "cattle-system"
+	// ConfigMap maps "<driver>.<hook>" keys to the absolute path of the
+	// executable implementing the hook for that driver.
+	ConfigMap = "machine-driver-hooks"
+	// DefaultTimeout is how long Run waits for a hook without a Timeout.
+	DefaultTimeout = 10 * time.Minute
+)
+
+// Input is written as JSON to the standard input of a hook.
+type Input struct {
+	Machine   string                 `json:"machine"`
+	Hostname  string                 `json:"hostname"`
+	Driver    string                 `json:"driver"`
+	StorePath string                 `json:"storePath,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Args      string                 `json:"args,omitempty"`
+}
+
+// Hook is a driver specific operation docker-machine has no command for, such
+// as snapshotting disks, implemented by an external executable.
+type Hook struct {
+	Driver  string
+	Name    string
+	Command string
+	// Timeout is how long Run waits for the hook before killing it,
+	// DefaultTimeout if zero.
+	Timeout time.Duration
+}
+
+// Lookup returns the hook name of driver. A driver without the hook, or a
+// missing ConfigMap, yields nil, so the hook doubles as a driver capability.
+func Lookup(configMaps typedv1.ConfigMapsGetter, driver, name string) (*Hook, error) {
+	cm, err := configMaps.ConfigMaps(Namespace).Get(ConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	command := cm.Data[driver+"."+name]
+	if command == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(command) {
+		return nil, fmt.Errorf("hook %s.%s in %s/%s must be an absolute path", driver, name, Namespace, ConfigMap)
+	}
+
+	return &Hook{
+		Driver:  driver,
+		Name:    name,
+		Command: command,
+	}, nil
+}
+
+// Run executes the hook with input on its standard input and decodes its
+// standard output as JSON into output, if not nil.
+func (h *Hook) Run(input Input, output interface{}) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, h.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s hook of driver %s timed out after %v", h.Name, h.Driver, timeout)
+		}
+		return errors.Wrapf(err, "%s hook of driver %s failed: %s", h.Name, h.Driver, stderr.String())
+	}
+
+	if output == nil || stdout.Len() == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), output); err != nil {
+		return errors.Wrapf(err, "failed to parse output of %s hook of driver %s", h.Name, h.Driver)
+	}
+	return nil
+}
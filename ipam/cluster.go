@@ -0,0 +1,150 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const maxUpdateAttempts = 5
+
+// clusterPool allocates addresses of Network, or Range, and records them in
+// the machine-ipam-<pool> ConfigMap in cattle-system, keyed by address with
+// the owner as value. Concurrent allocations are serialized by the
+// resourceVersion of the ConfigMap.
+type clusterPool struct {
+	pool       *Pool
+	configMaps typedv1.ConfigMapsGetter
+}
+
+func (c *clusterPool) configMapName() string {
+	return "machine-ipam-" + c.pool.name
+}
+
+func (c *clusterPool) Allocate(owner, hostname string) (*Allocation, error) {
+	first, last, err := c.bounds()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.update(func(cm *v1.ConfigMap) (*Allocation, error) {
+		for address, o := range cm.Data {
+			if o == owner {
+				return c.pool.allocation(address, address), nil
+			}
+		}
+		for ip := first; bytes.Compare(ip, last) <= 0; ip = next(ip) {
+			address := ip.String()
+			if _, used := cm.Data[address]; used || address == c.pool.Gateway {
+				continue
+			}
+			cm.Data[address] = owner
+			return c.pool.allocation(address, address), nil
+		}
+		return nil, fmt.Errorf("IPAM pool %s is exhausted", c.pool.name)
+	})
+}
+
+func (c *clusterPool) Release(allocation *Allocation) error {
+	_, err := c.update(func(cm *v1.ConfigMap) (*Allocation, error) {
+		if _, ok := cm.Data[allocation.Address]; !ok {
+			return nil, nil
+		}
+		delete(cm.Data, allocation.Address)
+		return allocation, nil
+	})
+	return err
+}
+
+// update applies f to the allocations of the pool, retrying on conflicts. A
+// nil allocation from f leaves the ConfigMap unchanged.
+func (c *clusterPool) update(f func(cm *v1.ConfigMap) (*Allocation, error)) (*Allocation, error) {
+	client := c.configMaps.ConfigMaps(Namespace)
+	var err error
+	for i := 0; i < maxUpdateAttempts; i++ {
+		cm, getErr := client.Get(c.configMapName(), metav1.GetOptions{})
+		create := apierrors.IsNotFound(getErr)
+		if create {
+			cm = &v1.ConfigMap{}
+			cm.Name = c.configMapName()
+			cm.Namespace = Namespace
+		} else if getErr != nil {
+			return nil, getErr
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+
+		allocation, fErr := f(cm)
+		if fErr != nil || allocation == nil {
+			return allocation, fErr
+		}
+		if create {
+			_, err = client.Create(cm)
+		} else {
+			_, err = client.Update(cm)
+		}
+		if err == nil {
+			return allocation, nil
+		}
+		if !apierrors.IsConflict(err) && !apierrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// bounds returns the first and last address that may be allocated. Without a
+// range the network and broadcast addresses of Network are left out.
+func (c *clusterPool) bounds() (net.IP, net.IP, error) {
+	if c.pool.Range != "" {
+		parts := strings.SplitN(c.pool.Range, "-", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid range %q of IPAM pool %s", c.pool.Range, c.pool.name)
+		}
+		first, last := net.ParseIP(strings.TrimSpace(parts[0])).To4(), net.ParseIP(strings.TrimSpace(parts[1])).To4()
+		if first == nil || last == nil {
+			return nil, nil, fmt.Errorf("invalid range %q of IPAM pool %s", c.pool.Range, c.pool.name)
+		}
+		return first, last, nil
+	}
+
+	_, network, err := net.ParseCIDR(c.pool.Network)
+	if err != nil || network.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid network %q of IPAM pool %s", c.pool.Network, c.pool.name)
+	}
+	first := network.IP.To4()
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+	return next(first), prev(last), nil
+}
+
+func next(ip net.IP) net.IP {
+	ip = append(net.IP{}, ip...)
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+	return ip
+}
+
+func prev(ip net.IP) net.IP {
+	ip = append(net.IP{}, ip...)
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]--
+		if ip[i] != 0xff {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,100 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const infobloxWAPIVersion = "v2.7"
+
+// infoblox allocates the next available address of Network as a host record
+// through the Infoblox WAPI.
+type infoblox struct {
+	pool *Pool
+}
+
+type infobloxHostRecord struct {
+	Ref       string `json:"_ref,omitempty"`
+	Name      string `json:"name"`
+	View      string `json:"view,omitempty"`
+	IPv4Addrs []struct {
+		IPv4Addr string `json:"ipv4addr"`
+	} `json:"ipv4addrs"`
+}
+
+func (i *infoblox) Allocate(owner, hostname string) (*Allocation, error) {
+	if i.pool.Network == "" {
+		return nil, fmt.Errorf("IPAM pool %s has no network", i.pool.name)
+	}
+
+	record := map[string]interface{}{
+		"name": hostname,
+		"ipv4addrs": []map[string]string{
+			{"ipv4addr": "func:nextavailableip:" + i.pool.Network},
+		},
+		"comment": owner,
+	}
+	if i.pool.View != "" {
+		record["view"] = i.pool.View
+	}
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := i.do(http.MethodPost, "record:host?_return_fields=ipv4addrs", body)
+	if err != nil {
+		return nil, err
+	}
+	created := &infobloxHostRecord{}
+	if err := json.Unmarshal(data, created); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Infoblox host record")
+	}
+	if len(created.IPv4Addrs) == 0 {
+		return nil, fmt.Errorf("Infoblox host record %s has no address", created.Ref)
+	}
+	return i.pool.allocation(created.IPv4Addrs[0].IPv4Addr, created.Ref), nil
+}
+
+func (i *infoblox) Release(allocation *Allocation) error {
+	if allocation.Ref == "" {
+		return nil
+	}
+	_, err := i.do(http.MethodDelete, allocation.Ref, nil)
+	return err
+}
+
+func (i *infoblox) do(method, path string, body []byte) ([]byte, error) {
+	url := strings.TrimSuffix(i.pool.URL, "/") + "/wapi/" + infobloxWAPIVersion + "/" + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(i.pool.username, i.pool.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodDelete {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Infoblox %s %s failed: %s: %s", method, path, resp.Status, data)
+	}
+	return data, nil
+}
@@ -0,0 +1,120 @@
+// Package ipam allocates addresses for machines on static IP networks from an
+// external IPAM system or an address pool kept in the cluster.
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	Namespace = "cattle-system"
+	// ConfigMap maps pool names to the JSON Pool definition of the pool.
+	ConfigMap = "machine-ipam-pools"
+
+	requestTimeout = 30 * time.Second
+)
+
+// Pool is a range of addresses managed by a provider.
+type Pool struct {
+	// Provider is infoblox, phpipam or cluster.
+	Provider string `json:"provider"`
+	// URL is the base URL of the external IPAM system.
+	URL string `json:"url,omitempty"`
+	// Secret names a Secret in cattle-system with the username and password
+	// keys used to authenticate with the external IPAM system.
+	Secret string `json:"secret,omitempty"`
+	// Network is the CIDR the addresses are allocated from.
+	Network string `json:"network,omitempty"`
+	// Range limits the addresses of a cluster pool to "<first>-<last>".
+	Range string `json:"range,omitempty"`
+	// View is the Infoblox network view.
+	View string `json:"view,omitempty"`
+	// App and Subnet are the phpIPAM API application and subnet ID.
+	App     string   `json:"app,omitempty"`
+	Subnet  string   `json:"subnet,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+
+	name     string
+	username string
+	password string
+}
+
+// Allocation is an address allocated to a machine.
+type Allocation struct {
+	Pool    string   `json:"pool"`
+	Address string   `json:"address"`
+	Prefix  int      `json:"prefix,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	// Ref identifies the allocation in the provider, for releasing it.
+	Ref string `json:"ref,omitempty"`
+}
+
+// Provider allocates and releases the addresses of a pool. owner identifies
+// the machine, hostname is recorded where the provider supports it.
+type Provider interface {
+	Allocate(owner, hostname string) (*Allocation, error)
+	Release(allocation *Allocation) error
+}
+
+// Lookup returns the provider of the named pool.
+func Lookup(configMaps typedv1.ConfigMapsGetter, secrets typedv1.SecretsGetter, name string) (Provider, error) {
+	cm, err := configMaps.ConfigMaps(Namespace).Get(ConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("IPAM pool %s not found, %s/%s does not exist", name, Namespace, ConfigMap)
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[name]
+	if !ok {
+		return nil, fmt.Errorf("IPAM pool %s not found in %s/%s", name, Namespace, ConfigMap)
+	}
+	pool := &Pool{name: name}
+	if err := json.Unmarshal([]byte(data), pool); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse IPAM pool %s", name)
+	}
+
+	if pool.Secret != "" {
+		secret, err := secrets.Secrets(Namespace).Get(pool.Secret, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get credentials of IPAM pool %s", name)
+		}
+		pool.username = string(secret.Data["username"])
+		pool.password = string(secret.Data["password"])
+	}
+
+	switch pool.Provider {
+	case "infoblox":
+		return &infoblox{pool: pool}, nil
+	case "phpipam":
+		return &phpIPAM{pool: pool}, nil
+	case "cluster":
+		return &clusterPool{pool: pool, configMaps: configMaps}, nil
+	}
+	return nil, fmt.Errorf("IPAM pool %s has unknown provider %q", name, pool.Provider)
+}
+
+// allocation returns the allocation of address in the pool.
+func (p *Pool) allocation(address, ref string) *Allocation {
+	a := &Allocation{
+		Pool:    p.name,
+		Address: address,
+		Gateway: p.Gateway,
+		DNS:     p.DNS,
+		Ref:     ref,
+	}
+	if _, network, err := net.ParseCIDR(p.Network); err == nil {
+		a.Prefix, _ = network.Mask.Size()
+	}
+	return a
+}
@@ -0,0 +1,116 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// phpIPAM allocates the first free address of a subnet through the phpIPAM
+// REST API.
+type phpIPAM struct {
+	pool *Pool
+}
+
+type phpIPAMResponse struct {
+	Code    int             `json:"code"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	ID      json.Number     `json:"id"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func (p *phpIPAM) Allocate(owner, hostname string) (*Allocation, error) {
+	if p.pool.Subnet == "" {
+		return nil, fmt.Errorf("IPAM pool %s has no subnet", p.pool.name)
+	}
+	token, err := p.login()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("hostname", hostname)
+	form.Set("description", owner)
+	resp, err := p.do(http.MethodPost, "addresses/first_free/"+p.pool.Subnet+"/", token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	var address string
+	if err := json.Unmarshal(resp.Data, &address); err != nil {
+		return nil, errors.Wrap(err, "failed to parse phpIPAM address")
+	}
+	return p.pool.allocation(address, resp.ID.String()), nil
+}
+
+func (p *phpIPAM) Release(allocation *Allocation) error {
+	if allocation.Ref == "" {
+		return nil
+	}
+	token, err := p.login()
+	if err != nil {
+		return err
+	}
+	_, err = p.do(http.MethodDelete, "addresses/"+allocation.Ref+"/", token, nil)
+	return err
+}
+
+func (p *phpIPAM) login() (string, error) {
+	resp, err := p.do(http.MethodPost, "user/", "", nil)
+	if err != nil {
+		return "", err
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return "", errors.Wrap(err, "failed to parse phpIPAM token")
+	}
+	return data.Token, nil
+}
+
+func (p *phpIPAM) do(method, path, token string, body io.Reader) (*phpIPAMResponse, error) {
+	u := strings.TrimSuffix(p.pool.URL, "/") + "/api/" + p.pool.App + "/" + path
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		req.SetBasicAuth(p.pool.username, p.pool.password)
+	} else {
+		req.Header.Set("token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &phpIPAMResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, errors.Wrapf(err, "phpIPAM %s %s failed: %s", method, path, httpResp.Status)
+	}
+	if resp.Code == http.StatusNotFound && method == http.MethodDelete {
+		return resp, nil
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("phpIPAM %s %s failed: %s", method, path, resp.Message)
+	}
+	return resp, nil
+}
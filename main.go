@@ -1,9 +1,23 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"sync/atomic"
+	"time"
 
+	"github.com/rancher/machine-controller/admission"
+	"github.com/rancher/machine-controller/cloudevents"
 	"github.com/rancher/machine-controller/controller"
+	"github.com/rancher/machine-controller/controller/options"
+	"github.com/rancher/machine-controller/download"
+	"github.com/rancher/machine-controller/metrics"
+	"github.com/rancher/machine-controller/query"
+	"github.com/rancher/machine-controller/sandbox"
+	"github.com/rancher/machine-controller/shell"
+	"github.com/rancher/norman/signal"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -11,6 +25,8 @@ import (
 )
 
 func main() {
+	sandbox.Main()
+
 	app := cli.NewApp()
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -18,6 +34,206 @@ func main() {
 			Usage:  "Kube config for accessing kubernetes cluster",
 			EnvVar: "KUBECONFIG",
 		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Address to serve Prometheus metrics on, e.g. :9100. Disabled if empty",
+		},
+		cli.BoolFlag{
+			Name:   "multi-tenancy",
+			Usage:  "Publish driver schemas into tenant namespaces, requires a namespaced DynamicSchema CRD",
+			EnvVar: "MULTI_TENANCY",
+		},
+		cli.BoolFlag{
+			Name:   "schema-only",
+			Usage:  "Only manage machine drivers and their schemas, never provision machines",
+			EnvVar: "SCHEMA_ONLY",
+		},
+		cli.DurationFlag{
+			Name:  "status-update-interval",
+			Usage: "Minimum interval between status updates of a machine while it is provisioned",
+			Value: 10 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "shell-listen",
+			Usage: "Address to serve websocket SSH access to machines on, e.g. :8443. Disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "shell-tls-cert",
+			Usage: "TLS certificate file of the machine access server",
+		},
+		cli.StringFlag{
+			Name:  "shell-tls-key",
+			Usage: "TLS key file of the machine access server",
+		},
+		cli.StringFlag{
+			Name:  "query-listen",
+			Usage: "Address to serve the read-only machine query API on, e.g. :8444. Disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "query-tls-cert",
+			Usage: "TLS certificate file of the machine query API",
+		},
+		cli.StringFlag{
+			Name:  "query-tls-key",
+			Usage: "TLS key file of the machine query API",
+		},
+		cli.StringFlag{
+			Name:  "admission-listen",
+			Usage: "Address to serve the admission webhook evaluating machine policies on, e.g. :8445. Disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "admission-tls-cert",
+			Usage: "TLS certificate file of the admission webhook",
+		},
+		cli.StringFlag{
+			Name:  "admission-tls-key",
+			Usage: "TLS key file of the admission webhook",
+		},
+		cli.StringFlag{
+			Name:  "shell-recording-dir",
+			Usage: "Directory to record transcripts of machine shell sessions in. Disabled if empty",
+		},
+		cli.DurationFlag{
+			Name:  "shell-recording-retention",
+			Usage: "How long to keep machine shell session transcripts, forever if zero",
+		},
+		cli.StringFlag{
+			Name:   "driver-catalog",
+			Usage:  "URL of a catalog index to seed machine drivers from",
+			EnvVar: "DRIVER_CATALOG",
+		},
+		cli.StringFlag{
+			Name:   "driver-catalog-key",
+			Usage:  "Base64 encoded ed25519 public key the signature of the driver catalog is verified with",
+			EnvVar: "DRIVER_CATALOG_KEY",
+		},
+		cli.StringFlag{
+			Name:   "driver-allow-list-key",
+			Usage:  "Base64 encoded ed25519 public key of the driver binary allow list. Enforced if set",
+			EnvVar: "DRIVER_ALLOW_LIST_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "driver-stale-after",
+			Usage: "Mark machine drivers unused for this long and by any machine as stale, e.g. 2160h. Disabled if zero",
+		},
+		cli.BoolFlag{
+			Name:  "driver-stale-deactivate",
+			Usage: "Deactivate stale machine drivers instead of only marking them",
+		},
+		cli.StringFlag{
+			Name:   "driver-download-ca",
+			Usage:  "CA bundle trusted for driver downloads, as secret/<name> or configmap/<name> in cattle-system with a ca.crt key",
+			EnvVar: "DRIVER_DOWNLOAD_CA",
+		},
+		cli.DurationFlag{
+			Name:  "driver-download-dial-timeout",
+			Usage: "Timeout of connecting to the servers drivers and catalogs are downloaded from",
+			Value: 30 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "driver-download-read-timeout",
+			Usage: "Fail driver and catalog downloads that receive no data for this long. Disabled if zero",
+		},
+		cli.IntFlag{
+			Name:  "driver-download-max-idle-conns",
+			Usage: "Maximum number of idle connections kept open for driver and catalog downloads",
+			Value: 100,
+		},
+		cli.StringFlag{
+			Name:   "driver-download-user-agent",
+			Usage:  "User-Agent header of driver and catalog downloads",
+			EnvVar: "DRIVER_DOWNLOAD_USER_AGENT",
+		},
+		cli.StringFlag{
+			Name:   "driver-download-tls-min-version",
+			Usage:  "Minimum TLS version of driver and catalog downloads: 1.0, 1.1 or 1.2",
+			EnvVar: "DRIVER_DOWNLOAD_TLS_MIN_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "driver-download-client-cert",
+			Usage:  "kubernetes.io/tls Secret in cattle-system presented as client certificate by driver and catalog downloads",
+			EnvVar: "DRIVER_DOWNLOAD_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "driver-local-dir",
+			Usage:  "Directory, such as a mounted volume, machine drivers with a file:// URL may be installed from",
+			EnvVar: "DRIVER_LOCAL_DIR",
+		},
+		cli.BoolTFlag{
+			Name:   "seed-builtin-drivers",
+			Usage:  "Create MachineDrivers for the drivers built into docker-machine that do not exist yet",
+			EnvVar: "SEED_BUILTIN_DRIVERS",
+		},
+		cli.StringFlag{
+			Name:   "ssh-key-type",
+			Usage:  "Type of the SSH keys generated for machines whose template does not select one: rsa-4096, ed25519 or ecdsa",
+			EnvVar: "SSH_KEY_TYPE",
+		},
+		cli.IntFlag{
+			Name:   "max-concurrent-provisions",
+			Usage:  "Maximum number of machines provisioned at once, 0 for no limit",
+			EnvVar: "MAX_CONCURRENT_PROVISIONS",
+		},
+		cli.IntFlag{
+			Name:   "provisioning-retries",
+			Usage:  "How often a failed machine create is retried, with exponential backoff, before the machine is left failed",
+			Value:  3,
+			EnvVar: "PROVISIONING_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "require-approval",
+			Usage:  "Hold the cloud create of every machine until it is approved, unless its template opts out",
+			EnvVar: "REQUIRE_APPROVAL",
+		},
+		cli.StringFlag{
+			Name:   "approval-webhook",
+			Usage:  "URL to POST an approval request to for each machine waiting for approval",
+			EnvVar: "APPROVAL_WEBHOOK",
+		},
+		cli.StringFlag{
+			Name:   "machine-state-namespace",
+			Usage:  "Namespace of the Secrets holding the docker-machine state of machines",
+			Value:  "cattle-system",
+			EnvVar: "MACHINE_STATE_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "events-sink",
+			Usage:  "URL to publish machine and driver lifecycle transitions to as CloudEvents: http(s)://... or nats://host:4222/<subject>. Disabled if empty",
+			EnvVar: "EVENTS_SINK",
+		},
+		cli.StringFlag{
+			Name:   "events-source",
+			Usage:  "Source attribute of the published CloudEvents",
+			Value:  "/machine-controller",
+			EnvVar: "EVENTS_SOURCE",
+		},
+		cli.StringFlag{
+			Name:   "watch-namespaces",
+			Usage:  "Comma separated namespaces, or glob patterns, whose machines are managed. All if empty",
+			EnvVar: "WATCH_NAMESPACES",
+		},
+		cli.StringFlag{
+			Name:   "ignore-namespaces",
+			Usage:  "Comma separated namespaces, or glob patterns, whose machines are left to other controllers",
+			EnvVar: "IGNORE_NAMESPACES",
+		},
+		cli.BoolTFlag{
+			Name:  "driver-no-new-privileges",
+			Usage: "Run docker-machine and driver plugins with no_new_privs set",
+		},
+		cli.BoolTFlag{
+			Name:  "driver-seccomp",
+			Usage: "Run docker-machine and driver plugins with a seccomp filter denying privileged system calls",
+		},
+		cli.StringFlag{
+			Name:   "driver-env",
+			Usage:  "Comma separated environment variables of the controller passed to docker-machine and driver plugins, e.g. GOOGLE_APPLICATION_CREDENTIALS",
+			EnvVar: "DRIVER_ENV",
+		},
+		cli.StringFlag{
+			Name:  "driver-apparmor-profile",
+			Usage: "AppArmor profile to run docker-machine and driver plugins in. Unconfined if empty",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Enable debug log",
@@ -28,7 +244,73 @@ func main() {
 		if c.Bool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
-		return run(c.String("config"))
+		opts := options.Options{
+			MultiTenancy:          c.Bool("multi-tenancy"),
+			SchemaOnly:            c.Bool("schema-only"),
+			StatusUpdateInterval:  c.Duration("status-update-interval"),
+			DriverCatalog:         c.String("driver-catalog"),
+			DriverCatalogKey:      c.String("driver-catalog-key"),
+			DriverAllowListKey:    c.String("driver-allow-list-key"),
+			DriverStaleAfter:      c.Duration("driver-stale-after"),
+			DriverStaleDeactivate: c.Bool("driver-stale-deactivate"),
+			DriverDownloadCA:      c.String("driver-download-ca"),
+			Download: download.Options{
+				DialTimeout:       c.Duration("driver-download-dial-timeout"),
+				ReadTimeout:       c.Duration("driver-download-read-timeout"),
+				MaxIdleConns:      c.Int("driver-download-max-idle-conns"),
+				UserAgent:         c.String("driver-download-user-agent"),
+				TLSMinVersion:     c.String("driver-download-tls-min-version"),
+				ClientCertificate: c.String("driver-download-client-cert"),
+			},
+			DriverLocalDir:          c.String("driver-local-dir"),
+			SSHKeyType:              c.String("ssh-key-type"),
+			SeedBuiltinDrivers:      c.BoolT("seed-builtin-drivers"),
+			MaxConcurrentProvisions: c.Int("max-concurrent-provisions"),
+			ProvisioningRetries:     c.Int("provisioning-retries"),
+			RequireApproval:         c.Bool("require-approval"),
+			ApprovalWebhook:         c.String("approval-webhook"),
+			MachineStateNamespace:   c.String("machine-state-namespace"),
+			DriverEnv:               options.ParseList(c.String("driver-env")),
+			Namespaces: options.NamespaceScope{
+				Allow: options.ParseList(c.String("watch-namespaces")),
+				Deny:  options.ParseList(c.String("ignore-namespaces")),
+			},
+			Events: cloudevents.Options{
+				Sink:   c.String("events-sink"),
+				Source: c.String("events-source"),
+			},
+			Sandbox: sandbox.Options{
+				NoNewPrivileges: c.BoolT("driver-no-new-privileges"),
+				Seccomp:         c.BoolT("driver-seccomp"),
+				AppArmorProfile: c.String("driver-apparmor-profile"),
+			},
+		}
+		if err := opts.Namespaces.Validate(); err != nil {
+			return fmt.Errorf("invalid namespace pattern: %v", err)
+		}
+		if addr := c.String("metrics-listen"); addr != "" {
+			go serveMetrics(addr, opts)
+		}
+		shellOpts := shellOptions{
+			addr:    c.String("shell-listen"),
+			tlsCert: c.String("shell-tls-cert"),
+			tlsKey:  c.String("shell-tls-key"),
+			server: shell.Options{
+				RecordingDir:       c.String("shell-recording-dir"),
+				RecordingRetention: c.Duration("shell-recording-retention"),
+			},
+		}
+		queryOpts := queryOptions{
+			addr:    c.String("query-listen"),
+			tlsCert: c.String("query-tls-cert"),
+			tlsKey:  c.String("query-tls-key"),
+		}
+		admissionOpts := admissionOptions{
+			addr:    c.String("admission-listen"),
+			tlsCert: c.String("admission-tls-cert"),
+			tlsKey:  c.String("admission-tls-key"),
+		}
+		return run(c.String("config"), shellOpts, queryOpts, admissionOpts, opts)
 	}
 
 	app.ExitErrHandler = func(c *cli.Context, err error) {
@@ -38,7 +320,98 @@ func main() {
 	app.Run(os.Args)
 }
 
-func run(kubeConfigFile string) error {
+// ready is set once the controllers are synced and running.
+var ready int32
+
+func serveMetrics(addr string, opts options.Options) {
+	mode := "full"
+	if opts.SchemaOnly {
+		mode = "schema-only"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(rw, "starting\nmode: %s\n", mode)
+			return
+		}
+		fmt.Fprintf(rw, "ok\nmode: %s\n", mode)
+	})
+	logrus.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("Metrics server failed: %v", err)
+	}
+}
+
+type shellOptions struct {
+	addr, tlsCert, tlsKey string
+	server                shell.Options
+}
+
+func serveShell(shellOpts shellOptions, management *config.ManagementContext) {
+	mux := http.NewServeMux()
+	mux.Handle("/machines/", shell.NewServer(management, shellOpts.server))
+	logrus.Infof("Serving machine access on %s", shellOpts.addr)
+
+	var err error
+	if shellOpts.tlsCert != "" && shellOpts.tlsKey != "" {
+		err = http.ListenAndServeTLS(shellOpts.addr, shellOpts.tlsCert, shellOpts.tlsKey, mux)
+	} else {
+		logrus.Warnf("Machine access on %s is served without TLS", shellOpts.addr)
+		err = http.ListenAndServe(shellOpts.addr, mux)
+	}
+	if err != nil {
+		logrus.Errorf("Machine access server failed: %v", err)
+	}
+}
+
+type queryOptions struct {
+	addr, tlsCert, tlsKey string
+}
+
+func serveQuery(queryOpts queryOptions, server *query.Server) {
+	mux := http.NewServeMux()
+	mux.Handle(query.Path, server)
+	logrus.Infof("Serving machine queries on %s", queryOpts.addr)
+
+	var err error
+	if queryOpts.tlsCert != "" && queryOpts.tlsKey != "" {
+		err = http.ListenAndServeTLS(queryOpts.addr, queryOpts.tlsCert, queryOpts.tlsKey, mux)
+	} else {
+		logrus.Warnf("Machine queries on %s are served without TLS", queryOpts.addr)
+		err = http.ListenAndServe(queryOpts.addr, mux)
+	}
+	if err != nil {
+		logrus.Errorf("Machine query server failed: %v", err)
+	}
+}
+
+type admissionOptions struct {
+	addr, tlsCert, tlsKey string
+}
+
+func serveAdmission(admissionOpts admissionOptions, server *admission.Server) {
+	mux := http.NewServeMux()
+	mux.Handle(admission.Path, server)
+	logrus.Infof("Serving the admission webhook on %s", admissionOpts.addr)
+
+	var err error
+	if admissionOpts.tlsCert != "" && admissionOpts.tlsKey != "" {
+		err = http.ListenAndServeTLS(admissionOpts.addr, admissionOpts.tlsCert, admissionOpts.tlsKey, mux)
+	} else {
+		// The API server only calls webhooks over TLS, so this is only
+		// reachable behind a proxy terminating it.
+		logrus.Warnf("Admission webhook on %s is served without TLS", admissionOpts.addr)
+		err = http.ListenAndServe(admissionOpts.addr, mux)
+	}
+	if err != nil {
+		logrus.Errorf("Admission webhook server failed: %v", err)
+	}
+}
+
+func run(kubeConfigFile string, shellOpts shellOptions, queryOpts queryOptions, admissionOpts admissionOptions, opts options.Options) error {
 	kubeConfig, err := clientcmd.BuildConfigFromFlags("", kubeConfigFile)
 	if err != nil {
 		return err
@@ -49,7 +422,23 @@ func run(kubeConfigFile string) error {
 		return err
 	}
 
-	controller.Register(management)
+	controller.Register(management, opts)
+	if shellOpts.addr != "" {
+		go serveShell(shellOpts, management)
+	}
+	if queryOpts.addr != "" {
+		go serveQuery(queryOpts, query.NewServer(management))
+	}
+	if admissionOpts.addr != "" {
+		go serveAdmission(admissionOpts, admission.NewServer(management, opts.MultiTenancy))
+	}
+
+	ctx := signal.SigTermCancelContext(context.Background())
+	if err := management.Start(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&ready, 1)
 
-	return management.StartAndWait()
+	<-ctx.Done()
+	return ctx.Err()
 }
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	registryLock = sync.Mutex{}
+	registry     []*GaugeVec
+)
+
+// GaugeVec is a set of gauges sharing a name and label names, exposed in the
+// Prometheus text format.
+type GaugeVec struct {
+	sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]gaugeValue
+}
+
+type gaugeValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewGaugeVec creates and registers a gauge vector.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]gaugeValue{},
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, g)
+
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.values[strings.Join(labelValues, "\x00")] = gaugeValue{
+		labelValues: labelValues,
+		value:       value,
+	}
+}
+
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	key := strings.Join(labelValues, "\x00")
+	current := g.values[key]
+	g.values[key] = gaugeValue{
+		labelValues: labelValues,
+		value:       current.value + value,
+	}
+}
+
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	delete(g.values, strings.Join(labelValues, "\x00"))
+}
+
+func (g *GaugeVec) write(w *bytes.Buffer) {
+	g.Lock()
+	defer g.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+
+	var keys []string
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := g.values[key]
+		var labels []string
+		for i, name := range g.labelNames {
+			if i < len(v.labelValues) {
+				labels = append(labels, fmt.Sprintf("%s=%q", name, v.labelValues[i]))
+			}
+		}
+		if len(labels) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", g.name, strings.Join(labels, ","), v.value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", g.name, v.value)
+		}
+	}
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		registryLock.Lock()
+		gauges := append([]*GaugeVec{}, registry...)
+		registryLock.Unlock()
+
+		buf := &bytes.Buffer{}
+		for _, g := range gauges {
+			g.write(buf)
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		rw.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/catalog"
+	"golang.org/x/crypto/ed25519"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// BinariesConfigMap holds the sha256 checksums of the driver binaries
+	// the controller may execute, one per line under ChecksumsKey, and the
+	// base64 ed25519 signature of that value under SignatureKey.
+	BinariesConfigMap = "machine-driver-allowed-binaries"
+	ChecksumsKey      = "checksums"
+	SignatureKey      = "checksums.sig"
+)
+
+// BinaryAllowList checks driver binaries against the signed checksums in the
+// machine-driver-allowed-binaries ConfigMap. A nil list allows everything.
+type BinaryAllowList struct {
+	configMaps typedv1.ConfigMapsGetter
+	key        ed25519.PublicKey
+}
+
+// NewBinaryAllowList enforces the allow list signed with the base64 encoded
+// ed25519 key, or nothing if key is empty.
+func NewBinaryAllowList(configMaps typedv1.ConfigMapsGetter, key string) (*BinaryAllowList, error) {
+	if key == "" {
+		return nil, nil
+	}
+	publicKey, err := catalog.ParsePublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryAllowList{
+		configMaps: configMaps,
+		key:        publicKey,
+	}, nil
+}
+
+// Check returns an error unless the sha256 checksum of the file at path is in
+// the allow list. The checksum is computed from the file itself, whatever the
+// MachineDriver claims. A missing or badly signed ConfigMap allows nothing.
+func (a *BinaryAllowList) Check(path string) error {
+	if a == nil {
+		return nil
+	}
+
+	checksums, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if !checksums[checksum] {
+		return fmt.Errorf("binary %s with checksum %s is not in %s/%s", path, checksum, Namespace, BinariesConfigMap)
+	}
+	return nil
+}
+
+func (a *BinaryAllowList) load() (map[string]bool, error) {
+	cm, err := a.configMaps.ConfigMaps(Namespace).Get(BinariesConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get allowed driver binaries")
+	}
+
+	data := cm.Data[ChecksumsKey]
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cm.Data[SignatureKey]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid signature of %s/%s", Namespace, BinariesConfigMap)
+	}
+	if !ed25519.Verify(a.key, []byte(data), sig) {
+		return nil, fmt.Errorf("signature of %s/%s does not verify", Namespace, BinariesConfigMap)
+	}
+
+	checksums := map[string]bool{}
+	for _, line := range strings.Split(data, "\n") {
+		// lines may be sha256sum output, "<checksum>  <file>"
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			checksums[strings.ToLower(fields[0])] = true
+		}
+	}
+	return checksums, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// DriversConfigMap lists the machine drivers each cluster and project may
+	// use, keyed by cluster name or by <cluster>.<project> for projects, as
+	// ConfigMap keys cannot contain the ':' of project IDs. Each value is a
+	// JSON list of driver names or shell patterns.
+	DriversConfigMap = "machine-allowed-drivers"
+	// ProjectAnnotation on a namespace is the ID of the project it belongs to.
+	ProjectAnnotation = "field.cattle.io/projectId"
+)
+
+// DriverScope is a cluster or project with a list of allowed drivers.
+type DriverScope struct {
+	Kind     string
+	Name     string
+	Patterns []string
+}
+
+// LoadAllowedDrivers returns the allow lists of the cluster and project of a
+// machine from the machine-allowed-drivers ConfigMap. Scopes without a list
+// may use any driver and are left out.
+func LoadAllowedDrivers(configMaps typedv1.ConfigMapsGetter, cluster, project string) ([]DriverScope, error) {
+	cm, err := configMaps.ConfigMaps(Namespace).Get(DriversConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var scopes []DriverScope
+	for _, scope := range []DriverScope{{Kind: "cluster", Name: cluster}, {Kind: "project", Name: project}} {
+		if scope.Name == "" {
+			continue
+		}
+		data, ok := cm.Data[strings.Replace(scope.Name, ":", ".", 1)]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &scope.Patterns); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse allowed drivers of %s %s", scope.Kind, scope.Name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// CheckDriver returns a Violation unless driver matches a pattern of every
+// scope.
+func CheckDriver(scopes []DriverScope, driver string) error {
+	for _, scope := range scopes {
+		allowed := false
+		for _, pattern := range scope.Patterns {
+			if matched, _ := path.Match(pattern, driver); matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &Violation{
+				Rule:  DriversConfigMap,
+				Field: "driver",
+				Msg:   fmt.Sprintf("machine driver %s is not allowed in %s %s", driver, scope.Kind, scope.Name),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+func TestCheckDriver(t *testing.T) {
+	cluster := DriverScope{Kind: "cluster", Name: "c-7qk9x", Patterns: []string{"amazonec2", "vmware*"}}
+	project := DriverScope{Kind: "project", Name: "c-7qk9x:p-2mgfl", Patterns: []string{"vmwarevsphere"}}
+	tests := []struct {
+		name    string
+		scopes  []DriverScope
+		driver  string
+		allowed bool
+	}{
+		{"no scopes", nil, "digitalocean", true},
+		{"listed", []DriverScope{cluster}, "amazonec2", true},
+		{"pattern", []DriverScope{cluster}, "vmwarevcloudair", true},
+		{"not listed", []DriverScope{cluster}, "digitalocean", false},
+		{"empty list", []DriverScope{{Kind: "cluster", Name: "c-7qk9x"}}, "amazonec2", false},
+		{"every scope", []DriverScope{cluster, project}, "vmwarevsphere", true},
+		{"one scope only", []DriverScope{cluster, project}, "amazonec2", false},
+	}
+	for _, test := range tests {
+		err := CheckDriver(test.scopes, test.driver)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %s is rejected: %v", test.name, test.driver, err)
+		}
+		if !test.allowed {
+			if _, ok := err.(*Violation); !ok {
+				t.Errorf("%s: %s is not rejected with a violation: %v", test.name, test.driver, err)
+			}
+		}
+	}
+}
+
+type fakeConfigMaps struct {
+	typedv1.ConfigMapInterface
+	cm *v1.ConfigMap
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) typedv1.ConfigMapInterface {
+	return f
+}
+
+func (f *fakeConfigMaps) Get(name string, opts metav1.GetOptions) (*v1.ConfigMap, error) {
+	return f.cm, nil
+}
+
+func TestLoadAllowedDriversOfProject(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		"c-7qk9x":         `["amazonec2"]`,
+		"c-7qk9x.p-2mgfl": `["amazonec2", "vmwarevsphere"]`,
+	}}
+	scopes, err := LoadAllowedDrivers(&fakeConfigMaps{cm: cm}, "c-7qk9x", "c-7qk9x:p-2mgfl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 {
+		t.Fatalf("got %d scopes, want the cluster and the project: %v", len(scopes), scopes)
+	}
+	if scopes[1].Kind != "project" || scopes[1].Name != "c-7qk9x:p-2mgfl" || len(scopes[1].Patterns) != 2 {
+		t.Errorf("project scope is %v", scopes[1])
+	}
+}
@@ -0,0 +1,1264 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expression is a compiled expression of the Common Expression Language
+// (https://github.com/google/cel-spec). A subset of CEL is supported:
+//
+//   - literals: int, double, string, bool, null, lists and maps
+//   - operators: ! - * / % + < <= > >= == != in && || ?: and field and
+//     index access
+//   - functions: size, int, double, string, has, matches, startsWith,
+//     endsWith and contains
+//   - macros on lists and maps: all, exists, exists_one, filter and map
+//
+// Unlike CEL, values are not type checked when compiled, and numbers of
+// different types are compared and combined as doubles.
+type Expression struct {
+	source string
+	root   node
+}
+
+// CompileExpression parses a CEL expression that may refer to the given
+// variables.
+func CompileExpression(source string, variables ...string) (*Expression, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{
+		tokens:   tokens,
+		declared: map[string]int{},
+	}
+	for _, variable := range variables {
+		p.declared[variable]++
+	}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return &Expression{
+		source: source,
+		root:   root,
+	}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression with the given values of its variables.
+func (e *Expression) Eval(vars map[string]interface{}) (interface{}, error) {
+	normalized := map[string]interface{}{}
+	for name, value := range vars {
+		normalized[name] = normalize(value)
+	}
+	return e.root.eval(&activation{vars: normalized})
+}
+
+// EvalBool evaluates an expression that must result in a bool.
+func (e *Expression) EvalBool(vars map[string]interface{}) (bool, error) {
+	value, err := e.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q results in %s, not a bool", e.source, typeName(value))
+	}
+	return b, nil
+}
+
+// normalize converts a value to the types expressions operate on: int64,
+// float64, string, bool, nil, []interface{} and map[string]interface{}.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, int64, float64:
+		return v
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalize(item)
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalize(item)
+		}
+		return m
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = normalize(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for _, key := range rv.MapKeys() {
+			m[key.String()] = normalize(rv.MapIndex(key).Interface())
+		}
+		return m
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalize(rv.Elem().Interface())
+	}
+	return fmt.Sprint(value)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenDouble
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators are ordered so that longer operators are matched first.
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=",
+	"<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}",
+}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(source); {
+		r, size := utf8.DecodeRuneInString(source[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case r == '"' || r == '\'' ||
+			((r == 'r' || r == 'R') && pos+1 < len(source) && (source[pos+1] == '"' || source[pos+1] == '\'')):
+			t, err := lexString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			pos += len(t.text)
+		case r >= '0' && r <= '9' || r == '.' && pos+1 < len(source) && source[pos+1] >= '0' && source[pos+1] <= '9':
+			t, err := lexNumber(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			pos += len(t.text)
+		case r == '_' || unicode.IsLetter(r):
+			end := pos
+			for end < len(source) {
+				r, size := utf8.DecodeRuneInString(source[end:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[pos:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", r, pos)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+func lexString(source string, pos int) (token, error) {
+	start := pos
+	raw := false
+	if source[pos] == 'r' || source[pos] == 'R' {
+		raw = true
+		pos++
+	}
+	quote := source[pos]
+	pos++
+
+	buf := &bytes.Buffer{}
+	for pos < len(source) {
+		c := source[pos]
+		switch {
+		case c == quote:
+			return token{kind: tokenString, text: source[start : pos+1], value: buf.String(), pos: start}, nil
+		case c == '\n':
+			return token{}, fmt.Errorf("unterminated string at %d", start)
+		case c == '\\' && !raw:
+			if pos+1 >= len(source) {
+				return token{}, fmt.Errorf("unterminated string at %d", start)
+			}
+			switch e := source[pos+1]; e {
+			case '\\', '"', '\'', '`', '?':
+				buf.WriteByte(e)
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			default:
+				return token{}, fmt.Errorf("invalid escape \\%c at %d", e, pos)
+			}
+			pos += 2
+			continue
+		default:
+			buf.WriteByte(c)
+		}
+		pos++
+	}
+	return token{}, fmt.Errorf("unterminated string at %d", start)
+}
+
+func lexNumber(source string, pos int) (token, error) {
+	start := pos
+	if strings.HasPrefix(source[pos:], "0x") || strings.HasPrefix(source[pos:], "0X") {
+		pos += 2
+		for pos < len(source) && strings.IndexByte("0123456789abcdefABCDEF", source[pos]) >= 0 {
+			pos++
+		}
+		n, err := strconv.ParseInt(source[start+2:pos], 16, 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid int %s at %d", source[start:pos], start)
+		}
+		return token{kind: tokenInt, text: source[start:pos], value: n, pos: start}, nil
+	}
+
+	digits := func() {
+		for pos < len(source) && source[pos] >= '0' && source[pos] <= '9' {
+			pos++
+		}
+	}
+	double := false
+	digits()
+	if pos+1 < len(source) && source[pos] == '.' && source[pos+1] >= '0' && source[pos+1] <= '9' {
+		double = true
+		pos++
+		digits()
+	}
+	if pos < len(source) && (source[pos] == 'e' || source[pos] == 'E') {
+		double = true
+		pos++
+		if pos < len(source) && (source[pos] == '+' || source[pos] == '-') {
+			pos++
+		}
+		digits()
+	}
+
+	text := source[start:pos]
+	if double {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid double %s at %d", text, start)
+		}
+		return token{kind: tokenDouble, text: text, value: f, pos: start}, nil
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return token{}, fmt.Errorf("invalid int %s at %d", text, start)
+	}
+	return token{kind: tokenInt, text: text, value: n, pos: start}, nil
+}
+
+// functions are the global functions and the number of their arguments.
+var functions = map[string]int{
+	"size":    1,
+	"int":     1,
+	"double":  1,
+	"string":  1,
+	"matches": 2,
+}
+
+// methods are the functions called on a value and the number of their
+// arguments besides it.
+var methods = map[string]int{
+	"size":       0,
+	"matches":    1,
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+}
+
+// macros take a variable and an expression evaluated for each item of the
+// list or key of the map they are called on.
+var macros = map[string]bool{
+	"all":        true,
+	"exists":     true,
+	"exists_one": true,
+	"filter":     true,
+	"map":        true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// declared counts the declarations of each variable in scope.
+	declared map[string]int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return p.errorf(t, "expected %q, found %s", op, t)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *parser) expr() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+// precedences are the binary operators from the lowest to the highest
+// precedence.
+var precedences = [][]string{
+	{"||"},
+	{"&&"},
+	{"<", "<=", ">", ">=", "==", "!=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedences) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if (t.kind != tokenOperator && !(t.kind == tokenIdent && t.text == "in")) || !contains(precedences[level], t.text) {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == tokenOperator && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: t.text, operand: operand}, nil
+	}
+	return p.member()
+}
+
+func (p *parser) member() (node, error) {
+	operand, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokenIdent {
+				return nil, p.errorf(t, "expected a field name, found %s", t)
+			}
+			if !p.accept("(") {
+				operand = &selection{operand: operand, field: t.text}
+				continue
+			}
+			if macros[t.text] {
+				operand, err = p.macro(t, operand)
+			} else {
+				operand, err = p.call(t, operand, methods)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			i, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			operand = &index{operand: operand, index: i}
+		default:
+			return operand, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenInt, tokenDouble, tokenString:
+		return &literal{value: t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		}
+		if !p.accept("(") {
+			if p.declared[t.text] == 0 {
+				return nil, p.errorf(t, "undeclared reference to %s", t.text)
+			}
+			return &identifier{name: t.text}, nil
+		}
+		if t.text == "has" {
+			return p.has(t)
+		}
+		return p.call(t, nil, functions)
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			items, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{items: items}, nil
+		case "{":
+			return p.mapLiteral()
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// list parses the comma separated expressions up to the closing operator.
+func (p *parser) list(closing string) ([]node, error) {
+	var items []node
+	for !p.accept(closing) {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept(closing) {
+				break
+			}
+		}
+		item, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *parser) mapLiteral() (node, error) {
+	m := &mapping{}
+	for !p.accept("}") {
+		if len(m.keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		key, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, key)
+		m.values = append(m.values, value)
+	}
+	return m, nil
+}
+
+func (p *parser) call(name token, target node, known map[string]int) (node, error) {
+	arity, ok := known[name.text]
+	if !ok {
+		return nil, p.errorf(name, "undeclared function %s", name.text)
+	}
+	args, err := p.list(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != arity {
+		return nil, p.errorf(name, "%s takes %d arguments, found %d", name.text, arity, len(args))
+	}
+	return &call{function: name.text, target: target, args: args}, nil
+}
+
+func (p *parser) has(name token) (node, error) {
+	arg, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	sel, ok := arg.(*selection)
+	if !ok {
+		return nil, p.errorf(name, "has takes a field selection")
+	}
+	return &selection{operand: sel.operand, field: sel.field, test: true}, nil
+}
+
+func (p *parser) macro(name token, target node) (node, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, p.errorf(t, "%s takes a variable name, found %s", name.text, t)
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+
+	p.declared[t.text]++
+	body, err := p.expr()
+	p.declared[t.text]--
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &comprehension{macro: name.text, target: target, variable: t.text, body: body}, nil
+}
+
+// activation holds the values of the variables in scope.
+type activation struct {
+	name   string
+	value  interface{}
+	parent *activation
+	vars   map[string]interface{}
+}
+
+func (a *activation) lookup(name string) (interface{}, bool) {
+	for ; a != nil; a = a.parent {
+		if a.vars != nil {
+			value, ok := a.vars[name]
+			return value, ok
+		}
+		if a.name == name {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+
+type node interface {
+	eval(a *activation) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(a *activation) (interface{}, error) {
+	return n.value, nil
+}
+
+type identifier struct {
+	name string
+}
+
+func (n *identifier) eval(a *activation) (interface{}, error) {
+	value, ok := a.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("no value for variable %s", n.name)
+	}
+	return value, nil
+}
+
+// selection is a field access, or the test whether the field is present if
+// it is the argument of has.
+type selection struct {
+	operand node
+	field   string
+	test    bool
+}
+
+func (n *selection) eval(a *activation) (interface{}, error) {
+	operand, err := n.operand.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select field %s of %s", n.field, typeName(operand))
+	}
+	value, ok := m[n.field]
+	if n.test {
+		return ok, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", n.field)
+	}
+	return value, nil
+}
+
+type index struct {
+	operand node
+	index   node
+}
+
+func (n *index) eval(a *activation) (interface{}, error) {
+	operand, err := n.operand.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.index.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	switch operand := operand.(type) {
+	case []interface{}:
+		pos, ok := i.(int64)
+		if !ok {
+			return nil, fmt.Errorf("cannot index a list with %s", typeName(i))
+		}
+		if pos < 0 || pos >= int64(len(operand)) {
+			return nil, fmt.Errorf("index %d out of range", pos)
+		}
+		return operand[pos], nil
+	case map[string]interface{}:
+		key, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot index a map with %s", typeName(i))
+		}
+		value, ok := operand[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", key)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(operand))
+}
+
+type list struct {
+	items []node
+}
+
+func (n *list) eval(a *activation) (interface{}, error) {
+	result := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = value
+	}
+	return result, nil
+}
+
+type mapping struct {
+	keys   []node
+	values []node
+}
+
+func (n *mapping) eval(a *activation) (interface{}, error) {
+	result := map[string]interface{}{}
+	for i := range n.keys {
+		key, err := n.keys[i].eval(a)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys must be strings, found %s", typeName(key))
+		}
+		if _, ok := result[s]; ok {
+			return nil, fmt.Errorf("duplicate map key %s", s)
+		}
+		value, err := n.values[i].eval(a)
+		if err != nil {
+			return nil, err
+		}
+		result[s] = value
+	}
+	return result, nil
+}
+
+type conditional struct {
+	cond      node
+	then      node
+	otherwise node
+}
+
+func (n *conditional) eval(a *activation) (interface{}, error) {
+	cond, err := n.cond.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := cond.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, not a bool", typeName(cond))
+	}
+	if b {
+		return n.then.eval(a)
+	}
+	return n.otherwise.eval(a)
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n *unary) eval(a *activation) (interface{}, error) {
+	operand, err := n.operand.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	switch v := operand.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s%s", n.op, typeName(operand))
+}
+
+type binary struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *binary) eval(a *activation) (interface{}, error) {
+	if n.op == "&&" || n.op == "||" {
+		return n.logical(a)
+	}
+
+	left, err := n.left.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(a)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==", "!=":
+		return equal(left, right) == (n.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), n.op, typeName(right))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		switch right := right.(type) {
+		case []interface{}:
+			for _, item := range right {
+				if equal(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = right[key]
+			return ok, nil
+		}
+		return nil, fmt.Errorf("no such overload: %s in %s", typeName(left), typeName(right))
+	}
+	return arithmetic(n.op, left, right)
+}
+
+// logical evaluates && and || like CEL: an error on one side is ignored if
+// the other side decides the outcome.
+func (n *binary) logical(a *activation) (interface{}, error) {
+	decisive := n.op == "||"
+	left, leftErr := n.left.eval(a)
+	if b, ok := left.(bool); leftErr == nil && ok && b == decisive {
+		return decisive, nil
+	}
+	right, rightErr := n.right.eval(a)
+	if b, ok := right.(bool); rightErr == nil && ok && b == decisive {
+		return decisive, nil
+	}
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if rightErr != nil {
+		return nil, rightErr
+	}
+	_, leftBool := left.(bool)
+	_, rightBool := right.(bool)
+	if !leftBool || !rightBool {
+		return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), n.op, typeName(right))
+	}
+	return !decisive, nil
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	switch l := left.(type) {
+	case int64:
+		if r, ok := right.(int64); ok {
+			switch op {
+			case "+":
+				return l + r, nil
+			case "-":
+				return l - r, nil
+			case "*":
+				return l * r, nil
+			case "/", "%":
+				if r == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if op == "/" {
+					return l / r, nil
+				}
+				return l % r, nil
+			}
+		}
+	case string:
+		if r, ok := right.(string); ok && op == "+" {
+			return l + r, nil
+		}
+	case []interface{}:
+		if r, ok := right.([]interface{}); ok && op == "+" {
+			return append(append([]interface{}{}, l...), r...), nil
+		}
+	}
+
+	l, lok := toDouble(left)
+	r, rok := toDouble(right)
+	if lok && rok {
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			return l / r, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), op, typeName(right))
+}
+
+func toDouble(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// equal compares values of any type; values of different types are not
+// equal, except numbers.
+func equal(left, right interface{}) bool {
+	switch l := left.(type) {
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !equal(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for key, value := range l {
+			other, ok := r[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	if c, err := compare(left, right); err == nil {
+		return c == 0
+	}
+	return left == nil && right == nil
+}
+
+// compare orders numbers, strings and bools, returning an error for values
+// that cannot be ordered.
+func compare(left, right interface{}) (int, error) {
+	switch l := left.(type) {
+	case int64:
+		if r, ok := right.(int64); ok {
+			switch {
+			case l < r:
+				return -1, nil
+			case l > r:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), nil
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			switch {
+			case l == r:
+				return 0, nil
+			case r:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	l, lok := toDouble(left)
+	r, rok := toDouble(right)
+	if !lok || !rok || math.IsNaN(l) || math.IsNaN(r) {
+		return 0, fmt.Errorf("cannot compare %s and %s", typeName(left), typeName(right))
+	}
+	switch {
+	case l < r:
+		return -1, nil
+	case l > r:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+type call struct {
+	function string
+	target   node
+	args     []node
+}
+
+func (n *call) eval(a *activation) (interface{}, error) {
+	var args []interface{}
+	if n.target != nil {
+		target, err := n.target.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, target)
+	}
+	for _, arg := range n.args {
+		value, err := arg.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	switch n.function {
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return int64(utf8.RuneCountInString(v)), nil
+		case []interface{}:
+			return int64(len(v)), nil
+		case map[string]interface{}:
+			return int64(len(v)), nil
+		}
+	case "int":
+		switch v := args[0].(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if math.IsNaN(v) || v <= math.MinInt64 || v >= math.MaxInt64 {
+				return nil, fmt.Errorf("int(%v) out of range", v)
+			}
+			return int64(v), nil
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("int(%q) is not an int", v)
+			}
+			return i, nil
+		}
+	case "double":
+		switch v := args[0].(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("double(%q) is not a double", v)
+			}
+			return f, nil
+		}
+	case "string":
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	default:
+		s, ok := args[0].(string)
+		arg, argOK := args[1].(string)
+		if !ok || !argOK {
+			break
+		}
+		switch n.function {
+		case "matches":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			return re.MatchString(s), nil
+		case "startsWith":
+			return strings.HasPrefix(s, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(s, arg), nil
+		case "contains":
+			return strings.Contains(s, arg), nil
+		}
+	}
+
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = typeName(arg)
+	}
+	return nil, fmt.Errorf("no such overload: %s(%s)", n.function, strings.Join(types, ", "))
+}
+
+type comprehension struct {
+	macro    string
+	target   node
+	variable string
+	body     node
+}
+
+func (n *comprehension) eval(a *activation) (interface{}, error) {
+	target, err := n.target.eval(a)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	switch v := target.(type) {
+	case []interface{}:
+		items = v
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			items = append(items, key)
+		}
+	default:
+		return nil, fmt.Errorf("cannot call %s on %s", n.macro, typeName(target))
+	}
+
+	var (
+		results []interface{}
+		matches int
+		lastErr error
+	)
+	for _, item := range items {
+		value, err := n.body.eval(&activation{name: n.variable, value: item, parent: a})
+		if n.macro == "map" {
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, value)
+			continue
+		}
+
+		b, ok := value.(bool)
+		if err == nil && !ok {
+			err = fmt.Errorf("%s takes a bool expression, found %s", n.macro, typeName(value))
+		}
+		if err != nil {
+			// Like &&, all and exists ignore errors if an item decides the
+			// outcome.
+			if n.macro != "all" && n.macro != "exists" {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		switch {
+		case n.macro == "all" && !b:
+			return false, nil
+		case n.macro == "exists" && b:
+			return true, nil
+		case b:
+			matches++
+			results = append(results, item)
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	switch n.macro {
+	case "all":
+		return true, nil
+	case "exists":
+		return false, nil
+	case "exists_one":
+		return matches == 1, nil
+	}
+	if results == nil {
+		results = []interface{}{}
+	}
+	return results, nil
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	vars := map[string]interface{}{
+		"config": map[string]interface{}{
+			"instanceType": "m5.large",
+			"diskSize":     float64(40),
+			"count":        3,
+			"tags":         []string{"team=a", "env=prod"},
+			"private":      true,
+		},
+		"labels": map[string]string{"env": "prod"},
+	}
+	tests := []struct {
+		source string
+		result interface{}
+		err    bool
+	}{
+		{source: `config.instanceType in ["m5.large", "m5.xlarge"]`, result: true},
+		{source: `config.diskSize >= 40`, result: true},
+		{source: `config.diskSize > 40.5`, result: false},
+		{source: `config.count * 2 + 1`, result: int64(7)},
+		{source: `config.count / 2`, result: int64(1)},
+		{source: `config.count % 2 == 1`, result: true},
+		{source: `config.diskSize / 16`, result: 2.5},
+		{source: `-config.count`, result: int64(-3)},
+		{source: `!config.private`, result: false},
+		{source: `labels.env != "prod" || config.instanceType.startsWith("m5.")`, result: true},
+		{source: `labels["env"] == 'prod' && config.private`, result: true},
+		{source: `config.instanceType.matches("^m[0-9]+\\.")`, result: true},
+		{source: `matches(config.instanceType, r"^t\d")`, result: false},
+		{source: `config.instanceType.endsWith("large") && config.instanceType.contains(".")`, result: true},
+		{source: `size(config.tags) == 2 && config.tags.size() == 2 && size("äb") == 2`, result: true},
+		{source: `config.tags.all(t, t.contains("="))`, result: true},
+		{source: `config.tags.exists(t, t == "env=prod")`, result: true},
+		{source: `config.tags.exists_one(t, t.startsWith("team"))`, result: true},
+		{source: `config.tags.filter(t, t.startsWith("env"))`, result: []interface{}{"env=prod"}},
+		{source: `config.tags.map(t, t + "!")`, result: []interface{}{"team=a!", "env=prod!"}},
+		{source: `labels.all(k, k == "env")`, result: true},
+		{source: `has(config.zone) ? config.zone : "a"`, result: "a"},
+		{source: `has(config.private)`, result: true},
+		{source: `"env" in labels && !("team" in labels)`, result: true},
+		{source: `{"a": 1}.a == 1 && [1, 2][1] == 2.0`, result: true},
+		{source: `int("40") == 40 && double(1) == 1.0 && string(40) == "40" && int(2.9) == 2`, result: true},
+		{source: `null == null && config.instanceType != null`, result: true},
+		{source: `0x10 == 16 && 1e2 == 100`, result: true},
+		{source: `[1] + [2] == [1, 2] && "a" + "b" == "ab"`, result: true},
+		{source: `false < true && "a" < "b"`, result: true},
+
+		// Errors on one side of && and || are ignored if the other side
+		// decides the outcome.
+		{source: `has(config.zone) && config.zone == "a"`, result: false},
+		{source: `config.zone == "a" || true`, result: true},
+		{source: `config.zone == "a" && true`, err: true},
+		{source: `config.zone == "a"`, err: true},
+		{source: `config.instanceType > 1`, err: true},
+		{source: `config.count / 0`, err: true},
+		{source: `config.tags[5]`, err: true},
+		{source: `size(config.count)`, err: true},
+		{source: `config.private ? 1 : 2 + "a"`, result: int64(1)},
+		{source: `config.tags.all(t, t)`, err: true},
+	}
+	for _, test := range tests {
+		expr, err := CompileExpression(test.source, "config", "labels")
+		if err != nil {
+			t.Errorf("%s: unexpected compile error: %v", test.source, err)
+			continue
+		}
+		result, err := expr.Eval(vars)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.source, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: got %#v, want %#v", test.source, result, test.result)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []string{
+		`config.diskSize >=`,
+		`unknown > 1`,
+		`config.tags.all(t, t == x)`,
+		`lower(config.instanceType)`,
+		`config.instanceType.startsWith()`,
+		`has(config)`,
+		`"unterminated`,
+		`"bad \q escape"`,
+		`config.diskSize # 1`,
+		`(config.diskSize > 1`,
+		`config.diskSize > 1 )`,
+	}
+	for _, source := range tests {
+		if _, err := CompileExpression(source, "config"); err == nil {
+			t.Errorf("%s: expected a compile error", source)
+		}
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	expr, err := CompileExpression(`size(name)`, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.EvalBool(map[string]interface{}{"name": "a"}); err == nil {
+		t.Errorf("expected an error for a non bool result")
+	}
+}
@@ -0,0 +1,251 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+)
+
+// BoundsAnnotation on a DynamicSchema holds the numeric bounds of its fields
+// as a JSON object of Bounds keyed by field name. The Min and Max of a field
+// cannot express a bound of zero, these can.
+const BoundsAnnotation = "io.cattle.machine_driver.field_bounds"
+
+// RulesAnnotation on a DynamicSchema holds the rules of its fields as a JSON
+// object of FieldRule lists keyed by field name.
+const RulesAnnotation = "io.cattle.machine_driver.field_rules"
+
+// Bounds are the smallest and largest value a numeric field may have, if
+// set.
+type Bounds struct {
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+}
+
+// FieldRule is a CEL expression a field must satisfy if it is set. The
+// expression refers to the field as self and to every field of the schema by
+// its name, which is null if the field is not set.
+type FieldRule struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message,omitempty"`
+}
+
+// ValidateSchema checks a driver config against the resource fields of its
+// DynamicSchema and the bounds and rules recorded on it.
+func ValidateSchema(schema *v3.DynamicSchema, config map[string]interface{}) error {
+	bounds := map[string]Bounds{}
+	if data := schema.Annotations[BoundsAnnotation]; data != "" {
+		if err := json.Unmarshal([]byte(data), &bounds); err != nil {
+			return errors.Wrapf(err, "invalid %s annotation of schema %s", BoundsAnnotation, schema.Name)
+		}
+	}
+	if err := ValidateFields(schema.Spec.ResourceFields, bounds, config); err != nil {
+		return err
+	}
+	return ValidateSchemaRules(schema, config)
+}
+
+// ValidateSchemaRules checks a driver config against the rules recorded on
+// its DynamicSchema only.
+func ValidateSchemaRules(schema *v3.DynamicSchema, config map[string]interface{}) error {
+	rules := map[string][]FieldRule{}
+	if data := schema.Annotations[RulesAnnotation]; data != "" {
+		if err := json.Unmarshal([]byte(data), &rules); err != nil {
+			return errors.Wrapf(err, "invalid %s annotation of schema %s", RulesAnnotation, schema.Name)
+		}
+	}
+	return ValidateRules(schema.Spec.ResourceFields, rules, config)
+}
+
+// CompileFieldRule compiles the rule of a field of a schema with the given
+// fields.
+func CompileFieldRule(fields map[string]v3.Field, rule FieldRule) (*Expression, error) {
+	variables := []string{"self"}
+	for name := range fields {
+		variables = append(variables, name)
+	}
+	return CompileExpression(rule.Rule, variables...)
+}
+
+// ValidateRules checks the set fields of a driver config against their
+// rules.
+func ValidateRules(fields map[string]v3.Field, rules map[string][]FieldRule, config map[string]interface{}) error {
+	var names []string
+	for name := range rules {
+		if _, ok := fields[name]; ok && !unset(config[name]) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	vars := map[string]interface{}{}
+	for name, field := range fields {
+		vars[name] = nil
+		if !unset(config[name]) {
+			vars[name] = typedValue(field, config[name])
+		}
+	}
+	for _, name := range names {
+		vars["self"] = vars[name]
+		for _, rule := range rules[name] {
+			expr, err := CompileFieldRule(fields, rule)
+			if err != nil {
+				return errors.Wrapf(err, "invalid rule %q of field %s", rule.Rule, name)
+			}
+			ok, err := expr.EvalBool(vars)
+			if ok {
+				continue
+			}
+			msg := rule.Message
+			switch {
+			case msg == "" && err != nil:
+				msg = fmt.Sprintf("failed rule %s: %v", rule.Rule, err)
+			case msg == "":
+				msg = fmt.Sprintf("must satisfy %s", rule.Rule)
+			}
+			return fieldError(name, msg)
+		}
+	}
+	return nil
+}
+
+func unset(value interface{}) bool {
+	return value == nil || value == ""
+}
+
+// typedValue converts the value of a field to the type of the field, as the
+// configs of drivers often hold numbers and bools as strings.
+func typedValue(field v3.Field, value interface{}) interface{} {
+	switch field.Type {
+	case "int":
+		if n, err := convert.ToNumber(value); err == nil {
+			return n
+		}
+	case "boolean":
+		if s, ok := value.(string); ok {
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		}
+	case "array[string]":
+		if values := convert.ToStringSlice(value); values != nil {
+			return values
+		}
+	}
+	return value
+}
+
+// ValidateFields checks a driver config against the constraints of the
+// resource fields of its DynamicSchema. The bounds of a field take
+// precedence over its non-zero Min and Max.
+func ValidateFields(fields map[string]v3.Field, bounds map[string]Bounds, config map[string]interface{}) error {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := validateField(name, fields[name], fieldBounds(fields[name], bounds[name]), config[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldBounds(field v3.Field, bounds Bounds) Bounds {
+	if bounds.Min == nil && field.Min != 0 {
+		min := field.Min
+		bounds.Min = &min
+	}
+	if bounds.Max == nil && field.Max != 0 {
+		max := field.Max
+		bounds.Max = &max
+	}
+	return bounds
+}
+
+func validateField(name string, field v3.Field, bounds Bounds, value interface{}) error {
+	if convert.IsEmpty(value) {
+		if field.Required && field.Default.StringValue == "" && field.Default.IntValue == 0 &&
+			len(field.Default.StringSliceValue) == 0 {
+			return fieldError(name, "is required")
+		}
+		return nil
+	}
+
+	switch field.Type {
+	case "int":
+		if _, err := convert.ToNumber(value); err != nil {
+			return fieldError(name, "must be an integer")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok && value != "true" && value != "false" {
+			return fieldError(name, "must be true or false")
+		}
+	}
+
+	values := convert.ToStringSlice(value)
+	if values == nil {
+		values = []string{convert.ToString(value)}
+	}
+
+	for _, v := range values {
+		if field.MinLength > 0 && int64(len(v)) < field.MinLength {
+			return fieldError(name, fmt.Sprintf("must be at least %d characters", field.MinLength))
+		}
+		if field.MaxLength > 0 && int64(len(v)) > field.MaxLength {
+			return fieldError(name, fmt.Sprintf("must be at most %d characters", field.MaxLength))
+		}
+		if len(field.Options) > 0 && !contains(field.Options, v) {
+			return fieldError(name, fmt.Sprintf("must be one of %v", field.Options))
+		}
+		if field.ValidChars != "" && strings.Trim(v, field.ValidChars) != "" {
+			return fieldError(name, fmt.Sprintf("may only contain the characters %q", field.ValidChars))
+		}
+		if field.InvalidChars != "" && strings.ContainsAny(v, field.InvalidChars) {
+			return fieldError(name, fmt.Sprintf("may not contain the characters %q", field.InvalidChars))
+		}
+		if bounds.Min != nil || bounds.Max != nil {
+			n, err := convert.ToNumber(v)
+			if err != nil {
+				return fieldError(name, "must be a number")
+			}
+			if bounds.Min != nil && n < *bounds.Min {
+				return fieldError(name, fmt.Sprintf("must be >= %d", *bounds.Min))
+			}
+			if bounds.Max != nil && n > *bounds.Max {
+				return fieldError(name, fmt.Sprintf("must be <= %d", *bounds.Max))
+			}
+		}
+	}
+
+	return nil
+}
+
+// FieldError is returned when a driver config does not satisfy the
+// constraints of a field.
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %s %s", e.Field, e.Msg)
+}
+
+func fieldError(name, msg string) error {
+	return &FieldError{
+		Field: name,
+		Msg:   msg,
+	}
+}
@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateSchemaRules(t *testing.T) {
+	schema := &v3.DynamicSchema{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "amazonec2config",
+			Annotations: map[string]string{RulesAnnotation: `{
+				"rootSize": [{"rule": "self >= 40"}],
+				"instanceType": [{"rule": "!self.startsWith('t2.') || privateAddressOnly", "message": "t2 instances must be private"}],
+				"zone": [{"rule": "self in ['a', 'b']"}],
+				"unknown": [{"rule": "false"}]
+			}`},
+		},
+		Spec: v3.DynamicSchemaSpec{ResourceFields: map[string]v3.Field{
+			"rootSize":           {Type: "int"},
+			"instanceType":       {Type: "string"},
+			"privateAddressOnly": {Type: "boolean"},
+			"zone":               {Type: "string"},
+		}},
+	}
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		err    string
+	}{
+		{"rules of unset fields are skipped", map[string]interface{}{"zone": ""}, ""},
+		{"int given as string", map[string]interface{}{"rootSize": "40"}, ""},
+		{"int given as number", map[string]interface{}{"rootSize": float64(20)}, "field rootSize must satisfy self >= 40"},
+		{"rule relating fields", map[string]interface{}{"instanceType": "t2.micro", "privateAddressOnly": "true"}, ""},
+		{"rule relating fields violated", map[string]interface{}{"instanceType": "t2.micro", "privateAddressOnly": false},
+			"field instanceType t2 instances must be private"},
+		{"rule on an unset field fails", map[string]interface{}{"instanceType": "t2.micro"},
+			"field instanceType t2 instances must be private"},
+		{"list rule", map[string]interface{}{"zone": "c"}, "field zone must satisfy self in ['a', 'b']"},
+	}
+	for _, test := range tests {
+		err := ValidateSchemaRules(schema, test.config)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%s: error is %v, want %s", test.name, err, test.err)
+		}
+		if _, ok := err.(*FieldError); err != nil && !ok {
+			t.Errorf("%s: error %v is not a field error", test.name, err)
+		}
+	}
+}
+
+func TestValidateSchemaChecksRules(t *testing.T) {
+	schema := &v3.DynamicSchema{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{RulesAnnotation: `{"rootSize": [{"rule": "self >= 40"}]}`},
+		},
+		Spec: v3.DynamicSchemaSpec{ResourceFields: map[string]v3.Field{
+			"rootSize": {Type: "int", Required: true},
+		}},
+	}
+	if err := ValidateSchema(schema, map[string]interface{}{}); err == nil || err.Error() != "field rootSize is required" {
+		t.Errorf("missing field: error is %v", err)
+	}
+	if err := ValidateSchema(schema, map[string]interface{}{"rootSize": "16"}); err == nil {
+		t.Errorf("violated rule: expected an error")
+	}
+	if err := ValidateSchema(schema, map[string]interface{}{"rootSize": "64"}); err != nil {
+		t.Errorf("satisfied rule: unexpected error: %v", err)
+	}
+}
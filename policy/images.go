@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	ImagesConfigMap = "machine-approved-images"
+	// DefaultImage stands for the image a driver picks when none is
+	// configured.
+	DefaultImage = "default"
+)
+
+// LoadApprovedImages returns the approved image patterns of a driver from the
+// machine-approved-images ConfigMap, keyed by driver name. ok is false if any
+// image may be used.
+func LoadApprovedImages(configMaps typedv1.ConfigMapsGetter, driver string) (patterns []string, ok bool, err error) {
+	cm, err := configMaps.ConfigMaps(Namespace).Get(ImagesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	data, ok := cm.Data[driver]
+	if !ok {
+		return nil, false, nil
+	}
+	if err := json.Unmarshal([]byte(data), &patterns); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to parse approved images of driver %s", driver)
+	}
+	return patterns, true, nil
+}
+
+// CheckImage returns a Violation unless image matches one of the approved
+// shell patterns. An empty image is the driver default.
+func CheckImage(patterns []string, field, image string) error {
+	if image == "" {
+		image = DefaultImage
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, image); matched {
+			return nil
+		}
+	}
+	return &Violation{
+		Rule:  ImagesConfigMap,
+		Field: field,
+		Msg:   fmt.Sprintf("image %s is not approved", image),
+	}
+}
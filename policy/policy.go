@@ -0,0 +1,228 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	Namespace      = "cattle-system"
+	RulesConfigMap = "machine-policies"
+	rulesKey       = "rules"
+
+	OperatorIn           = "In"
+	OperatorNotIn        = "NotIn"
+	OperatorExists       = "Exists"
+	OperatorDoesNotExist = "DoesNotExist"
+	OperatorMatches      = "Matches"
+)
+
+// Rule restricts the value of a single driver config field or, if it has an
+// Expression, must satisfy a CEL expression over the variables config (the
+// driver config), driver and labels. A rule applies to the objects of Driver
+// (or all drivers if empty) whose labels match Selector.
+type Rule struct {
+	Name       string   `json:"name"`
+	Driver     string   `json:"driver,omitempty"`
+	Selector   string   `json:"selector,omitempty"`
+	Field      string   `json:"field,omitempty"`
+	Operator   string   `json:"operator,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+	Message    string   `json:"message,omitempty"`
+}
+
+// Violation is returned when a driver config does not satisfy a rule.
+type Violation struct {
+	Rule  string
+	Field string
+	Msg   string
+}
+
+func (v *Violation) Error() string {
+	if v.Field == "" {
+		return fmt.Sprintf("policy %s rejected the config: %s", v.Rule, v.Msg)
+	}
+	return fmt.Sprintf("policy %s rejected field %s: %s", v.Rule, v.Field, v.Msg)
+}
+
+// Load reads the rules from the machine-policies ConfigMap. A missing ConfigMap
+// means there are no rules.
+func Load(configMaps typedv1.ConfigMapsGetter) ([]Rule, error) {
+	cm, err := configMaps.ConfigMaps(Namespace).Get(RulesConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if data := cm.Data[rulesKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &rules); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s/%s", Namespace, RulesConfigMap)
+		}
+	}
+	return rules, nil
+}
+
+// Evaluate checks the driver config of an object against all applicable rules
+// and returns the first violation found.
+func Evaluate(rules []Rule, driver string, objLabels map[string]string, config map[string]interface{}) error {
+	for _, rule := range rules {
+		if rule.Driver != "" && !strings.EqualFold(rule.Driver, driver) {
+			continue
+		}
+
+		selector, err := labels.Parse(rule.Selector)
+		if err != nil {
+			return errors.Wrapf(err, "invalid selector in policy %s", rule.Name)
+		}
+		if !selector.Matches(labels.Set(objLabels)) {
+			continue
+		}
+
+		if rule.Expression != "" {
+			err = rule.evaluateExpression(driver, objLabels, config)
+		} else {
+			err = rule.evaluate(config)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) evaluateExpression(driver string, objLabels map[string]string, config map[string]interface{}) error {
+	expr, err := CompileExpression(r.Expression, "config", "driver", "labels")
+	if err != nil {
+		return errors.Wrapf(err, "invalid expression in policy %s", r.Name)
+	}
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+	ok, err := expr.EvalBool(map[string]interface{}{
+		"config": config,
+		"driver": driver,
+		"labels": objLabels,
+	})
+	if ok {
+		return nil
+	}
+
+	msg := r.Message
+	switch {
+	case msg == "" && err != nil:
+		msg = fmt.Sprintf("expression %s failed: %v", r.Expression, err)
+	case msg == "":
+		msg = fmt.Sprintf("value must satisfy %s", r.Expression)
+	}
+	return &Violation{
+		Rule: r.Name,
+		Msg:  msg,
+	}
+}
+
+func (r *Rule) evaluate(config map[string]interface{}) error {
+	value, exists := values.GetValue(config, strings.Split(r.Field, ".")...)
+	if exists && convert.IsEmpty(value) {
+		exists = false
+	}
+
+	fieldValues := convert.ToStringSlice(value)
+	if fieldValues == nil && exists {
+		fieldValues = []string{convert.ToString(value)}
+	}
+
+	var ok bool
+	switch r.Operator {
+	case OperatorExists:
+		ok = exists
+	case OperatorDoesNotExist:
+		ok = !exists
+	case OperatorIn:
+		ok = exists && allIn(fieldValues, r.Values)
+	case OperatorNotIn:
+		ok = !exists || noneIn(fieldValues, r.Values)
+	case OperatorMatches:
+		var err error
+		ok, err = allMatch(fieldValues, r.Values)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern in policy %s", r.Name)
+		}
+		ok = exists && ok
+	default:
+		return fmt.Errorf("unknown operator %s in policy %s", r.Operator, r.Name)
+	}
+
+	if ok {
+		return nil
+	}
+
+	msg := r.Message
+	if msg == "" {
+		msg = fmt.Sprintf("value must satisfy %s %v", r.Operator, r.Values)
+	}
+	return &Violation{
+		Rule:  r.Name,
+		Field: r.Field,
+		Msg:   msg,
+	}
+}
+
+func allIn(fieldValues, allowed []string) bool {
+	for _, v := range fieldValues {
+		if !contains(allowed, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func noneIn(fieldValues, denied []string) bool {
+	for _, v := range fieldValues {
+		if contains(denied, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func allMatch(fieldValues, patterns []string) (bool, error) {
+	for _, v := range fieldValues {
+		matched := false
+		for _, pattern := range patterns {
+			ok, err := regexp.MatchString(pattern, v)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,337 @@
+// Package query serves a read-only view joining machines, their pools,
+// machine drivers and nodes, filtered on the server, so dashboards need a
+// single request instead of listing and joining the raw resources.
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rancher/machine-controller/authz"
+	"github.com/rancher/machine-controller/controller/machine"
+	"github.com/rancher/machine-controller/controller/machinedriver"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Path is the path the view is served on. The query parameters
+	// namespace, phase, driver, pool and zone filter the machines, each
+	// taking a comma separated list of values.
+	Path = "/query"
+)
+
+// Result is the view of the machines matching a query, with the pools and
+// drivers they belong to.
+type Result struct {
+	Machines []Machine `json:"machines"`
+	Pools    []Pool    `json:"pools"`
+	Drivers  []Driver  `json:"drivers"`
+}
+
+// Machine is a machine joined with its driver and node.
+type Machine struct {
+	Namespace   string  `json:"namespace"`
+	Name        string  `json:"name"`
+	Hostname    string  `json:"hostname,omitempty"`
+	Phase       string  `json:"phase"`
+	Driver      string  `json:"driver,omitempty"`
+	DriverState string  `json:"driverState,omitempty"`
+	Pool        string  `json:"pool,omitempty"`
+	Zone        string  `json:"zone,omitempty"`
+	Address     string  `json:"address,omitempty"`
+	Node        *Node   `json:"node,omitempty"`
+	Errors      []Error `json:"errors,omitempty"`
+}
+
+// Node is the node a machine registered as.
+type Node struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+}
+
+// Error is a failed condition.
+type Error struct {
+	Condition string `json:"condition"`
+	Time      string `json:"time"`
+	Message   string `json:"message"`
+}
+
+// Pool is a machine template with the number of matching machines in each
+// phase.
+type Pool struct {
+	Namespace string         `json:"namespace"`
+	Name      string         `json:"name"`
+	Driver    string         `json:"driver,omitempty"`
+	Machines  map[string]int `json:"machines"`
+}
+
+// Driver is a machine driver with the number of matching machines using it.
+type Driver struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Machines int    `json:"machines"`
+}
+
+// Server serves the view from the informer caches of the controller. Every
+// request is authenticated with the bearer token of the caller, who must be
+// allowed to list machines in the queried namespace, or in all of them.
+type Server struct {
+	k8s       kubernetes.Interface
+	machines  v3.MachineLister
+	templates v3.MachineTemplateLister
+	drivers   v3.MachineDriverLister
+}
+
+// NewServer returns the query server. It must be created before the
+// management context is started, so the caches it reads are synced.
+func NewServer(management *config.ManagementContext) *Server {
+	return &Server{
+		k8s:       management.K8sClient,
+		machines:  management.Management.Machines("").Controller().Lister(),
+		templates: management.Management.MachineTemplates("").Controller().Lister(),
+		drivers:   management.Management.MachineDrivers("").Controller().Lister(),
+	}
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != Path {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f := parseFilter(req)
+	namespace := ""
+	if len(f.namespaces) == 1 {
+		namespace = f.namespaces[0]
+	}
+	if err := s.authorize(req, namespace); err != nil {
+		logrus.Infof("Denied machine query: %v", err)
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	result, err := s.query(f)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+func (s *Server) authorize(req *http.Request, namespace string) error {
+	user, err := authz.Authenticate(s.k8s, req)
+	if err != nil {
+		return err
+	}
+	allowed, err := authz.Allowed(s.k8s, user, authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "list",
+		Group:     v3.MachineGroupVersionKind.Group,
+		Resource:  v3.MachineResource.Name,
+	})
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		if namespace == "" {
+			return fmt.Errorf("user %s may not list machines", user.Username)
+		}
+		return fmt.Errorf("user %s may not list machines in %s", user.Username, namespace)
+	}
+	return nil
+}
+
+func (s *Server) query(f filter) (*Result, error) {
+	drivers, err := s.drivers.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	driversByName := map[string]*v3.MachineDriver{}
+	for _, driver := range drivers {
+		driversByName[driver.Name] = driver
+	}
+
+	objs, err := s.machines.List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Machines: []Machine{},
+		Pools:    []Pool{},
+		Drivers:  []Driver{},
+	}
+	pools := map[string]*Pool{}
+	driverCounts := map[string]int{}
+	for _, obj := range objs {
+		m := newMachine(obj, driversByName)
+		if !f.matches(m) {
+			continue
+		}
+		result.Machines = append(result.Machines, m)
+
+		if m.Driver != "" {
+			driverCounts[m.Driver]++
+		}
+		if m.Pool != "" {
+			key := m.Namespace + "/" + m.Pool
+			pool, ok := pools[key]
+			if !ok {
+				pool = &Pool{
+					Namespace: m.Namespace,
+					Name:      m.Pool,
+					Machines:  map[string]int{},
+				}
+				if template := s.template(m.Namespace, m.Pool); template != nil {
+					pool.Driver = template.Spec.Driver
+				}
+				pools[key] = pool
+			}
+			pool.Machines[m.Phase]++
+		}
+	}
+
+	for _, pool := range pools {
+		result.Pools = append(result.Pools, *pool)
+	}
+	for name, count := range driverCounts {
+		result.Drivers = append(result.Drivers, Driver{
+			Name:     name,
+			State:    driverState(driversByName[name]),
+			Machines: count,
+		})
+	}
+
+	sort.Slice(result.Machines, func(i, j int) bool {
+		a, b := result.Machines[i], result.Machines[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Name < b.Name
+	})
+	sort.Slice(result.Pools, func(i, j int) bool {
+		a, b := result.Pools[i], result.Pools[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Name < b.Name
+	})
+	sort.Slice(result.Drivers, func(i, j int) bool {
+		return result.Drivers[i].Name < result.Drivers[j].Name
+	})
+	return result, nil
+}
+
+// template returns the machine template of a pool, looked up in the
+// namespace of its machines first and at cluster scope second.
+func (s *Server) template(namespace, name string) *v3.MachineTemplate {
+	if template, err := s.templates.Get(namespace, name); err == nil {
+		return template
+	}
+	if template, err := s.templates.Get("", name); err == nil {
+		return template
+	}
+	return nil
+}
+
+func newMachine(obj *v3.Machine, drivers map[string]*v3.MachineDriver) Machine {
+	m := Machine{
+		Namespace: obj.Namespace,
+		Name:      obj.Name,
+		Hostname:  obj.Spec.RequestedHostname,
+		Phase:     machine.Phase(obj),
+		Pool:      obj.Spec.MachineTemplateName,
+	}
+	if obj.Status.MachineTemplateSpec != nil {
+		m.Driver = obj.Status.MachineTemplateSpec.Driver
+		m.DriverState = driverState(drivers[m.Driver])
+		m.Zone = machine.Zone(obj, drivers[m.Driver])
+	}
+	if obj.Status.NodeConfig != nil {
+		m.Address = obj.Status.NodeConfig.Address
+	}
+	if obj.Status.NodeName != "" {
+		m.Node = &Node{
+			Name:  obj.Status.NodeName,
+			Ready: nodeReady(obj.Status.NodeStatus),
+		}
+	}
+	for _, cond := range obj.Status.Conditions {
+		if cond.Status == "False" {
+			m.Errors = append(m.Errors, Error{
+				Condition: string(cond.Type),
+				Time:      cond.LastUpdateTime,
+				Message:   cond.Message,
+			})
+		}
+	}
+	return m
+}
+
+func driverState(driver *v3.MachineDriver) string {
+	if driver == nil {
+		return ""
+	}
+	state, _ := machinedriver.State(driver)
+	return state
+}
+
+func nodeReady(status v1.NodeStatus) bool {
+	for _, cond := range status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+type filter struct {
+	namespaces, phases, drivers, pools, zones []string
+}
+
+func parseFilter(req *http.Request) filter {
+	values := req.URL.Query()
+	list := func(name string) []string {
+		var result []string
+		for _, value := range values[name] {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					result = append(result, item)
+				}
+			}
+		}
+		return result
+	}
+	return filter{
+		namespaces: list("namespace"),
+		phases:     list("phase"),
+		drivers:    list("driver"),
+		pools:      list("pool"),
+		zones:      list("zone"),
+	}
+}
+
+func (f filter) matches(m Machine) bool {
+	return matchesAny(f.namespaces, m.Namespace) && matchesAny(f.phases, m.Phase) &&
+		matchesAny(f.drivers, m.Driver) && matchesAny(f.pools, m.Pool) && matchesAny(f.zones, m.Zone)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
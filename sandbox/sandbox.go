@@ -0,0 +1,122 @@
+// Package sandbox confines docker-machine and the third-party driver plugins
+// it starts. Commands are re-executed through the controller binary, which
+// applies the restrictions to itself and then execs the command, so they are
+// inherited by everything the command spawns.
+package sandbox
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+const (
+	// ExecArg is the first argument of a sandboxed re-execution of the
+	// controller binary.
+	ExecArg = "sandbox-exec"
+)
+
+// Options select the restrictions applied to sandboxed commands.
+type Options struct {
+	// NoNewPrivileges stops setuid binaries and file capabilities from
+	// granting privileges.
+	NoNewPrivileges bool
+	// Seccomp denies system calls no driver needs, such as mount, ptrace or
+	// loading kernel modules.
+	Seccomp bool
+	// AppArmorProfile is the AppArmor profile commands are confined by.
+	AppArmorProfile string
+}
+
+// IsZero reports whether no restriction is selected.
+func (o Options) IsZero() bool {
+	return !o.NoNewPrivileges && !o.Seccomp && o.AppArmorProfile == ""
+}
+
+var (
+	lock       sync.RWMutex
+	current    Options
+	executable string
+)
+
+// Configure sets the restrictions applied by Apply.
+func Configure(opts Options) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if opts.IsZero() {
+		current = opts
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	current, executable = opts, self
+	return nil
+}
+
+// Enabled reports whether commands are sandboxed.
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return !current.IsZero()
+}
+
+// Apply rewrites cmd, which must not have been started, to run in the
+// configured sandbox.
+func Apply(cmd *exec.Cmd) {
+	lock.RLock()
+	opts, self := current, executable
+	lock.RUnlock()
+
+	if opts.IsZero() {
+		return
+	}
+
+	args := []string{cmd.Args[0], ExecArg}
+	if opts.NoNewPrivileges {
+		args = append(args, "-no-new-privileges")
+	}
+	if opts.Seccomp {
+		args = append(args, "-seccomp")
+	}
+	if opts.AppArmorProfile != "" {
+		args = append(args, "-apparmor-profile", opts.AppArmorProfile)
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+}
+
+// Main handles a sandboxed re-execution, if that is what the process was
+// started as, and returns otherwise. It has to be called first thing in main.
+func Main() {
+	if len(os.Args) < 2 || os.Args[1] != ExecArg {
+		return
+	}
+
+	opts := Options{}
+	flags := flag.NewFlagSet(ExecArg, flag.ExitOnError)
+	flags.BoolVar(&opts.NoNewPrivileges, "no-new-privileges", false, "")
+	flags.BoolVar(&opts.Seccomp, "seccomp", false, "")
+	flags.StringVar(&opts.AppArmorProfile, "apparmor-profile", "", "")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "sandbox: no command given")
+		os.Exit(1)
+	}
+
+	args := flags.Args()
+	if err := enter(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(1)
+	}
+	err := syscall.Exec(args[0], args, os.Environ())
+	fmt.Fprintf(os.Stderr, "sandbox: failed to exec %s: %v\n", args[0], err)
+	os.Exit(1)
+}
@@ -0,0 +1,117 @@
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	// offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+var (
+	auditArches = map[string]uint32{
+		"386":     0x40000003,
+		"amd64":   0xc000003e,
+		"arm":     0x40000028,
+		"arm64":   0xc00000b7,
+		"ppc64le": 0xc0000015,
+		"s390x":   0x80000016,
+	}
+
+	deniedSyscalls = []uintptr{
+		unix.SYS_ACCT,
+		unix.SYS_ADD_KEY,
+		unix.SYS_BPF,
+		unix.SYS_CHROOT,
+		unix.SYS_CLOCK_SETTIME,
+		unix.SYS_DELETE_MODULE,
+		unix.SYS_FINIT_MODULE,
+		unix.SYS_INIT_MODULE,
+		unix.SYS_KEXEC_LOAD,
+		unix.SYS_KEYCTL,
+		unix.SYS_MOUNT,
+		unix.SYS_OPEN_BY_HANDLE_AT,
+		unix.SYS_PERF_EVENT_OPEN,
+		unix.SYS_PIVOT_ROOT,
+		unix.SYS_PTRACE,
+		unix.SYS_QUOTACTL,
+		unix.SYS_REBOOT,
+		unix.SYS_REQUEST_KEY,
+		unix.SYS_SETDOMAINNAME,
+		unix.SYS_SETHOSTNAME,
+		unix.SYS_SETNS,
+		unix.SYS_SETTIMEOFDAY,
+		unix.SYS_SWAPOFF,
+		unix.SYS_SWAPON,
+		unix.SYS_UMOUNT2,
+		unix.SYS_UNSHARE,
+		unix.SYS_USERFAULTFD,
+	}
+)
+
+// enter applies opts to the calling thread, which then execs the command.
+func enter(opts Options) error {
+	runtime.LockOSThread()
+
+	if opts.AppArmorProfile != "" {
+		attr := fmt.Sprintf("/proc/self/task/%d/attr/exec", unix.Gettid())
+		if err := ioutil.WriteFile(attr, []byte("exec "+opts.AppArmorProfile), 0); err != nil {
+			return errors.Wrapf(err, "failed to change to AppArmor profile %s", opts.AppArmorProfile)
+		}
+	}
+
+	if opts.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return errors.Wrap(err, "failed to set no_new_privs")
+		}
+	}
+
+	if opts.Seccomp {
+		if err := loadSeccompFilter(); err != nil {
+			return errors.Wrap(err, "failed to load seccomp filter")
+		}
+	}
+	return nil
+}
+
+// loadSeccompFilter installs a filter failing the denied system calls with
+// EPERM. System calls of foreign architectures, like 32 bit calls on 64 bit
+// kernels, are killed as they would bypass the filter.
+func loadSeccompFilter() error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKill},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr)},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func enter(opts Options) error {
+	if opts.IsZero() {
+		return nil
+	}
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
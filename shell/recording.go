@@ -0,0 +1,80 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	recordingSuffix = ".log"
+	pruneInterval   = time.Hour
+)
+
+// recorder writes session transcripts into a directory, typically a mounted
+// volume shipped elsewhere, and deletes them after the retention period.
+type recorder struct {
+	dir       string
+	retention time.Duration
+}
+
+// open creates the transcript of a new session. The transcript holds a header
+// line followed by the terminal output of the session.
+func (r *recorder) open(machine *v3.Machine, user, subresource string) (io.WriteCloser, error) {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s_%s_%s_%s_%s%s", sanitize(machine.Namespace), sanitize(machine.Name), subresource,
+		sanitize(user), now.Format("20060102T150405Z"), recordingSuffix)
+
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "# %s session of user %s on machine %s/%s (%s) at %s\n", subresource, user,
+		machine.Namespace, machine.Name, machine.Spec.RequestedHostname, now.Format(time.RFC3339))
+	return f, nil
+}
+
+func (r *recorder) pruneLoop() {
+	for {
+		r.prune()
+		time.Sleep(pruneInterval)
+	}
+}
+
+func (r *recorder) prune() {
+	if r.retention <= 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		logrus.Errorf("Failed to read session recordings in %s: %v", r.dir, err)
+		return
+	}
+	cutoff := time.Now().Add(-r.retention)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), recordingSuffix) || file.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.dir, file.Name())); err != nil {
+			logrus.Errorf("Failed to remove session recording %s: %v", file.Name(), err)
+		}
+	}
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
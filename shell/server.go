@@ -0,0 +1,148 @@
+package shell
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/authz"
+	"github.com/rancher/machine-controller/sshclient"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// pathPrefix is followed by <namespace>/<name>/<subresource>.
+	pathPrefix = "/machines/"
+)
+
+// Server gives access to provisioned machines over SSH, using the keys the
+// controller stored when provisioning them. Every request is authenticated
+// with the bearer token of the caller and authorized with a
+// SubjectAccessReview for the machine subresource being accessed.
+type Server struct {
+	management *config.ManagementContext
+	k8s        kubernetes.Interface
+	handlers   map[string]handlerFunc
+	recorder   *recorder
+}
+
+// Options configure the machine access server.
+type Options struct {
+	// RecordingDir, if set, receives a transcript of every session.
+	RecordingDir string
+	// RecordingRetention is how long transcripts are kept, forever if zero.
+	RecordingRetention time.Duration
+}
+
+type handlerFunc func(s *Server, rw http.ResponseWriter, req *http.Request, machine *v3.Machine, user string)
+
+// NewServer returns the machine access server.
+func NewServer(management *config.ManagementContext, opts Options) *Server {
+	s := &Server{
+		management: management,
+		k8s:        management.K8sClient,
+		handlers: map[string]handlerFunc{
+			"shell":  (*Server).shell,
+			"tunnel": (*Server).tunnel,
+		},
+	}
+	if opts.RecordingDir != "" {
+		s.recorder = &recorder{
+			dir:       opts.RecordingDir,
+			retention: opts.RecordingRetention,
+		}
+		go s.recorder.pruneLoop()
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, pathPrefix), "/")
+	if !strings.HasPrefix(req.URL.Path, pathPrefix) || len(parts) != 3 {
+		http.NotFound(rw, req)
+		return
+	}
+	namespace, name, subresource := parts[0], parts[1], parts[2]
+
+	handler, ok := s.handlers[subresource]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	user, err := s.authorize(req, namespace, name, subresource)
+	if err != nil {
+		logrus.Infof("Denied %s access to machine %s/%s: %v", subresource, namespace, name, err)
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	machine, err := s.management.Management.Machines(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.audit(machine, user, subresource)
+	handler(s, rw, req, machine, user)
+}
+
+// audit records who accessed which machine, as an event on the machine and
+// in the log.
+func (s *Server) audit(machine *v3.Machine, user, subresource string) {
+	logrus.WithFields(logrus.Fields{
+		"audit":       "machine-access",
+		"user":        user,
+		"machine":     machine.Namespace + "/" + machine.Name,
+		"subresource": subresource,
+		"time":        time.Now().UTC().Format(time.RFC3339),
+	}).Info("Machine access granted")
+	s.management.EventLogger.Infof(machine, "User %s opened %s on machine %s", user, subresource, machine.Name)
+}
+
+// authorize authenticates the bearer token of req and checks that its user
+// may create the subresource of the machine. It returns the user name.
+func (s *Server) authorize(req *http.Request, namespace, name, subresource string) (string, error) {
+	user, err := authz.Authenticate(s.k8s, req)
+	if err != nil {
+		return "", err
+	}
+	allowed, err := authz.Allowed(s.k8s, user, authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Verb:        "create",
+		Group:       v3.MachineGroupVersionKind.Group,
+		Resource:    v3.MachineResource.Name,
+		Subresource: subresource,
+		Name:        name,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", fmt.Errorf("user %s may not create %s of machine %s/%s", user.Username, subresource, namespace, name)
+	}
+	return user.Username, nil
+}
+
+// dial opens an SSH connection to a provisioned machine.
+func dial(machine *v3.Machine) (*ssh.Client, error) {
+	node := machine.Status.NodeConfig
+	if node == nil || node.Address == "" || node.SSHKey == "" {
+		return nil, fmt.Errorf("machine %s is not provisioned", machine.Name)
+	}
+
+	opts, err := sshclient.Parse(machine.Annotations[sshclient.Annotation])
+	if err != nil {
+		return nil, err
+	}
+	client, err := sshclient.Dial(node.Address, 0, node.User, []byte(node.SSHKey), opts)
+	return client, errors.Wrapf(err, "failed to connect to machine %s", machine.Name)
+}
@@ -0,0 +1,144 @@
+package shell
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var upgrader = websocket.Upgrader{
+	// requests carry a bearer token, so they cannot come from a browser
+	// session riding on cookies
+	CheckOrigin: func(req *http.Request) bool { return true },
+}
+
+// resize is sent by clients as a text message to change the terminal size.
+// Binary messages are terminal input.
+type resize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// shell proxies an interactive SSH session over a websocket. The initial
+// terminal size is taken from the cols and rows query parameters.
+func (s *Server) shell(rw http.ResponseWriter, req *http.Request, machine *v3.Machine, user string) {
+	client, err := dial(machine)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer session.Close()
+
+	cols, rows := queryInt(req, "cols", 80), queryInt(req, "rows", 24)
+	if err := session.RequestPty("xterm", rows, cols, ssh.TerminalModes{}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var out io.Writer = &wsWriter{conn: conn}
+	if s.recorder != nil {
+		transcript, err := s.recorder.open(machine, user, "shell")
+		if err != nil {
+			logrus.Errorf("Failed to record shell session on machine %s: %v", machine.Name, err)
+			conn.WriteMessage(websocket.TextMessage, []byte("session recording failed"))
+			return
+		}
+		defer transcript.Close()
+		out = &lockedWriter{w: io.MultiWriter(out, transcript)}
+	}
+	session.Stdout = out
+	session.Stderr = out
+	if err := session.Shell(); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		return
+	}
+
+	go pumpInput(conn, stdin, session)
+	session.Wait()
+	logrus.Infof("User %s closed the shell on machine %s/%s", user, machine.Namespace, machine.Name)
+}
+
+func pumpInput(conn *websocket.Conn, stdin io.WriteCloser, session *ssh.Session) {
+	defer stdin.Close()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			session.Close()
+			return
+		}
+		switch messageType {
+		case websocket.BinaryMessage:
+			if _, err := stdin.Write(data); err != nil {
+				return
+			}
+		case websocket.TextMessage:
+			size := resize{}
+			if json.Unmarshal(data, &size) == nil && size.Cols > 0 && size.Rows > 0 {
+				session.WindowChange(size.Rows, size.Cols)
+			}
+		}
+	}
+}
+
+// wsWriter sends everything written to it as binary websocket messages.
+// Stdout and stderr are copied concurrently, but a websocket connection
+// supports only one writer at a time.
+type wsWriter struct {
+	sync.Mutex
+	conn *websocket.Conn
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lockedWriter serializes the writes of stdout and stderr into a shared
+// transcript.
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.w.Write(p)
+}
+
+func queryInt(req *http.Request, name string, def int) int {
+	if v, err := strconv.Atoi(req.URL.Query().Get(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,68 @@
+package shell
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// tunnel forwards a websocket to a TCP port reachable from the machine, such
+// as the kubelet or node-exporter, through the SSH connection. The target is
+// given by the port query parameter and the optional host parameter, which
+// defaults to the machine itself. Binary messages carry the TCP stream.
+func (s *Server) tunnel(rw http.ResponseWriter, req *http.Request, machine *v3.Machine, user string) {
+	port, err := strconv.Atoi(req.URL.Query().Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(rw, "port query parameter required", http.StatusBadRequest)
+		return
+	}
+	host := req.URL.Query().Get("host")
+	if host == "" {
+		host = "localhost"
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	client, err := dial(machine)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer client.Close()
+
+	remote, err := client.Dial("tcp", target)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	logrus.Infof("User %s opened a tunnel to %s through machine %s/%s", user, target, machine.Namespace, machine.Name)
+	go func() {
+		io.Copy(&wsWriter{conn: conn}, remote)
+		conn.Close()
+	}()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if _, err := remote.Write(data); err != nil {
+			break
+		}
+	}
+	logrus.Infof("User %s closed the tunnel to %s through machine %s/%s", user, target, machine.Namespace, machine.Name)
+}
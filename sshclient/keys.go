@@ -0,0 +1,149 @@
+package sshclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Key types of generated machine keys. ECDSA uses the NIST P-256 curve, which
+// together with RSA 4096 is FIPS approved.
+const (
+	KeyTypeRSA4096 = "rsa-4096"
+	KeyTypeED25519 = "ed25519"
+	KeyTypeECDSA   = "ecdsa"
+)
+
+// ValidateKeyType returns an error unless keyType is empty or a supported key
+// type.
+func ValidateKeyType(keyType string) error {
+	switch keyType {
+	case "", KeyTypeRSA4096, KeyTypeED25519, KeyTypeECDSA:
+		return nil
+	}
+	return fmt.Errorf("unsupported SSH key type %q, must be %s, %s or %s", keyType, KeyTypeRSA4096, KeyTypeED25519, KeyTypeECDSA)
+}
+
+// GenerateKey returns a new PEM private key of keyType and its public key in
+// authorized_keys format.
+func GenerateKey(keyType string) ([]byte, string, error) {
+	var (
+		private interface{}
+		block   *pem.Block
+		err     error
+	)
+	switch keyType {
+	case KeyTypeRSA4096:
+		var key *rsa.PrivateKey
+		if key, err = rsa.GenerateKey(rand.Reader, 4096); err != nil {
+			return nil, "", err
+		}
+		private = key
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case KeyTypeECDSA:
+		var key *ecdsa.PrivateKey
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, "", err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, "", err
+		}
+		private = key
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case KeyTypeED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		private = key
+		if block, err = marshalED25519(key); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", ValidateKeyType(keyType)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, "", err
+	}
+	return pem.EncodeToMemory(block), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// HasKeyType returns whether the PEM private key is of keyType.
+func HasKeyType(key []byte, keyType string) bool {
+	private, err := ssh.ParseRawPrivateKey(key)
+	if err != nil {
+		return false
+	}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		return keyType == KeyTypeRSA4096 && k.N.BitLen() == 4096
+	case *ecdsa.PrivateKey:
+		return keyType == KeyTypeECDSA && k.Curve == elliptic.P256()
+	case *ed25519.PrivateKey, ed25519.PrivateKey:
+		return keyType == KeyTypeED25519
+	}
+	return false
+}
+
+// AuthorizedKey returns the public key of a PEM private key in
+// authorized_keys format.
+func AuthorizedKey(key []byte) (string, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// marshalED25519 encodes an ed25519 key in the OpenSSH private key format,
+// the only format OpenSSH reads ed25519 keys in.
+func marshalED25519(key ed25519.PrivateKey) (*pem.Block, error) {
+	pub := ssh.Marshal(struct {
+		KeyType string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, []byte(key.Public().(ed25519.PublicKey))})
+
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check)
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{checkInt, checkInt, ssh.KeyAlgoED25519, []byte(key.Public().(ed25519.PublicKey)), []byte(key), ""})
+	// The private section is padded to the cipher block size, 8 without
+	// encryption.
+	for i := 1; len(private)%8 != 0; i++ {
+		private = append(private, byte(i))
+	}
+
+	data := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pub, private})
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), data...),
+	}, nil
+}
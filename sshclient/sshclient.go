@@ -0,0 +1,156 @@
+// Package sshclient opens the SSH connections the controller makes to
+// provisioned hosts, tuned by the SSH options of their machine template.
+package sshclient
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Annotation on a machine, or on its machine template, holds the JSON
+	// Options for SSH connections to the machine.
+	Annotation = "io.cattle.machine.ssh_options"
+
+	defaultPort    = 22
+	defaultUser    = "root"
+	defaultTimeout = 30 * time.Second
+)
+
+// Options tune SSH connections to hardened images. Port and User override the
+// ones docker-machine recorded for the host. Ciphers, MACs and KeyExchanges
+// restrict the algorithms offered, in order of preference. KeepAlive sends a
+// keepalive request at that interval, e.g. "30s", so idle connections survive
+// firewalls dropping them. ConnectTimeout bounds the TCP connect and SSH
+// handshake.
+type Options struct {
+	Port           int      `json:"port,omitempty"`
+	User           string   `json:"user,omitempty"`
+	Ciphers        []string `json:"ciphers,omitempty"`
+	MACs           []string `json:"macs,omitempty"`
+	KeyExchanges   []string `json:"keyExchanges,omitempty"`
+	KeepAlive      string   `json:"keepAlive,omitempty"`
+	ConnectTimeout string   `json:"connectTimeout,omitempty"`
+
+	keepAlive      time.Duration
+	connectTimeout time.Duration
+}
+
+// Parse returns the options in the value of the annotation, the zero Options
+// if it is empty.
+func Parse(data string) (Options, error) {
+	opts := Options{}
+	if data == "" {
+		return opts, nil
+	}
+	if err := json.Unmarshal([]byte(data), &opts); err != nil {
+		return opts, errors.Wrapf(err, "invalid %s annotation", Annotation)
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return opts, errors.Errorf("invalid %s annotation: port %d out of range", Annotation, opts.Port)
+	}
+
+	var err error
+	if opts.KeepAlive != "" {
+		if opts.keepAlive, err = time.ParseDuration(opts.KeepAlive); err != nil {
+			return opts, errors.Wrapf(err, "invalid %s annotation: keepAlive", Annotation)
+		}
+	}
+	if opts.ConnectTimeout != "" {
+		if opts.connectTimeout, err = time.ParseDuration(opts.ConnectTimeout); err != nil {
+			return opts, errors.Wrapf(err, "invalid %s annotation: connectTimeout", Annotation)
+		}
+	}
+	return opts, nil
+}
+
+// Dial connects to address with the private key, as user on port unless the
+// options override them.
+func Dial(address string, port int, user string, key []byte, opts Options) (*ssh.Client, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse SSH key")
+	}
+
+	if opts.Port > 0 {
+		port = opts.Port
+	} else if port <= 0 {
+		port = defaultPort
+	}
+	if opts.User != "" {
+		user = opts.User
+	} else if user == "" {
+		user = defaultUser
+	}
+	timeout := opts.connectTimeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	config := &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:      opts.Ciphers,
+			MACs:         opts.MACs,
+			KeyExchanges: opts.KeyExchanges,
+		},
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// docker-machine does not record host keys either
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         timeout,
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(port)), config)
+	if err != nil {
+		return nil, err
+	}
+	if opts.keepAlive > 0 {
+		go keepAlive(client, opts.keepAlive)
+	}
+	return client, nil
+}
+
+// keepAlive sends keepalive requests until the connection is closed, and
+// closes it once the server stops answering them.
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// Run runs command in a new session and returns its combined output and exit
+// code. The error is only set when the command could not run to completion.
+func Run(client *ssh.Client, command string) ([]byte, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(command)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return out, exitErr.ExitStatus(), nil
+	}
+	return out, 0, err
+}
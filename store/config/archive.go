@@ -16,6 +16,7 @@ import (
 	"crypto/x509"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/machine-controller/dockermachine"
 	"github.com/sirupsen/logrus"
 )
 
@@ -217,6 +218,9 @@ func addDirToArchive(source string, tarfileWriter *tar.Writer) error {
 				return err
 			}
 
+			if info.IsDir() && info.Name() == dockermachine.ScratchDir {
+				return filepath.SkipDir
+			}
 			if path == source || strings.HasSuffix(info.Name(), ".iso") ||
 				strings.HasSuffix(info.Name(), ".tar.gz") ||
 				strings.HasSuffix(info.Name(), ".vmdk") ||
@@ -18,15 +18,25 @@ const (
 	defaultCattleHome = "/var/lib/rancher"
 )
 
+// MachineConfig is the docker-machine state directory of a machine, with its
+// certificates, SSH key and host config, kept in a Secret of its own so it
+// survives restarts and rescheduling of the controller.
 type MachineConfig struct {
 	store   *store.GenericEncryptedStore
 	baseDir string
 	id      string
-	cm      map[string]string
-}
-
-func NewStore(management *config.ManagementContext) (*store.GenericEncryptedStore, error) {
-	return store.NewGenericEncrypedStore("mc-", "", management.Core.Namespaces(""),
+	// legacyID is the key the state of a machine provisioned by an older
+	// controller is stored under, which only holds the machine name and
+	// collides for machines of the same name in different namespaces.
+	legacyID string
+	legacy   bool
+	cm       map[string]string
+}
+
+// NewStore returns the store of machine state Secrets in namespace, or in
+// cattle-system if empty.
+func NewStore(management *config.ManagementContext, namespace string) (*store.GenericEncryptedStore, error) {
+	return store.NewGenericEncrypedStore("mc-", namespace, management.Core.Namespaces(""),
 		management.K8sClient.CoreV1())
 }
 
@@ -37,11 +47,28 @@ func NewMachineConfig(store *store.GenericEncryptedStore, machine *v3.Machine) (
 	}
 	logrus.Debugf("Created machine storage directory %s", machineDir)
 
-	return &MachineConfig{
+	config := &MachineConfig{
 		store:   store,
-		id:      machine.Name,
+		id:      stateID(machine),
 		baseDir: machineDir,
-	}, nil
+	}
+	// Only machines that have been provisioned before can have legacy state,
+	// so a new machine never picks up the state of a namesake.
+	for _, cond := range machine.Status.Conditions {
+		if cond.Type == v3.MachineConditionProvisioned {
+			config.legacyID = machine.Name
+		}
+	}
+	return config, nil
+}
+
+// stateID returns the key of the state of a machine. Namespaces cannot contain
+// dots, so the key is unique.
+func stateID(machine *v3.Machine) string {
+	if machine.Namespace == "" {
+		return machine.Name
+	}
+	return machine.Namespace + "." + machine.Name
 }
 
 func (m *MachineConfig) Dir() string {
@@ -54,6 +81,11 @@ func (m *MachineConfig) Cleanup() error {
 
 func (m *MachineConfig) Remove() error {
 	m.Cleanup()
+	if m.legacy {
+		if err := m.store.Remove(m.legacyID); err != nil {
+			return err
+		}
+	}
 	return m.store.Remove(m.id)
 }
 
@@ -82,6 +114,17 @@ func (m *MachineConfig) InternalIP() (string, error) {
 	return convert.ToString(values.GetValueN(config, "Driver", "PrivateIPAddress")), nil
 }
 
+// DriverConfig returns the driver section of the saved docker-machine config,
+// which holds the IDs of the cloud resources the driver created.
+func (m *MachineConfig) DriverConfig() (map[string]interface{}, error) {
+	config, err := m.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return convert.ToMapInterface(config["Driver"]), nil
+}
+
 func (m *MachineConfig) Save() error {
 	extractedConfig, err := compressConfig(m.baseDir)
 	if err != nil {
@@ -102,6 +145,13 @@ func (m *MachineConfig) Save() error {
 		m.cm = nil
 		return err
 	}
+	if m.legacy {
+		if err := m.store.Remove(m.legacyID); err != nil {
+			logrus.Warnf("Failed to remove legacy state of machine %s: %v", m.id, err)
+		} else {
+			m.legacy = false
+		}
+	}
 
 	return nil
 }
@@ -124,10 +174,16 @@ func (m *MachineConfig) loadConfig() error {
 		return nil
 	}
 
-	cm, err := m.getConfigMap()
+	cm, err := m.getConfigMap(m.id)
 	if err != nil {
 		return err
 	}
+	if cm == nil && m.legacyID != "" && m.legacyID != m.id {
+		if cm, err = m.getConfigMap(m.legacyID); err != nil {
+			return err
+		}
+		m.legacy = cm != nil
+	}
 
 	if cm == nil {
 		cm = map[string]string{}
@@ -137,8 +193,8 @@ func (m *MachineConfig) loadConfig() error {
 	return nil
 }
 
-func (m *MachineConfig) getConfigMap() (map[string]string, error) {
-	configMap, err := m.store.Get(m.id)
+func (m *MachineConfig) getConfigMap(id string) (map[string]string, error) {
+	configMap, err := m.store.Get(id)
 	if errors.IsNotFound(err) {
 		return nil, nil
 	}
@@ -0,0 +1,230 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PartOfLabel is set on the extra schemas holding the overflow fields of
+	// a split schema and names the schema they belong to. Parts embed their
+	// fields into that schema, so they are not published as types of their
+	// own.
+	PartOfLabel = "io.cattle.machine_driver.schema_part_of"
+	// PartsAnnotation is set on a split schema to the number of extra parts.
+	PartsAnnotation = "io.cattle.machine_driver.schema_parts"
+
+	defaultMaxBytes = 512 * 1024
+)
+
+// MaxBytes is the maximum serialized size of the resource fields stored in a
+// single DynamicSchema object, configurable through SCHEMA_MAX_BYTES.
+func MaxBytes() int {
+	if v, err := strconv.Atoi(os.Getenv("SCHEMA_MAX_BYTES")); err == nil && v > 0 {
+		return v
+	}
+	return defaultMaxBytes
+}
+
+// PartName is the name of the nth extra part of a schema.
+func PartName(name string, n int) string {
+	return fmt.Sprintf("%s-part-%d", name, n)
+}
+
+// Split keeps as many resource fields in schema as fit into maxBytes and moves
+// the rest into additional part schemas.
+func Split(schema *v3.DynamicSchema, maxBytes int) []*v3.DynamicSchema {
+	var names []string
+	for name := range schema.Spec.ResourceFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		chunks []map[string]v3.Field
+		chunk  = map[string]v3.Field{}
+		size   = 0
+	)
+	for _, name := range names {
+		field := schema.Spec.ResourceFields[name]
+		fieldSize := len(name)
+		if bytes, err := json.Marshal(field); err == nil {
+			fieldSize += len(bytes)
+		}
+		if size+fieldSize > maxBytes && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk = map[string]v3.Field{}
+			size = 0
+		}
+		chunk[name] = field
+		size += fieldSize
+	}
+	chunks = append(chunks, chunk)
+
+	schema.Spec.ResourceFields = chunks[0]
+	if len(chunks) == 1 {
+		delete(schema.Annotations, PartsAnnotation)
+		return nil
+	}
+
+	if schema.Annotations == nil {
+		schema.Annotations = map[string]string{}
+	}
+	schema.Annotations[PartsAnnotation] = strconv.Itoa(len(chunks) - 1)
+
+	var parts []*v3.DynamicSchema
+	for i, fields := range chunks[1:] {
+		part := &v3.DynamicSchema{}
+		part.Name = PartName(schema.Name, i+1)
+		part.Namespace = schema.Namespace
+		part.OwnerReferences = schema.OwnerReferences
+		part.Labels = map[string]string{}
+		for k, v := range schema.Labels {
+			part.Labels[k] = v
+		}
+		part.Labels[PartOfLabel] = schema.Name
+		part.Spec.ResourceFields = fields
+		part.Spec.Embed = true
+		part.Spec.EmbedType = schema.Name
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// Create splits schema if needed and creates it together with its parts. An
+// existing schema is left untouched, together with its parts. Parts left over
+// from an earlier schema of the same name are updated or deleted.
+func Create(client Client, schema *v3.DynamicSchema) error {
+	if _, err := client.Get(schema.Name, metav1.GetOptions{}); err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	parts := Split(schema, MaxBytes())
+	if err := writeParts(client, parts); err != nil {
+		return err
+	}
+	if _, err := client.Create(schema); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return deleteStaleParts(client, schema.Name, len(parts))
+}
+
+// Get returns the named schema with the resource fields of all of its parts
+// merged back in.
+func Get(client Client, name string) (*v3.DynamicSchema, error) {
+	schema, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	count, _ := strconv.Atoi(schema.Annotations[PartsAnnotation])
+	if count == 0 {
+		return schema, nil
+	}
+
+	schema = schema.DeepCopy()
+	if schema.Spec.ResourceFields == nil {
+		schema.Spec.ResourceFields = map[string]v3.Field{}
+	}
+	for i := 1; i <= count; i++ {
+		part, err := client.Get(PartName(name, i), metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range part.Spec.ResourceFields {
+			schema.Spec.ResourceFields[k] = v
+		}
+	}
+	delete(schema.Annotations, PartsAnnotation)
+
+	return schema, nil
+}
+
+// Update replaces the resource fields and annotations of an existing schema
+// with those of schema, creating and deleting parts as the size changes.
+func Update(client Client, schema *v3.DynamicSchema) error {
+	existing, err := client.Get(schema.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	oldCount, _ := strconv.Atoi(existing.Annotations[PartsAnnotation])
+
+	existing = existing.DeepCopy()
+	existing.Spec.ResourceFields = schema.Spec.ResourceFields
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	for k, v := range schema.Annotations {
+		existing.Annotations[k] = v
+	}
+
+	parts := Split(existing, MaxBytes())
+	if err := writeParts(client, parts); err != nil {
+		return err
+	}
+
+	if _, err := client.Update(existing); err != nil {
+		return err
+	}
+
+	for i := len(parts) + 1; i <= oldCount; i++ {
+		if err := client.Delete(PartName(schema.Name, i), &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return deleteStaleParts(client, schema.Name, len(parts))
+}
+
+// writeParts creates parts, or updates them where they exist.
+func writeParts(client Client, parts []*v3.DynamicSchema) error {
+	for _, part := range parts {
+		current, err := client.Get(part.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			if _, err := client.Create(part); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		current = current.DeepCopy()
+		current.Labels = part.Labels
+		current.OwnerReferences = part.OwnerReferences
+		current.Spec = part.Spec
+		if _, err := client.Update(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteStaleParts deletes the parts of the named schema beyond the first
+// count, found by PartOfLabel.
+func deleteStaleParts(client Client, name string, count int) error {
+	names, err := ListAll(client, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", PartOfLabel, name),
+	})
+	if err != nil {
+		return err
+	}
+	for _, partName := range names {
+		n, err := strconv.Atoi(strings.TrimPrefix(partName, name+"-part-"))
+		if err != nil || n <= count {
+			continue
+		}
+		if err := client.Delete(partName, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package schema
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeClient stores schemas in memory.
+type fakeClient struct {
+	objs map[string]*v3.DynamicSchema
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{objs: map[string]*v3.DynamicSchema{}}
+}
+
+func (f *fakeClient) Create(obj *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	if _, ok := f.objs[obj.Name]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "dynamicschemas"}, obj.Name)
+	}
+	f.objs[obj.Name] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeClient) Get(name string, opts metav1.GetOptions) (*v3.DynamicSchema, error) {
+	obj, ok := f.objs[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (f *fakeClient) Update(obj *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	if _, ok := f.objs[obj.Name]; !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, obj.Name)
+	}
+	f.objs[obj.Name] = obj.DeepCopy()
+	return obj, nil
+}
+
+func (f *fakeClient) Delete(name string, options *metav1.DeleteOptions) error {
+	if _, ok := f.objs[name]; !ok {
+		return errors.NewNotFound(schema.GroupResource{Resource: "dynamicschemas"}, name)
+	}
+	delete(f.objs, name)
+	return nil
+}
+
+func (f *fakeClient) List(opts metav1.ListOptions) (*v3.DynamicSchemaList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &v3.DynamicSchemaList{}
+	for _, obj := range f.objs {
+		if selector.Matches(labels.Set(obj.Labels)) {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeClient) names() []string {
+	var names []string
+	for name := range f.objs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testFields(n int) map[string]v3.Field {
+	fields := map[string]v3.Field{}
+	for i := 0; i < n; i++ {
+		fields["field"+strconv.Itoa(i)] = v3.Field{Type: "string", Description: "A driver flag"}
+	}
+	return fields
+}
+
+// fieldsSize is the size Split counts for fields.
+func fieldsSize(t *testing.T, fields map[string]v3.Field) int {
+	size := 0
+	for name, field := range fields {
+		data, err := json.Marshal(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += len(name) + len(data)
+	}
+	return size
+}
+
+func testSchema(fields map[string]v3.Field) *v3.DynamicSchema {
+	s := &v3.DynamicSchema{}
+	s.Name = "amazonec2config"
+	s.Labels = map[string]string{"driver": "amazonec2"}
+	s.Spec.ResourceFields = map[string]v3.Field{}
+	for k, v := range fields {
+		s.Spec.ResourceFields[k] = v
+	}
+	return s
+}
+
+func TestSplitAtSizeBoundary(t *testing.T) {
+	fields := testFields(4)
+	size := fieldsSize(t, fields)
+	tests := []struct {
+		name     string
+		maxBytes int
+		parts    int
+	}{
+		{"fits exactly", size, 0},
+		{"one byte short", size - 1, 1},
+		{"one field each", 1, 3},
+	}
+	for _, test := range tests {
+		s := testSchema(fields)
+		parts := Split(s, test.maxBytes)
+		if len(parts) != test.parts {
+			t.Errorf("%s: got %d parts, want %d", test.name, len(parts), test.parts)
+			continue
+		}
+		merged := map[string]v3.Field{}
+		for k, v := range s.Spec.ResourceFields {
+			merged[k] = v
+		}
+		for i, part := range parts {
+			if part.Name != PartName(s.Name, i+1) || part.Labels[PartOfLabel] != s.Name || !part.Spec.Embed || part.Spec.EmbedType != s.Name {
+				t.Errorf("%s: part %d is %s embedded in %q with labels %v", test.name, i+1, part.Name, part.Spec.EmbedType, part.Labels)
+			}
+			for k, v := range part.Spec.ResourceFields {
+				merged[k] = v
+			}
+		}
+		if !reflect.DeepEqual(merged, fields) {
+			t.Errorf("%s: split lost fields: %v", test.name, merged)
+		}
+		if got, want := s.Annotations[PartsAnnotation], strconv.Itoa(test.parts); test.parts > 0 && got != want {
+			t.Errorf("%s: %s is %q, want %q", test.name, PartsAnnotation, got, want)
+		}
+	}
+}
+
+func TestCreateGetRoundTrip(t *testing.T) {
+	fields := testFields(6)
+	defer os.Setenv("SCHEMA_MAX_BYTES", os.Getenv("SCHEMA_MAX_BYTES"))
+	os.Setenv("SCHEMA_MAX_BYTES", strconv.Itoa(fieldsSize(t, fields)/3))
+
+	client := newFakeClient()
+	if err := Create(client, testSchema(fields)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.objs) < 3 {
+		t.Fatalf("schema is stored in %v, want parts", client.names())
+	}
+	got, err := Get(client, "amazonec2config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Spec.ResourceFields, fields) {
+		t.Errorf("got fields %v, want %v", got.Spec.ResourceFields, fields)
+	}
+	if _, ok := got.Annotations[PartsAnnotation]; ok {
+		t.Errorf("reassembled schema has %s", PartsAnnotation)
+	}
+}
+
+func TestCreateDeletesStaleParts(t *testing.T) {
+	fields := testFields(2)
+	defer os.Setenv("SCHEMA_MAX_BYTES", os.Getenv("SCHEMA_MAX_BYTES"))
+	os.Setenv("SCHEMA_MAX_BYTES", strconv.Itoa(fieldsSize(t, fields)))
+
+	client := newFakeClient()
+	for i := 1; i <= 2; i++ {
+		stale := testSchema(testFields(1))
+		stale.Name = PartName("amazonec2config", i)
+		stale.Labels[PartOfLabel] = "amazonec2config"
+		client.objs[stale.Name] = stale
+	}
+	if err := Create(client, testSchema(fields)); err != nil {
+		t.Fatal(err)
+	}
+	if names := client.names(); !reflect.DeepEqual(names, []string{"amazonec2config"}) {
+		t.Errorf("schemas are %v, want the stale parts deleted", names)
+	}
+}
+
+func TestUpdateResizesParts(t *testing.T) {
+	small, large := testFields(2), testFields(6)
+	defer os.Setenv("SCHEMA_MAX_BYTES", os.Getenv("SCHEMA_MAX_BYTES"))
+	os.Setenv("SCHEMA_MAX_BYTES", strconv.Itoa(fieldsSize(t, small)))
+
+	client := newFakeClient()
+	if err := Create(client, testSchema(small)); err != nil {
+		t.Fatal(err)
+	}
+	for _, fields := range []map[string]v3.Field{large, small} {
+		if err := Update(client, testSchema(fields)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Get(client, "amazonec2config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Spec.ResourceFields, fields) {
+			t.Errorf("got %d fields, want %d", len(got.Spec.ResourceFields), len(fields))
+		}
+	}
+	if names := client.names(); !reflect.DeepEqual(names, []string{"amazonec2config"}) {
+		t.Errorf("schemas are %v, want the parts deleted after shrinking", names)
+	}
+}
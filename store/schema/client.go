@@ -0,0 +1,68 @@
+package schema
+
+import (
+	"github.com/rancher/norman/clientbase"
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+)
+
+// Client is the subset of v3.DynamicSchemaInterface used to manage schemas.
+type Client interface {
+	Create(*v3.DynamicSchema) (*v3.DynamicSchema, error)
+	Get(name string, opts metav1.GetOptions) (*v3.DynamicSchema, error)
+	Update(*v3.DynamicSchema) (*v3.DynamicSchema, error)
+	Delete(name string, options *metav1.DeleteOptions) error
+	List(opts metav1.ListOptions) (*v3.DynamicSchemaList, error)
+}
+
+// NewNamespacedClient returns a client for DynamicSchemas in the given
+// namespace. The generated v3 client treats DynamicSchemas as cluster scoped,
+// so this is only usable when the CRD is installed with namespace scope.
+func NewNamespacedClient(restClient rest.Interface, namespace string) Client {
+	resource := v3.DynamicSchemaResource
+	resource.Namespaced = true
+	return &namespacedClient{
+		objectClient: clientbase.NewObjectClient(namespace, restClient, &resource,
+			v3.DynamicSchemaGroupVersionKind, factory{}),
+	}
+}
+
+type factory struct{}
+
+func (factory) Object() runtime.Object {
+	return &v3.DynamicSchema{}
+}
+
+func (factory) List() runtime.Object {
+	return &v3.DynamicSchemaList{}
+}
+
+type namespacedClient struct {
+	objectClient *clientbase.ObjectClient
+}
+
+func (c *namespacedClient) Create(o *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	obj, err := c.objectClient.Create(o)
+	return obj.(*v3.DynamicSchema), err
+}
+
+func (c *namespacedClient) Get(name string, opts metav1.GetOptions) (*v3.DynamicSchema, error) {
+	obj, err := c.objectClient.Get(name, opts)
+	return obj.(*v3.DynamicSchema), err
+}
+
+func (c *namespacedClient) Update(o *v3.DynamicSchema) (*v3.DynamicSchema, error) {
+	obj, err := c.objectClient.Update(o.Name, o)
+	return obj.(*v3.DynamicSchema), err
+}
+
+func (c *namespacedClient) Delete(name string, options *metav1.DeleteOptions) error {
+	return c.objectClient.Delete(name, options)
+}
+
+func (c *namespacedClient) List(opts metav1.ListOptions) (*v3.DynamicSchemaList, error) {
+	obj, err := c.objectClient.List(opts)
+	return obj.(*v3.DynamicSchemaList), err
+}
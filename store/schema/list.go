@@ -0,0 +1,28 @@
+package schema
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PageSize is the number of objects fetched per list request.
+const PageSize = 500
+
+// ListAll returns the names of all schemas matching opts, fetched in pages of
+// PageSize so large clusters are never listed in a single request.
+func ListAll(client Client, opts metav1.ListOptions) ([]string, error) {
+	var names []string
+	opts.Limit = PageSize
+	for {
+		list, err := client.List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, schema := range list.Items {
+			names = append(names, schema.Name)
+		}
+		if list.Continue == "" {
+			return names, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
@@ -0,0 +1,67 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// PatchOp is a single RFC 6902 JSON patch operation.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// JSONPatch applies ops to the named schema. Unlike Update it only touches the
+// paths in ops, so concurrent edits of other fields by other components are
+// preserved.
+func JSONPatch(restClient rest.Interface, namespace, name string, ops []PatchOp) error {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	return restClient.Patch(types.JSONPatchType).
+		Prefix("apis", v3.DynamicSchemaGroupVersionKind.Group, v3.DynamicSchemaGroupVersionKind.Version).
+		NamespaceIfScoped(namespace, namespace != "").
+		Resource(v3.DynamicSchemaResource.Name).
+		Name(name).
+		Body(data).
+		Do().
+		Error()
+}
+
+// AddFieldOps returns the operations adding a resource field to schema. If the
+// schema has no resource fields at all the whole map has to be created, which
+// is guarded by a resourceVersion test so a concurrently added map is never
+// overwritten.
+func AddFieldOps(schema *v3.DynamicSchema, name string, field v3.Field) []PatchOp {
+	if schema.Spec.ResourceFields == nil {
+		return []PatchOp{
+			{Op: "test", Path: "/metadata/resourceVersion", Value: schema.ResourceVersion},
+			{Op: "add", Path: "/spec/resourceFields", Value: map[string]v3.Field{name: field}},
+		}
+	}
+	return []PatchOp{
+		{Op: "add", Path: fieldPath(name), Value: field},
+	}
+}
+
+// RemoveFieldOps returns the operations removing a resource field, provided it
+// still has the given type.
+func RemoveFieldOps(name string, field v3.Field) []PatchOp {
+	return []PatchOp{
+		{Op: "test", Path: fieldPath(name) + "/type", Value: field.Type},
+		{Op: "remove", Path: fieldPath(name)},
+	}
+}
+
+func fieldPath(name string) string {
+	name = strings.Replace(name, "~", "~0", -1)
+	name = strings.Replace(name, "/", "~1", -1)
+	return "/spec/resourceFields/" + name
+}
@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// newTestRESTClient returns a REST client talking to server.
+func newTestRESTClient(t *testing.T, server *httptest.Server) rest.Interface {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gv := v3.DynamicSchemaGroupVersionKind.GroupVersion()
+	client, err := rest.NewRESTClient(u, "", rest.ContentConfig{
+		GroupVersion:         &gv,
+		NegotiatedSerializer: scheme.Codecs,
+	}, 0, 0, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		namespace string
+		path      string
+	}{
+		{"", "/apis/management.cattle.io/v3/dynamicschemas/machineconfig"},
+		{"tenant-a", "/apis/management.cattle.io/v3/namespaces/tenant-a/dynamicschemas/machineconfig"},
+	}
+	for _, test := range tests {
+		var method, path, contentType string
+		var body []PatchOp
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path, contentType = r.Method, r.URL.Path, r.Header.Get("Content-Type")
+			data, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(data, &body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		}))
+
+		ops := RemoveFieldOps("amazonec2Config", v3.Field{Type: "amazonec2config"})
+		err := JSONPatch(newTestRESTClient(t, server), test.namespace, "machineconfig", ops)
+		server.Close()
+		if err != nil {
+			t.Errorf("%q: %v", test.namespace, err)
+			continue
+		}
+		if method != "PATCH" || path != test.path || contentType != "application/json-patch+json" {
+			t.Errorf("%q: sent %s %s as %s", test.namespace, method, path, contentType)
+		}
+		if !reflect.DeepEqual(body, ops) {
+			t.Errorf("%q: sent %v, want %v", test.namespace, body, ops)
+		}
+	}
+}
+
+func TestJSONPatchConflict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Conflict", "code": 409}`))
+	}))
+	defer server.Close()
+
+	err := JSONPatch(newTestRESTClient(t, server), "", "machineconfig", nil)
+	if !errors.IsConflict(err) {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+}
+
+func TestFieldOps(t *testing.T) {
+	field := v3.Field{Type: "amazonec2config"}
+	empty := &v3.DynamicSchema{}
+	empty.ResourceVersion = "42"
+	existing := &v3.DynamicSchema{}
+	existing.Spec.ResourceFields = map[string]v3.Field{}
+
+	tests := []struct {
+		name string
+		ops  []PatchOp
+		want []PatchOp
+	}{
+		{"add to schema without fields", AddFieldOps(empty, "amazonec2Config", field), []PatchOp{
+			{Op: "test", Path: "/metadata/resourceVersion", Value: "42"},
+			{Op: "add", Path: "/spec/resourceFields", Value: map[string]v3.Field{"amazonec2Config": field}},
+		}},
+		{"add", AddFieldOps(existing, "amazonec2Config", field), []PatchOp{
+			{Op: "add", Path: "/spec/resourceFields/amazonec2Config", Value: field},
+		}},
+		{"remove", RemoveFieldOps("amazonec2Config", field), []PatchOp{
+			{Op: "test", Path: "/spec/resourceFields/amazonec2Config/type", Value: "amazonec2config"},
+			{Op: "remove", Path: "/spec/resourceFields/amazonec2Config"},
+		}},
+		{"escaped name", RemoveFieldOps("a/b~c", field), []PatchOp{
+			{Op: "test", Path: "/spec/resourceFields/a~1b~0c/type", Value: "amazonec2config"},
+			{Op: "remove", Path: "/spec/resourceFields/a~1b~0c"},
+		}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.ops, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.ops, test.want)
+		}
+	}
+}